@@ -17,9 +17,12 @@
 package v1
 
 import (
+	"encoding/json"
 	"fmt"
 	"io"
 	"os"
+	"regexp"
+	"time"
 
 	cli "github.com/urfave/cli/v2"
 	altsrc "github.com/urfave/cli/v2/altsrc"
@@ -32,18 +35,110 @@ const Version = "v1"
 
 // Config is a versioned struct used to hold configuration information.
 type Config struct {
-	Version string `json:"version"         yaml:"version"`
-	Flags   Flags  `json:"flags,omitempty" yaml:"flags"`
+	Version   string    `json:"version"             yaml:"version"`
+	Flags     Flags     `json:"flags,omitempty"     yaml:"flags"`
+	Resources Resources `json:"resources,omitempty" yaml:"resources,omitempty"`
 }
 
 // CommandLineFlags holds the list of command line flags used to configure the device plugin.
 type CommandLineFlags struct {
-	MigStrategy        string `json:"migStrategy"        yaml:"migStrategy"`
-	FailOnInitError    bool   `json:"failOnInitError"    yaml:"failOnInitError"`
-	PassDeviceSpecs    bool   `json:"passDeviceSpecs"    yaml:"passDeviceSpecs"`
-	DeviceListStrategy string `json:"deviceListStrategy" yaml:"deviceListStrategy"`
-	DeviceIDStrategy   string `json:"deviceIDStrategy"   yaml:"deviceIDStrategy"`
-	NvidiaDriverRoot   string `json:"nvidiaDriverRoot"   yaml:"nvidiaDriverRoot"`
+	MigStrategy                       string   `json:"migStrategy"                       yaml:"migStrategy"`
+	FailOnInitError                   bool     `json:"failOnInitError"                   yaml:"failOnInitError"`
+	PassDeviceSpecs                   bool     `json:"passDeviceSpecs"                   yaml:"passDeviceSpecs"`
+	DeviceListStrategy                string   `json:"deviceListStrategy"                yaml:"deviceListStrategy"`
+	DeviceIDStrategy                  string   `json:"deviceIDStrategy"                  yaml:"deviceIDStrategy"`
+	NvidiaDriverRoot                  string   `json:"nvidiaDriverRoot"                  yaml:"nvidiaDriverRoot"`
+	PluginLabels                      []string `json:"pluginLabels"                      yaml:"pluginLabels"`
+	NoSelfLabel                       bool     `json:"noSelfLabel"                       yaml:"noSelfLabel"`
+	SetPowerLimitWatts                int      `json:"setPowerLimitWatts"                yaml:"setPowerLimitWatts"`
+	DryRunAllocate                    bool     `json:"dryRunAllocate"                    yaml:"dryRunAllocate"`
+	ClockThrottlePollInterval         Duration `json:"clockThrottlePollInterval"         yaml:"clockThrottlePollInterval"`
+	DebugAddr                         string   `json:"debugAddr"                         yaml:"debugAddr"`
+	GracefulPeriodOnUnhealthy         int      `json:"gracefulPeriodOnUnhealthy"         yaml:"gracefulPeriodOnUnhealthy"`
+	HealthEventWindow                 Duration `json:"healthEventWindow"                 yaml:"healthEventWindow"`
+	PreferSameNUMASocket              bool     `json:"preferSameNUMASocket"              yaml:"preferSameNUMASocket"`
+	NoHealthCheck                     bool     `json:"noHealthCheck"                     yaml:"noHealthCheck"`
+	WatchXIDErrors                    bool     `json:"watchXIDErrors"                    yaml:"watchXIDErrors"`
+	AllocateRetryPolicy               string   `json:"allocateRetryPolicy"               yaml:"allocateRetryPolicy"`
+	SocketWatchInterval               Duration `json:"socketWatchInterval"               yaml:"socketWatchInterval"`
+	ExportPrometheusTextfile          string   `json:"exportPrometheusTextfile"          yaml:"exportPrometheusTextfile"`
+	EnergyPollInterval                Duration `json:"energyPollInterval"                yaml:"energyPollInterval"`
+	ResetGPUOnRelease                 bool     `json:"resetGPUOnRelease"                 yaml:"resetGPUOnRelease"`
+	EnableSentinelDevice              bool     `json:"enableSentinelDevice"              yaml:"enableSentinelDevice"`
+	IgnoreDeviceUUIDs                 []string `json:"ignoreDeviceUUIDs"                 yaml:"ignoreDeviceUUIDs"`
+	HealthcheckExec                   string   `json:"healthcheckExec"                   yaml:"healthcheckExec"`
+	HealthcheckExecTimeout            Duration `json:"healthcheckExecTimeout"            yaml:"healthcheckExecTimeout"`
+	EmitK8sDeviceEvents               bool     `json:"emitK8sDeviceEvents"               yaml:"emitK8sDeviceEvents"`
+	TopologyHintsEnabled              bool     `json:"topologyHintsEnabled"              yaml:"topologyHintsEnabled"`
+	HealthHistorySize                 int      `json:"healthHistorySize"                 yaml:"healthHistorySize"`
+	LeaderElection                    bool     `json:"leaderElection"                    yaml:"leaderElection"`
+	AllocateResponseDelay             Duration `json:"allocateResponseDelay"             yaml:"allocateResponseDelay"`
+	PanicOnDoubleAllocate             bool     `json:"panicOnDoubleAllocate"             yaml:"panicOnDoubleAllocate"`
+	SimulateNGPUs                     int      `json:"simulateNGPUs"                     yaml:"simulateNGPUs"`
+	SimulateGPUMemoryMB               int      `json:"simulateGPUMemoryMB"               yaml:"simulateGPUMemoryMB"`
+	ScaleDownOnLowMemory              bool     `json:"scaleDownOnLowMemory"              yaml:"scaleDownOnLowMemory"`
+	MinFreeMemoryMiB                  int      `json:"minFreeMemoryMiB"                  yaml:"minFreeMemoryMiB"`
+	ReplicaIDCodec                    string   `json:"replicaIDCodec"                    yaml:"replicaIDCodec"`
+	PreStopTimeout                    Duration `json:"preStopTimeout"                    yaml:"preStopTimeout"`
+	PreStopMemoryUtilizationThreshold int      `json:"preStopMemoryUtilizationThreshold" yaml:"preStopMemoryUtilizationThreshold"`
+	MaxGRPCMessageSize                int      `json:"maxGRPCMessageSize"                yaml:"maxGRPCMessageSize"`
+	SMWeightedAllocation              bool     `json:"smWeightedAllocation"              yaml:"smWeightedAllocation"`
+	SocketCleanupOnExit               bool     `json:"socketCleanupOnExit"               yaml:"socketCleanupOnExit"`
+	GPUModelFilter                    []string `json:"gpuModelFilter"                    yaml:"gpuModelFilter"`
+	GoroutineAlertThreshold           int      `json:"goroutineAlertThreshold"           yaml:"goroutineAlertThreshold"`
+	GRPCStopTimeout                   Duration `json:"grpcStopTimeout"                   yaml:"grpcStopTimeout"`
+	RequireVBIOSVersion               string   `json:"requireVBIOSVersion"               yaml:"requireVBIOSVersion"`
+	ExtenderMode                      bool     `json:"extenderMode"                      yaml:"extenderMode"`
+	ExtenderAddr                      string   `json:"extenderAddr"                      yaml:"extenderAddr"`
+	OTelEndpoint                      string   `json:"otelEndpoint"                      yaml:"otelEndpoint"`
+	RollingRestartDrainTimeout        Duration `json:"rollingRestartDrainTimeout"        yaml:"rollingRestartDrainTimeout"`
+	SyncConfigToConfigMap             string   `json:"syncConfigToConfigMap"             yaml:"syncConfigToConfigMap"`
+	HealthRecoveryInterval            Duration `json:"healthRecoveryInterval"            yaml:"healthRecoveryInterval"`
+	MemorySliceMB                     int      `json:"memorySliceMB"                     yaml:"memorySliceMB"`
+	MaxAutoReplicas                   int      `json:"maxAutoReplicas"                   yaml:"maxAutoReplicas"`
+	MetricsAddr                       string   `json:"metricsAddr"                       yaml:"metricsAddr"`
+	MaxReplicasPerDevice              int      `json:"maxReplicasPerDevice"              yaml:"maxReplicasPerDevice"`
+	ReplicaIDSeparator                string   `json:"replicaIDSeparator"                yaml:"replicaIDSeparator"`
+	PrestartValidate                  bool     `json:"prestartValidate"                  yaml:"prestartValidate"`
+	PrestartValidateNvidiaSMI         string   `json:"prestartValidateNvidiaSMI"         yaml:"prestartValidateNvidiaSMI"`
+	PrestartValidateTimeout           Duration `json:"prestartValidateTimeout"           yaml:"prestartValidateTimeout"`
+	LogFormat                         string   `json:"logFormat"                         yaml:"logFormat"`
+	LogLevel                          string   `json:"logLevel"                          yaml:"logLevel"`
+	HealthzAddr                       string   `json:"healthzAddr"                       yaml:"healthzAddr"`
+	HealthzWindow                     Duration `json:"healthzWindow"                     yaml:"healthzWindow"`
+	AuditLogFile                      string   `json:"auditLogFile"                      yaml:"auditLogFile"`
+	AuditLogMaxSizeMB                 int      `json:"auditLogMaxSizeMB"                 yaml:"auditLogMaxSizeMB"`
+	AuditLogMaxBackups                int      `json:"auditLogMaxBackups"                yaml:"auditLogMaxBackups"`
+	DryRun                            bool     `json:"dryRun"                            yaml:"dryRun"`
+	TopologyPolicy                    string   `json:"topologyPolicy"                    yaml:"topologyPolicy"`
+	ExtraDeviceEnvvars                []string `json:"extraDeviceEnvvars"                yaml:"extraDeviceEnvvars"`
+	ReservedMemoryPerGPUMB            int      `json:"reservedMemoryPerGPUMB"            yaml:"reservedMemoryPerGPUMB"`
+	RestartStableDuration             Duration `json:"restartStableDuration"             yaml:"restartStableDuration"`
+	ResourceName                      string   `json:"resourceName"                      yaml:"resourceName"`
+	DeviceListEnvvar                  string   `json:"deviceListEnvvar"                  yaml:"deviceListEnvvar"`
+	HealthCheckInterval               Duration `json:"healthCheckInterval"               yaml:"healthCheckInterval"`
+	NodeLabelSelector                 string   `json:"nodeLabelSelector"                 yaml:"nodeLabelSelector"`
+	NoReplicas                        bool     `json:"noReplicas"                        yaml:"noReplicas"`
+	SocketDir                         string   `json:"socketDir"                         yaml:"socketDir"`
+	TieredResources                   string   `json:"tieredResources"                   yaml:"tieredResources"`
+	GRPCDialTimeout                   Duration `json:"grpcDialTimeout"                   yaml:"grpcDialTimeout"`
+	KubeletRegistrationTimeout        Duration `json:"kubeletRegistrationTimeout"        yaml:"kubeletRegistrationTimeout"`
+	DeviceFilterUUIDRegex             string   `json:"deviceFilterUUIDRegex"             yaml:"deviceFilterUUIDRegex"`
+	DeviceFilterIndex                 []string `json:"deviceFilterIndex"                 yaml:"deviceFilterIndex"`
+	AllocationTimeout                 Duration `json:"allocationTimeout"                 yaml:"allocationTimeout"`
+	TopologyFile                      string   `json:"topologyFile"                      yaml:"topologyFile"`
+	LeaseConfigMap                    string   `json:"leaseConfigMap"                    yaml:"leaseConfigMap"`
+	StartupTimeout                    Duration `json:"startupTimeout"                    yaml:"startupTimeout"`
+	EnforceSameGPU                    bool     `json:"enforceSameGPU"                    yaml:"enforceSameGPU"`
+	DeviceCacheFile                   string   `json:"deviceCacheFile"                   yaml:"deviceCacheFile"`
+	DeviceCacheTTL                    Duration `json:"deviceCacheTTL"                    yaml:"deviceCacheTTL"`
+	VolumeMountSourceStrategy         string   `json:"volumeMountSourceStrategy"         yaml:"volumeMountSourceStrategy"`
+	HealthDebounceMs                  int      `json:"healthDebounceMs"                  yaml:"healthDebounceMs"`
+	ResourceNamespace                 string   `json:"resourceNamespace"                 yaml:"resourceNamespace"`
+	WSL2Mode                          bool     `json:"wsl2Mode"                          yaml:"wsl2Mode"`
+	MinReplicas                       int      `json:"minReplicas"                       yaml:"minReplicas"`
+	MaxReplicas                       int      `json:"maxReplicas"                       yaml:"maxReplicas"`
+	WatchConfigMap                    string   `json:"watchConfigMap"                    yaml:"watchConfigMap"`
 }
 
 // Flags holds the full list of flags used to configure the device plugin.
@@ -51,6 +146,92 @@ type Flags struct {
 	*CommandLineFlags
 }
 
+// Duration wraps time.Duration so that it is read from and written to config files as a string (e.g. "30s").
+type Duration time.Duration
+
+// MarshalJSON encodes a Duration as a string
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// UnmarshalJSON decodes a Duration from either a string or an integer number of nanoseconds
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var value interface{}
+	if err := json.Unmarshal(b, &value); err != nil {
+		return err
+	}
+	switch v := value.(type) {
+	case float64:
+		*d = Duration(time.Duration(v))
+	case string:
+		duration, err := time.ParseDuration(v)
+		if err != nil {
+			return err
+		}
+		*d = Duration(duration)
+	default:
+		return fmt.Errorf("invalid duration: %v", value)
+	}
+	return nil
+}
+
+// autoReplicas is the value of Replicas deriving the number of replicas from the memory of each device
+const autoReplicas = "auto"
+
+// Resources maps the name of a resource (e.g. 'gpu' or 'mig-3g.20gb') to the number of replicas of its devices.
+// When set, it replaces the --resource-config command line flag.
+type Resources map[string]Replicas
+
+// Replicas is either a fixed number of replicas or "auto" to derive it from the memory of each device
+type Replicas struct {
+	Count uint
+	Auto  bool
+}
+
+// MarshalJSON encodes Replicas as either an integer or "auto"
+func (r Replicas) MarshalJSON() ([]byte, error) {
+	if r.Auto {
+		return json.Marshal(autoReplicas)
+	}
+	return json.Marshal(r.Count)
+}
+
+// UnmarshalJSON decodes Replicas from either a non-negative integer or "auto". Zero disables sharing.
+func (r *Replicas) UnmarshalJSON(b []byte) error {
+	var value interface{}
+	if err := json.Unmarshal(b, &value); err != nil {
+		return err
+	}
+	switch v := value.(type) {
+	case float64:
+		if v < 0 || v != float64(uint(v)) {
+			return fmt.Errorf("invalid replicas: %v, must be a non-negative integer or %q", v, autoReplicas)
+		}
+		*r = Replicas{Count: uint(v)}
+	case string:
+		if v != autoReplicas {
+			return fmt.Errorf("invalid replicas: %q, must be a non-negative integer or %q", v, autoReplicas)
+		}
+		*r = Replicas{Auto: true}
+	default:
+		return fmt.Errorf("invalid replicas: %v, must be a non-negative integer or %q", value, autoReplicas)
+	}
+	return nil
+}
+
+// Validate checks the resources against the rules of the config file schema (schema.json)
+func (r Resources) Validate() error {
+	for name := range r {
+		if !resourceNamePattern.MatchString(name) {
+			return fmt.Errorf("invalid resource name %q: must match %s", name, resourceNamePattern)
+		}
+	}
+	return nil
+}
+
+// resourceNamePattern matches the names of resources without their 'nvidia.com/' prefix
+var resourceNamePattern = regexp.MustCompile(`^[a-z0-9]([-a-z0-9.]*[a-z0-9])?$`)
+
 // parseConfig parses a config file as either YAML of JSON and unmarshals it into a Config struct.
 func parseConfig(configFile string) (*Config, error) {
 	reader, err := os.Open(configFile)
@@ -59,7 +240,7 @@ func parseConfig(configFile string) (*Config, error) {
 	}
 	defer reader.Close()
 
-	config, err := parseConfigFrom(reader)
+	config, err := ParseConfigFrom(reader)
 	if err != nil {
 		return nil, fmt.Errorf("error parsing config file: %v", err)
 	}
@@ -67,7 +248,8 @@ func parseConfig(configFile string) (*Config, error) {
 	return config, nil
 }
 
-func parseConfigFrom(reader io.Reader) (*Config, error) {
+// ParseConfigFrom parses a config file read from 'reader' as either YAML or JSON, as parseConfig does.
+func ParseConfigFrom(reader io.Reader) (*Config, error) {
 	var err error
 	var configYaml []byte
 
@@ -76,7 +258,10 @@ func parseConfigFrom(reader io.Reader) (*Config, error) {
 		return nil, fmt.Errorf("read error: %v", err)
 	}
 
-	var config Config
+	// Flags that default to true are preset so that only an explicit false in the file clears them
+	config := Config{
+		Flags: Flags{&CommandLineFlags{TopologyHintsEnabled: true}},
+	}
 	err = yaml.Unmarshal(configYaml, &config)
 	if err != nil {
 		return nil, fmt.Errorf("unmarshal error: %v", err)
@@ -90,18 +275,113 @@ func parseConfigFrom(reader io.Reader) (*Config, error) {
 		return nil, fmt.Errorf("unknown version: %v", config.Version)
 	}
 
+	if err := config.Resources.Validate(); err != nil {
+		return nil, err
+	}
+
 	return &config, nil
 }
 
 // NewCommandLineFlags builds out a CommandLineFlags struct from the flags in cli.Context.
 func NewCommandLineFlags(c *cli.Context) *CommandLineFlags {
 	return &CommandLineFlags{
-		MigStrategy:        c.String("mig-strategy"),
-		FailOnInitError:    c.Bool("fail-on-init-error"),
-		PassDeviceSpecs:    c.Bool("pass-device-specs"),
-		DeviceListStrategy: c.String("device-list-strategy"),
-		DeviceIDStrategy:   c.String("device-id-strategy"),
-		NvidiaDriverRoot:   c.String("nvidia-driver-root"),
+		MigStrategy:                       c.String("mig-strategy"),
+		FailOnInitError:                   c.Bool("fail-on-init-error"),
+		PassDeviceSpecs:                   c.Bool("pass-device-specs"),
+		DeviceListStrategy:                c.String("device-list-strategy"),
+		DeviceIDStrategy:                  c.String("device-id-strategy"),
+		NvidiaDriverRoot:                  c.String("nvidia-driver-root"),
+		PluginLabels:                      c.StringSlice("plugin-label"),
+		NoSelfLabel:                       c.Bool("no-self-label"),
+		SetPowerLimitWatts:                c.Int("set-power-limit-watts"),
+		DryRunAllocate:                    c.Bool("dry-run-allocate"),
+		ClockThrottlePollInterval:         Duration(c.Duration("clock-throttle-poll-interval")),
+		DebugAddr:                         c.String("debug-addr"),
+		GracefulPeriodOnUnhealthy:         c.Int("graceful-period-on-unhealthy"),
+		HealthEventWindow:                 Duration(c.Duration("health-event-window")),
+		PreferSameNUMASocket:              c.Bool("prefer-same-numa-socket"),
+		NoHealthCheck:                     c.Bool("no-health-check"),
+		WatchXIDErrors:                    c.Bool("watch-xid-errors"),
+		AllocateRetryPolicy:               c.String("allocate-retry-policy"),
+		SocketWatchInterval:               Duration(c.Duration("socket-watch-interval")),
+		ExportPrometheusTextfile:          c.String("export-prometheus-textfile"),
+		EnergyPollInterval:                Duration(c.Duration("energy-poll-interval")),
+		ResetGPUOnRelease:                 c.Bool("reset-gpu-on-release"),
+		EnableSentinelDevice:              c.Bool("enable-sentinel-device"),
+		IgnoreDeviceUUIDs:                 c.StringSlice("ignore-device-uuids"),
+		HealthcheckExec:                   c.String("healthcheck-exec"),
+		HealthcheckExecTimeout:            Duration(c.Duration("healthcheck-exec-timeout")),
+		EmitK8sDeviceEvents:               c.Bool("emit-k8s-device-events"),
+		TopologyHintsEnabled:              c.Bool("topology-hints-enabled"),
+		HealthHistorySize:                 c.Int("health-history-size"),
+		LeaderElection:                    c.Bool("leader-election"),
+		AllocateResponseDelay:             Duration(c.Duration("allocate-response-delay")),
+		PanicOnDoubleAllocate:             c.Bool("panic-on-double-allocate"),
+		SimulateNGPUs:                     c.Int("simulate-n-gpus"),
+		SimulateGPUMemoryMB:               c.Int("simulate-gpu-memory-mb"),
+		ScaleDownOnLowMemory:              c.Bool("scale-down-on-low-memory"),
+		MinFreeMemoryMiB:                  c.Int("min-free-memory-mib"),
+		ReplicaIDCodec:                    c.String("replica-id-codec"),
+		PreStopTimeout:                    Duration(c.Duration("prestop-timeout")),
+		PreStopMemoryUtilizationThreshold: c.Int("prestop-memory-utilization-threshold"),
+		MaxGRPCMessageSize:                c.Int("max-grpc-message-size"),
+		SMWeightedAllocation:              c.Bool("sm-weighted-allocation"),
+		SocketCleanupOnExit:               c.Bool("socket-cleanup-on-exit"),
+		GPUModelFilter:                    c.StringSlice("gpu-model-filter"),
+		GoroutineAlertThreshold:           c.Int("goroutine-alert-threshold"),
+		GRPCStopTimeout:                   Duration(c.Duration("grpc-stop-timeout")),
+		RequireVBIOSVersion:               c.String("require-vbios-version"),
+		ExtenderMode:                      c.Bool("extender-mode"),
+		ExtenderAddr:                      c.String("extender-addr"),
+		OTelEndpoint:                      c.String("otel-endpoint"),
+		RollingRestartDrainTimeout:        Duration(c.Duration("rolling-restart-drain-timeout")),
+		SyncConfigToConfigMap:             c.String("sync-config-to-configmap"),
+		HealthRecoveryInterval:            Duration(c.Duration("health-recovery-interval")),
+		MemorySliceMB:                     c.Int("memory-slice-mb"),
+		MaxAutoReplicas:                   c.Int("max-auto-replicas"),
+		MetricsAddr:                       c.String("metrics-addr"),
+		MaxReplicasPerDevice:              c.Int("max-replicas-per-device"),
+		ReplicaIDSeparator:                c.String("replica-id-separator"),
+		PrestartValidate:                  c.Bool("prestart-validate"),
+		PrestartValidateNvidiaSMI:         c.String("prestart-validate-nvidia-smi"),
+		PrestartValidateTimeout:           Duration(c.Duration("prestart-validate-timeout")),
+		LogFormat:                         c.String("log-format"),
+		LogLevel:                          c.String("log-level"),
+		HealthzAddr:                       c.String("healthz-addr"),
+		HealthzWindow:                     Duration(c.Duration("healthz-window")),
+		AuditLogFile:                      c.String("audit-log-file"),
+		AuditLogMaxSizeMB:                 c.Int("audit-log-max-size-mb"),
+		AuditLogMaxBackups:                c.Int("audit-log-max-backups"),
+		DryRun:                            c.Bool("dry-run"),
+		TopologyPolicy:                    c.String("topology-policy"),
+		ExtraDeviceEnvvars:                c.StringSlice("extra-device-envvars"),
+		ReservedMemoryPerGPUMB:            c.Int("reserved-memory-per-gpu-mb"),
+		RestartStableDuration:             Duration(c.Duration("restart-stable-duration")),
+		ResourceName:                      c.String("resource-name"),
+		DeviceListEnvvar:                  c.String("device-list-envvar"),
+		HealthCheckInterval:               Duration(c.Duration("health-check-interval")),
+		NodeLabelSelector:                 c.String("node-label-selector"),
+		NoReplicas:                        c.Bool("no-replicas"),
+		SocketDir:                         c.String("socket-dir"),
+		TieredResources:                   c.String("tiered-resources"),
+		GRPCDialTimeout:                   Duration(c.Duration("grpc-dial-timeout")),
+		KubeletRegistrationTimeout:        Duration(c.Duration("kubelet-registration-timeout")),
+		DeviceFilterUUIDRegex:             c.String("device-filter-uuid-regex"),
+		DeviceFilterIndex:                 c.StringSlice("device-filter-index"),
+		AllocationTimeout:                 Duration(c.Duration("allocation-timeout")),
+		TopologyFile:                      c.String("topology-file"),
+		LeaseConfigMap:                    c.String("lease-configmap"),
+		StartupTimeout:                    Duration(c.Duration("startup-timeout")),
+		EnforceSameGPU:                    c.Bool("enforce-same-gpu"),
+		DeviceCacheFile:                   c.String("device-cache-file"),
+		DeviceCacheTTL:                    Duration(c.Duration("device-cache-ttl")),
+		VolumeMountSourceStrategy:         c.String("volume-mount-source-strategy"),
+		HealthDebounceMs:                  c.Int("health-debounce-ms"),
+		ResourceNamespace:                 c.String("resource-namespace"),
+		WSL2Mode:                          c.Bool("wsl2-mode"),
+		MinReplicas:                       c.Int("min-replicas"),
+		MaxReplicas:                       c.Int("max-replicas"),
+		WatchConfigMap:                    c.String("watch-configmap"),
 	}
 }
 
@@ -125,15 +405,113 @@ func NewConfig(c *cli.Context, flags []cli.Flag) (*Config, error) {
 	}
 
 	commandLineFlagsFromConfig := map[interface{}]interface{}{
-		"mig-strategy":         config.Flags.MigStrategy,
-		"fail-on-init-error":   config.Flags.FailOnInitError,
-		"pass-device-specs":    config.Flags.PassDeviceSpecs,
-		"device-list-strategy": config.Flags.DeviceListStrategy,
-		"device-id-strategy":   config.Flags.DeviceIDStrategy,
-		"nvidia-driver-root":   config.Flags.NvidiaDriverRoot,
+		"mig-strategy":                         config.Flags.MigStrategy,
+		"fail-on-init-error":                   config.Flags.FailOnInitError,
+		"pass-device-specs":                    config.Flags.PassDeviceSpecs,
+		"device-list-strategy":                 config.Flags.DeviceListStrategy,
+		"device-id-strategy":                   config.Flags.DeviceIDStrategy,
+		"nvidia-driver-root":                   config.Flags.NvidiaDriverRoot,
+		"plugin-label":                         toInterfaceSlice(config.Flags.PluginLabels),
+		"no-self-label":                        config.Flags.NoSelfLabel,
+		"set-power-limit-watts":                config.Flags.SetPowerLimitWatts,
+		"dry-run-allocate":                     config.Flags.DryRunAllocate,
+		"clock-throttle-poll-interval":         time.Duration(config.Flags.ClockThrottlePollInterval),
+		"debug-addr":                           config.Flags.DebugAddr,
+		"graceful-period-on-unhealthy":         config.Flags.GracefulPeriodOnUnhealthy,
+		"health-event-window":                  time.Duration(config.Flags.HealthEventWindow),
+		"prefer-same-numa-socket":              config.Flags.PreferSameNUMASocket,
+		"no-health-check":                      config.Flags.NoHealthCheck,
+		"watch-xid-errors":                     config.Flags.WatchXIDErrors,
+		"allocate-retry-policy":                config.Flags.AllocateRetryPolicy,
+		"socket-watch-interval":                time.Duration(config.Flags.SocketWatchInterval),
+		"export-prometheus-textfile":           config.Flags.ExportPrometheusTextfile,
+		"energy-poll-interval":                 time.Duration(config.Flags.EnergyPollInterval),
+		"reset-gpu-on-release":                 config.Flags.ResetGPUOnRelease,
+		"enable-sentinel-device":               config.Flags.EnableSentinelDevice,
+		"ignore-device-uuids":                  toInterfaceSlice(config.Flags.IgnoreDeviceUUIDs),
+		"healthcheck-exec":                     config.Flags.HealthcheckExec,
+		"healthcheck-exec-timeout":             time.Duration(config.Flags.HealthcheckExecTimeout),
+		"emit-k8s-device-events":               config.Flags.EmitK8sDeviceEvents,
+		"topology-hints-enabled":               config.Flags.TopologyHintsEnabled,
+		"health-history-size":                  config.Flags.HealthHistorySize,
+		"leader-election":                      config.Flags.LeaderElection,
+		"allocate-response-delay":              time.Duration(config.Flags.AllocateResponseDelay),
+		"panic-on-double-allocate":             config.Flags.PanicOnDoubleAllocate,
+		"simulate-n-gpus":                      config.Flags.SimulateNGPUs,
+		"simulate-gpu-memory-mb":               config.Flags.SimulateGPUMemoryMB,
+		"scale-down-on-low-memory":             config.Flags.ScaleDownOnLowMemory,
+		"min-free-memory-mib":                  config.Flags.MinFreeMemoryMiB,
+		"replica-id-codec":                     config.Flags.ReplicaIDCodec,
+		"prestop-timeout":                      time.Duration(config.Flags.PreStopTimeout),
+		"prestop-memory-utilization-threshold": config.Flags.PreStopMemoryUtilizationThreshold,
+		"max-grpc-message-size":                config.Flags.MaxGRPCMessageSize,
+		"sm-weighted-allocation":               config.Flags.SMWeightedAllocation,
+		"socket-cleanup-on-exit":               config.Flags.SocketCleanupOnExit,
+		"gpu-model-filter":                     toInterfaceSlice(config.Flags.GPUModelFilter),
+		"goroutine-alert-threshold":            config.Flags.GoroutineAlertThreshold,
+		"grpc-stop-timeout":                    time.Duration(config.Flags.GRPCStopTimeout),
+		"require-vbios-version":                config.Flags.RequireVBIOSVersion,
+		"extender-mode":                        config.Flags.ExtenderMode,
+		"extender-addr":                        config.Flags.ExtenderAddr,
+		"otel-endpoint":                        config.Flags.OTelEndpoint,
+		"rolling-restart-drain-timeout":        time.Duration(config.Flags.RollingRestartDrainTimeout),
+		"sync-config-to-configmap":             config.Flags.SyncConfigToConfigMap,
+		"health-recovery-interval":             time.Duration(config.Flags.HealthRecoveryInterval),
+		"memory-slice-mb":                      config.Flags.MemorySliceMB,
+		"max-auto-replicas":                    config.Flags.MaxAutoReplicas,
+		"metrics-addr":                         config.Flags.MetricsAddr,
+		"max-replicas-per-device":              config.Flags.MaxReplicasPerDevice,
+		"replica-id-separator":                 config.Flags.ReplicaIDSeparator,
+		"prestart-validate":                    config.Flags.PrestartValidate,
+		"prestart-validate-nvidia-smi":         config.Flags.PrestartValidateNvidiaSMI,
+		"prestart-validate-timeout":            time.Duration(config.Flags.PrestartValidateTimeout),
+		"log-format":                           config.Flags.LogFormat,
+		"log-level":                            config.Flags.LogLevel,
+		"healthz-addr":                         config.Flags.HealthzAddr,
+		"healthz-window":                       time.Duration(config.Flags.HealthzWindow),
+		"audit-log-file":                       config.Flags.AuditLogFile,
+		"audit-log-max-size-mb":                config.Flags.AuditLogMaxSizeMB,
+		"audit-log-max-backups":                config.Flags.AuditLogMaxBackups,
+		"dry-run":                              config.Flags.DryRun,
+		"topology-policy":                      config.Flags.TopologyPolicy,
+		"extra-device-envvars":                 toInterfaceSlice(config.Flags.ExtraDeviceEnvvars),
+		"reserved-memory-per-gpu-mb":           config.Flags.ReservedMemoryPerGPUMB,
+		"restart-stable-duration":              time.Duration(config.Flags.RestartStableDuration),
+		"resource-name":                        config.Flags.ResourceName,
+		"device-list-envvar":                   config.Flags.DeviceListEnvvar,
+		"health-check-interval":                time.Duration(config.Flags.HealthCheckInterval),
+		"node-label-selector":                  config.Flags.NodeLabelSelector,
+		"no-replicas":                          config.Flags.NoReplicas,
+		"socket-dir":                           config.Flags.SocketDir,
+		"tiered-resources":                     config.Flags.TieredResources,
+		"grpc-dial-timeout":                    time.Duration(config.Flags.GRPCDialTimeout),
+		"kubelet-registration-timeout":         time.Duration(config.Flags.KubeletRegistrationTimeout),
+		"device-filter-uuid-regex":             config.Flags.DeviceFilterUUIDRegex,
+		"device-filter-index":                  toInterfaceSlice(config.Flags.DeviceFilterIndex),
+		"allocation-timeout":                   time.Duration(config.Flags.AllocationTimeout),
+		"topology-file":                        config.Flags.TopologyFile,
+		"lease-configmap":                      config.Flags.LeaseConfigMap,
+		"startup-timeout":                      time.Duration(config.Flags.StartupTimeout),
+		"enforce-same-gpu":                     config.Flags.EnforceSameGPU,
+		"device-cache-file":                    config.Flags.DeviceCacheFile,
+		"device-cache-ttl":                     time.Duration(config.Flags.DeviceCacheTTL),
+		"volume-mount-source-strategy":         config.Flags.VolumeMountSourceStrategy,
+		"health-debounce-ms":                   config.Flags.HealthDebounceMs,
+		"resource-namespace":                   config.Flags.ResourceNamespace,
+		"wsl2-mode":                            config.Flags.WSL2Mode,
+		"min-replicas":                         config.Flags.MinReplicas,
+		"max-replicas":                         config.Flags.MaxReplicas,
+		"watch-configmap":                      config.Flags.WatchConfigMap,
 	}
 	commandLineFlagsInputSource := altsrc.NewMapInputSource(configFile, commandLineFlagsFromConfig)
 
+	// altsrc only applies boolean flags that are true in the config file, so a false is set explicitly
+	if !config.Flags.TopologyHintsEnabled && !c.IsSet("topology-hints-enabled") {
+		if err := c.Set("topology-hints-enabled", "false"); err != nil {
+			return nil, fmt.Errorf("unable to load command line flags from config: %v", err)
+		}
+	}
+
 	err = altsrc.ApplyInputSourceValues(c, commandLineFlagsInputSource, flags)
 	if err != nil {
 		return nil, fmt.Errorf("unable to load command line flags from config: %v", err)
@@ -142,3 +520,15 @@ func NewConfig(c *cli.Context, flags []cli.Flag) (*Config, error) {
 
 	return config, nil
 }
+
+// toInterfaceSlice converts a string slice into the form expected by altsrc for slice flags.
+func toInterfaceSlice(values []string) []interface{} {
+	if values == nil {
+		return nil
+	}
+	var result []interface{}
+	for _, v := range values {
+		result = append(result, v)
+	}
+	return result
+}
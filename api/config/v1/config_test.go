@@ -0,0 +1,118 @@
+/*
+ * Copyright (c) 2022, NVIDIA CORPORATION.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package v1
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	cli "github.com/urfave/cli/v2"
+	altsrc "github.com/urfave/cli/v2/altsrc"
+)
+
+func TestParseConfigResources(t *testing.T) {
+	config, err := ParseConfigFrom(strings.NewReader(`
+version: v1
+flags:
+  migStrategy: mixed
+resources:
+  gpu: 4
+  mig-3g.20gb: auto
+`))
+	require.NoError(t, err)
+	require.Equal(t, Resources{
+		"gpu":         {Count: 4},
+		"mig-3g.20gb": {Auto: true},
+	}, config.Resources)
+
+	data, err := json.Marshal(config.Resources)
+	require.NoError(t, err)
+	require.JSONEq(t, `{"gpu": 4, "mig-3g.20gb": "auto"}`, string(data))
+}
+
+func TestParseConfigZeroReplicas(t *testing.T) {
+	config, err := ParseConfigFrom(strings.NewReader("version: v1\nresources:\n  gpu: 0\n"))
+	require.NoError(t, err)
+	require.Equal(t, Resources{"gpu": {Count: 0}}, config.Resources)
+}
+
+func TestParseConfigInvalidResources(t *testing.T) {
+	invalid := map[string]string{
+		"negative replicas":   "gpu: -1",
+		"fractional replicas": "gpu: 1.5",
+		"unknown string":      "gpu: many",
+		"list":                "gpu: [1]",
+		"prefixed name":       "nvidia.com/gpu: 2",
+		"uppercase name":      "GPU: 2",
+	}
+	for description, resources := range invalid {
+		_, err := ParseConfigFrom(strings.NewReader("version: v1\nresources:\n  " + resources + "\n"))
+		require.Error(t, err, description)
+	}
+}
+
+func TestSchema(t *testing.T) {
+	data, err := ioutil.ReadFile("schema.json")
+	require.NoError(t, err)
+
+	var schema struct {
+		Properties struct {
+			Resources struct {
+				PropertyNames struct {
+					Pattern string `json:"pattern"`
+				} `json:"propertyNames"`
+			} `json:"resources"`
+		} `json:"properties"`
+	}
+	require.NoError(t, json.Unmarshal(data, &schema))
+
+	// The schema documents the rules validated at startup
+	require.Equal(t, resourceNamePattern.String(), schema.Properties.Resources.PropertyNames.Pattern)
+}
+
+func TestNewConfigTopologyHintsEnabled(t *testing.T) {
+	newConfig := func(file string, args ...string) *Config {
+		path := filepath.Join(t.TempDir(), "config.yaml")
+		require.NoError(t, ioutil.WriteFile(path, []byte(file), 0o600))
+
+		var flags CommandLineFlags
+		var config *Config
+		app := cli.NewApp()
+		app.Flags = []cli.Flag{
+			&cli.StringFlag{Name: "config-file"},
+			altsrc.NewBoolFlag(&cli.BoolFlag{Name: "topology-hints-enabled", Value: true, Destination: &flags.TopologyHintsEnabled}),
+		}
+		app.Action = func(c *cli.Context) error {
+			var err error
+			config, err = NewConfig(c, app.Flags)
+			return err
+		}
+		require.NoError(t, app.Run(append([]string{"plugin", "--config-file", path}, args...)))
+		return config
+	}
+
+	require.True(t, newConfig("version: v1\n").Flags.TopologyHintsEnabled)
+	require.True(t, newConfig("version: v1\nflags:\n  topologyHintsEnabled: true\n").Flags.TopologyHintsEnabled)
+	// altsrc ignores booleans that are false in the config file
+	require.False(t, newConfig("version: v1\nflags:\n  topologyHintsEnabled: false\n").Flags.TopologyHintsEnabled)
+	// The command line takes precedence over the config file
+	require.True(t, newConfig("version: v1\nflags:\n  topologyHintsEnabled: false\n", "--topology-hints-enabled=true").Flags.TopologyHintsEnabled)
+}
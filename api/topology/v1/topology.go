@@ -0,0 +1,197 @@
+/*
+ * Copyright (c) 2022, NVIDIA CORPORATION.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package v1
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/NVIDIA/go-gpuallocator/gpuallocator"
+	"github.com/NVIDIA/gpu-monitoring-tools/bindings/go/nvml"
+)
+
+// Version indicates the version of the topology file format
+const Version = "v1"
+
+// Topology describes the links between the GPUs of a node, as a sparse matrix of the peer access between
+// each pair of devices. It stands in for the topology queried through NVML where it is unavailable.
+type Topology struct {
+	Version string   `json:"version"`
+	Devices []Device `json:"devices"`
+}
+
+// Device is a GPU along with its links to the other GPUs of the node
+type Device struct {
+	UUID  string `json:"uuid"`
+	Index int    `json:"index"`
+	Links []Link `json:"links,omitempty"`
+}
+
+// Link is a point-to-point link from a device to its peer, the type of the link ranking its bandwidth
+type Link struct {
+	Peer string `json:"peer"`
+	Type string `json:"type"`
+}
+
+// linkTypes names the link types in the topology file, from the slowest to the fastest
+var linkTypes = map[string]nvml.P2PLinkType{
+	"cross-cpu":     nvml.P2PLinkCrossCPU,
+	"same-cpu":      nvml.P2PLinkSameCPU,
+	"host-bridge":   nvml.P2PLinkHostBridge,
+	"multi-switch":  nvml.P2PLinkMultiSwitch,
+	"single-switch": nvml.P2PLinkSingleSwitch,
+	"same-board":    nvml.P2PLinkSameBoard,
+	"nvlink1":       nvml.SingleNVLINKLink,
+	"nvlink2":       nvml.TwoNVLINKLinks,
+	"nvlink3":       nvml.ThreeNVLINKLinks,
+	"nvlink4":       nvml.FourNVLINKLinks,
+	"nvlink5":       nvml.FiveNVLINKLinks,
+	"nvlink6":       nvml.SixNVLINKLinks,
+	"nvlink7":       nvml.SevenNVLINKLinks,
+	"nvlink8":       nvml.EightNVLINKLinks,
+	"nvlink9":       nvml.NineNVLINKLinks,
+	"nvlink10":      nvml.TenNVLINKLinks,
+	"nvlink11":      nvml.ElevenNVLINKLinks,
+	"nvlink12":      nvml.TwelveNVLINKLinks,
+}
+
+// Load reads and validates the topology file at 'path'
+func Load(path string) (*Topology, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("error opening topology file: %v", err)
+	}
+	defer f.Close()
+
+	t, err := parse(f)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing topology file %s: %v", path, err)
+	}
+	return t, nil
+}
+
+func parse(reader io.Reader) (*Topology, error) {
+	var t Topology
+	decoder := json.NewDecoder(reader)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&t); err != nil {
+		return nil, err
+	}
+	if err := t.Validate(); err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+// Validate checks the topology against the rules of the topology file schema (schema.json)
+func (t *Topology) Validate() error {
+	if t.Version != Version {
+		return fmt.Errorf("unknown version: %q", t.Version)
+	}
+
+	uuids := make(map[string]bool)
+	indices := make(map[int]bool)
+	for _, d := range t.Devices {
+		if d.UUID == "" {
+			return fmt.Errorf("device %d has no uuid", d.Index)
+		}
+		if uuids[d.UUID] {
+			return fmt.Errorf("device %s listed more than once", d.UUID)
+		}
+		if d.Index < 0 || indices[d.Index] {
+			return fmt.Errorf("device %s has an invalid or duplicate index: %d", d.UUID, d.Index)
+		}
+		uuids[d.UUID] = true
+		indices[d.Index] = true
+	}
+
+	for _, d := range t.Devices {
+		for _, l := range d.Links {
+			if !uuids[l.Peer] || l.Peer == d.UUID {
+				return fmt.Errorf("device %s has a link to an invalid peer: %q", d.UUID, l.Peer)
+			}
+			if _, ok := linkTypes[l.Type]; !ok {
+				return fmt.Errorf("device %s has a link of unknown type: %q", d.UUID, l.Type)
+			}
+		}
+	}
+	return nil
+}
+
+// Write writes the topology in the format read by Load
+func (t *Topology) Write(w io.Writer) error {
+	data, err := json.MarshalIndent(t, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(data, '\n'))
+	return err
+}
+
+// New returns the topology of 'devices', as discovered by gpuallocator.NewDevices
+func New(devices []*gpuallocator.Device) *Topology {
+	names := make(map[nvml.P2PLinkType]string)
+	for name, linkType := range linkTypes {
+		names[linkType] = name
+	}
+
+	t := &Topology{Version: Version}
+	for _, d := range devices {
+		device := Device{UUID: d.UUID, Index: d.Index}
+		for _, d2 := range devices {
+			for _, l := range d.Links[d2.Index] {
+				if name, ok := names[l.Type]; ok {
+					device.Links = append(device.Links, Link{Peer: d2.UUID, Type: name})
+				}
+			}
+		}
+		t.Devices = append(t.Devices, device)
+	}
+	return t
+}
+
+// DevicesFrom returns the devices with the given UUIDs linked as described by the topology,
+// as gpuallocator.NewDevicesFrom does with the topology queried through NVML
+func (t *Topology) DevicesFrom(uuids []string) ([]*gpuallocator.Device, error) {
+	byUUID := make(map[string]*gpuallocator.Device)
+	for _, d := range t.Devices {
+		byUUID[d.UUID] = &gpuallocator.Device{
+			Device: &nvml.Device{UUID: d.UUID},
+			Index:  d.Index,
+			Links:  make(map[int][]gpuallocator.P2PLink),
+		}
+	}
+	for _, d := range t.Devices {
+		device := byUUID[d.UUID]
+		for _, l := range d.Links {
+			peer := byUUID[l.Peer]
+			device.Links[peer.Index] = append(device.Links[peer.Index], gpuallocator.P2PLink{GPU: peer, Type: linkTypes[l.Type]})
+		}
+	}
+
+	var devices []*gpuallocator.Device
+	for _, uuid := range uuids {
+		device, ok := byUUID[uuid]
+		if !ok {
+			return nil, fmt.Errorf("no device with uuid: %v", uuid)
+		}
+		devices = append(devices, device)
+	}
+	return devices, nil
+}
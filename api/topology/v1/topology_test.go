@@ -0,0 +1,122 @@
+/*
+ * Copyright (c) 2022, NVIDIA CORPORATION.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package v1
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/NVIDIA/gpu-monitoring-tools/bindings/go/nvml"
+	"github.com/stretchr/testify/require"
+)
+
+const testTopology = `{
+  "version": "v1",
+  "devices": [
+    {"uuid": "GPU-a", "index": 0, "links": [{"peer": "GPU-b", "type": "nvlink2"}, {"peer": "GPU-c", "type": "cross-cpu"}]},
+    {"uuid": "GPU-b", "index": 1, "links": [{"peer": "GPU-a", "type": "nvlink2"}]},
+    {"uuid": "GPU-c", "index": 2}
+  ]
+}`
+
+func TestDevicesFrom(t *testing.T) {
+	topology, err := parse(strings.NewReader(testTopology))
+	require.NoError(t, err)
+
+	devices, err := topology.DevicesFrom([]string{"GPU-b", "GPU-a"})
+	require.NoError(t, err)
+	require.Len(t, devices, 2)
+	require.Equal(t, "GPU-b", devices[0].UUID)
+	require.Equal(t, 1, devices[0].Index)
+	require.Len(t, devices[1].Links[1], 1)
+	require.Equal(t, nvml.TwoNVLINKLinks, devices[1].Links[1][0].Type)
+	require.Equal(t, devices[0], devices[1].Links[1][0].GPU)
+	require.Equal(t, nvml.P2PLinkCrossCPU, devices[1].Links[2][0].Type)
+
+	_, err = topology.DevicesFrom([]string{"GPU-z"})
+	require.Error(t, err)
+}
+
+func TestWriteRoundTrip(t *testing.T) {
+	topology, err := parse(strings.NewReader(testTopology))
+	require.NoError(t, err)
+	devices, err := topology.DevicesFrom([]string{"GPU-a", "GPU-b", "GPU-c"})
+	require.NoError(t, err)
+
+	var buf bytes.Buffer
+	require.NoError(t, New(devices).Write(&buf))
+	written, err := parse(&buf)
+	require.NoError(t, err)
+	require.Equal(t, topology, written)
+}
+
+func TestParseInvalidTopology(t *testing.T) {
+	invalid := map[string]string{
+		"unknown version":  `{"version": "v2", "devices": []}`,
+		"unknown field":    `{"version": "v1", "devices": [], "links": []}`,
+		"missing uuid":     `{"version": "v1", "devices": [{"index": 0}]}`,
+		"duplicate uuid":   `{"version": "v1", "devices": [{"uuid": "GPU-a", "index": 0}, {"uuid": "GPU-a", "index": 1}]}`,
+		"duplicate index":  `{"version": "v1", "devices": [{"uuid": "GPU-a", "index": 0}, {"uuid": "GPU-b", "index": 0}]}`,
+		"unknown peer":     `{"version": "v1", "devices": [{"uuid": "GPU-a", "index": 0, "links": [{"peer": "GPU-b", "type": "nvlink1"}]}]}`,
+		"link to itself":   `{"version": "v1", "devices": [{"uuid": "GPU-a", "index": 0, "links": [{"peer": "GPU-a", "type": "nvlink1"}]}]}`,
+		"unknown linktype": `{"version": "v1", "devices": [{"uuid": "GPU-a", "index": 0}, {"uuid": "GPU-b", "index": 1, "links": [{"peer": "GPU-a", "type": "pcie"}]}]}`,
+	}
+	for description, topology := range invalid {
+		_, err := parse(strings.NewReader(topology))
+		require.Error(t, err, description)
+	}
+}
+
+func TestSchema(t *testing.T) {
+	data, err := ioutil.ReadFile("schema.json")
+	require.NoError(t, err)
+
+	var schema struct {
+		Properties struct {
+			Devices struct {
+				Items struct {
+					Properties struct {
+						Links struct {
+							Items struct {
+								Properties struct {
+									Type struct {
+										Enum []string `json:"enum"`
+									} `json:"type"`
+								} `json:"properties"`
+							} `json:"items"`
+						} `json:"links"`
+					} `json:"properties"`
+				} `json:"items"`
+			} `json:"devices"`
+		} `json:"properties"`
+	}
+	require.NoError(t, json.Unmarshal(data, &schema))
+
+	// The schema documents the link types accepted at startup
+	var names []string
+	for name := range linkTypes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	enum := schema.Properties.Devices.Items.Properties.Links.Items.Properties.Type.Enum
+	sort.Strings(enum)
+	require.Equal(t, names, enum)
+}
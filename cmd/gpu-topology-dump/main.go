@@ -0,0 +1,64 @@
+/*
+ * Copyright (c) 2022, NVIDIA CORPORATION.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// gpu-topology-dump writes the topology of the GPUs of the node, as queried through NVML, in the format
+// read by the --topology-file flag of the device plugin. It is meant to be run on a node where the topology
+// can be queried, to generate the file for similar nodes where it cannot.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+
+	"github.com/NVIDIA/go-gpuallocator/gpuallocator"
+	"github.com/NVIDIA/gpu-monitoring-tools/bindings/go/nvml"
+	topology "github.com/NVIDIA/k8s-device-plugin/api/topology/v1"
+)
+
+func main() {
+	output := flag.String("output", "", "file to write the topology to, instead of the standard output")
+	flag.Parse()
+
+	if err := dump(*output); err != nil {
+		log.Fatalf("Error: %v", err)
+	}
+}
+
+func dump(output string) error {
+	if err := nvml.Init(); err != nil {
+		return fmt.Errorf("failed to initialize NVML: %v", err)
+	}
+	defer nvml.Shutdown()
+
+	devices, err := gpuallocator.NewDevices()
+	if err != nil {
+		return fmt.Errorf("failed to query the topology: %v", err)
+	}
+
+	var w io.Writer = os.Stdout
+	if output != "" {
+		f, err := os.Create(output)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+	return topology.New(devices).Write(w)
+}
@@ -0,0 +1,359 @@
+/*
+ * Copyright (c) 2022, NVIDIA CORPORATION.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+// Allocation is a set of replicas handed out to a single container by Allocate
+type Allocation struct {
+	ID         int
+	ReplicaIDs []string
+	Time       time.Time
+}
+
+// AllocationStore keeps track of the replicas handed out by Allocate.
+// The kubelet does not notify device plugins when a container releases its devices. However, it only
+// hands out a device again once the container it was allocated to is gone, so an allocation is
+// considered released as soon as any of its replicas is allocated again.
+type AllocationStore struct {
+	sync.RWMutex
+	codec       ReplicaIDCodec
+	nextID      int
+	allocations map[int]*Allocation
+	owners      map[string]int  // replica ID to allocation ID
+	seen        map[string]bool // replicas allocated at least once since the store was created
+}
+
+// NewAllocationStore returns an empty AllocationStore for replica IDs built with 'codec'
+func NewAllocationStore(codec ReplicaIDCodec) *AllocationStore {
+	return &AllocationStore{
+		codec:       codec,
+		allocations: make(map[int]*Allocation),
+		owners:      make(map[string]int),
+		seen:        make(map[string]bool),
+	}
+}
+
+// Add records a new allocation of 'replicaIDs'. Previous allocations sharing any of these replicas are evicted.
+// It returns the evicted allocations along with the physical GPUs that no longer have any replica allocated.
+func (s *AllocationStore) Add(replicaIDs []string) (evicted []*Allocation, released []string) {
+	s.Lock()
+	defer s.Unlock()
+
+	before := s.physicalCounts()
+
+	for _, id := range replicaIDs {
+		owner, exists := s.owners[id]
+		if !exists {
+			continue
+		}
+		allocation := s.allocations[owner]
+		for _, r := range allocation.ReplicaIDs {
+			delete(s.owners, r)
+		}
+		delete(s.allocations, owner)
+		evicted = append(evicted, allocation)
+	}
+
+	s.nextID++
+	allocation := &Allocation{
+		ID:         s.nextID,
+		ReplicaIDs: append([]string(nil), replicaIDs...),
+		Time:       time.Now(),
+	}
+	s.allocations[allocation.ID] = allocation
+	for _, id := range replicaIDs {
+		s.owners[id] = allocation.ID
+		s.seen[id] = true
+	}
+
+	after := s.physicalCounts()
+	for uuid := range before {
+		if after[uuid] == 0 {
+			released = append(released, uuid)
+		}
+	}
+	sort.Strings(released)
+
+	return evicted, released
+}
+
+// HeldAfter returns the sorted replicas that would be allocated once each of 'requests' is added in turn
+func (s *AllocationStore) HeldAfter(requests [][]string) []string {
+	s.RLock()
+	defer s.RUnlock()
+
+	held := make(map[string]bool)
+	for id := range s.owners {
+		held[id] = true
+	}
+	for _, replicaIDs := range requests {
+		for _, id := range replicaIDs {
+			if owner := s.owner(id); owner != nil {
+				for _, r := range owner.ReplicaIDs {
+					delete(held, r)
+				}
+			}
+		}
+	}
+	for _, replicaIDs := range requests {
+		for _, id := range replicaIDs {
+			held[id] = true
+		}
+	}
+
+	var ids []string
+	for id := range held {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// Allocated returns whether the replica 'replicaID' is allocated
+func (s *AllocationStore) Allocated(replicaID string) bool {
+	s.RLock()
+	defer s.RUnlock()
+	_, exists := s.owners[replicaID]
+	return exists
+}
+
+// Seen returns whether each of 'replicaIDs' has been allocated at least once since the store was created
+func (s *AllocationStore) Seen(replicaIDs []string) bool {
+	s.RLock()
+	defer s.RUnlock()
+	for _, id := range replicaIDs {
+		if !s.seen[id] {
+			return false
+		}
+	}
+	return true
+}
+
+// AllocatedReplicas returns the number of allocated replicas of the physical GPU 'uuid'
+func (s *AllocationStore) AllocatedReplicas(uuid string) int {
+	s.RLock()
+	defer s.RUnlock()
+	return s.physicalCounts()[uuid]
+}
+
+// owner returns the allocation currently holding the replica 'replicaID', or nil if it is not allocated.
+// The caller must hold the lock of the store.
+func (s *AllocationStore) owner(replicaID string) *Allocation {
+	id, exists := s.owners[replicaID]
+	if !exists {
+		return nil
+	}
+	return s.allocations[id]
+}
+
+// Count returns the number of allocations in the store
+func (s *AllocationStore) Count() int {
+	s.RLock()
+	defer s.RUnlock()
+	return len(s.allocations)
+}
+
+// physicalCounts returns the number of allocated replicas of each physical GPU
+func (s *AllocationStore) physicalCounts() map[string]int {
+	counts := make(map[string]int)
+	for id := range s.owners {
+		counts[stripReplica(id, s.codec)]++
+	}
+	return counts
+}
+
+// resetGPU resets a GPU through nvidia-smi. This fails if any process is still using the GPU.
+func resetGPU(uuid string) error {
+	_, err := runNvidiaSMI("--id="+uuid, "--gpu-reset")
+	return err
+}
+
+// resetReleasedGPUs resets each of the given GPUs in the background when --reset-gpu-on-release is set.
+// The AllocationStore does not know about the allocations made before the plugin started, so a GPU is
+// only reset once each of its replicas has been allocated since: their previous holders are then gone.
+func (m *NvidiaDevicePlugin) resetReleasedGPUs(uuids []string) {
+	if !m.config.Flags.ResetGPUOnRelease {
+		return
+	}
+	for _, uuid := range uuids {
+		if !m.allocations.Seen(m.replicaIDsOf(uuid)) {
+			m.logger.Info("Not resetting released device, it may still be used by containers started before the plugin", logKeyEventType, "gpu_reset_skipped", logKeyDeviceUUID, uuid)
+			continue
+		}
+		go func(uuid string) {
+			m.logger.Info("All replicas of the device have been released, resetting it", logKeyEventType, "gpu_reset", logKeyDeviceUUID, uuid)
+			if err := m.resetGPU(uuid); err != nil {
+				m.logger.Error("Failed to reset device", logKeyEventType, "gpu_reset_failed", logKeyDeviceUUID, uuid, "error", err)
+			}
+		}(uuid)
+	}
+}
+
+// replicaIDsOf returns the IDs of the replicas of the physical GPU 'uuid'
+func (m *NvidiaDevicePlugin) replicaIDsOf(uuid string) []string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var ids []string
+	for _, r := range m.deviceReplicas {
+		if stripReplica(r.ID, m.replicaCodec) == uuid {
+			ids = append(ids, r.ID)
+		}
+	}
+	return ids
+}
+
+// recordAllocationEvents records a GPUReleased event for each evicted allocation followed by a
+// GPUAllocated event for the new allocation of 'replicaIDs' when --emit-k8s-device-events is set
+func (m *NvidiaDevicePlugin) recordAllocationEvents(replicaIDs []string, evicted []*Allocation) {
+	if !m.config.Flags.EmitK8sDeviceEvents || m.events == nil {
+		return
+	}
+	// The replica IDs were validated when they were allocated
+	for _, a := range evicted {
+		uuids, _ := m.stripReplicas(a.ReplicaIDs)
+		m.events.Normal("GPUReleased", fmt.Sprintf("Released '%s' devices %s (replicas %s)", m.resourceName, strings.Join(uuids, ","), strings.Join(a.ReplicaIDs, ",")))
+	}
+	uuids, _ := m.stripReplicas(replicaIDs)
+	m.events.Normal("GPUAllocated", fmt.Sprintf("Allocated '%s' devices %s (replicas %s)", m.resourceName, strings.Join(uuids, ","), strings.Join(replicaIDs, ",")))
+}
+
+// findDoubleAllocation returns the first replica requested more than once across the containers of a request
+func findDoubleAllocation(reqs *pluginapi.AllocateRequest) (string, bool) {
+	requested := make(map[string]bool)
+	for _, req := range reqs.ContainerRequests {
+		for _, id := range req.DevicesIDs {
+			if requested[id] {
+				return id, true
+			}
+			requested[id] = true
+		}
+	}
+	return "", false
+}
+
+// checkSameGPU fails with InvalidArgument if the replicas requested for any container belong to more than one
+// physical GPU, as enforced by --enforce-same-gpu
+func (m *NvidiaDevicePlugin) checkSameGPU(reqs *pluginapi.AllocateRequest) error {
+	for _, req := range reqs.ContainerRequests {
+		uuids, err := m.stripReplicas(req.DevicesIDs)
+		if err != nil {
+			return status.Errorf(codes.InvalidArgument, "invalid allocation request for '%s': %v", m.resourceName, err)
+		}
+		if len(uuids) <= 1 {
+			continue
+		}
+		m.logger.Warn("Rejecting allocation spanning several GPUs", logKeyEventType, "allocation_rejected_multiple_gpus", "device_ids", req.DevicesIDs, "uuids", uuids)
+		return status.Errorf(codes.InvalidArgument, "invalid allocation request for '%s': replicas %s belong to %d GPUs (%s), but --enforce-same-gpu requires a single one",
+			m.resourceName, strings.Join(req.DevicesIDs, ","), len(uuids), strings.Join(uuids, ","))
+	}
+	return nil
+}
+
+// AllocationState is the debug view of the allocation currently holding a replica
+type AllocationState struct {
+	ResourceName string    `json:"resourceName"`
+	DeviceID     string    `json:"deviceID"`
+	AllocationID int       `json:"allocationID"`
+	ReplicaIDs   []string  `json:"replicaIDs"`
+	Time         time.Time `json:"time"`
+}
+
+// serveAllocation serves 'GET /allocations/<deviceID>' for admission webhooks verifying device assignments.
+// Allocate is not told which container it allocates devices to, so the allocation is identified by the ID
+// assigned by the AllocationStore along with all the replicas handed out with the requested one.
+// It answers 404 if the replica is not allocated by any of the plugins.
+func (s *DebugServer) serveAllocation(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	id := strings.TrimPrefix(r.URL.Path, "/allocations/")
+	if id == "" {
+		http.Error(w, "no device given", http.StatusBadRequest)
+		return
+	}
+
+	s.Lock()
+	plugins := s.plugins
+	s.Unlock()
+
+	for _, p := range plugins {
+		if p.serveAllocation(w, id) {
+			return
+		}
+	}
+	http.Error(w, fmt.Sprintf("device %s is not allocated", id), http.StatusNotFound)
+}
+
+// serveAllocation writes the allocation holding the replica 'id' if there is one. The allocation is encoded
+// while the store is read-locked, so that it cannot be evicted in the meantime, but written once it is
+// unlocked, so that a slow client does not hold up Allocate.
+func (m *NvidiaDevicePlugin) serveAllocation(w http.ResponseWriter, id string) bool {
+	var buf bytes.Buffer
+	found, err := m.encodeAllocation(&buf, id)
+	if !found {
+		return false
+	}
+	if err != nil {
+		m.logger.Error("Failed to encode allocation", logKeyDeviceUUID, id, "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return true
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if _, err := buf.WriteTo(w); err != nil {
+		m.logger.Warn("Failed to write allocation", logKeyDeviceUUID, id, "error", err)
+	}
+	return true
+}
+
+// encodeAllocation encodes the allocation holding the replica 'id' into 'buf', returning whether there is one
+func (m *NvidiaDevicePlugin) encodeAllocation(buf *bytes.Buffer, id string) (bool, error) {
+	m.allocations.RLock()
+	defer m.allocations.RUnlock()
+
+	a := m.allocations.owner(id)
+	if a == nil {
+		return false, nil
+	}
+
+	encoder := json.NewEncoder(buf)
+	encoder.SetIndent("", "  ")
+	return true, encoder.Encode(&AllocationState{
+		ResourceName: m.resourceName,
+		DeviceID:     id,
+		AllocationID: a.ID,
+		ReplicaIDs:   a.ReplicaIDs,
+		Time:         a.Time,
+	})
+}
@@ -0,0 +1,288 @@
+/*
+ * Copyright (c) 2022, NVIDIA CORPORATION.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	config "github.com/NVIDIA/k8s-device-plugin/api/config/v1"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+func TestAllocationStore(t *testing.T) {
+	s := NewAllocationStore(defaultReplicaIDCodec)
+
+	evicted, released := s.Add([]string{"GPU-0-replica-0", "GPU-1-replica-0"})
+	require.Empty(t, evicted)
+	require.Empty(t, released)
+
+	evicted, released = s.Add([]string{"GPU-0-replica-1"})
+	require.Empty(t, evicted)
+	require.Empty(t, released)
+	require.Equal(t, 2, s.AllocatedReplicas("GPU-0"))
+
+	// Reallocating GPU-1-replica-0 releases the first allocation; GPU-0 is still used by the second
+	evicted, released = s.Add([]string{"GPU-1-replica-0"})
+	require.Len(t, evicted, 1)
+	require.Equal(t, []string{"GPU-0-replica-0", "GPU-1-replica-0"}, evicted[0].ReplicaIDs)
+	require.Empty(t, released)
+	require.Equal(t, 1, s.AllocatedReplicas("GPU-0"))
+	require.Equal(t, 1, s.AllocatedReplicas("GPU-1"))
+
+	// Reallocating GPU-0-replica-1 on its own does not release GPU-0 either
+	_, released = s.Add([]string{"GPU-0-replica-1"})
+	require.Empty(t, released)
+
+	// Moving the workload to GPU-2 leaves GPU-1 without any allocated replica
+	_, released = s.Add([]string{"GPU-1-replica-0", "GPU-2-replica-0"})
+	require.Empty(t, released)
+	_, released = s.Add([]string{"GPU-2-replica-0"})
+	require.Equal(t, []string{"GPU-1"}, released)
+	require.Equal(t, 0, s.AllocatedReplicas("GPU-1"))
+}
+
+// fakeExecCommand replaces execCommand for the duration of the test, recording the arguments of every command.
+// The commands run the test binary's TestHelperProcess, which exits successfully.
+func fakeExecCommand(t *testing.T) func() [][]string {
+	var lock sync.Mutex
+	var commands [][]string
+
+	original := execCommand
+	execCommand = func(name string, args ...string) *exec.Cmd {
+		lock.Lock()
+		commands = append(commands, append([]string{name}, args...))
+		lock.Unlock()
+
+		cmd := exec.Command(os.Args[0], "-test.run=TestHelperProcess")
+		cmd.Env = []string{"GO_WANT_HELPER_PROCESS=1"}
+		return cmd
+	}
+	t.Cleanup(func() { execCommand = original })
+
+	return func() [][]string {
+		lock.Lock()
+		defer lock.Unlock()
+		return append([][]string(nil), commands...)
+	}
+}
+
+func TestHelperProcess(t *testing.T) {
+	if os.Getenv("GO_WANT_HELPER_PROCESS") != "1" {
+		return
+	}
+	os.Exit(0)
+}
+
+func TestResetGPUOnRelease(t *testing.T) {
+	commands := fakeExecCommand(t)
+
+	m := newTestPlugin(config.CommandLineFlags{ResetGPUOnRelease: true}, 2,
+		&Device{Device: newPluginDevice("GPU-0")},
+		&Device{Device: newPluginDevice("GPU-1")},
+	)
+	allocate := func(ids ...string) {
+		_, err := m.Allocate(context.Background(), &pluginapi.AllocateRequest{
+			ContainerRequests: []*pluginapi.ContainerAllocateRequest{{DevicesIDs: ids}},
+		})
+		require.NoError(t, err)
+	}
+
+	allocate("GPU-0-replica-0", "GPU-0-replica-1")
+	allocate("GPU-1-replica-0")
+	require.Empty(t, commands())
+
+	// The first container is gone once its replica is handed out again, releasing GPU-0
+	allocate("GPU-0-replica-1", "GPU-1-replica-1")
+	require.Empty(t, commands())
+	allocate("GPU-1-replica-1")
+	require.Eventually(t, func() bool { return len(commands()) == 1 }, time.Second, time.Millisecond)
+	require.Equal(t, "nvidia-smi --id=GPU-0 --gpu-reset", strings.Join(commands()[0], " "))
+}
+
+func TestNoResetGPUOnReleaseAfterRestart(t *testing.T) {
+	resets := make(chan string, 1)
+	m := newTestPlugin(config.CommandLineFlags{ResetGPUOnRelease: true}, 2,
+		&Device{Device: newPluginDevice("GPU-0")},
+		&Device{Device: newPluginDevice("GPU-1")},
+	)
+	m.resetGPU = func(uuid string) error {
+		resets <- uuid
+		return nil
+	}
+	allocate := func(ids ...string) {
+		_, err := m.Allocate(context.Background(), &pluginapi.AllocateRequest{
+			ContainerRequests: []*pluginapi.ContainerAllocateRequest{{DevicesIDs: ids}},
+		})
+		require.NoError(t, err)
+	}
+
+	// GPU-0-replica-1 may still be held by a container started before the plugin
+	allocate("GPU-0-replica-0", "GPU-1-replica-0")
+	allocate("GPU-1-replica-0")
+	select {
+	case uuid := <-resets:
+		t.Fatalf("unexpected reset of %s", uuid)
+	default:
+	}
+
+	// Once each replica has been allocated since the start, the GPU is reset when released
+	allocate("GPU-0-replica-0", "GPU-0-replica-1", "GPU-1-replica-1")
+	allocate("GPU-1-replica-1")
+	select {
+	case uuid := <-resets:
+		require.Equal(t, "GPU-0", uuid)
+	case <-time.After(time.Second):
+		t.Fatal("GPU-0 was not reset")
+	}
+}
+
+func TestNoResetGPUOnReleaseByDefault(t *testing.T) {
+	resets := 0
+	m := newTestPlugin(config.CommandLineFlags{}, 1, &Device{Device: newPluginDevice("GPU-0")})
+	m.resetGPU = func(uuid string) error {
+		resets++
+		return nil
+	}
+
+	m.resetReleasedGPUs([]string{"GPU-0"})
+	require.Zero(t, resets)
+}
+
+func TestEmitK8sDeviceEvents(t *testing.T) {
+	m := newTestPlugin(config.CommandLineFlags{EmitK8sDeviceEvents: true}, 2, &Device{Device: newPluginDevice("GPU-0")})
+	events := &fakeEventRecorder{}
+	m.events = events
+
+	for _, ids := range [][]string{{"GPU-0-replica-0"}, {"GPU-0-replica-1"}, {"GPU-0-replica-0"}} {
+		_, err := m.Allocate(context.Background(), &pluginapi.AllocateRequest{
+			ContainerRequests: []*pluginapi.ContainerAllocateRequest{{DevicesIDs: ids}},
+		})
+		require.NoError(t, err)
+	}
+
+	require.Equal(t, []string{
+		"GPUAllocated: Allocated 'nvidia.com/gpu' devices GPU-0 (replicas GPU-0-replica-0)",
+		"GPUAllocated: Allocated 'nvidia.com/gpu' devices GPU-0 (replicas GPU-0-replica-1)",
+		"GPUReleased: Released 'nvidia.com/gpu' devices GPU-0 (replicas GPU-0-replica-0)",
+		"GPUAllocated: Allocated 'nvidia.com/gpu' devices GPU-0 (replicas GPU-0-replica-0)",
+	}, events.normals)
+}
+
+func TestAllocateRejectsDoubleAllocation(t *testing.T) {
+	m := newTestPlugin(config.CommandLineFlags{}, 2, &Device{Device: newPluginDevice("GPU-a")})
+
+	_, err := m.Allocate(context.Background(), &pluginapi.AllocateRequest{
+		ContainerRequests: []*pluginapi.ContainerAllocateRequest{
+			{DevicesIDs: []string{"GPU-a-replica-0"}},
+			{DevicesIDs: []string{"GPU-a-replica-1", "GPU-a-replica-0"}},
+		},
+	})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "GPU-a-replica-0")
+	require.Empty(t, m.allocations.AllocatedReplicas("GPU-a"))
+}
+
+func TestEnforceSameGPU(t *testing.T) {
+	m := newTestPlugin(config.CommandLineFlags{EnforceSameGPU: true}, 2,
+		&Device{Device: newPluginDevice("GPU-a")}, &Device{Device: newPluginDevice("GPU-b")})
+	logs := captureLog(t)
+
+	_, err := m.Allocate(context.Background(), &pluginapi.AllocateRequest{
+		ContainerRequests: []*pluginapi.ContainerAllocateRequest{{DevicesIDs: []string{"GPU-a-replica-0", "GPU-a-replica-1"}}},
+	})
+	require.NoError(t, err)
+
+	_, err = m.Allocate(context.Background(), &pluginapi.AllocateRequest{
+		ContainerRequests: []*pluginapi.ContainerAllocateRequest{
+			{DevicesIDs: []string{"GPU-b-replica-0"}},
+			{DevicesIDs: []string{"GPU-a-replica-0", "GPU-b-replica-1"}},
+		},
+	})
+	require.Equal(t, codes.InvalidArgument, status.Code(err), "%v", err)
+	require.Contains(t, err.Error(), "GPU-a,GPU-b")
+	require.Contains(t, logs.String(), "event_type=allocation_rejected_multiple_gpus")
+	require.Equal(t, 1, m.allocations.Count())
+}
+
+// lockCheckingRecorder records whether the allocation store could be written to while the response was written
+type lockCheckingRecorder struct {
+	*httptest.ResponseRecorder
+	store          *AllocationStore
+	writableDuring bool
+}
+
+func (r *lockCheckingRecorder) Write(b []byte) (int, error) {
+	if r.store.TryLock() {
+		r.writableDuring = true
+		r.store.Unlock()
+	}
+	return r.ResponseRecorder.Write(b)
+}
+
+func TestAllocationsEndpoint(t *testing.T) {
+	m := newTestPlugin(config.CommandLineFlags{}, 3, &Device{Device: newPluginDevice("GPU-0")}, &Device{Device: newPluginDevice("GPU-1")})
+	server := NewDebugServer()
+	server.SetPlugins([]*NvidiaDevicePlugin{m})
+
+	_, err := m.Allocate(context.Background(), &pluginapi.AllocateRequest{
+		ContainerRequests: []*pluginapi.ContainerAllocateRequest{
+			{DevicesIDs: []string{"GPU-0-replica-1", "GPU-1-replica-2"}},
+			{DevicesIDs: []string{"GPU-0-replica-2"}},
+		},
+	})
+	require.NoError(t, err)
+
+	get := func(id string) *lockCheckingRecorder {
+		rec := &lockCheckingRecorder{ResponseRecorder: httptest.NewRecorder(), store: m.allocations}
+		server.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/allocations/"+id, nil))
+		return rec
+	}
+
+	rec := get("GPU-1-replica-2")
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.True(t, rec.writableDuring, "the allocation store must not stay locked while the response is written")
+
+	var first AllocationState
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &first))
+	require.Equal(t, "nvidia.com/gpu", first.ResourceName)
+	require.Equal(t, "GPU-1-replica-2", first.DeviceID)
+	require.Equal(t, []string{"GPU-0-replica-1", "GPU-1-replica-2"}, first.ReplicaIDs)
+	require.False(t, first.Time.IsZero())
+
+	var second AllocationState
+	rec = get("GPU-0-replica-2")
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &second))
+	require.Equal(t, []string{"GPU-0-replica-2"}, second.ReplicaIDs)
+	require.NotEqual(t, first.AllocationID, second.AllocationID)
+
+	require.Equal(t, http.StatusNotFound, get("GPU-0-replica-0").Code)
+	require.Equal(t, http.StatusNotFound, get("GPU-unknown").Code)
+	require.Equal(t, http.StatusBadRequest, get("").Code)
+}
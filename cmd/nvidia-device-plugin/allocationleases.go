@@ -0,0 +1,308 @@
+/*
+ * Copyright (c) 2022, NVIDIA CORPORATION.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+// Claims not renewed within allocationClaimDuration are left by an instance that did not stop cleanly, e.g. a
+// killed or evicted pod: they are ignored and removed by the other instances.
+const (
+	allocationClaimDuration      = 2 * time.Minute
+	allocationClaimRenewInterval = 30 * time.Second
+)
+
+// allocationClaims are the replicas of a resource allocated by a plugin instance, as recorded in the
+// ConfigMap named by --lease-configmap
+type allocationClaims struct {
+	ResourceName string    `json:"resourceName"`
+	ReplicaIDs   []string  `json:"replicaIDs"`
+	RenewTime    time.Time `json:"renewTime"`
+}
+
+// expired returns whether the instance holding the claims stopped renewing them at 'now'
+func (c *allocationClaims) expired(now time.Time) bool {
+	return now.Sub(c.RenewTime) > allocationClaimDuration
+}
+
+// ReplicaClaimedError is returned when a replica is claimed by another plugin instance
+type ReplicaClaimedError struct {
+	ReplicaID string
+	Owner     string // ConfigMap key of the claims of the other instance
+}
+
+func (e *ReplicaClaimedError) Error() string {
+	return fmt.Sprintf("replica %s is already claimed by %s", e.ReplicaID, e.Owner)
+}
+
+// AllocationLeases records the replicas allocated by a plugin instance in a ConfigMap shared with the other
+// instances of the plugin, e.g. the old and new pods of a rolling update, so that they cannot hand out the same
+// replica. The ConfigMap holds one key per instance and resource, updated with optimistic concurrency. The claims
+// are stamped with the time they were last renewed at, so that those of instances that are gone expire.
+type AllocationLeases struct {
+	sync.Mutex
+	client       *KubeClient
+	namespace    string
+	name         string
+	key          string
+	resourceName string
+	claimed      []string // replicas claimed by this instance, renewed until released
+	now          func() time.Time
+}
+
+// NewAllocationLeases returns the AllocationLeases of the instance 'identity' for 'resourceName' in the ConfigMap 'namespace/name'
+func NewAllocationLeases(client *KubeClient, namespace string, name string, identity string, resourceName string) *AllocationLeases {
+	return &AllocationLeases{
+		client:    client,
+		namespace: namespace,
+		name:      name,
+		// Keys may only hold alphanumerics, '-', '_' and '.', e.g. "plugin-abcde.nvidia.com_gpu" for nvidia.com/gpu
+		key:          identity + "." + strings.ReplaceAll(resourceName, "/", "_"),
+		resourceName: resourceName,
+		now:          time.Now,
+	}
+}
+
+// NewInClusterAllocationLeases returns the AllocationLeases of the plugin pod named by the environment
+// for 'resourceName' in the ConfigMap 'name' of its namespace
+func NewInClusterAllocationLeases(name string, resourceName string) (*AllocationLeases, error) {
+	namespace := os.Getenv(envPodNamespace)
+	if namespace == "" {
+		return nil, fmt.Errorf("%s must be set", envPodNamespace)
+	}
+
+	identity := os.Getenv(envPodName)
+	if identity == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return nil, fmt.Errorf("unable to determine identity: %v", err)
+		}
+		identity = hostname
+	}
+
+	client, err := NewInClusterKubeClient()
+	if err != nil {
+		return nil, err
+	}
+	return NewAllocationLeases(client, namespace, name, identity, resourceName), nil
+}
+
+// Claim records 'replicaIDs' as the replicas allocated by this instance, replacing its previous claims.
+// It fails with a ReplicaClaimedError, leaving the claims untouched, if another instance claims any of them.
+func (l *AllocationLeases) Claim(ctx context.Context, replicaIDs []string) error {
+	l.Lock()
+	defer l.Unlock()
+
+	replicaIDs = append([]string(nil), replicaIDs...)
+	sort.Strings(replicaIDs)
+	if err := l.write(ctx, replicaIDs); err != nil {
+		return err
+	}
+	l.claimed = replicaIDs
+	return nil
+}
+
+// Renew stamps the claims of this instance with the current time so that they do not expire.
+// It does nothing until replicas are claimed, or once they are released.
+func (l *AllocationLeases) Renew(ctx context.Context) error {
+	l.Lock()
+	defer l.Unlock()
+
+	if l.claimed == nil {
+		return nil
+	}
+	return l.write(ctx, l.claimed)
+}
+
+// write records 'replicaIDs' under the key of this instance, removing the expired claims of other instances
+func (l *AllocationLeases) write(ctx context.Context, replicaIDs []string) error {
+	now := l.now()
+	claims := allocationClaims{ResourceName: l.resourceName, ReplicaIDs: replicaIDs, RenewTime: now}
+	data, err := json.Marshal(&claims)
+	if err != nil {
+		return fmt.Errorf("unable to encode claims: %v", err)
+	}
+
+	return retryOnConflict(ctx, func() error {
+		cm, err := l.client.GetConfigMap(ctx, l.namespace, l.name)
+		if isKubeAPIStatus(err, http.StatusNotFound) {
+			cm = NewConfigMap(l.namespace, l.name)
+			cm.Data[l.key] = string(data)
+			// Another instance creating the ConfigMap first is a conflict as well, so the claim is retried against it
+			_, err = l.client.CreateConfigMap(ctx, cm)
+			return err
+		}
+		if err != nil {
+			return fmt.Errorf("unable to get ConfigMap: %v", err)
+		}
+
+		l.removeExpiredClaims(cm, now)
+		if err := l.checkClaimedElsewhere(cm, claims.ReplicaIDs); err != nil {
+			return err
+		}
+		if cm.Data == nil {
+			cm.Data = make(map[string]string)
+		}
+		cm.Data[l.key] = string(data)
+		_, err = l.client.UpdateConfigMap(ctx, cm)
+		return err
+	})
+}
+
+// removeExpiredClaims removes from 'cm' the claims of other instances that were not renewed in time at 'now'
+func (l *AllocationLeases) removeExpiredClaims(cm *ConfigMap, now time.Time) {
+	for key, data := range cm.Data {
+		var claims allocationClaims
+		if key == l.key || json.Unmarshal([]byte(data), &claims) != nil || !claims.expired(now) {
+			continue
+		}
+		slog.Info("Removing expired allocation claims", logKeyEventType, "allocation_claims_expired", "owner", key, "renew_time", claims.RenewTime)
+		delete(cm.Data, key)
+	}
+}
+
+// checkClaimedElsewhere returns a ReplicaClaimedError if any of 'replicaIDs' is claimed by another instance in 'cm'
+func (l *AllocationLeases) checkClaimedElsewhere(cm *ConfigMap, replicaIDs []string) error {
+	var keys []string
+	for key := range cm.Data {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		if key == l.key {
+			continue
+		}
+		var claims allocationClaims
+		if err := json.Unmarshal([]byte(cm.Data[key]), &claims); err != nil || claims.ResourceName != l.resourceName {
+			continue
+		}
+		for _, id := range replicaIDs {
+			if find(claims.ReplicaIDs, id) != len(claims.ReplicaIDs) {
+				return &ReplicaClaimedError{ReplicaID: id, Owner: key}
+			}
+		}
+	}
+	return nil
+}
+
+// Release removes the claims of this instance
+func (l *AllocationLeases) Release(ctx context.Context) error {
+	l.Lock()
+	defer l.Unlock()
+
+	l.claimed = nil
+	return retryOnConflict(ctx, func() error {
+		cm, err := l.client.GetConfigMap(ctx, l.namespace, l.name)
+		if isKubeAPIStatus(err, http.StatusNotFound) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("unable to get ConfigMap: %v", err)
+		}
+		if _, exists := cm.Data[l.key]; !exists {
+			return nil
+		}
+		delete(cm.Data, l.key)
+		_, err = l.client.UpdateConfigMap(ctx, cm)
+		return err
+	})
+}
+
+// setupAllocationLeases records the allocations of the plugin in the ConfigMap named by --lease-configmap
+func (m *NvidiaDevicePlugin) setupAllocationLeases() error {
+	name := m.config.Flags.LeaseConfigMap
+	if name == "" || m.leases != nil {
+		return nil
+	}
+	leases, err := NewInClusterAllocationLeases(name, m.resourceName)
+	if err != nil {
+		return fmt.Errorf("unable to record allocations in ConfigMap %s: %v", name, err)
+	}
+	m.leases = leases
+	return nil
+}
+
+// renewAllocationClaims renews the claims of the plugin every 'interval' until 'stop' is closed
+func (m *NvidiaDevicePlugin) renewAllocationClaims(stop <-chan interface{}, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), interval)
+		if err := m.leases.Renew(ctx); err != nil {
+			m.logger.Warn("Failed to renew allocation claims", logKeyEventType, "allocation_renew_failed", "error", err)
+		}
+		cancel()
+	}
+}
+
+// claimAllocations claims the replicas held by the plugin once 'reqs' is allocated, failing if another
+// instance of the plugin claims any of them
+func (m *NvidiaDevicePlugin) claimAllocations(ctx context.Context, reqs *pluginapi.AllocateRequest) error {
+	var requested [][]string
+	for _, req := range reqs.ContainerRequests {
+		requested = append(requested, req.DevicesIDs)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(m.config.Flags.AllocationTimeout))
+	defer cancel()
+
+	err := m.leases.Claim(ctx, m.allocations.HeldAfter(requested))
+	var claimed *ReplicaClaimedError
+	if errors.As(err, &claimed) {
+		m.logger.Warn("Refusing allocation claimed by another instance", logKeyEventType, "allocation_claimed", "device_id", claimed.ReplicaID, "owner", claimed.Owner)
+		return status.Errorf(codes.AlreadyExists, "invalid allocation request for '%s': %v", m.resourceName, err)
+	}
+	if err != nil {
+		return status.Errorf(codes.Unavailable, "unable to claim allocation request for '%s': %v", m.resourceName, err)
+	}
+	return nil
+}
+
+// releaseAllocations removes the claims of the plugin from the ConfigMap named by --lease-configmap
+func (m *NvidiaDevicePlugin) releaseAllocations() {
+	if m.leases == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if err := m.leases.Release(ctx); err != nil {
+		m.logger.Error("Failed to release allocation claims", logKeyEventType, "allocation_release_failed", "error", err)
+	}
+}
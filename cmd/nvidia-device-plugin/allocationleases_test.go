@@ -0,0 +1,180 @@
+/*
+ * Copyright (c) 2022, NVIDIA CORPORATION.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	config "github.com/NVIDIA/k8s-device-plugin/api/config/v1"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+const testLeaseConfigMapPath = "/api/v1/namespaces/kube-system/configmaps/gpu-allocations"
+
+// claimsOf returns the replicas claimed under 'key' in the ConfigMap of the fake API server
+func claimsOf(t *testing.T, api *fakeKubeAPI, key string) []string {
+	api.Lock()
+	defer api.Unlock()
+	data, exists := api.configMaps[testLeaseConfigMapPath].Data[key]
+	if !exists {
+		return nil
+	}
+	var claims allocationClaims
+	require.NoError(t, json.Unmarshal([]byte(data), &claims))
+	return claims.ReplicaIDs
+}
+
+func TestAllocationLeases(t *testing.T) {
+	api := newFakeKubeAPI()
+	server := httptest.NewServer(api)
+	defer server.Close()
+
+	client := NewKubeClient(server.URL, "", server.Client())
+	a := NewAllocationLeases(client, "kube-system", "gpu-allocations", "plugin-a", "nvidia.com/gpu")
+	b := NewAllocationLeases(client, "kube-system", "gpu-allocations", "plugin-b", "nvidia.com/gpu")
+	other := NewAllocationLeases(client, "kube-system", "gpu-allocations", "plugin-b", "nvidia.com/gpu-large")
+	ctx := context.Background()
+
+	require.NoError(t, a.Claim(ctx, []string{"GPU-a-replica-1", "GPU-a-replica-0"}))
+	require.Equal(t, []string{"GPU-a-replica-0", "GPU-a-replica-1"}, claimsOf(t, api, "plugin-a.nvidia.com_gpu"))
+
+	// Replicas claimed by another instance cannot be claimed, and the claims are left untouched
+	err := b.Claim(ctx, []string{"GPU-a-replica-2", "GPU-a-replica-1"})
+	var claimed *ReplicaClaimedError
+	require.True(t, errors.As(err, &claimed), "%v", err)
+	require.Equal(t, "GPU-a-replica-1", claimed.ReplicaID)
+	require.Equal(t, "plugin-a.nvidia.com_gpu", claimed.Owner)
+	require.Empty(t, claimsOf(t, api, "plugin-b.nvidia.com_gpu"))
+
+	require.NoError(t, b.Claim(ctx, []string{"GPU-a-replica-2"}))
+	require.NoError(t, other.Claim(ctx, []string{"GPU-a-replica-1"}))
+
+	// Claims replace the previous ones, and are removed once released
+	require.NoError(t, a.Claim(ctx, []string{"GPU-a-replica-0"}))
+	require.NoError(t, b.Claim(ctx, []string{"GPU-a-replica-2", "GPU-a-replica-1"}))
+	require.NoError(t, b.Release(ctx))
+	require.Nil(t, claimsOf(t, api, "plugin-b.nvidia.com_gpu"))
+	require.Equal(t, []string{"GPU-a-replica-0"}, claimsOf(t, api, "plugin-a.nvidia.com_gpu"))
+	require.NoError(t, b.Release(ctx))
+}
+
+func TestAllocationLeasesExpiry(t *testing.T) {
+	api := newFakeKubeAPI()
+	server := httptest.NewServer(api)
+	defer server.Close()
+
+	client := NewKubeClient(server.URL, "", server.Client())
+	clock := &fakeClock{now: time.Now()}
+	newLeases := func(identity string) *AllocationLeases {
+		l := NewAllocationLeases(client, "kube-system", "gpu-allocations", identity, "nvidia.com/gpu")
+		l.now = clock.Now
+		return l
+	}
+	a, b, c := newLeases("plugin-a"), newLeases("plugin-b"), newLeases("plugin-c")
+	ctx := context.Background()
+
+	// Renewed claims do not expire
+	require.NoError(t, a.Claim(ctx, []string{"GPU-a-replica-0"}))
+	clock.advance(allocationClaimDuration * 3 / 4)
+	require.NoError(t, a.Renew(ctx))
+	clock.advance(allocationClaimDuration * 3 / 4)
+	var claimed *ReplicaClaimedError
+	require.True(t, errors.As(b.Claim(ctx, []string{"GPU-a-replica-0"}), &claimed))
+
+	// The claims of an instance that stopped renewing them, e.g. a killed pod, are ignored and removed
+	clock.advance(allocationClaimDuration + time.Second)
+	require.NoError(t, b.Claim(ctx, []string{"GPU-a-replica-0"}))
+	require.Equal(t, []string{"GPU-a-replica-0"}, claimsOf(t, api, "plugin-b.nvidia.com_gpu"))
+	require.Nil(t, claimsOf(t, api, "plugin-a.nvidia.com_gpu"))
+
+	// Released claims are not renewed
+	require.NoError(t, b.Release(ctx))
+	require.NoError(t, b.Renew(ctx))
+	require.Nil(t, claimsOf(t, api, "plugin-b.nvidia.com_gpu"))
+	require.NoError(t, c.Renew(ctx))
+	require.Nil(t, claimsOf(t, api, "plugin-c.nvidia.com_gpu"))
+}
+
+func TestAllocationLeasesRetryOnConflict(t *testing.T) {
+	api := newFakeKubeAPI()
+	// The ConfigMap is modified by another instance between the first read and write
+	concurrentWrites := 1
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPut && concurrentWrites > 0 {
+			concurrentWrites--
+			api.Lock()
+			cm := api.configMaps[r.URL.Path]
+			cm.Data["plugin-b.nvidia.com_gpu"] = `{"resourceName":"nvidia.com/gpu","replicaIDs":["GPU-a-replica-1"],"renewTime":"` + time.Now().Format(time.RFC3339) + `"}`
+			cm.Metadata.ResourceVersion = nextResourceVersion(cm.Metadata.ResourceVersion)
+			api.Unlock()
+		}
+		api.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+
+	client := NewKubeClient(server.URL, "", server.Client())
+	a := NewAllocationLeases(client, "kube-system", "gpu-allocations", "plugin-a", "nvidia.com/gpu")
+	ctx := context.Background()
+
+	require.NoError(t, a.Claim(ctx, []string{"GPU-a-replica-0"}))
+	// Once retried against the concurrent write, the claim conflicts with it
+	err := a.Claim(ctx, []string{"GPU-a-replica-0", "GPU-a-replica-1"})
+	var claimed *ReplicaClaimedError
+	require.True(t, errors.As(err, &claimed), "%v", err)
+	require.Equal(t, []string{"GPU-a-replica-0"}, claimsOf(t, api, "plugin-a.nvidia.com_gpu"))
+	require.Equal(t, []string{"GPU-a-replica-1"}, claimsOf(t, api, "plugin-b.nvidia.com_gpu"))
+}
+
+func TestAllocateClaimsReplicas(t *testing.T) {
+	api := newFakeKubeAPI()
+	server := httptest.NewServer(api)
+	defer server.Close()
+
+	client := NewKubeClient(server.URL, "", server.Client())
+	m := newTestPlugin(config.CommandLineFlags{}, 3, &Device{Device: newPluginDevice("GPU-a")})
+	m.leases = NewAllocationLeases(client, "kube-system", "gpu-allocations", "plugin-a", m.resourceName)
+	other := NewAllocationLeases(client, "kube-system", "gpu-allocations", "plugin-b", m.resourceName)
+	require.NoError(t, other.Claim(context.Background(), []string{"GPU-a-replica-1"}))
+
+	allocate := func(ids ...string) error {
+		_, err := m.Allocate(context.Background(), &pluginapi.AllocateRequest{
+			ContainerRequests: []*pluginapi.ContainerAllocateRequest{{DevicesIDs: ids}},
+		})
+		return err
+	}
+
+	require.NoError(t, allocate("GPU-a-replica-0", "GPU-a-replica-2"))
+	require.Equal(t, []string{"GPU-a-replica-0", "GPU-a-replica-2"}, claimsOf(t, api, "plugin-a.nvidia.com_gpu"))
+
+	require.Error(t, allocate("GPU-a-replica-1"))
+	require.Equal(t, 1, m.allocations.Count())
+
+	// Allocating a replica again releases the previous allocation holding it
+	require.NoError(t, allocate("GPU-a-replica-0"))
+	require.Equal(t, []string{"GPU-a-replica-0"}, claimsOf(t, api, "plugin-a.nvidia.com_gpu"))
+
+	m.releaseAllocations()
+	require.Nil(t, claimsOf(t, api, "plugin-a.nvidia.com_gpu"))
+	require.Equal(t, []string{"GPU-a-replica-1"}, claimsOf(t, api, "plugin-b.nvidia.com_gpu"))
+}
@@ -0,0 +1,159 @@
+/*
+ * Copyright (c) 2022, NVIDIA CORPORATION.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+// auditLog records the allocations to --audit-log-file, nil when it is not set
+var auditLog *AuditLog
+
+// AuditRecord is the line appended to the audit log for each container allocation.
+// The device plugin API does not tell which pod an allocation is for.
+type AuditRecord struct {
+	Timestamp     time.Time `json:"timestamp"`
+	ResourceName  string    `json:"resourceName"`
+	ReplicaIDs    []string  `json:"replicaIDs"`
+	PhysicalUUIDs []string  `json:"physicalUUIDs"`
+}
+
+// AuditLog appends JSON records to a file, rotating it once it grows over a maximum size.
+// It is safe for concurrent use. Failures to write are logged and do not fail the allocations.
+type AuditLog struct {
+	sync.Mutex
+	path       string
+	maxSize    int64
+	maxBackups int
+	file       *os.File
+	size       int64
+	closed     bool
+}
+
+// NewAuditLog opens the audit log at 'path', appending to it if it exists. The file is rotated once
+// it grows over 'maxSize' bytes, keeping 'maxBackups' rotated files.
+func NewAuditLog(path string, maxSize int64, maxBackups int) (*AuditLog, error) {
+	a := &AuditLog{
+		path:       path,
+		maxSize:    maxSize,
+		maxBackups: maxBackups,
+	}
+	if err := a.open(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+func (a *AuditLog) open() error {
+	file, err := os.OpenFile(a.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return fmt.Errorf("unable to open audit log: %v", err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("unable to open audit log: %v", err)
+	}
+	a.file = file
+	a.size = info.Size()
+	return nil
+}
+
+// Record appends a record of the allocation of 'replicaIDs', backed by the physical devices 'uuids'
+func (a *AuditLog) Record(resourceName string, replicaIDs []string, uuids []string) {
+	if a == nil {
+		return
+	}
+	line, err := json.Marshal(&AuditRecord{
+		Timestamp:     time.Now().UTC(),
+		ResourceName:  resourceName,
+		ReplicaIDs:    replicaIDs,
+		PhysicalUUIDs: uuids,
+	})
+	if err != nil {
+		slog.Warn("Failed to encode audit record", logKeyEventType, "audit_failed", "error", err)
+		return
+	}
+	line = append(line, '\n')
+
+	a.Lock()
+	defer a.Unlock()
+	if a.closed {
+		return
+	}
+	if a.file != nil && a.size > 0 && a.size+int64(len(line)) > a.maxSize {
+		if err := a.rotate(); err != nil {
+			slog.Warn("Failed to rotate audit log", logKeyEventType, "audit_failed", "error", err)
+		}
+	}
+	if a.file == nil {
+		// A previous rotation failed to reopen the file
+		if err := a.open(); err != nil {
+			slog.Warn("Failed to record allocation", logKeyEventType, "audit_failed", "device_ids", replicaIDs, "error", err)
+			return
+		}
+	}
+	n, err := a.file.Write(line)
+	a.size += int64(n)
+	if err != nil {
+		slog.Warn("Failed to record allocation", logKeyEventType, "audit_failed", "device_ids", replicaIDs, "error", err)
+	}
+}
+
+// rotate renames the audit log to <path>.1, shifting the previous backups and dropping the oldest one
+func (a *AuditLog) rotate() error {
+	a.file.Close()
+	a.file = nil
+
+	backup := func(i int) string { return fmt.Sprintf("%s.%d", a.path, i) }
+	if a.maxBackups == 0 {
+		if err := os.Remove(a.path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	} else {
+		for i := a.maxBackups - 1; i > 0; i-- {
+			if err := os.Rename(backup(i), backup(i+1)); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+		if err := os.Rename(a.path, backup(1)); err != nil {
+			return err
+		}
+	}
+	return a.open()
+}
+
+// Close closes the audit log
+func (a *AuditLog) Close() error {
+	if a == nil {
+		return nil
+	}
+	a.Lock()
+	defer a.Unlock()
+	a.closed = true
+	if a.file == nil {
+		return nil
+	}
+	err := a.file.Close()
+	a.file = nil
+	return err
+}
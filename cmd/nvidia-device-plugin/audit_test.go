@@ -0,0 +1,148 @@
+/*
+ * Copyright (c) 2022, NVIDIA CORPORATION.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	config "github.com/NVIDIA/k8s-device-plugin/api/config/v1"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+// readAuditRecords returns the records of the audit log file at 'path'
+func readAuditRecords(t *testing.T, path string) []AuditRecord {
+	file, err := os.Open(path)
+	require.NoError(t, err)
+	defer file.Close()
+
+	var records []AuditRecord
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var record AuditRecord
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &record))
+		records = append(records, record)
+	}
+	require.NoError(t, scanner.Err())
+	return records
+}
+
+func TestAuditLogAllocate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	a, err := NewAuditLog(path, 1024*1024, 1)
+	require.NoError(t, err)
+	defer a.Close()
+	auditLog = a
+	defer func() { auditLog = nil }()
+
+	m := newTestPlugin(config.CommandLineFlags{}, 2,
+		&Device{Device: newPluginDevice("GPU-0")},
+		&Device{Device: newPluginDevice("GPU-1")},
+	)
+	_, err = m.Allocate(context.Background(), &pluginapi.AllocateRequest{
+		ContainerRequests: []*pluginapi.ContainerAllocateRequest{
+			{DevicesIDs: []string{"GPU-0-replica-1", "GPU-1-replica-0"}},
+			{DevicesIDs: []string{"GPU-1-replica-1"}},
+		},
+	})
+	require.NoError(t, err)
+
+	records := readAuditRecords(t, path)
+	require.Len(t, records, 2)
+	require.Equal(t, "nvidia.com/gpu", records[0].ResourceName)
+	require.Equal(t, []string{"GPU-0-replica-1", "GPU-1-replica-0"}, records[0].ReplicaIDs)
+	require.Equal(t, []string{"GPU-0", "GPU-1"}, records[0].PhysicalUUIDs)
+	require.False(t, records[0].Timestamp.IsZero())
+	require.Equal(t, []string{"GPU-1-replica-1"}, records[1].ReplicaIDs)
+	require.Equal(t, []string{"GPU-1"}, records[1].PhysicalUUIDs)
+}
+
+func TestAuditLogRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	a, err := NewAuditLog(path, 300, 2)
+	require.NoError(t, err)
+	defer a.Close()
+
+	for i := 0; i < 10; i++ {
+		a.Record("nvidia.com/gpu", []string{fmt.Sprintf("GPU-%d-replica-0", i)}, []string{fmt.Sprintf("GPU-%d", i)})
+	}
+
+	// Records take ~130 bytes, so each file holds two of them and only the last six records are kept
+	var kept []string
+	for _, p := range []string{path + ".2", path + ".1", path} {
+		info, err := os.Stat(p)
+		require.NoError(t, err)
+		require.True(t, info.Size() <= 300)
+		for _, record := range readAuditRecords(t, p) {
+			kept = append(kept, record.PhysicalUUIDs[0])
+		}
+	}
+	require.Equal(t, []string{"GPU-4", "GPU-5", "GPU-6", "GPU-7", "GPU-8", "GPU-9"}, kept)
+	_, err = os.Stat(path + ".3")
+	require.True(t, os.IsNotExist(err))
+}
+
+func TestAuditLogConcurrentRecords(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	a, err := NewAuditLog(path, 1024*1024, 0)
+	require.NoError(t, err)
+	defer a.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			a.Record("nvidia.com/gpu", []string{fmt.Sprintf("GPU-%d-replica-0", i)}, []string{fmt.Sprintf("GPU-%d", i)})
+		}(i)
+	}
+	wg.Wait()
+
+	require.Len(t, readAuditRecords(t, path), 20)
+}
+
+func TestAuditLogWriteFailure(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "audit.log")
+	a, err := NewAuditLog(path, 100, 1)
+	require.NoError(t, err)
+	defer a.Close()
+	auditLog = a
+	defer func() { auditLog = nil }()
+	logs := captureLog(t)
+
+	// The rotation fails once the directory is gone, without failing the allocations
+	a.Record("nvidia.com/gpu", []string{"GPU-0-replica-0"}, []string{"GPU-0"})
+	require.NoError(t, os.RemoveAll(dir))
+
+	m := newTestPlugin(config.CommandLineFlags{}, 2, &Device{Device: newPluginDevice("GPU-0")})
+	_, err = m.Allocate(context.Background(), &pluginapi.AllocateRequest{
+		ContainerRequests: []*pluginapi.ContainerAllocateRequest{
+			{DevicesIDs: []string{"GPU-0-replica-1"}},
+		},
+	})
+	require.NoError(t, err)
+	require.Contains(t, logs.String(), "Failed to rotate audit log")
+	require.Contains(t, logs.String(), "Failed to record allocation event_type=audit_failed device_ids=[GPU-0-replica-1]")
+}
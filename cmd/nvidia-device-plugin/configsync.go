@@ -0,0 +1,99 @@
+/*
+ * Copyright (c) 2022, NVIDIA CORPORATION.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	config "github.com/NVIDIA/k8s-device-plugin/api/config/v1"
+	"golang.org/x/net/context"
+)
+
+// PluginConfig is the configuration of a plugin as written to the ConfigMap named by --sync-config-to-configmap.
+// It only holds what the plugin was configured with, none of the state it builds at runtime.
+type PluginConfig struct {
+	ResourceName     string        `json:"resourceName"`
+	Socket           string        `json:"socket"`
+	DeviceListEnvvar string        `json:"deviceListEnvvar"`
+	Replicas         uint          `json:"replicas"`
+	AutoReplicas     bool          `json:"autoReplicas"`
+	Config           config.Config `json:"config"`
+}
+
+// MarshalConfig returns the configuration of the plugin as JSON
+func (m *NvidiaDevicePlugin) MarshalConfig() ([]byte, error) {
+	return json.MarshalIndent(&PluginConfig{
+		ResourceName:     m.resourceName,
+		Socket:           m.socket,
+		DeviceListEnvvar: m.deviceListEnvvar,
+		Replicas:         m.replicas,
+		AutoReplicas:     m.autoReplicas,
+		Config:           m.config,
+	}, "", "  ")
+}
+
+// UnmarshalConfig decodes the configuration of a plugin returned by MarshalConfig
+func UnmarshalConfig(data []byte) (*PluginConfig, error) {
+	var c PluginConfig
+	if err := json.Unmarshal(data, &c); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+// configMapKey returns the ConfigMap key under which the configuration of the plugin is written.
+// Keys may only hold alphanumerics, '-', '_' and '.', e.g. "nvidia.com_gpu.json" for nvidia.com/gpu.
+func (m *NvidiaDevicePlugin) configMapKey() string {
+	return strings.ReplaceAll(m.resourceName, "/", "_") + ".json"
+}
+
+// syncConfigToConfigMap writes the configuration of the plugin to the ConfigMap 'namespace/name'
+func (m *NvidiaDevicePlugin) syncConfigToConfigMap(ctx context.Context, client *KubeClient, namespace string, name string) error {
+	data, err := m.MarshalConfig()
+	if err != nil {
+		return fmt.Errorf("unable to encode configuration: %v", err)
+	}
+	return client.UpsertConfigMapData(ctx, namespace, name, map[string]string{m.configMapKey(): string(data)})
+}
+
+// syncConfig writes the configuration of the plugin to the ConfigMap 'name' in the namespace of the plugin pod
+func (m *NvidiaDevicePlugin) syncConfig(name string) {
+	namespace := os.Getenv(envPodNamespace)
+	if namespace == "" {
+		m.logger.Warn("Not syncing the configuration to ConfigMap, "+envPodNamespace+" must be set", logKeyEventType, "config_sync_skipped", "configmap", name)
+		return
+	}
+
+	client, err := NewInClusterKubeClient()
+	if err != nil {
+		m.logger.Warn("Not syncing the configuration to ConfigMap", logKeyEventType, "config_sync_skipped", "configmap", name, "error", err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	if err := m.syncConfigToConfigMap(ctx, client, namespace, name); err != nil {
+		m.logger.Error("Failed to sync the configuration to ConfigMap", logKeyEventType, "config_sync_failed", "configmap", namespace+"/"+name, "error", err)
+		return
+	}
+	m.logger.Info("Synced the configuration to ConfigMap", logKeyEventType, "config_synced", "configmap", namespace+"/"+name)
+}
@@ -0,0 +1,104 @@
+/*
+ * Copyright (c) 2022, NVIDIA CORPORATION.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	config "github.com/NVIDIA/k8s-device-plugin/api/config/v1"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+func TestMarshalConfig(t *testing.T) {
+	m := newTestPlugin(config.CommandLineFlags{
+		FailOnInitError:    true,
+		DeviceListStrategy: "envvar",
+		GRPCStopTimeout:    config.Duration(10 * time.Second),
+	}, 4, &Device{Device: newPluginDevice("GPU-0")})
+	m.config.Version = "v1"
+
+	data, err := m.MarshalConfig()
+	require.NoError(t, err)
+	require.True(t, json.Valid(data))
+
+	// Runtime state such as the devices is not part of the configuration
+	var fields map[string]json.RawMessage
+	require.NoError(t, json.Unmarshal(data, &fields))
+	require.ElementsMatch(t, []string{"resourceName", "socket", "deviceListEnvvar", "replicas", "autoReplicas", "config"}, keys(fields))
+
+	c, err := UnmarshalConfig(data)
+	require.NoError(t, err)
+	require.Equal(t, "nvidia.com/gpu", c.ResourceName)
+	require.Equal(t, uint(4), c.Replicas)
+	require.Equal(t, m.config, c.Config)
+
+	again, err := (&NvidiaDevicePlugin{
+		resourceName:     c.ResourceName,
+		socket:           c.Socket,
+		deviceListEnvvar: c.DeviceListEnvvar,
+		replicas:         c.Replicas,
+		autoReplicas:     c.AutoReplicas,
+		config:           c.Config,
+	}).MarshalConfig()
+	require.NoError(t, err)
+	require.JSONEq(t, string(data), string(again))
+
+	_, err = UnmarshalConfig([]byte("{"))
+	require.Error(t, err)
+}
+
+func keys(m map[string]json.RawMessage) []string {
+	var keys []string
+	for k := range m {
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+func TestSyncConfigToConfigMap(t *testing.T) {
+	api := newFakeKubeAPI()
+	server := httptest.NewServer(api)
+	defer server.Close()
+	client := NewKubeClient(server.URL, "", server.Client())
+
+	gpu := newTestPlugin(config.CommandLineFlags{}, 2, &Device{Device: newPluginDevice("GPU-0")})
+	shared := newTestPlugin(config.CommandLineFlags{}, 4, &Device{Device: newPluginDevice("GPU-0")})
+	shared.resourceName = "nvidia.com/gpu-shared"
+
+	require.NoError(t, gpu.syncConfigToConfigMap(context.Background(), client, "kube-system", "plugin-config"))
+	require.NoError(t, shared.syncConfigToConfigMap(context.Background(), client, "kube-system", "plugin-config"))
+
+	cm := api.configMaps["/api/v1/namespaces/kube-system/configmaps/plugin-config"]
+	require.NotNil(t, cm)
+	require.Len(t, cm.Data, 2)
+
+	c, err := UnmarshalConfig([]byte(cm.Data["nvidia.com_gpu-shared.json"]))
+	require.NoError(t, err)
+	require.Equal(t, uint(4), c.Replicas)
+
+	// Syncing again after a restart replaces the configuration of the plugin
+	gpu.replicas = 3
+	require.NoError(t, gpu.syncConfigToConfigMap(context.Background(), client, "kube-system", "plugin-config"))
+	c, err = UnmarshalConfig([]byte(cm.Data["nvidia.com_gpu.json"]))
+	require.NoError(t, err)
+	require.Equal(t, uint(3), c.Replicas)
+	require.Len(t, cm.Data, 2)
+}
@@ -0,0 +1,299 @@
+/*
+ * Copyright (c) 2022, NVIDIA CORPORATION.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	config "github.com/NVIDIA/k8s-device-plugin/api/config/v1"
+	"golang.org/x/net/context"
+)
+
+// configMapConfigKey is the key of the ConfigMap named by --watch-configmap holding the config file
+const configMapConfigKey = "config.yaml"
+
+// configMapWatchInterval is how often the ConfigMap named by --watch-configmap is checked for changes
+const configMapWatchInterval = 10 * time.Second
+
+// The kubelet does not tell when a container releases its devices, and a retired replica allocated on its own
+// is never evicted by another allocation, so retired replicas stop being advertised after retiredReplicaTimeout.
+// The kubelet keeps running the containers of devices that are no longer advertised.
+const (
+	retiredReplicaTimeout       = time.Hour
+	retiredReplicaPruneInterval = time.Minute
+)
+
+// parseNamespacedName splits a 'namespace/name' reference to a Kubernetes object
+func parseNamespacedName(ref string) (string, string, error) {
+	parts := strings.Split(ref, "/")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", fmt.Errorf("%q must be of the form namespace/name", ref)
+	}
+	return parts[0], parts[1], nil
+}
+
+// configMapWatcher polls a ConfigMap holding a config file under configMapConfigKey, sending the resources
+// of the config file on its Events channel whenever the ConfigMap changes. The plugin talks to the API server
+// through its own minimal client, so the resourceVersion of the ConfigMap is polled rather than watched
+// through an informer.
+type configMapWatcher struct {
+	Events chan config.Resources
+	stop   chan struct{}
+}
+
+func newConfigMapWatcher(client *KubeClient, namespace string, name string, interval time.Duration) *configMapWatcher {
+	w := &configMapWatcher{
+		Events: make(chan config.Resources),
+		stop:   make(chan struct{}),
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		var version string
+		var lastErr string
+		for {
+			ctx, cancel := context.WithTimeout(context.Background(), interval)
+			cm, err := client.GetConfigMap(ctx, namespace, name)
+			cancel()
+
+			if err != nil {
+				// The ConfigMap may well be missing for a while, only log once per error
+				if err.Error() != lastErr {
+					slog.Warn("Unable to get ConfigMap", logKeyEventType, "configmap_watch_failed", "configmap", namespace+"/"+name, "error", err)
+					lastErr = err.Error()
+				}
+			} else if cm.Metadata.ResourceVersion != version {
+				version, lastErr = cm.Metadata.ResourceVersion, ""
+				resources, err := configMapResources(cm)
+				if err != nil {
+					slog.Warn("Ignoring invalid ConfigMap", logKeyEventType, "configmap_invalid", "configmap", namespace+"/"+name, "version", version, "error", err)
+				} else {
+					select {
+					case w.Events <- resources:
+					case <-w.stop:
+						return
+					}
+				}
+			}
+
+			select {
+			case <-w.stop:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+
+	return w
+}
+
+// events returns the Events channel, or nil for a nil configMapWatcher so that receiving from it blocks forever
+func (w *configMapWatcher) events() <-chan config.Resources {
+	if w == nil {
+		return nil
+	}
+	return w.Events
+}
+
+// Close stops polling for the ConfigMap
+func (w *configMapWatcher) Close() {
+	if w == nil {
+		return
+	}
+	close(w.stop)
+}
+
+// configMapResources returns the resources of the config file held by 'cm'
+func configMapResources(cm *ConfigMap) (config.Resources, error) {
+	data, exists := cm.Data[configMapConfigKey]
+	if !exists {
+		return nil, fmt.Errorf("no %s key", configMapConfigKey)
+	}
+	cfg, err := config.ParseConfigFrom(strings.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("error parsing config file: %v", err)
+	}
+	if len(cfg.Resources) == 0 {
+		return nil, fmt.Errorf("no resources in config file")
+	}
+	return cfg.Resources, nil
+}
+
+// resizePlugins applies the replicas of 'rc' to the running 'plugins' without restarting them. It fails if the
+// plugins for 'rc' are not the running ones, or if their devices would be advertised under other IDs, in which
+// case the plugins must be restarted instead.
+func resizePlugins(cfg *config.Config, rc resourceConfiguration, plugins []*NvidiaDevicePlugin) error {
+	if cfg.Flags.EnableSentinelDevice {
+		return fmt.Errorf("sentinel replicas are only reserved when the plugins start")
+	}
+
+	migStrategy, err := NewMigStrategy(cfg, rc)
+	if err != nil {
+		return fmt.Errorf("error creating MIG strategy: %v", err)
+	}
+	current, err := migStrategy.GetPlugins()
+	if err != nil {
+		return fmt.Errorf("error creating plugins: %v", err)
+	}
+	resized := make(map[string]*NvidiaDevicePlugin)
+	for _, p := range current {
+		resized[p.Name()] = p
+	}
+	if len(resized) != len(plugins) {
+		return fmt.Errorf("the resources to advertise changed")
+	}
+	for _, p := range plugins {
+		r, exists := resized[p.Name()]
+		if !exists {
+			return fmt.Errorf("'%s' is no longer advertised", p.Name())
+		}
+		if r.replicasDisabled() != p.replicasDisabled() {
+			return fmt.Errorf("sharing of '%s' was turned on or off", p.Name())
+		}
+		// The memory reserved on each device is only determined when the plugin starts
+		if r.autoReplicas != p.autoReplicas {
+			return fmt.Errorf("auto replicas of '%s' were turned on or off", p.Name())
+		}
+	}
+
+	for _, p := range plugins {
+		r := resized[p.Name()]
+		if r.replicas == p.replicas {
+			continue
+		}
+		p.logger.Info("Resizing replicas", logKeyEventType, "replicas_resized", "from", p.replicas, "to", r.replicas)
+		p.resizeReplicas(r.replicas)
+	}
+	return nil
+}
+
+// resizeReplicas sets the number of replicas of the devices of the plugin. A running plugin updates the
+// replicas it advertises without restarting.
+func (m *NvidiaDevicePlugin) resizeReplicas(replicas uint) {
+	m.mu.Lock()
+	m.replicas = replicas
+	resized := m.resized
+	m.mu.Unlock()
+
+	if resized == nil {
+		// Not running, the replicas are advertised once started
+		return
+	}
+	select {
+	case resized <- struct{}{}:
+	default:
+	}
+}
+
+// updateReplicas advertises the replicas of each device for the current number of replicas. The replicas
+// which remain keep their health, the added ones get the health of their device, and the removed ones which
+// are still allocated stay advertised unhealthy until released, so that the kubelet does not lose track of them.
+func (m *NvidiaDevicePlugin) updateReplicas() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	current := make(map[string]*Device)
+	for _, r := range m.deviceReplicas {
+		current[r.ID] = r
+	}
+
+	var updated []*Device
+	kept := make(map[string]bool)
+	for _, dev := range m.cachedDevices {
+		for _, r := range m.newReplicas(dev) {
+			kept[r.ID] = true
+			if existing, exists := current[r.ID]; exists {
+				delete(m.retiredReplicas, r.ID)
+				updated = append(updated, existing)
+				continue
+			}
+			m.logger.Info("Replica added", logKeyEventType, "replica_added", logKeyDeviceUUID, dev.ID, "device_id", r.ID)
+			updated = append(updated, r)
+		}
+	}
+	for _, r := range m.deviceReplicas {
+		if kept[r.ID] {
+			continue
+		}
+		if m.allocations.Allocated(r.ID) {
+			if _, retired := m.retiredReplicas[r.ID]; !retired {
+				m.logger.Info("Replica retired until released", logKeyEventType, "replica_retired", "device_id", r.ID)
+				m.retiredReplicas[r.ID] = time.Now()
+			}
+			updated = append(updated, r)
+			continue
+		}
+		delete(m.retiredReplicas, r.ID)
+		m.logger.Info("Replica removed", logKeyEventType, "replica_removed", "device_id", r.ID)
+	}
+	m.deviceReplicas = updated
+
+	for _, dev := range m.cachedDevices {
+		m.updateReplicaHealth(dev)
+	}
+	m.initReplicaMetrics()
+}
+
+// notifyEvictions notifies ListAndWatch that allocations were evicted, so that it stops advertising the
+// retired replicas they released
+func (m *NvidiaDevicePlugin) notifyEvictions() {
+	select {
+	case m.evictions <- struct{}{}:
+	default:
+	}
+}
+
+// pruneRetiredReplicas stops advertising the retired replicas which are no longer allocated, or which were
+// retired for longer than retiredReplicaTimeout at 'now', returning whether there were any
+func (m *NvidiaDevicePlugin) pruneRetiredReplicas(now time.Time) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if len(m.retiredReplicas) == 0 {
+		return false
+	}
+	pruned := false
+	var advertised []*Device
+	for _, r := range m.deviceReplicas {
+		retired, exists := m.retiredReplicas[r.ID]
+		if !exists {
+			advertised = append(advertised, r)
+			continue
+		}
+		switch {
+		case !m.allocations.Allocated(r.ID):
+			m.logger.Info("Retired replica released", logKeyEventType, "replica_removed", "device_id", r.ID)
+		case now.Sub(retired) > retiredReplicaTimeout:
+			m.logger.Info("Retired replica timed out", logKeyEventType, "replica_removed", "device_id", r.ID, "retired_at", retired)
+		default:
+			advertised = append(advertised, r)
+			continue
+		}
+		delete(m.retiredReplicas, r.ID)
+		pruned = true
+	}
+	if pruned {
+		m.deviceReplicas = advertised
+		m.initReplicaMetrics()
+	}
+	return pruned
+}
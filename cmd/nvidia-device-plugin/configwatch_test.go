@@ -0,0 +1,234 @@
+/*
+ * Copyright (c) 2022, NVIDIA CORPORATION.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	config "github.com/NVIDIA/k8s-device-plugin/api/config/v1"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+func TestParseNamespacedName(t *testing.T) {
+	namespace, name, err := parseNamespacedName("kube-system/plugin-config")
+	require.NoError(t, err)
+	require.Equal(t, "kube-system", namespace)
+	require.Equal(t, "plugin-config", name)
+
+	for _, ref := range []string{"", "plugin-config", "/plugin-config", "kube-system/", "a/b/c"} {
+		_, _, err := parseNamespacedName(ref)
+		require.Error(t, err, ref)
+	}
+}
+
+func TestConfigMapWatcher(t *testing.T) {
+	api := newFakeKubeAPI()
+	server := httptest.NewServer(api)
+	defer server.Close()
+	client := NewKubeClient(server.URL, "", server.Client())
+
+	setConfig := func(version string, data string) {
+		api.Lock()
+		defer api.Unlock()
+		cm := NewConfigMap("kube-system", "plugin-config")
+		cm.Metadata.ResourceVersion = version
+		cm.Data[configMapConfigKey] = data
+		api.configMaps[configMapPath("kube-system", "plugin-config")] = cm
+	}
+	next := func(w *configMapWatcher) config.Resources {
+		select {
+		case resources := <-w.events():
+			return resources
+		case <-time.After(200 * time.Millisecond):
+			return nil
+		}
+	}
+
+	w := newConfigMapWatcher(client, "kube-system", "plugin-config", 10*time.Millisecond)
+	defer w.Close()
+
+	// The ConfigMap does not exist yet
+	require.Nil(t, next(w))
+
+	setConfig("1", "version: v1\nresources:\n  gpu: 2\n")
+	require.Equal(t, config.Resources{"gpu": {Count: 2}}, next(w))
+	// Only a new version of the ConfigMap is sent
+	require.Nil(t, next(w))
+
+	setConfig("2", "version: v1\nresources:\n  gpu: auto\n")
+	require.Equal(t, config.Resources{"gpu": {Auto: true}}, next(w))
+
+	// Invalid config files and config files without resources are ignored
+	setConfig("3", "version: v2\nresources:\n  gpu: 4\n")
+	require.Nil(t, next(w))
+	setConfig("4", "version: v1\n")
+	require.Nil(t, next(w))
+
+	setConfig("5", "version: v1\nresources:\n  gpu: 4\n")
+	require.Equal(t, config.Resources{"gpu": {Count: 4}}, next(w))
+
+	var stopped *configMapWatcher
+	require.Nil(t, stopped.events())
+	stopped.Close()
+}
+
+func TestResizeReplicas(t *testing.T) {
+	m := newTestPlugin(config.CommandLineFlags{}, 2,
+		&Device{Device: newPluginDevice("GPU-a")},
+		&Device{Device: newPluginDevice("GPU-b")},
+	)
+	defer close(m.stop)
+
+	s := newFakeListAndWatchServer()
+	go m.ListAndWatch(&pluginapi.Empty{}, s)
+	require.Len(t, s.next(time.Second).Devices, 4)
+
+	health := func(resp *pluginapi.ListAndWatchResponse) map[string]string {
+		require.NotNil(t, resp)
+		health := make(map[string]string)
+		for _, d := range resp.Devices {
+			health[d.ID] = d.Health
+		}
+		return health
+	}
+
+	// Both replicas of GPU-a are allocated to a single container
+	_, err := m.Allocate(context.Background(), &pluginapi.AllocateRequest{
+		ContainerRequests: []*pluginapi.ContainerAllocateRequest{{DevicesIDs: []string{"GPU-a-replica-0", "GPU-a-replica-1"}}},
+	})
+	require.NoError(t, err)
+
+	m.resizeReplicas(3)
+	require.Equal(t, map[string]string{
+		"GPU-a-replica-0": pluginapi.Healthy, "GPU-a-replica-1": pluginapi.Healthy, "GPU-a-replica-2": pluginapi.Healthy,
+		"GPU-b-replica-0": pluginapi.Healthy, "GPU-b-replica-1": pluginapi.Healthy, "GPU-b-replica-2": pluginapi.Healthy,
+	}, health(s.next(time.Second)))
+
+	// The allocated replica removed stays advertised unhealthy, the others are gone
+	m.resizeReplicas(1)
+	require.Equal(t, map[string]string{
+		"GPU-a-replica-0": pluginapi.Healthy, "GPU-a-replica-1": pluginapi.Unhealthy,
+		"GPU-b-replica-0": pluginapi.Healthy,
+	}, health(s.next(time.Second)))
+
+	// A retired replica stays unhealthy along with the health of its device
+	m.health <- m.cachedDevices[0]
+	require.Equal(t, pluginapi.Unhealthy, health(s.next(time.Second))["GPU-a-replica-1"])
+	m.setHealth(m.cachedDevices[0], pluginapi.Healthy, "test")
+	require.Equal(t, map[string]string{
+		"GPU-a-replica-0": pluginapi.Healthy, "GPU-a-replica-1": pluginapi.Unhealthy,
+		"GPU-b-replica-0": pluginapi.Healthy,
+	}, health(&pluginapi.ListAndWatchResponse{Devices: m.apiDevices()}))
+
+	// Allocating GPU-a-replica-0 again releases the allocation holding the retired replica
+	_, err = m.Allocate(context.Background(), &pluginapi.AllocateRequest{
+		ContainerRequests: []*pluginapi.ContainerAllocateRequest{{DevicesIDs: []string{"GPU-a-replica-0"}}},
+	})
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{
+		"GPU-a-replica-0": pluginapi.Healthy,
+		"GPU-b-replica-0": pluginapi.Healthy,
+	}, health(s.next(time.Second)))
+	require.Empty(t, m.retiredReplicas)
+}
+
+func TestResizeDuringAllocate(t *testing.T) {
+	m := newTestPlugin(config.CommandLineFlags{}, 2, &Device{Device: newPluginDevice("GPU-a")})
+	defer close(m.stop)
+
+	// Run with -race: the RPCs read the replicas while ListAndWatch resizes them
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			m.resizeReplicas(uint(2 + i%2))
+			m.updateReplicas()
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		_, err := m.Allocate(context.Background(), &pluginapi.AllocateRequest{
+			ContainerRequests: []*pluginapi.ContainerAllocateRequest{{DevicesIDs: []string{"GPU-a-replica-0"}}},
+		})
+		require.NoError(t, err)
+		_, err = m.GetDevicePluginOptions(context.Background(), &pluginapi.Empty{})
+		require.NoError(t, err)
+		_, err = m.GetPreferredAllocation(context.Background(), &pluginapi.PreferredAllocationRequest{
+			ContainerRequests: []*pluginapi.ContainerPreferredAllocationRequest{{AvailableDeviceIDs: []string{"GPU-a-replica-0", "GPU-a-replica-1"}, AllocationSize: 1}},
+		})
+		require.NoError(t, err)
+	}
+	<-done
+}
+
+func TestRetiredReplicaTimeout(t *testing.T) {
+	m := newTestPlugin(config.CommandLineFlags{}, 2, &Device{Device: newPluginDevice("GPU-a")})
+	defer close(m.stop)
+
+	// A retired replica allocated on its own is never evicted by another allocation
+	_, err := m.Allocate(context.Background(), &pluginapi.AllocateRequest{
+		ContainerRequests: []*pluginapi.ContainerAllocateRequest{{DevicesIDs: []string{"GPU-a-replica-1"}}},
+	})
+	require.NoError(t, err)
+	m.resizeReplicas(1)
+	m.updateReplicas()
+	require.Len(t, m.apiDevices(), 2)
+
+	require.False(t, m.pruneRetiredReplicas(time.Now()))
+	require.True(t, m.pruneRetiredReplicas(time.Now().Add(retiredReplicaTimeout+time.Minute)))
+	require.Equal(t, []*pluginapi.Device{{ID: "GPU-a-replica-0", Health: pluginapi.Healthy}}, m.apiDevices())
+	require.Empty(t, m.retiredReplicas)
+}
+
+func TestResizeStoppedPlugin(t *testing.T) {
+	m := newTestPlugin(config.CommandLineFlags{}, 2, &Device{Device: newPluginDevice("GPU-a")})
+	m.cleanup()
+
+	m.resizeReplicas(3)
+	require.Equal(t, uint(3), m.replicas)
+
+	m.initialize()
+	defer close(m.stop)
+	require.Len(t, m.deviceReplicas, 3)
+}
+
+func TestResizePlugins(t *testing.T) {
+	cfg := &config.Config{Flags: config.Flags{CommandLineFlags: &config.CommandLineFlags{
+		MigStrategy:         MigStrategyNone,
+		ResourceName:        "nvidia.com/gpu",
+		SocketDir:           "/var/lib/kubelet/device-plugins",
+		DeviceListEnvvar:    "NVIDIA_VISIBLE_DEVICES",
+		DeviceListStrategy:  DeviceListStrategyEnvvar,
+		DeviceIDStrategy:    DeviceIDStrategyUUID,
+		SimulateNGPUs:       2,
+		SimulateGPUMemoryMB: 8192,
+	}}}
+	plugins, err := newSimulatedGPUPlugins(cfg, resourceConfiguration{"gpu": {Name: "gpu", Replicas: 2}})
+	require.NoError(t, err)
+
+	require.NoError(t, resizePlugins(cfg, resourceConfiguration{"gpu": {Name: "gpu", Replicas: 4}}, plugins))
+	require.Equal(t, uint(4), plugins[0].replicas)
+
+	// Changes which advertise the devices under other IDs need a restart
+	require.Error(t, resizePlugins(cfg, resourceConfiguration{"gpu": {Name: "gpu"}}, plugins))
+	require.Error(t, resizePlugins(cfg, resourceConfiguration{"gpu": {Name: "gpu", Replicas: 1, AutoReplicas: true}}, plugins))
+	require.Error(t, resizePlugins(cfg, resourceConfiguration{"gpu": {Name: "gpu-shared", Replicas: 4}}, plugins))
+	require.Equal(t, uint(4), plugins[0].replicas)
+}
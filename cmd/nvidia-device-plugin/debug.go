@@ -0,0 +1,156 @@
+/*
+ * Copyright (c) 2022, NVIDIA CORPORATION.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"sync"
+	"sync/atomic"
+)
+
+// DeviceState is the debug view of a single physical device
+type DeviceState struct {
+	ID                     string   `json:"id"`
+	Index                  string   `json:"index"`
+	Health                 string   `json:"health"`
+	TotalMemory            uint     `json:"totalMemory"`
+	ReservedMemory         uint     `json:"reservedMemory,omitempty"`
+	VirtualType            string   `json:"virtualType"`
+	PowerLimitWatts        uint     `json:"powerLimitWatts,omitempty"`
+	DefaultPowerLimitWatts uint     `json:"defaultPowerLimitWatts,omitempty"`
+	ClockThrottleReasons   []string `json:"clockThrottleReasons"`
+	EnergyConsumption      uint64   `json:"energyConsumptionMillijoules"`
+	SMCount                uint     `json:"smCount,omitempty"`
+	VBIOSVersion           string   `json:"vbiosVersion,omitempty"`
+}
+
+// PluginState is the debug view of a single NvidiaDevicePlugin
+type PluginState struct {
+	ResourceName string         `json:"resourceName"`
+	Socket       string         `json:"socket"`
+	Replicas     int            `json:"replicas"`
+	Devices      []*DeviceState `json:"devices"`
+
+	HealthHistory map[string][]*HealthTransition `json:"healthHistory"`
+
+	AllocateCallsTotal               uint64 `json:"allocateCallsTotal"`
+	AllocateErrorsTotal              uint64 `json:"allocateErrorsTotal"`
+	GetPreferredAllocationCallsTotal uint64 `json:"getPreferredAllocationCallsTotal"`
+}
+
+// State returns a snapshot of the plugin's state for debugging purposes
+func (m *NvidiaDevicePlugin) State() *PluginState {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	state := &PluginState{
+		ResourceName: m.resourceName,
+		Socket:       m.socket,
+		Replicas:     len(m.deviceReplicas),
+		Devices:      []*DeviceState{},
+
+		HealthHistory: make(map[string][]*HealthTransition),
+
+		AllocateCallsTotal:               m.allocateCallsTotal.Load(),
+		AllocateErrorsTotal:              m.allocateErrorsTotal.Load(),
+		GetPreferredAllocationCallsTotal: m.getPreferredAllocationCallsTotal.Load(),
+	}
+
+	for _, d := range m.cachedDevices {
+		state.Devices = append(state.Devices, &DeviceState{
+			ID:                     d.ID,
+			Index:                  d.Index,
+			Health:                 d.Health,
+			TotalMemory:            d.TotalMemory,
+			ReservedMemory:         d.ReservedMemoryMB,
+			VirtualType:            d.VirtualType,
+			PowerLimitWatts:        d.PowerLimitWatts,
+			DefaultPowerLimitWatts: d.DefaultPowerLimitWatts,
+			ClockThrottleReasons:   decodeClocksThrottleReasons(atomic.LoadUint64(&d.ClockThrottleReasons)),
+			EnergyConsumption:      atomic.LoadUint64(&d.EnergyConsumption),
+			SMCount:                d.SMCount,
+			VBIOSVersion:           d.VBIOSVersion,
+		})
+	}
+
+	for _, id := range m.healthHistory.DeviceIDs() {
+		state.HealthHistory[id] = m.healthHistory.History(id)
+	}
+
+	return state
+}
+
+// DebugServer serves the state of the running plugins and their metrics over HTTP
+type DebugServer struct {
+	sync.Mutex
+	plugins []*NvidiaDevicePlugin
+	mux     *http.ServeMux
+}
+
+// NewDebugServer returns a DebugServer with all of its endpoints registered
+func NewDebugServer() *DebugServer {
+	s := &DebugServer{
+		mux: http.NewServeMux(),
+	}
+	s.mux.HandleFunc("/debug/state", s.serveState)
+	s.mux.HandleFunc("/debug/goroutines", s.serveGoroutines)
+	s.mux.HandleFunc("/allocations/", s.serveAllocation)
+	s.mux.Handle("/metrics", metrics)
+	return s
+}
+
+// SetPlugins replaces the set of plugins reported by the server
+func (s *DebugServer) SetPlugins(plugins []*NvidiaDevicePlugin) {
+	s.Lock()
+	defer s.Unlock()
+	s.plugins = plugins
+}
+
+// ListenAndServe serves the debug endpoints on 'addr' in the background
+func (s *DebugServer) ListenAndServe(addr string) {
+	go func() {
+		slog.Info("Starting debug server", "addr", addr)
+		if err := http.ListenAndServe(addr, s.mux); err != nil {
+			slog.Error("Debug server stopped", "addr", addr, "error", err)
+		}
+	}()
+}
+
+// ServeHTTP dispatches requests to the debug endpoints
+func (s *DebugServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.ServeHTTP(w, r)
+}
+
+func (s *DebugServer) serveState(w http.ResponseWriter, r *http.Request) {
+	s.Lock()
+	plugins := s.plugins
+	s.Unlock()
+
+	states := []*PluginState{}
+	for _, p := range plugins {
+		states = append(states, p.State())
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(map[string]interface{}{"plugins": states}); err != nil {
+		slog.Warn("Failed to encode debug state", "error", err)
+	}
+}
@@ -0,0 +1,187 @@
+/*
+ * Copyright (c) 2022, NVIDIA CORPORATION.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// deviceTentativelyHealthy is the health of the devices restored from --device-cache-file. The kubelet
+// keeps them in the capacity of the node without allocating them until the plugin sees them again.
+const deviceTentativelyHealthy = "tentative-healthy"
+
+// restoredDevicesPollInterval is how often a plugin serving restored devices checks whether NVML reports devices again
+const restoredDevicesPollInterval = 30 * time.Second
+
+// deviceCacheLock serializes the updates of --device-cache-file, which is shared by all plugins
+var deviceCacheLock sync.Mutex
+
+// cachedResourceDevices are the last devices of a resource, as saved when its plugin stopped
+type cachedResourceDevices struct {
+	Timestamp time.Time `json:"timestamp"`
+	Devices   []*Device `json:"devices"`
+}
+
+// readDeviceCache reads the devices saved per resource name in 'path'
+func readDeviceCache(path string) (map[string]*cachedResourceDevices, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	cache := make(map[string]*cachedResourceDevices)
+	if err := json.Unmarshal(data, &cache); err != nil {
+		return nil, fmt.Errorf("unable to parse %s: %v", path, err)
+	}
+	return cache, nil
+}
+
+// writeDeviceCache atomically replaces 'path' with the devices saved per resource name
+func writeDeviceCache(path string, cache map[string]*cachedResourceDevices) error {
+	data, err := json.MarshalIndent(cache, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".")
+	if err != nil {
+		return fmt.Errorf("unable to create temporary file: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("unable to write devices: %v", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("unable to write devices: %v", err)
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// saveDevices records the devices of the plugin in --device-cache-file. Devices which were themselves
+// restored from the file are not saved again, so that they cannot outlive --device-cache-ttl.
+func (m *NvidiaDevicePlugin) saveDevices() {
+	path := m.config.Flags.DeviceCacheFile
+	if path == "" || m.devicesRestored || len(m.cachedDevices) == 0 {
+		return
+	}
+
+	deviceCacheLock.Lock()
+	defer deviceCacheLock.Unlock()
+
+	cache, err := readDeviceCache(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			m.logger.Warn("Overwriting unreadable device cache", logKeyEventType, "device_cache_unreadable", "path", path, "error", err)
+		}
+		cache = make(map[string]*cachedResourceDevices)
+	}
+	cache[m.resourceName] = &cachedResourceDevices{Timestamp: time.Now(), Devices: m.cachedDevices}
+	if err := writeDeviceCache(path, cache); err != nil {
+		m.logger.Error("Unable to save devices", logKeyEventType, "device_cache_write_failed", "path", path, "error", err)
+	}
+}
+
+// savedDevices returns the devices saved in --device-cache-file for the resource of the plugin, if any
+func (m *NvidiaDevicePlugin) savedDevices() (*cachedResourceDevices, error) {
+	path := m.config.Flags.DeviceCacheFile
+	if path == "" {
+		return nil, nil
+	}
+
+	deviceCacheLock.Lock()
+	cache, err := readDeviceCache(path)
+	deviceCacheLock.Unlock()
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	saved := cache[m.resourceName]
+	if saved == nil || len(saved.Devices) == 0 {
+		return nil, nil
+	}
+	return saved, nil
+}
+
+// hasRestorableDevices returns whether NVML reports no devices for the plugin but devices saved in
+// --device-cache-file less than --device-cache-ttl ago would be restored when it starts
+func (m *NvidiaDevicePlugin) hasRestorableDevices() bool {
+	if m.DeviceCount() > 0 {
+		return false
+	}
+	saved, err := m.savedDevices()
+	return err == nil && saved != nil && time.Since(saved.Timestamp) <= time.Duration(m.config.Flags.DeviceCacheTTL)
+}
+
+// restoreDevices returns the devices saved in --device-cache-file for the resource of the plugin, marked
+// as tentatively healthy, unless they were saved longer than --device-cache-ttl ago
+func (m *NvidiaDevicePlugin) restoreDevices() []*Device {
+	path := m.config.Flags.DeviceCacheFile
+	saved, err := m.savedDevices()
+	if err != nil {
+		m.logger.Warn("Unable to read device cache", logKeyEventType, "device_cache_unreadable", "path", path, "error", err)
+		return nil
+	}
+	if saved == nil {
+		return nil
+	}
+	age := time.Since(saved.Timestamp)
+	if ttl := time.Duration(m.config.Flags.DeviceCacheTTL); age > ttl {
+		m.logger.Info("Ignoring stale device cache", logKeyEventType, "device_cache_stale", "path", path, "age", age, "ttl", ttl)
+		return nil
+	}
+
+	for _, d := range saved.Devices {
+		d.Health = deviceTentativelyHealthy
+	}
+	m.devicesRestored = true
+	m.logger.Warn("No devices found, restoring the last known devices", logKeyEventType, "devices_restored", "path", path, "devices", len(saved.Devices), "age", age)
+	return saved.Devices
+}
+
+// watchRestoredDevices checks every 'interval' whether NVML reports devices again for a plugin serving restored
+// devices, until 'stop' is closed. The plugin is then sent on 'devicesFound' once, to be restarted with them.
+func (m *NvidiaDevicePlugin) watchRestoredDevices(stop <-chan interface{}, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		if m.DeviceCount() == 0 {
+			continue
+		}
+		m.logger.Info("NVML reports devices again, replacing the restored ones", logKeyEventType, "devices_found", "devices", m.DeviceCount())
+		select {
+		case m.devicesFound <- m:
+		case <-stop:
+		}
+		return
+	}
+}
@@ -0,0 +1,197 @@
+/*
+ * Copyright (c) 2022, NVIDIA CORPORATION.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	config "github.com/NVIDIA/k8s-device-plugin/api/config/v1"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+func TestDeviceCache(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "devices.json")
+	flags := config.CommandLineFlags{DeviceCacheFile: path, DeviceCacheTTL: config.Duration(5 * time.Minute)}
+
+	m := newTestPlugin(flags, 2, &Device{Device: newPluginDevice("GPU-a")}, &Device{Device: newPluginDevice("GPU-b")})
+	m.saveDevices()
+
+	// NVML reports no devices after the restart, the saved ones are advertised but not allocatable
+	restarted := newTestPlugin(flags, 2)
+	require.True(t, restarted.devicesRestored)
+	require.Len(t, restarted.cachedDevices, 2)
+	require.Len(t, restarted.deviceReplicas, 4)
+	for _, d := range restarted.deviceReplicas {
+		require.Equal(t, deviceTentativelyHealthy, d.Health)
+	}
+
+	// The restored devices are not saved again, so that they cannot outlive the TTL
+	cache, err := readDeviceCache(path)
+	require.NoError(t, err)
+	saved := cache["nvidia.com/gpu"].Timestamp
+	restarted.saveDevices()
+	cache, err = readDeviceCache(path)
+	require.NoError(t, err)
+	require.Equal(t, saved, cache["nvidia.com/gpu"].Timestamp)
+
+	// Devices reported by NVML take precedence over the saved ones
+	m = newTestPlugin(flags, 2, &Device{Device: newPluginDevice("GPU-c")})
+	require.False(t, m.devicesRestored)
+	require.Len(t, m.cachedDevices, 1)
+	require.Equal(t, pluginapi.Healthy, m.cachedDevices[0].Health)
+}
+
+func TestDeviceCacheTTL(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "devices.json")
+	cache := map[string]*cachedResourceDevices{
+		"nvidia.com/gpu": {
+			Timestamp: time.Now().Add(-10 * time.Minute),
+			Devices:   []*Device{{Device: newPluginDevice("GPU-a")}},
+		},
+	}
+	data, err := json.Marshal(cache)
+	require.NoError(t, err)
+	require.NoError(t, ioutil.WriteFile(path, data, 0644))
+
+	m := newTestPlugin(config.CommandLineFlags{DeviceCacheFile: path, DeviceCacheTTL: config.Duration(5 * time.Minute)}, 2)
+	require.False(t, m.devicesRestored)
+	require.Empty(t, m.cachedDevices)
+
+	m = newTestPlugin(config.CommandLineFlags{DeviceCacheFile: path, DeviceCacheTTL: config.Duration(time.Hour)}, 2)
+	require.True(t, m.devicesRestored)
+	require.Len(t, m.cachedDevices, 1)
+}
+
+func TestDeviceCacheSharedByResources(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "devices.json")
+	flags := config.CommandLineFlags{DeviceCacheFile: path, DeviceCacheTTL: config.Duration(5 * time.Minute)}
+
+	m := newTestPlugin(flags, 2, &Device{Device: newPluginDevice("GPU-a")})
+	m.saveDevices()
+	other := newTestPlugin(flags, 2, &Device{Device: newPluginDevice("MIG-a")})
+	other.resourceName = "nvidia.com/mig-1g.5gb"
+	other.saveDevices()
+
+	cache, err := readDeviceCache(path)
+	require.NoError(t, err)
+	require.Len(t, cache, 2)
+	require.Equal(t, "GPU-a", cache["nvidia.com/gpu"].Devices[0].ID)
+	require.Equal(t, "MIG-a", cache["nvidia.com/mig-1g.5gb"].Devices[0].ID)
+}
+
+// appearingResourceManager is a testResourceManager whose devices can be changed while the plugin runs
+type appearingResourceManager struct {
+	sync.Mutex
+	testResourceManager
+}
+
+func (r *appearingResourceManager) Devices() []*Device {
+	r.Lock()
+	defer r.Unlock()
+	return r.testResourceManager.Devices()
+}
+
+func (r *appearingResourceManager) DeviceCount() int {
+	r.Lock()
+	defer r.Unlock()
+	return r.testResourceManager.DeviceCount()
+}
+
+func (r *appearingResourceManager) setDevices(devices ...*Device) {
+	r.Lock()
+	defer r.Unlock()
+	r.devices = devices
+}
+
+func TestRestoredDevicesServedUntilFound(t *testing.T) {
+	kubelet, dir := newFakeKubelet(t)
+	path := filepath.Join(t.TempDir(), "devices.json")
+	flags := config.CommandLineFlags{DeviceCacheFile: path, DeviceCacheTTL: config.Duration(5 * time.Minute)}
+	saved := newTestPlugin(flags, 2, &Device{Device: newPluginDevice("GPU-a")}, &Device{Device: newPluginDevice("GPU-b")})
+	saved.saveDevices()
+
+	flags.DeviceListStrategy = DeviceListStrategyEnvvar
+	flags.DeviceIDStrategy = DeviceIDStrategyUUID
+	flags.GRPCDialTimeout = config.Duration(5 * time.Second)
+	flags.KubeletRegistrationTimeout = config.Duration(5 * time.Second)
+	flags.AllocationTimeout = config.Duration(10 * time.Second)
+	flags.GRPCStopTimeout = config.Duration(5 * time.Second)
+	cfg := &config.Config{Flags: config.Flags{CommandLineFlags: &flags}}
+	newPlugin := func(resourceName string, rm ResourceManager, socket string) *NvidiaDevicePlugin {
+		m, err := NewNvidiaDevicePlugin(cfg, resourceName, rm, "NVIDIA_VISIBLE_DEVICES", nil, filepath.Join(dir, socket), 2, false, nil)
+		require.NoError(t, err)
+		m.simulateNVML()
+		return m
+	}
+	rm := &appearingResourceManager{}
+	m := newPlugin("nvidia.com/gpu", rm, "nvidia-gpu.sock")
+	found := make(chan *NvidiaDevicePlugin, 1)
+	m.devicesFound = found
+
+	// The plugin is started although NVML reports no devices, as saved devices are restored
+	uncached := newPlugin("nvidia.com/mig-1g.5gb", &testResourceManager{}, "nvidia-mig-1g.5gb.sock")
+	require.Equal(t, []*NvidiaDevicePlugin{m}, pluginsToServe([]*NvidiaDevicePlugin{m, uncached}))
+
+	listDevices := func() map[string]string {
+		registration, err := kubelet.NextRegistration(5 * time.Second)
+		require.NoError(t, err)
+		client, err := kubelet.Connect(registration.Endpoint, 5*time.Second)
+		require.NoError(t, err)
+		stream, err := client.ListAndWatch(context.Background(), &pluginapi.Empty{})
+		require.NoError(t, err)
+		response, err := stream.Recv()
+		require.NoError(t, err)
+		health := make(map[string]string)
+		for _, d := range response.Devices {
+			health[d.ID] = d.Health
+		}
+		return health
+	}
+	require.NoError(t, m.Start())
+	defer func() { m.Stop() }()
+	require.Equal(t, map[string]string{
+		"GPU-a-replica-0": deviceTentativelyHealthy,
+		"GPU-a-replica-1": deviceTentativelyHealthy,
+		"GPU-b-replica-0": deviceTentativelyHealthy,
+		"GPU-b-replica-1": deviceTentativelyHealthy,
+	}, listDevices())
+
+	// Once NVML reports devices again, the plugin asks to be restarted with them
+	go m.watchRestoredDevices(m.stop, 10*time.Millisecond)
+	rm.setDevices(&Device{Device: newPluginDevice("GPU-a")})
+	select {
+	case p := <-found:
+		require.Equal(t, m, p)
+	case <-time.After(5 * time.Second):
+		t.Fatal("the devices reported by NVML were not found")
+	}
+
+	require.NoError(t, m.Stop())
+	require.NoError(t, m.Start())
+	require.False(t, m.devicesRestored)
+	require.Equal(t, map[string]string{
+		"GPU-a-replica-0": pluginapi.Healthy,
+		"GPU-a-replica-1": pluginapi.Healthy,
+	}, listDevices())
+}
@@ -0,0 +1,65 @@
+/*
+ * Copyright (c) 2022, NVIDIA CORPORATION.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// DryRunPlan is what --dry-run prints for each plugin with devices to serve
+type DryRunPlan struct {
+	ResourceName string    `json:"resourceName"`
+	Socket       string    `json:"socket"`
+	Devices      []*Device `json:"devices"`
+	Replicas     []*Device `json:"replicas"`
+}
+
+// dryRun discovers the devices of the plugins of the strategy and writes the replicas they would advertise
+// to 'w' as JSON, without serving them. Device discovery panics on NVML errors, which are returned instead.
+func dryRun(w io.Writer, strategy MigStrategy) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("device discovery failed: %v", r)
+		}
+	}()
+
+	plugins, err := strategy.GetPlugins()
+	if err != nil {
+		return err
+	}
+
+	plans := []*DryRunPlan{}
+	for _, p := range plugins {
+		if p.servedDeviceCount() == 0 {
+			continue
+		}
+		p.initialize()
+		plans = append(plans, &DryRunPlan{
+			ResourceName: p.resourceName,
+			Socket:       p.socket,
+			Devices:      p.cachedDevices,
+			Replicas:     p.deviceReplicas,
+		})
+		p.cleanup()
+	}
+
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(plans)
+}
@@ -0,0 +1,93 @@
+/*
+ * Copyright (c) 2022, NVIDIA CORPORATION.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/NVIDIA/gpu-monitoring-tools/bindings/go/nvml"
+	config "github.com/NVIDIA/k8s-device-plugin/api/config/v1"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeMigStrategy returns a fixed set of plugins
+type fakeMigStrategy struct {
+	plugins []*NvidiaDevicePlugin
+}
+
+func (s *fakeMigStrategy) GetPlugins() ([]*NvidiaDevicePlugin, error) {
+	return s.plugins, nil
+}
+
+func (s *fakeMigStrategy) MatchesResource(mig *nvml.Device, resource string) bool {
+	return false
+}
+
+// failingResourceManager fails device discovery the way NVML errors do
+type failingResourceManager struct {
+	testResourceManager
+}
+
+func (r *failingResourceManager) DeviceCount() int {
+	check(fmt.Errorf("ERROR_UNKNOWN"))
+	return 0
+}
+
+func TestDryRun(t *testing.T) {
+	gpus := newTestPlugin(config.CommandLineFlags{}, 2,
+		&Device{Device: newPluginDevice("GPU-0")},
+		&Device{Device: newPluginDevice("GPU-1")},
+	)
+	gpus.cleanup()
+	empty := newTestPlugin(config.CommandLineFlags{}, 2)
+	empty.cleanup()
+
+	var out bytes.Buffer
+	require.NoError(t, dryRun(&out, &fakeMigStrategy{plugins: []*NvidiaDevicePlugin{gpus, empty}}))
+
+	var plans []*DryRunPlan
+	require.NoError(t, json.Unmarshal(out.Bytes(), &plans))
+	require.Len(t, plans, 1)
+	require.Equal(t, "nvidia.com/gpu", plans[0].ResourceName)
+	require.Len(t, plans[0].Devices, 2)
+	var replicas []string
+	for _, r := range plans[0].Replicas {
+		replicas = append(replicas, r.ID)
+	}
+	require.Equal(t, []string{"GPU-0-replica-0", "GPU-0-replica-1", "GPU-1-replica-0", "GPU-1-replica-1"}, replicas)
+
+	// Nothing is served
+	require.Nil(t, gpus.server)
+	require.Nil(t, gpus.deviceReplicas)
+}
+
+func TestDryRunDiscoveryFailure(t *testing.T) {
+	cfg := &config.Config{Flags: config.Flags{CommandLineFlags: &config.CommandLineFlags{}}}
+	m, err := NewNvidiaDevicePlugin(cfg, "nvidia.com/gpu", &failingResourceManager{}, "NVIDIA_VISIBLE_DEVICES", nil, "", 2, false, nil)
+	require.NoError(t, err)
+	captureLog(t)
+
+	var out bytes.Buffer
+	err = dryRun(&out, &fakeMigStrategy{plugins: []*NvidiaDevicePlugin{m}})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "device discovery failed")
+	require.Contains(t, err.Error(), "ERROR_UNKNOWN")
+	require.Zero(t, out.Len())
+}
@@ -0,0 +1,96 @@
+/*
+ * Copyright (c) 2022, NVIDIA CORPORATION.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var energyConsumptionTotal = metrics.NewCounterVec(
+	"nvidia_gpu_energy_consumption_millijoules_total",
+	"Energy consumed by a device since the plugin started tracking it, in millijoules.",
+	"plugin", "device_uuid",
+)
+
+// reportedEnergy holds the running total of energy last added to the counter of each device, by UUID. It survives
+// plugin restarts, so that the running total of a device is not added to its counter again once it is back.
+var reportedEnergy = struct {
+	sync.Mutex
+	totals map[string]uint64
+}{totals: make(map[string]uint64)}
+
+// queryEnergyConsumption returns the energy consumed by a device since the driver was last loaded, in millijoules.
+// nvmlDeviceGetTotalEnergyConsumption() is not exposed by the NVML go bindings, so nvidia-smi is used instead.
+func queryEnergyConsumption(uuid string) (uint64, error) {
+	values, err := queryNvidiaSMI(uuid, "total_energy_consumption")
+	if err != nil {
+		return 0, err
+	}
+	energy, err := strconv.ParseUint(values[0], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("unable to parse energy consumption '%s': %v", values[0], err)
+	}
+	return energy, nil
+}
+
+// watchEnergyConsumption polls each device for its total energy consumption until 'stop' is closed
+func (m *NvidiaDevicePlugin) watchEnergyConsumption(stop <-chan interface{}, devices []*Device, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		for _, d := range devices {
+			energy, err := m.queryEnergy(d.ID)
+			if err != nil {
+				m.logger.Warn("Unable to query energy consumption", logKeyEventType, "energy_query_failed", logKeyDeviceUUID, d.ID, "error", err)
+				continue
+			}
+			m.updateEnergyConsumption(d, energy)
+		}
+
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// updateEnergyConsumption records the running total reported by NVML for a device and adds the energy consumed
+// since the last update to its counter. The first update only records the running total as a baseline. Should
+// the running total go backwards, e.g. because the driver was reloaded, the new total is added so that the counter
+// never decreases.
+func (m *NvidiaDevicePlugin) updateEnergyConsumption(d *Device, energy uint64) {
+	atomic.StoreUint64(&d.EnergyConsumption, energy)
+
+	reportedEnergy.Lock()
+	previous, ok := reportedEnergy.totals[d.ID]
+	reportedEnergy.totals[d.ID] = energy
+	reportedEnergy.Unlock()
+	switch {
+	case !ok:
+		energyConsumptionTotal.Add(0, m.Name(), d.ID)
+	case energy >= previous:
+		energyConsumptionTotal.Add(float64(energy-previous), m.Name(), d.ID)
+	default:
+		energyConsumptionTotal.Add(float64(energy), m.Name(), d.ID)
+	}
+}
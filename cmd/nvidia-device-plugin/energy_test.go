@@ -0,0 +1,85 @@
+/*
+ * Copyright (c) 2022, NVIDIA CORPORATION.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	config "github.com/NVIDIA/k8s-device-plugin/api/config/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func resetReportedEnergy() {
+	reportedEnergy.Lock()
+	defer reportedEnergy.Unlock()
+	reportedEnergy.totals = make(map[string]uint64)
+}
+
+func TestWatchEnergyConsumption(t *testing.T) {
+	resetReportedEnergy()
+	defer resetReportedEnergy()
+
+	m := newTestPlugin(config.CommandLineFlags{}, 1, &Device{Device: newPluginDevice("GPU-energy")})
+	d := m.cachedDevices[0]
+
+	readings := []uint64{5000000, 5000000, 5002500, 1000, 1500}
+	query := func(uuid string) (uint64, error) {
+		if len(readings) == 0 {
+			return 0, fmt.Errorf("no more readings")
+		}
+		energy := readings[0]
+		readings = readings[1:]
+		return energy, nil
+	}
+	m.queryEnergy = query
+	poll := func() {
+		stop := make(chan interface{})
+		close(stop)
+		m.watchEnergyConsumption(stop, m.cachedDevices, time.Hour)
+	}
+
+	// The running total reported at startup is only a baseline
+	start := energyConsumptionTotal.Get(m.Name(), "GPU-energy")
+	poll()
+	require.Equal(t, uint64(5000000), d.EnergyConsumption)
+	require.Equal(t, start, energyConsumptionTotal.Get(m.Name(), "GPU-energy"))
+
+	poll()
+	poll()
+	require.Equal(t, uint64(5002500), d.EnergyConsumption)
+	require.Equal(t, start+2500, energyConsumptionTotal.Get(m.Name(), "GPU-energy"))
+
+	// A reset of the running total does not decrease the counter
+	poll()
+	require.Equal(t, uint64(1000), d.EnergyConsumption)
+	require.Equal(t, start+3500, energyConsumptionTotal.Get(m.Name(), "GPU-energy"))
+
+	// A restarted plugin rebuilds its devices but keeps counting from the last running total
+	m = newTestPlugin(config.CommandLineFlags{}, 1, &Device{Device: newPluginDevice("GPU-energy")})
+	d = m.cachedDevices[0]
+	m.queryEnergy = query
+	poll()
+	require.Equal(t, uint64(1500), d.EnergyConsumption)
+	require.Equal(t, start+4000, energyConsumptionTotal.Get(m.Name(), "GPU-energy"))
+
+	// Failed queries leave the values untouched
+	poll()
+	require.Equal(t, uint64(1500), d.EnergyConsumption)
+	require.Equal(t, uint64(1500), m.State().Devices[0].EnergyConsumption)
+}
@@ -0,0 +1,159 @@
+/*
+ * Copyright (c) 2022, NVIDIA CORPORATION.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// unhealthyEventInterval is the minimum time between two GPUDeviceUnhealthy events for the same device
+const unhealthyEventInterval = 10 * time.Minute
+
+// EventRecorder records Kubernetes events about the node the plugin is running on
+type EventRecorder interface {
+	Normal(reason string, message string)
+	Warning(reason string, message string)
+}
+
+// eventQueueSize is the number of events waiting to be created before new ones are dropped
+const eventQueueSize = 100
+
+// nodeEventRecorder implements the EventRecorder interface through the Kubernetes API.
+// Events are queued and created in the background, so that a slow API server does not hold their callers,
+// e.g. Allocate. Without a client, events are only logged.
+type nodeEventRecorder struct {
+	client *KubeClient
+	node   string
+	queue  chan *Event
+}
+
+// sharedNodeEvents is the EventRecorder shared by all the plugins of the process and their restarts
+var sharedNodeEvents struct {
+	once     sync.Once
+	recorder EventRecorder
+}
+
+// sharedNodeEventRecorder returns the EventRecorder shared by all the plugins, creating it on the first call
+func sharedNodeEventRecorder() EventRecorder {
+	sharedNodeEvents.once.Do(func() {
+		sharedNodeEvents.recorder = newNodeEventRecorder()
+	})
+	return sharedNodeEvents.recorder
+}
+
+// newNodeEventRecorder returns an EventRecorder for the node named by the NODE_NAME environment variable
+func newNodeEventRecorder() EventRecorder {
+	node := os.Getenv(envNodeName)
+	if node == "" {
+		slog.Warn("Not recording node events, " + envNodeName + " must be set")
+		return &nodeEventRecorder{}
+	}
+
+	client, err := NewInClusterKubeClient()
+	if err != nil {
+		slog.Warn("Not recording node events", "error", err)
+		return &nodeEventRecorder{node: node}
+	}
+	return newQueuedNodeEventRecorder(client, node)
+}
+
+// newQueuedNodeEventRecorder returns an EventRecorder creating events on 'node' through 'client' in the background
+func newQueuedNodeEventRecorder(client *KubeClient, node string) *nodeEventRecorder {
+	r := &nodeEventRecorder{
+		client: client,
+		node:   node,
+		queue:  make(chan *Event, eventQueueSize),
+	}
+	go r.run()
+	return r
+}
+
+// Normal records an informational event on the node
+func (r *nodeEventRecorder) Normal(reason string, message string) {
+	slog.Info(message, logKeyEventType, "node_event", "reason", reason)
+	r.record("Normal", reason, message)
+}
+
+// Warning records a warning event on the node
+func (r *nodeEventRecorder) Warning(reason string, message string) {
+	slog.Warn(message, logKeyEventType, "node_event", "reason", reason)
+	r.record("Warning", reason, message)
+}
+
+// record queues an event to create, dropping it if the queue is full
+func (r *nodeEventRecorder) record(eventType string, reason string, message string) {
+	if r.client == nil {
+		return
+	}
+
+	select {
+	case r.queue <- NewNodeEvent(r.node, eventType, reason, message):
+	default:
+		slog.Warn("Dropping node event, the queue of events to create is full", "reason", reason, "node", r.node, "queued", eventQueueSize)
+	}
+}
+
+// run creates the queued events one at a time
+func (r *nodeEventRecorder) run() {
+	for event := range r.queue {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		if err := r.client.CreateEvent(ctx, event); err != nil {
+			slog.Warn("Failed to record node event", "reason", event.Reason, "node", r.node, "error", err)
+		}
+		cancel()
+	}
+}
+
+// eventRateLimiter lets through at most one event per key in any interval
+type eventRateLimiter struct {
+	sync.Mutex
+	interval time.Duration
+	last     map[string]time.Time
+}
+
+func newEventRateLimiter(interval time.Duration) *eventRateLimiter {
+	return &eventRateLimiter{interval: interval, last: make(map[string]time.Time)}
+}
+
+// Allow returns whether an event for 'key' may be recorded at 'now', counting it if so
+func (l *eventRateLimiter) Allow(key string, now time.Time) bool {
+	l.Lock()
+	defer l.Unlock()
+	if last, ok := l.last[key]; ok && now.Sub(last) < l.interval {
+		return false
+	}
+	l.last[key] = now
+	return true
+}
+
+// recordUnhealthyEvent records a GPUDeviceUnhealthy warning on the node for the physical device 'd' when
+// --emit-k8s-device-events is set, at most once per device every unhealthyEventInterval
+func (m *NvidiaDevicePlugin) recordUnhealthyEvent(d *Device) {
+	if !m.config.Flags.EmitK8sDeviceEvents || m.events == nil {
+		return
+	}
+	if !m.unhealthyEvents.Allow(d.ID, time.Now()) {
+		return
+	}
+	m.events.Warning("GPUDeviceUnhealthy", fmt.Sprintf("Device %s of '%s' is unhealthy", d.ID, m.resourceName))
+}
@@ -0,0 +1,100 @@
+/*
+ * Copyright (c) 2022, NVIDIA CORPORATION.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	config "github.com/NVIDIA/k8s-device-plugin/api/config/v1"
+	"github.com/stretchr/testify/require"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+func TestEventRateLimiter(t *testing.T) {
+	l := newEventRateLimiter(10 * time.Minute)
+	start := time.Now()
+
+	require.True(t, l.Allow("GPU-a", start))
+	require.False(t, l.Allow("GPU-a", start.Add(time.Minute)))
+	require.True(t, l.Allow("GPU-b", start.Add(time.Minute)))
+	require.True(t, l.Allow("GPU-a", start.Add(10*time.Minute)))
+	require.False(t, l.Allow("GPU-a", start.Add(15*time.Minute)))
+}
+
+func TestUnhealthyDeviceEvents(t *testing.T) {
+	m := newTestPlugin(config.CommandLineFlags{EmitK8sDeviceEvents: true}, 2,
+		&Device{Device: newPluginDevice("GPU-a")}, &Device{Device: newPluginDevice("GPU-b")})
+	events := &fakeEventRecorder{}
+	m.events = events
+	m.ResourceManager.(*testResourceManager).unhealthy = []string{"GPU-a"}
+	defer close(m.stop)
+
+	s := newFakeListAndWatchServer()
+	go m.ListAndWatch(&pluginapi.Empty{}, s)
+	require.NotNil(t, s.next(5*time.Second))
+
+	// The device is reported unhealthy twice in a row, as after flapping back to healthy
+	m.startHealthChecks()
+	require.NotNil(t, s.next(5*time.Second))
+	m.health <- m.cachedDevices[0]
+	require.NotNil(t, s.next(5*time.Second))
+
+	events.Lock()
+	defer events.Unlock()
+	require.Equal(t, []string{"GPUDeviceUnhealthy: Device GPU-a of 'nvidia.com/gpu' is unhealthy"}, events.warnings)
+}
+
+func TestNodeEventRecorderQueuesEvents(t *testing.T) {
+	api := newFakeKubeAPI()
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		api.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+
+	r := newQueuedNodeEventRecorder(NewKubeClient(server.URL, "", server.Client()), "node-1")
+
+	// Recording does not wait for the API server
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < eventQueueSize+10; i++ {
+			r.Normal("GPUAllocated", "Allocated 'nvidia.com/gpu' devices GPU-0")
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("recording events blocked on the API server")
+	}
+
+	// The queued events are created once the API server answers; the overflow is dropped
+	close(release)
+	require.Eventually(t, func() bool {
+		api.Lock()
+		defer api.Unlock()
+		return len(api.events) >= eventQueueSize
+	}, 5*time.Second, 10*time.Millisecond)
+	api.Lock()
+	defer api.Unlock()
+	require.LessOrEqual(t, len(api.events), eventQueueSize+1)
+	require.Equal(t, "GPUAllocated", api.events[0].Reason)
+}
@@ -0,0 +1,304 @@
+/*
+ * Copyright (c) 2022, NVIDIA CORPORATION.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// MaxExtenderPriority is the highest score a scheduler extender may give a node
+const MaxExtenderPriority = 10
+
+// ExtenderArgs is the payload sent by the scheduler to the filter and prioritize verbs of an extender.
+// Nodes are only sent in full if the extender is not configured as nodeCacheCapable, in which case they are
+// kept as raw JSON so that they can be returned untouched.
+type ExtenderArgs struct {
+	Pod       *Pod              `json:"pod"`
+	Nodes     *ExtenderNodeList `json:"nodes,omitempty"`
+	NodeNames *[]string         `json:"nodenames,omitempty"`
+}
+
+// ExtenderNodeList is a core/v1 NodeList as sent by the scheduler
+type ExtenderNodeList struct {
+	Items []json.RawMessage `json:"items"`
+}
+
+// ExtenderFilterResult is the response of the filter verb
+type ExtenderFilterResult struct {
+	Nodes       *ExtenderNodeList `json:"nodes,omitempty"`
+	NodeNames   *[]string         `json:"nodenames,omitempty"`
+	FailedNodes map[string]string `json:"failedNodes,omitempty"`
+	Error       string            `json:"error,omitempty"`
+}
+
+// HostPriority is the score of a single node in the response of the prioritize verb
+type HostPriority struct {
+	Host  string `json:"host"`
+	Score int64  `json:"score"`
+}
+
+// HostPriorityList is the response of the prioritize verb
+type HostPriorityList []HostPriority
+
+// Extender implements the filter and prioritize verbs of the scheduler extender protocol for clusters
+// placing GPU workloads through an extender: nodes are filtered and scored by their free GPU replicas.
+type Extender struct {
+	resourceName string
+	freeReplicas func(ctx context.Context, node string) (int, error)
+	mux          *http.ServeMux
+}
+
+// NewExtender returns an Extender counting the free replicas of 'resourceName' through the Kubernetes API
+func NewExtender(resourceName string, client *KubeClient) *Extender {
+	e := newExtender(resourceName, nil)
+	e.freeReplicas = func(ctx context.Context, node string) (int, error) {
+		return countFreeReplicas(ctx, client, resourceName, node)
+	}
+	return e
+}
+
+func newExtender(resourceName string, freeReplicas func(ctx context.Context, node string) (int, error)) *Extender {
+	e := &Extender{
+		resourceName: resourceName,
+		freeReplicas: freeReplicas,
+		mux:          http.NewServeMux(),
+	}
+	e.mux.HandleFunc("/filter", e.serveFilter)
+	e.mux.HandleFunc("/prioritize", e.servePrioritize)
+	return e
+}
+
+// ServeHTTP dispatches requests to the extender verbs
+func (e *Extender) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	e.mux.ServeHTTP(w, r)
+}
+
+// parseReplicaCount parses the quantity of an extended resource, which is always an integer
+func parseReplicaCount(quantity string) (int, error) {
+	n, err := strconv.Atoi(quantity)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid quantity %q", quantity)
+	}
+	return n, nil
+}
+
+// requestedReplicas returns the number of replicas of 'resourceName' requested by the containers of a pod.
+// Extended resources cannot be overcommitted, so their requests default to their limits.
+func requestedReplicas(pod *Pod, resourceName string) (int, error) {
+	total := 0
+	for _, c := range pod.Spec.Containers {
+		quantity, exists := c.Resources.Limits[resourceName]
+		if !exists {
+			quantity, exists = c.Resources.Requests[resourceName]
+		}
+		if !exists {
+			continue
+		}
+		n, err := parseReplicaCount(quantity)
+		if err != nil {
+			return 0, fmt.Errorf("container %s of pod %s/%s requests %s: %v", c.Name, pod.Metadata.Namespace, pod.Metadata.Name, resourceName, err)
+		}
+		total += n
+	}
+	return total, nil
+}
+
+// countFreeReplicas returns the allocatable replicas of 'resourceName' on a node not requested by its running pods
+func countFreeReplicas(ctx context.Context, client *KubeClient, resourceName string, nodeName string) (int, error) {
+	node, err := client.GetNode(ctx, nodeName)
+	if err != nil {
+		return 0, fmt.Errorf("unable to get node %s: %v", nodeName, err)
+	}
+	allocatable, exists := node.Status.Allocatable[resourceName]
+	if !exists {
+		return 0, nil
+	}
+	free, err := parseReplicaCount(allocatable)
+	if err != nil {
+		return 0, fmt.Errorf("node %s has %s allocatable: %v", nodeName, resourceName, err)
+	}
+
+	pods, err := client.ListNodePods(ctx, nodeName)
+	if err != nil {
+		return 0, fmt.Errorf("unable to list pods of node %s: %v", nodeName, err)
+	}
+	for _, pod := range pods {
+		if pod.Status.Phase == "Succeeded" || pod.Status.Phase == "Failed" {
+			continue
+		}
+		n, err := requestedReplicas(pod, resourceName)
+		if err != nil {
+			return 0, err
+		}
+		free -= n
+	}
+	if free < 0 {
+		free = 0
+	}
+	return free, nil
+}
+
+// nodeNames returns the names of the candidate nodes of a request
+func (args *ExtenderArgs) nodeNames() ([]string, error) {
+	if args.NodeNames != nil {
+		return *args.NodeNames, nil
+	}
+	if args.Nodes == nil {
+		return nil, nil
+	}
+	var names []string
+	for _, raw := range args.Nodes.Items {
+		var node Node
+		if err := json.Unmarshal(raw, &node); err != nil {
+			return nil, fmt.Errorf("unable to decode node: %v", err)
+		}
+		names = append(names, node.Metadata.Name)
+	}
+	return names, nil
+}
+
+// decodeExtenderArgs decodes the payload of an extender verb, answering the request itself on failure
+func decodeExtenderArgs(w http.ResponseWriter, r *http.Request) (*ExtenderArgs, []string, bool) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return nil, nil, false
+	}
+	var args ExtenderArgs
+	if err := json.NewDecoder(r.Body).Decode(&args); err != nil {
+		http.Error(w, fmt.Sprintf("unable to decode extender arguments: %v", err), http.StatusBadRequest)
+		return nil, nil, false
+	}
+	if args.Pod == nil {
+		http.Error(w, "no pod given", http.StatusBadRequest)
+		return nil, nil, false
+	}
+	names, err := args.nodeNames()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil, nil, false
+	}
+	return &args, names, true
+}
+
+func writeExtenderResponse(w http.ResponseWriter, response interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		slog.Warn("Failed to encode extender response", "error", err)
+	}
+}
+
+// serveFilter removes the nodes lacking enough free replicas for the pod
+func (e *Extender) serveFilter(w http.ResponseWriter, r *http.Request) {
+	args, names, ok := decodeExtenderArgs(w, r)
+	if !ok {
+		return
+	}
+
+	result := &ExtenderFilterResult{FailedNodes: make(map[string]string)}
+	requested, err := requestedReplicas(args.Pod, e.resourceName)
+	if err != nil {
+		result.Error = err.Error()
+		writeExtenderResponse(w, result)
+		return
+	}
+
+	fits := make(map[string]bool)
+	for _, name := range names {
+		if requested == 0 {
+			fits[name] = true
+			continue
+		}
+		free, err := e.freeReplicas(r.Context(), name)
+		switch {
+		case err != nil:
+			result.FailedNodes[name] = err.Error()
+		case free < requested:
+			result.FailedNodes[name] = fmt.Sprintf("insufficient %s: %d free, %d requested", e.resourceName, free, requested)
+		default:
+			fits[name] = true
+		}
+	}
+
+	if args.NodeNames != nil {
+		filtered := []string{}
+		for _, name := range names {
+			if fits[name] {
+				filtered = append(filtered, name)
+			}
+		}
+		result.NodeNames = &filtered
+	} else if args.Nodes != nil {
+		result.Nodes = &ExtenderNodeList{Items: []json.RawMessage{}}
+		for i, name := range names {
+			if fits[name] {
+				result.Nodes.Items = append(result.Nodes.Items, args.Nodes.Items[i])
+			}
+		}
+	}
+	writeExtenderResponse(w, result)
+}
+
+// servePrioritize scores the nodes by their free replicas, the node with the most free replicas scoring MaxExtenderPriority
+func (e *Extender) servePrioritize(w http.ResponseWriter, r *http.Request) {
+	_, names, ok := decodeExtenderArgs(w, r)
+	if !ok {
+		return
+	}
+
+	free := make([]int, len(names))
+	most := 0
+	for i, name := range names {
+		n, err := e.freeReplicas(r.Context(), name)
+		if err != nil {
+			slog.Warn("Scoring node 0", "node", name, "error", err)
+			continue
+		}
+		free[i] = n
+		if n > most {
+			most = n
+		}
+	}
+
+	priorities := HostPriorityList{}
+	for i, name := range names {
+		var score int64
+		if most > 0 {
+			score = int64(free[i] * MaxExtenderPriority / most)
+		}
+		priorities = append(priorities, HostPriority{Host: name, Score: score})
+	}
+	writeExtenderResponse(w, priorities)
+}
+
+// ListenAndServe serves the extender verbs on 'addr' until it fails
+func (e *Extender) ListenAndServe(addr string) error {
+	slog.Info("Starting scheduler extender", logKeyResourceName, e.resourceName, "addr", addr)
+	server := &http.Server{
+		Addr:         addr,
+		Handler:      e,
+		ReadTimeout:  30 * time.Second,
+		WriteTimeout: 30 * time.Second,
+	}
+	return server.ListenAndServe()
+}
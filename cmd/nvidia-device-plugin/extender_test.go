@@ -0,0 +1,165 @@
+/*
+ * Copyright (c) 2022, NVIDIA CORPORATION.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+func newExtenderPod(replicas ...string) *Pod {
+	pod := &Pod{}
+	pod.Metadata.Name = "pod"
+	pod.Metadata.Namespace = "default"
+	for i, n := range replicas {
+		c := &Container{Name: fmt.Sprintf("c%d", i)}
+		c.Resources.Limits = map[string]string{"nvidia.com/gpu": n}
+		pod.Spec.Containers = append(pod.Spec.Containers, c)
+	}
+	return pod
+}
+
+func newExtenderNode(name string, allocatable string) json.RawMessage {
+	node := &Node{}
+	node.Metadata.Name = name
+	if allocatable != "" {
+		node.Status.Allocatable = map[string]string{"nvidia.com/gpu": allocatable}
+	}
+	raw, _ := json.Marshal(node)
+	return raw
+}
+
+// postExtender sends 'args' to the extender verb at 'path' and decodes the response into 'out'
+func postExtender(t *testing.T, server *httptest.Server, path string, args *ExtenderArgs, out interface{}) {
+	body, err := json.Marshal(args)
+	require.NoError(t, err)
+	resp, err := http.Post(server.URL+path, "application/json", bytes.NewReader(body))
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(out))
+}
+
+func newTestExtender(free map[string]int) *httptest.Server {
+	return httptest.NewServer(newExtender("nvidia.com/gpu", func(ctx context.Context, node string) (int, error) {
+		n, exists := free[node]
+		if !exists {
+			return 0, fmt.Errorf("node %s not found", node)
+		}
+		return n, nil
+	}))
+}
+
+func TestExtenderFilter(t *testing.T) {
+	server := newTestExtender(map[string]int{"node-a": 4, "node-b": 1, "node-c": 0})
+	defer server.Close()
+
+	// Node names only, as sent to nodeCacheCapable extenders
+	names := []string{"node-a", "node-b", "node-c", "node-unknown"}
+	var result ExtenderFilterResult
+	postExtender(t, server, "/filter", &ExtenderArgs{Pod: newExtenderPod("1", "1"), NodeNames: &names}, &result)
+	require.Empty(t, result.Error)
+	require.Equal(t, []string{"node-a"}, *result.NodeNames)
+	require.Equal(t, map[string]string{
+		"node-b":       "insufficient nvidia.com/gpu: 1 free, 2 requested",
+		"node-c":       "insufficient nvidia.com/gpu: 0 free, 2 requested",
+		"node-unknown": "node node-unknown not found",
+	}, result.FailedNodes)
+
+	// Full nodes are returned untouched
+	nodes := &ExtenderNodeList{Items: []json.RawMessage{newExtenderNode("node-a", "8"), newExtenderNode("node-b", "2")}}
+	result = ExtenderFilterResult{}
+	postExtender(t, server, "/filter", &ExtenderArgs{Pod: newExtenderPod("1"), Nodes: nodes}, &result)
+	require.Nil(t, result.NodeNames)
+	require.Len(t, result.Nodes.Items, 2)
+	require.JSONEq(t, string(nodes.Items[0]), string(result.Nodes.Items[0]))
+
+	// Pods without GPU requests fit anywhere
+	result = ExtenderFilterResult{}
+	postExtender(t, server, "/filter", &ExtenderArgs{Pod: newExtenderPod(), NodeNames: &names}, &result)
+	require.Equal(t, names, *result.NodeNames)
+	require.Empty(t, result.FailedNodes)
+
+	// Invalid requests are reported in the result
+	result = ExtenderFilterResult{}
+	postExtender(t, server, "/filter", &ExtenderArgs{Pod: newExtenderPod("half"), NodeNames: &names}, &result)
+	require.Contains(t, result.Error, `invalid quantity "half"`)
+}
+
+func TestExtenderPrioritize(t *testing.T) {
+	server := newTestExtender(map[string]int{"node-a": 4, "node-b": 1, "node-c": 8})
+	defer server.Close()
+
+	names := []string{"node-a", "node-b", "node-c", "node-unknown"}
+	var priorities HostPriorityList
+	postExtender(t, server, "/prioritize", &ExtenderArgs{Pod: newExtenderPod("1"), NodeNames: &names}, &priorities)
+	require.Equal(t, HostPriorityList{
+		{Host: "node-a", Score: 5},
+		{Host: "node-b", Score: 1},
+		{Host: "node-c", Score: MaxExtenderPriority},
+		{Host: "node-unknown", Score: 0},
+	}, priorities)
+}
+
+func TestExtenderRejectsInvalidRequests(t *testing.T) {
+	server := newTestExtender(nil)
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/filter")
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusMethodNotAllowed, resp.StatusCode)
+
+	resp, err = http.Post(server.URL+"/prioritize", "application/json", bytes.NewReader([]byte(`{}`)))
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+}
+
+func TestCountFreeReplicas(t *testing.T) {
+	api := http.NewServeMux()
+	api.HandleFunc("/api/v1/nodes/node-a", func(w http.ResponseWriter, r *http.Request) {
+		w.Write(newExtenderNode("node-a", "8"))
+	})
+	api.HandleFunc("/api/v1/pods", func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "spec.nodeName=node-a", r.URL.Query().Get("fieldSelector"))
+		running, pending, succeeded := newExtenderPod("2", "1"), newExtenderPod("1"), newExtenderPod("4")
+		running.Status.Phase, pending.Status.Phase, succeeded.Status.Phase = "Running", "Pending", "Succeeded"
+		json.NewEncoder(w).Encode(map[string]interface{}{"items": []*Pod{running, pending, succeeded}})
+	})
+	server := httptest.NewServer(api)
+	defer server.Close()
+
+	client := NewKubeClient(server.URL, "", nil)
+	free, err := countFreeReplicas(context.Background(), client, "nvidia.com/gpu", "node-a")
+	require.NoError(t, err)
+	require.Equal(t, 4, free)
+
+	free, err = countFreeReplicas(context.Background(), client, "nvidia.com/mig-1g.5gb", "node-a")
+	require.NoError(t, err)
+	require.Equal(t, 0, free)
+
+	_, err = countFreeReplicas(context.Background(), client, "nvidia.com/gpu", "node-b")
+	require.Error(t, err)
+}
@@ -0,0 +1,92 @@
+/*
+ * Copyright (c) 2022, NVIDIA CORPORATION.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"runtime"
+	"time"
+)
+
+// goroutineCheckInterval is how often the number of goroutines is compared to --goroutine-alert-threshold
+const goroutineCheckInterval = 30 * time.Second
+
+// goroutineStacks returns the stack traces of all goroutines, growing the buffer until they fit
+func goroutineStacks() []byte {
+	buf := make([]byte, 1<<16)
+	for {
+		n := runtime.Stack(buf, true)
+		if n < len(buf) {
+			return buf[:n]
+		}
+		buf = make([]byte, 2*len(buf))
+	}
+}
+
+// goroutineWatcher logs a warning whenever the number of goroutines exceeds a threshold.
+// A steadily growing count usually points at leaked handlers, e.g. ListAndWatch streams that are never closed;
+// their stacks can be inspected on /debug/goroutines.
+type goroutineWatcher struct {
+	stop chan struct{}
+	done chan struct{}
+}
+
+// newGoroutineWatcher starts comparing the number of goroutines returned by 'count' to 'threshold' every 'interval'
+func newGoroutineWatcher(threshold int, interval time.Duration, count func() int) *goroutineWatcher {
+	w := &goroutineWatcher{
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	go func() {
+		defer close(w.done)
+		watchGoroutineCount(w.stop, threshold, interval, count)
+	}()
+	return w
+}
+
+// Stop stops the watcher and waits for it to return
+func (w *goroutineWatcher) Stop() {
+	close(w.stop)
+	<-w.done
+}
+
+// watchGoroutineCount logs a warning whenever the number of goroutines returned by 'count' exceeds 'threshold'
+// until 'stop' is closed
+func watchGoroutineCount(stop <-chan struct{}, threshold int, interval time.Duration, count func() int) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if n := count(); n > threshold {
+			slog.Warn("Goroutine count exceeds the threshold", logKeyEventType, "goroutine_threshold_exceeded", "goroutines", n, "threshold", threshold)
+		}
+
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (s *DebugServer) serveGoroutines(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if _, err := w.Write(goroutineStacks()); err != nil {
+		slog.Warn("Failed to write goroutine stacks", "error", err)
+	}
+}
@@ -0,0 +1,80 @@
+/*
+ * Copyright (c) 2022, NVIDIA CORPORATION.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestGoroutinesEndpoint(t *testing.T) {
+	// A goroutine parked in a recognizable function must show up in the dump
+	watcher := newGoroutineWatcher(1<<20, time.Hour, runtime.NumGoroutine)
+	defer watcher.Stop()
+
+	server := NewDebugServer()
+	get := func() *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		server.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/debug/goroutines", nil))
+		return rec
+	}
+
+	rec := get()
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Equal(t, "text/plain; charset=utf-8", rec.Header().Get("Content-Type"))
+	require.True(t, strings.HasPrefix(rec.Body.String(), "goroutine "), "unexpected dump: %s", rec.Body.String())
+	require.Contains(t, rec.Body.String(), "TestGoroutinesEndpoint")
+
+	require.Eventually(t, func() bool {
+		return strings.Contains(get().Body.String(), "watchGoroutineCount")
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestWatchGoroutineCount(t *testing.T) {
+	// With 'stop' already closed, the count is checked exactly once
+	stop := make(chan struct{})
+	close(stop)
+
+	logs := captureLog(t)
+	watchGoroutineCount(stop, 100, time.Hour, func() int { return 100 })
+	require.NotContains(t, logs.String(), "goroutine_threshold_exceeded")
+
+	watchGoroutineCount(stop, 100, time.Hour, func() int { return 150 })
+	require.Contains(t, logs.String(), "event_type=goroutine_threshold_exceeded goroutines=150 threshold=100")
+}
+
+func TestGoroutineWatcherStop(t *testing.T) {
+	var checks int32
+	watcher := newGoroutineWatcher(100, time.Millisecond, func() int {
+		atomic.AddInt32(&checks, 1)
+		return 0
+	})
+	require.Eventually(t, func() bool { return atomic.LoadInt32(&checks) > 1 }, 5*time.Second, time.Millisecond)
+
+	// No check runs once Stop returned
+	watcher.Stop()
+	n := atomic.LoadInt32(&checks)
+	time.Sleep(10 * time.Millisecond)
+	require.Equal(t, n, atomic.LoadInt32(&checks))
+}
@@ -0,0 +1,68 @@
+/*
+ * Copyright (c) 2022, NVIDIA CORPORATION.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"log/slog"
+	"time"
+)
+
+// healthCheckExecInterval is the time between two runs of the --healthcheck-exec script on a device
+const healthCheckExecInterval = 30 * time.Second
+
+// runHealthCheckExec runs the health check script for a device. The script fails the check by exiting
+// with a non-zero status or by not exiting within 'timeout', in which case it is killed.
+func runHealthCheckExec(script string, uuid string, timeout time.Duration) error {
+	return runCommandWithTimeout(timeout, script, uuid)
+}
+
+// checkHealthExec checks the health of the devices with an external script every 'interval' until 'stop' is closed.
+// Devices are reported unhealthy once they failed the number of consecutive checks set by --graceful-period-on-unhealthy.
+func checkHealthExec(stop <-chan interface{}, devices []*Device, unhealthy chan<- *Device, script string, timeout time.Duration, interval time.Duration, gracePeriod int) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	grace := newHealthGracePeriod(gracePeriod, 0)
+	for {
+		for _, d := range devices {
+			err := runHealthCheckExec(script, d.ID, timeout)
+			if err == nil {
+				slog.Debug("Health check passed", logKeyEventType, "health_check_passed", logKeyDeviceUUID, d.ID, "script", script)
+				grace.pass(d.ID)
+				continue
+			}
+			if !grace.fail(d.ID) {
+				slog.Warn("Health check failed", logKeyEventType, "health_check_failed", logKeyDeviceUUID, d.ID, "script", script, "failures", grace.count(d.ID), "threshold", grace.threshold, "error", err)
+				continue
+			}
+			slog.Error("Health check failed, the device will go unhealthy", logKeyEventType, "health_check_failed", logKeyDeviceUUID, d.ID, "script", script, "error", err)
+			uuid := d.ID
+			setHealthRecheck(uuid, func() error { return runHealthCheckExec(script, uuid, timeout) })
+			select {
+			case unhealthy <- d:
+			case <-stop:
+				return
+			}
+		}
+
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
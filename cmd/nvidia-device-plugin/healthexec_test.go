@@ -0,0 +1,75 @@
+/*
+ * Copyright (c) 2022, NVIDIA CORPORATION.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// writeHealthCheckScript writes an executable shell script with the given body and returns its path
+func writeHealthCheckScript(t *testing.T, body string) string {
+	path := filepath.Join(t.TempDir(), "check.sh")
+	require.NoError(t, ioutil.WriteFile(path, []byte("#!/bin/sh\n"+body+"\n"), 0755))
+	return path
+}
+
+func TestRunHealthCheckExec(t *testing.T) {
+	script := writeHealthCheckScript(t, `[ "$1" = "GPU-healthy" ]`)
+	require.NoError(t, runHealthCheckExec(script, "GPU-healthy", time.Second))
+	require.Error(t, runHealthCheckExec(script, "GPU-broken", time.Second))
+
+	slow := writeHealthCheckScript(t, "exec sleep 10")
+	start := time.Now()
+	err := runHealthCheckExec(slow, "GPU-slow", 50*time.Millisecond)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "timed out")
+	require.Less(t, int64(time.Since(start)), int64(5*time.Second))
+
+	require.Error(t, runHealthCheckExec(filepath.Join(t.TempDir(), "missing.sh"), "GPU-0", time.Second))
+}
+
+func TestCheckHealthExec(t *testing.T) {
+	resetHealthRechecks()
+	defer resetHealthRechecks()
+	script := writeHealthCheckScript(t, `[ "$1" != "GPU-1" ]`)
+	devices := []*Device{
+		{Device: newPluginDevice("GPU-0")},
+		{Device: newPluginDevice("GPU-1")},
+	}
+
+	stop := make(chan interface{})
+	defer close(stop)
+	unhealthy := make(chan *Device)
+	go checkHealthExec(stop, devices, unhealthy, script, time.Second, time.Millisecond, 2)
+
+	select {
+	case d := <-unhealthy:
+		require.Equal(t, "GPU-1", d.ID)
+	case <-time.After(5 * time.Second):
+		t.Fatal("failing device was not reported unhealthy")
+	}
+
+	// Recovering the device re-runs the script
+	recheck := healthRecheck("GPU-1")
+	require.NotNil(t, recheck)
+	require.Error(t, recheck())
+}
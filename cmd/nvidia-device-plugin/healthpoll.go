@@ -0,0 +1,86 @@
+/*
+ * Copyright (c) 2022, NVIDIA CORPORATION.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"log/slog"
+	"time"
+)
+
+// eventTypeDoubleBitEccError is nvmlEventTypeDoubleBitEccError, which the NVML bindings do not export
+const eventTypeDoubleBitEccError = 0x2
+
+// pollHealth checks the health of devices for which NVML events are unavailable every 'interval' until 'stop'
+// is closed. A check fails when the driver no longer responds to queries about the device, with 'probe', or when
+// the count of an Xid that is not in 'skippedXids' went up since the previous check, with 'readXIDs'. Devices are
+// reported unhealthy once they failed the number of consecutive checks set by --graceful-period-on-unhealthy.
+func pollHealth(stop <-chan interface{}, devices []*Device, unhealthy chan<- *Device, skippedXids map[uint64]bool, interval time.Duration, gracePeriod int,
+	probe func(d *Device) error, readXIDs func(busID string) (map[uint]uint64, error)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	// Xid counts only tell about errors that happened since the previous check
+	counts := make(map[string]map[uint]uint64)
+	for _, d := range devices {
+		if c, err := readXIDs(d.BusID); err == nil {
+			counts[d.ID] = c
+		}
+	}
+
+	grace := newHealthGracePeriod(gracePeriod, 0)
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		for _, d := range devices {
+			failure := ""
+			var xid uint
+			var recheck func() error
+			if err := probe(d); err != nil {
+				failure = err.Error()
+				d := d
+				recheck = func() error { return probe(d) }
+			} else if c, err := readXIDs(d.BusID); err == nil {
+				for code, count := range c {
+					if count > counts[d.ID][code] && !skippedXids[uint64(code)] {
+						failure, xid = "Xid error", code
+					}
+				}
+				counts[d.ID] = c
+			}
+
+			if failure == "" {
+				grace.pass(d.ID)
+				continue
+			}
+			if !grace.fail(d.ID) {
+				slog.Warn("Health check failed", logKeyEventType, "health_check_failed", logKeyDeviceUUID, d.ID, "xid", xid, "failures", grace.count(d.ID), "threshold", grace.threshold, "error", failure)
+				continue
+			}
+			slog.Error("Health check failed, the device will go unhealthy", logKeyEventType, "health_check_failed", logKeyDeviceUUID, d.ID, "xid", xid, "error", failure)
+			setHealthRecheck(d.ID, recheck)
+			select {
+			case unhealthy <- d:
+			case <-stop:
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,130 @@
+/*
+ * Copyright (c) 2022, NVIDIA CORPORATION.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPollHealth(t *testing.T) {
+	resetHealthRechecks()
+	defer resetHealthRechecks()
+	devices := []*Device{
+		{Device: newPluginDevice("GPU-probe"), BusID: "0"},
+		{Device: newPluginDevice("GPU-xid"), BusID: "1"},
+		{Device: newPluginDevice("GPU-skipped-xid"), BusID: "2"},
+		{Device: newPluginDevice("GPU-healthy"), BusID: "3"},
+	}
+
+	// Xid counts present at startup, and those of skipped Xids, do not fail the checks
+	var mutex sync.Mutex
+	reads := 0
+	readXIDs := func(busID string) (map[uint]uint64, error) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		reads++
+		switch {
+		case busID == "1" && reads > len(devices):
+			return map[uint]uint64{79: 2}, nil
+		case busID == "2" && reads > len(devices):
+			return map[uint]uint64{79: 1, 13: 5}, nil
+		default:
+			return map[uint]uint64{79: 1}, nil
+		}
+	}
+	probe := func(d *Device) error {
+		if d.ID == "GPU-probe" {
+			return fmt.Errorf("GPU is lost")
+		}
+		return nil
+	}
+
+	stop := make(chan interface{})
+	defer close(stop)
+	unhealthy := make(chan *Device)
+	go pollHealth(stop, devices, unhealthy, map[uint64]bool{13: true}, time.Millisecond, 1, probe, readXIDs)
+
+	var failed []string
+	for len(failed) < 2 {
+		select {
+		case d := <-unhealthy:
+			failed = append(failed, d.ID)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("failing devices were not reported unhealthy, got %v", failed)
+		}
+	}
+	require.ElementsMatch(t, []string{"GPU-probe", "GPU-xid"}, failed)
+
+	// Only probe failures can be rechecked, Xid errors are never recovered
+	require.NotNil(t, healthRecheck("GPU-probe"))
+	require.Nil(t, healthRecheck("GPU-xid"))
+
+	select {
+	case d := <-unhealthy:
+		t.Fatalf("%s reported unhealthy", d.ID)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestPollHealthGracePeriod(t *testing.T) {
+	resetHealthRechecks()
+	defer resetHealthRechecks()
+	devices := []*Device{{Device: newPluginDevice("GPU-0"), BusID: "0"}}
+
+	stop := make(chan interface{})
+	defer close(stop)
+
+	// Each check takes the next result, a passing check resetting the count of consecutive failures
+	results := make(chan error)
+	probe := func(d *Device) error {
+		select {
+		case err := <-results:
+			return err
+		case <-stop:
+			return nil
+		}
+	}
+	readXIDs := func(busID string) (map[uint]uint64, error) {
+		return map[uint]uint64{}, nil
+	}
+
+	unhealthy := make(chan *Device, 1)
+	go pollHealth(stop, devices, unhealthy, nil, time.Millisecond, 3, probe, readXIDs)
+
+	lost := fmt.Errorf("GPU is lost")
+	for _, err := range []error{lost, lost, nil, lost, lost} {
+		results <- err
+	}
+	select {
+	case <-unhealthy:
+		t.Fatal("device reported unhealthy before 3 consecutive failed checks")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	results <- lost
+	select {
+	case d := <-unhealthy:
+		require.Equal(t, "GPU-0", d.ID)
+	case <-time.After(5 * time.Second):
+		t.Fatal("device not reported unhealthy after 3 consecutive failed checks")
+	}
+}
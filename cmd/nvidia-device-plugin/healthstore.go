@@ -0,0 +1,103 @@
+/*
+ * Copyright (c) 2022, NVIDIA CORPORATION.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// defaultHealthHistorySize is the number of health transitions kept per device by default
+const defaultHealthHistorySize = 100
+
+// HealthTransition is a single change of the health of a device
+type HealthTransition struct {
+	DeviceID   string    `json:"deviceID"`
+	FromHealth string    `json:"fromHealth"`
+	ToHealth   string    `json:"toHealth"`
+	Timestamp  time.Time `json:"timestamp"`
+	Reason     string    `json:"reason"`
+}
+
+// DeviceHealthStore keeps the most recent health transitions of each device in a ring buffer
+// so that flapping devices can be investigated after the fact.
+type DeviceHealthStore struct {
+	sync.Mutex
+	size        int
+	transitions map[string][]*HealthTransition
+	next        map[string]int // position of the oldest transition once the buffer is full
+}
+
+// NewDeviceHealthStore returns an empty DeviceHealthStore keeping the last 'size' transitions per device
+func NewDeviceHealthStore(size int) *DeviceHealthStore {
+	if size <= 0 {
+		size = defaultHealthHistorySize
+	}
+	return &DeviceHealthStore{
+		size:        size,
+		transitions: make(map[string][]*HealthTransition),
+		next:        make(map[string]int),
+	}
+}
+
+// Record adds a health transition of a device, evicting its oldest transition if the buffer is full
+func (s *DeviceHealthStore) Record(deviceID string, from string, to string, reason string) {
+	s.Lock()
+	defer s.Unlock()
+
+	t := &HealthTransition{
+		DeviceID:   deviceID,
+		FromHealth: from,
+		ToHealth:   to,
+		Timestamp:  time.Now(),
+		Reason:     reason,
+	}
+
+	if len(s.transitions[deviceID]) < s.size {
+		s.transitions[deviceID] = append(s.transitions[deviceID], t)
+		return
+	}
+	s.transitions[deviceID][s.next[deviceID]] = t
+	s.next[deviceID] = (s.next[deviceID] + 1) % s.size
+}
+
+// History returns the recorded transitions of a device, oldest first
+func (s *DeviceHealthStore) History(deviceID string) []*HealthTransition {
+	s.Lock()
+	defer s.Unlock()
+
+	buffer := s.transitions[deviceID]
+	next := s.next[deviceID]
+	history := make([]*HealthTransition, 0, len(buffer))
+	history = append(history, buffer[next:]...)
+	history = append(history, buffer[:next]...)
+	return history
+}
+
+// DeviceIDs returns the sorted IDs of all devices with recorded transitions
+func (s *DeviceHealthStore) DeviceIDs() []string {
+	s.Lock()
+	defer s.Unlock()
+
+	var ids []string
+	for id := range s.transitions {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
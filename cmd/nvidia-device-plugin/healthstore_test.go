@@ -0,0 +1,78 @@
+/*
+ * Copyright (c) 2022, NVIDIA CORPORATION.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	config "github.com/NVIDIA/k8s-device-plugin/api/config/v1"
+	"github.com/stretchr/testify/require"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+func TestDeviceHealthStoreEvictsOldTransitions(t *testing.T) {
+	s := NewDeviceHealthStore(3)
+	require.Empty(t, s.History("GPU-a"))
+
+	for i := 0; i < 5; i++ {
+		s.Record("GPU-a", pluginapi.Healthy, pluginapi.Unhealthy, fmt.Sprintf("failure %d", i))
+	}
+	s.Record("GPU-b", pluginapi.Healthy, pluginapi.Unhealthy, "failure")
+
+	var reasons []string
+	for _, transition := range s.History("GPU-a") {
+		require.Equal(t, "GPU-a", transition.DeviceID)
+		reasons = append(reasons, transition.Reason)
+	}
+	require.Equal(t, []string{"failure 2", "failure 3", "failure 4"}, reasons)
+	require.Len(t, s.History("GPU-b"), 1)
+	require.Equal(t, []string{"GPU-a", "GPU-b"}, s.DeviceIDs())
+
+	require.Equal(t, defaultHealthHistorySize, NewDeviceHealthStore(0).size)
+}
+
+func TestHealthHistoryInDebugState(t *testing.T) {
+	m := newTestPlugin(config.CommandLineFlags{}, 2, &Device{Device: newPluginDevice("GPU-a")})
+	d := m.cachedDevices[0]
+
+	m.setHealth(d, pluginapi.Unhealthy, "health check failed")
+	// Setting the same health again is not a transition
+	m.setHealth(d, pluginapi.Unhealthy, "health check failed")
+
+	server := NewDebugServer()
+	server.SetPlugins([]*NvidiaDevicePlugin{m})
+	rec := httptest.NewRecorder()
+	server.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/debug/state", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	var state struct {
+		Plugins []*PluginState `json:"plugins"`
+	}
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &state))
+	require.Len(t, state.Plugins, 1)
+
+	history := state.Plugins[0].HealthHistory["GPU-a"]
+	require.Len(t, history, 1)
+	require.Equal(t, pluginapi.Healthy, history[0].FromHealth)
+	require.Equal(t, pluginapi.Unhealthy, history[0].ToHealth)
+	require.Equal(t, "health check failed", history[0].Reason)
+	require.False(t, history[0].Timestamp.IsZero())
+}
@@ -0,0 +1,155 @@
+/*
+ * Copyright (c) 2022, NVIDIA CORPORATION.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+// sendDevices sends the current device list to the kubelet, recording when it was last sent successfully for /healthz
+func (m *NvidiaDevicePlugin) sendDevices(s pluginapi.DevicePlugin_ListAndWatchServer) {
+	if err := s.Send(&pluginapi.ListAndWatchResponse{Devices: m.apiDevices()}); err != nil {
+		m.logger.Warn("Failed to send the device list to kubelet", logKeyEventType, "list_and_watch_send_failed", "error", err)
+		return
+	}
+	m.lastListAndWatchSend.Store(time.Now().UnixNano())
+}
+
+// checkLiveness returns an error unless the plugin is registered with the kubelet and sent it the device list within 'window'
+func (m *NvidiaDevicePlugin) checkLiveness(now time.Time, window time.Duration) error {
+	if !m.registered.Load() {
+		return fmt.Errorf("'%s' is not registered with the kubelet", m.Name())
+	}
+	last := m.lastListAndWatchSend.Load()
+	if last == 0 {
+		return fmt.Errorf("'%s' has not sent the device list to the kubelet yet", m.Name())
+	}
+	if elapsed := now.Sub(time.Unix(0, last)); elapsed > window {
+		return fmt.Errorf("'%s' last sent the device list to the kubelet %v ago", m.Name(), elapsed.Round(time.Second))
+	}
+	return nil
+}
+
+// healthyDeviceCount returns the number of healthy physical devices of the plugin
+func (m *NvidiaDevicePlugin) healthyDeviceCount() int {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	count := 0
+	for _, d := range m.cachedDevices {
+		if d.Health == pluginapi.Healthy {
+			count++
+		}
+	}
+	return count
+}
+
+// HealthzServer serves the liveness and readiness of the running plugins over HTTP
+type HealthzServer struct {
+	sync.Mutex
+	plugins []*NvidiaDevicePlugin
+	window  time.Duration
+	now     func() time.Time
+	mux     *http.ServeMux
+}
+
+// NewHealthzServer returns a HealthzServer requiring the plugins to have sent the device list within 'window'
+func NewHealthzServer(window time.Duration) *HealthzServer {
+	s := &HealthzServer{
+		window: window,
+		now:    time.Now,
+		mux:    http.NewServeMux(),
+	}
+	s.mux.HandleFunc("/healthz", s.serveHealthz)
+	s.mux.HandleFunc("/readyz", s.serveReadyz)
+	return s
+}
+
+// SetPlugins replaces the set of plugins checked by the server, which are those with devices to serve
+func (s *HealthzServer) SetPlugins(plugins []*NvidiaDevicePlugin) {
+	s.Lock()
+	defer s.Unlock()
+	s.plugins = plugins
+}
+
+// ListenAndServe serves the health endpoints on 'addr' in the background
+func (s *HealthzServer) ListenAndServe(addr string) {
+	go func() {
+		slog.Info("Starting healthz server", "addr", addr)
+		if err := http.ListenAndServe(addr, s.mux); err != nil {
+			slog.Error("Healthz server stopped", "addr", addr, "error", err)
+		}
+	}()
+}
+
+// ServeHTTP dispatches requests to the health endpoints
+func (s *HealthzServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.ServeHTTP(w, r)
+}
+
+func (s *HealthzServer) getPlugins() []*NvidiaDevicePlugin {
+	s.Lock()
+	defer s.Unlock()
+	return s.plugins
+}
+
+// liveness returns the reasons for which the plugins are not live
+func (s *HealthzServer) liveness(plugins []*NvidiaDevicePlugin) []string {
+	var failures []string
+	now := s.now()
+	for _, p := range plugins {
+		if err := p.checkLiveness(now, s.window); err != nil {
+			failures = append(failures, err.Error())
+		}
+	}
+	return failures
+}
+
+func (s *HealthzServer) serveHealthz(w http.ResponseWriter, r *http.Request) {
+	writeHealthz(w, s.liveness(s.getPlugins()))
+}
+
+func (s *HealthzServer) serveReadyz(w http.ResponseWriter, r *http.Request) {
+	plugins := s.getPlugins()
+	failures := s.liveness(plugins)
+	healthy := 0
+	for _, p := range plugins {
+		healthy += p.healthyDeviceCount()
+	}
+	if healthy == 0 {
+		failures = append(failures, "no healthy device")
+	}
+	writeHealthz(w, failures)
+}
+
+// writeHealthz answers 200 without failures, and 503 listing them otherwise
+func writeHealthz(w http.ResponseWriter, failures []string) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if len(failures) > 0 {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintln(w, strings.Join(failures, "\n"))
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
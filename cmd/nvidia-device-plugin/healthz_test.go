@@ -0,0 +1,106 @@
+/*
+ * Copyright (c) 2022, NVIDIA CORPORATION.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	config "github.com/NVIDIA/k8s-device-plugin/api/config/v1"
+	"github.com/stretchr/testify/require"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+func TestHealthz(t *testing.T) {
+	m := newTestPlugin(config.CommandLineFlags{}, 2,
+		&Device{Device: newPluginDevice("GPU-0")},
+		&Device{Device: newPluginDevice("GPU-1")},
+	)
+	now := time.Now()
+	s := NewHealthzServer(time.Minute)
+	s.now = func() time.Time { return now }
+	s.SetPlugins([]*NvidiaDevicePlugin{m})
+
+	get := func(path string) (int, string) {
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		return rec.Code, rec.Body.String()
+	}
+
+	code, body := get("/healthz")
+	require.Equal(t, http.StatusServiceUnavailable, code)
+	require.Contains(t, body, "is not registered with the kubelet")
+
+	m.registered.Store(true)
+	code, body = get("/healthz")
+	require.Equal(t, http.StatusServiceUnavailable, code)
+	require.Contains(t, body, "has not sent the device list to the kubelet yet")
+
+	m.sendDevices(newFakeListAndWatchServer())
+	now = time.Now()
+	code, _ = get("/healthz")
+	require.Equal(t, http.StatusOK, code)
+	code, _ = get("/readyz")
+	require.Equal(t, http.StatusOK, code)
+
+	// Readiness also requires a healthy device
+	m.setHealth(m.cachedDevices[0], pluginapi.Unhealthy, "test")
+	code, _ = get("/readyz")
+	require.Equal(t, http.StatusOK, code)
+	m.setHealth(m.cachedDevices[1], pluginapi.Unhealthy, "test")
+	code, body = get("/readyz")
+	require.Equal(t, http.StatusServiceUnavailable, code)
+	require.Contains(t, body, "no healthy device")
+	code, _ = get("/healthz")
+	require.Equal(t, http.StatusOK, code)
+
+	// A stream that stopped sending fails the liveness
+	now = now.Add(2 * time.Minute)
+	code, body = get("/healthz")
+	require.Equal(t, http.StatusServiceUnavailable, code)
+	require.Contains(t, body, "last sent the device list to the kubelet 2m0s ago")
+}
+
+func TestHealthzWithoutPlugins(t *testing.T) {
+	s := NewHealthzServer(time.Minute)
+
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	rec = httptest.NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	require.Equal(t, http.StatusServiceUnavailable, rec.Code)
+}
+
+func TestListAndWatchResync(t *testing.T) {
+	m := newTestPlugin(config.CommandLineFlags{HealthzAddr: ":2113", HealthzWindow: config.Duration(100 * time.Millisecond)}, 2,
+		&Device{Device: newPluginDevice("GPU-0")},
+	)
+
+	stream := newFakeListAndWatchServer()
+	go m.ListAndWatch(&pluginapi.Empty{}, stream)
+	defer close(m.stop)
+	require.NotNil(t, stream.next(time.Second))
+
+	// Without any change, the device list is sent again every half window
+	resp := stream.next(time.Second)
+	require.NotNil(t, resp)
+	require.Len(t, resp.Devices, 2)
+}
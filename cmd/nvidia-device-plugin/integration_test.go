@@ -0,0 +1,107 @@
+/*
+ * Copyright (c) 2022, NVIDIA CORPORATION.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	config "github.com/NVIDIA/k8s-device-plugin/api/config/v1"
+	kubelettesting "github.com/NVIDIA/k8s-device-plugin/testing"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+// newFakeKubelet starts a fake kubelet in a temporary plugin directory, stopped at the end of the test
+func newFakeKubelet(t *testing.T) (*kubelettesting.FakeKubelet, string) {
+	dir := t.TempDir()
+	kubelet, err := kubelettesting.NewFakeKubelet(dir)
+	require.NoError(t, err)
+	t.Cleanup(kubelet.Stop)
+	return kubelet, dir
+}
+
+func TestPluginLifecycle(t *testing.T) {
+	kubelet, dir := newFakeKubelet(t)
+
+	cfg := &config.Config{Flags: config.Flags{CommandLineFlags: &config.CommandLineFlags{
+		DeviceListStrategy:         DeviceListStrategyEnvvar,
+		DeviceIDStrategy:           DeviceIDStrategyUUID,
+		GRPCDialTimeout:            config.Duration(5 * time.Second),
+		KubeletRegistrationTimeout: config.Duration(5 * time.Second),
+		AllocationTimeout:          config.Duration(10 * time.Second),
+		GRPCStopTimeout:            config.Duration(5 * time.Second),
+	}}}
+	rm := &testResourceManager{devices: []*Device{
+		{Device: newPluginDevice("GPU-a"), Index: "0"},
+		{Device: newPluginDevice("GPU-b"), Index: "1"},
+	}}
+	m, err := NewNvidiaDevicePlugin(cfg, "nvidia.com/gpu", rm, "NVIDIA_VISIBLE_DEVICES", nil, filepath.Join(dir, "nvidia-gpu.sock"), 2, false, nil)
+	require.NoError(t, err)
+	m.simulateNVML()
+
+	// The plugin registers with the options of a replicated resource
+	require.NoError(t, m.Start())
+	registration, err := kubelet.NextRegistration(5 * time.Second)
+	require.NoError(t, err)
+	require.Equal(t, "nvidia.com/gpu", registration.ResourceName)
+	require.Equal(t, "nvidia-gpu.sock", registration.Endpoint)
+	require.True(t, registration.Options.GetPreferredAllocationAvailable)
+
+	client, err := kubelet.Connect(registration.Endpoint, 5*time.Second)
+	require.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stream, err := client.ListAndWatch(ctx, &pluginapi.Empty{})
+	require.NoError(t, err)
+	initial, err := stream.Recv()
+	require.NoError(t, err)
+	require.Len(t, initial.Devices, 4)
+
+	// A health event marks the replicas of the device unhealthy
+	m.health <- m.cachedDevices[1]
+	update, err := stream.Recv()
+	require.NoError(t, err)
+	health := make(map[string]string)
+	for _, d := range update.Devices {
+		health[d.ID] = d.Health
+	}
+	require.Equal(t, map[string]string{
+		"GPU-a-replica-0": pluginapi.Healthy,
+		"GPU-a-replica-1": pluginapi.Healthy,
+		"GPU-b-replica-0": pluginapi.Unhealthy,
+		"GPU-b-replica-1": pluginapi.Unhealthy,
+	}, health)
+
+	resp, err := client.Allocate(ctx, &pluginapi.AllocateRequest{
+		ContainerRequests: []*pluginapi.ContainerAllocateRequest{{DevicesIDs: []string{"GPU-a-replica-1"}}},
+	})
+	require.NoError(t, err)
+	require.Len(t, resp.ContainerResponses, 1)
+	require.Equal(t, map[string]string{"NVIDIA_VISIBLE_DEVICES": "GPU-a"}, resp.ContainerResponses[0].Envs)
+
+	// Stopping the plugin gracefully ends the stream and removes its socket
+	require.NoError(t, m.Stop())
+	_, err = stream.Recv()
+	require.Equal(t, io.EOF, err)
+	_, err = os.Stat(filepath.Join(dir, "nvidia-gpu.sock"))
+	require.True(t, os.IsNotExist(err), "%v", err)
+}
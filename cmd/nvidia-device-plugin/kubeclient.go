@@ -0,0 +1,525 @@
+/*
+ * Copyright (c) 2022, NVIDIA CORPORATION.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// Environment variables and paths used to reach the Kubernetes API server from within a pod
+const (
+	envKubernetesServiceHost = "KUBERNETES_SERVICE_HOST"
+	envKubernetesServicePort = "KUBERNETES_SERVICE_PORT"
+	envPodName               = "POD_NAME"
+	envPodNamespace          = "POD_NAMESPACE"
+	envNodeName              = "NODE_NAME"
+	serviceAccountDir        = "/var/run/secrets/kubernetes.io/serviceaccount"
+)
+
+// KubeClient is a minimal client for the handful of Kubernetes API calls made by the plugin
+type KubeClient struct {
+	host   string
+	token  string
+	client *http.Client
+}
+
+// NewKubeClient returns a KubeClient talking to the API server at 'host' using the bearer token 'token'
+func NewKubeClient(host string, token string, client *http.Client) *KubeClient {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return &KubeClient{
+		host:   strings.TrimSuffix(host, "/"),
+		token:  token,
+		client: client,
+	}
+}
+
+// NewInClusterKubeClient returns a KubeClient configured from the service account mounted into the pod
+func NewInClusterKubeClient() (*KubeClient, error) {
+	host, port := os.Getenv(envKubernetesServiceHost), os.Getenv(envKubernetesServicePort)
+	if host == "" || port == "" {
+		return nil, fmt.Errorf("not running in a cluster: %s and %s must be set", envKubernetesServiceHost, envKubernetesServicePort)
+	}
+
+	token, err := ioutil.ReadFile(filepath.Join(serviceAccountDir, "token"))
+	if err != nil {
+		return nil, fmt.Errorf("unable to read service account token: %v", err)
+	}
+
+	ca, err := ioutil.ReadFile(filepath.Join(serviceAccountDir, "ca.crt"))
+	if err != nil {
+		return nil, fmt.Errorf("unable to read service account CA: %v", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, fmt.Errorf("unable to parse service account CA")
+	}
+
+	client := &http.Client{
+		Timeout: 30 * time.Second,
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{RootCAs: pool},
+		},
+	}
+
+	return NewKubeClient("https://"+net.JoinHostPort(host, port), strings.TrimSpace(string(token)), client), nil
+}
+
+// KubeAPIError is returned when the API server answers with a non-2xx status code
+type KubeAPIError struct {
+	StatusCode int
+	Message    string
+}
+
+var _ error = &KubeAPIError{}
+
+func (e *KubeAPIError) Error() string {
+	return fmt.Sprintf("kubernetes API returned %d: %s", e.StatusCode, e.Message)
+}
+
+// kubeAPIRetryBackoff is the delay before the first retry of a request that failed with a transient error.
+// The delay doubles with every retry up to kubeAPIMaxRetryBackoff.
+var kubeAPIRetryBackoff = 100 * time.Millisecond
+
+const kubeAPIMaxRetryBackoff = 5 * time.Second
+
+// kubeAPIConflictRetries is the number of times retryOnConflict calls its function before giving up
+const kubeAPIConflictRetries = 5
+
+// isKubeAPIStatus returns whether 'err' is an answer of the API server with the given status code
+func isKubeAPIStatus(err error, statusCode int) bool {
+	var apiErr *KubeAPIError
+	return errors.As(err, &apiErr) && apiErr.StatusCode == statusCode
+}
+
+// retryOnConflict calls 'fn' again as long as it fails with a conflict, i.e. because the object it read
+// was modified before it could be written back, up to kubeAPIConflictRetries times
+func retryOnConflict(ctx context.Context, fn func() error) error {
+	backoff := kubeAPIRetryBackoff
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if !isKubeAPIStatus(err, http.StatusConflict) || attempt == kubeAPIConflictRetries {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("giving up after %d attempt(s): %v", attempt, err)
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+// isTransientKubeAPIError returns whether a request may succeed when retried, i.e. whether it failed
+// because the API server could not be reached, was unavailable or throttled the client. A POST is not
+// idempotent, so it is only retried when the API server cannot have created the object: when it
+// throttled the client or was unavailable, or when the connection failed before the request was sent.
+func isTransientKubeAPIError(method string, err error) bool {
+	var apiErr *KubeAPIError
+	if errors.As(err, &apiErr) {
+		if method == http.MethodPost {
+			return apiErr.StatusCode == http.StatusTooManyRequests || apiErr.StatusCode == http.StatusServiceUnavailable
+		}
+		return apiErr.StatusCode == http.StatusTooManyRequests || apiErr.StatusCode >= 500
+	}
+	if method == http.MethodPost {
+		var opErr *net.OpError
+		return errors.As(err, &opErr) && opErr.Op == "dial"
+	}
+	var urlErr *url.Error
+	return errors.As(err, &urlErr)
+}
+
+// do issues a request against the API server, encoding 'body' and decoding the response into 'out' as JSON.
+// Requests failing with a transient error are retried with exponential backoff until the context is done.
+func (k *KubeClient) do(ctx context.Context, method string, path string, contentType string, body interface{}, out interface{}) error {
+	var data []byte
+	if body != nil {
+		var err error
+		data, err = json.Marshal(body)
+		if err != nil {
+			return fmt.Errorf("unable to encode request body: %v", err)
+		}
+	}
+
+	backoff := kubeAPIRetryBackoff
+	for attempt := 1; ; attempt++ {
+		err := k.doOnce(ctx, method, path, contentType, data, out)
+		if err == nil || !isTransientKubeAPIError(method, err) {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("giving up after %d attempt(s): %v", attempt, err)
+		case <-time.After(backoff):
+		}
+
+		backoff *= 2
+		if backoff > kubeAPIMaxRetryBackoff {
+			backoff = kubeAPIMaxRetryBackoff
+		}
+	}
+}
+
+func (k *KubeClient) doOnce(ctx context.Context, method string, path string, contentType string, body []byte, out interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+
+	req, err := http.NewRequest(method, k.host+path, reader)
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", contentType)
+	}
+	if k.token != "" {
+		req.Header.Set("Authorization", "Bearer "+k.token)
+	}
+
+	resp, err := k.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("unable to read response body: %v", err)
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return &KubeAPIError{StatusCode: resp.StatusCode, Message: strings.TrimSpace(string(data))}
+	}
+
+	if out != nil {
+		if err := json.Unmarshal(data, out); err != nil {
+			return fmt.Errorf("unable to decode response body: %v", err)
+		}
+	}
+	return nil
+}
+
+// PatchPodLabels merges 'labels' into the labels of the pod 'namespace/name'
+func (k *KubeClient) PatchPodLabels(ctx context.Context, namespace string, name string, labels map[string]string) error {
+	patch := map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"labels": labels,
+		},
+	}
+	path := fmt.Sprintf("/api/v1/namespaces/%s/pods/%s", namespace, name)
+	return k.do(ctx, http.MethodPatch, path, "application/merge-patch+json", patch, nil)
+}
+
+// Event is the subset of a core/v1 Event set by the plugin
+type Event struct {
+	Metadata struct {
+		GenerateName string `json:"generateName"`
+		Namespace    string `json:"namespace"`
+	} `json:"metadata"`
+	InvolvedObject struct {
+		Kind string `json:"kind"`
+		Name string `json:"name"`
+	} `json:"involvedObject"`
+	Reason  string `json:"reason"`
+	Message string `json:"message"`
+	Type    string `json:"type"`
+	Source  struct {
+		Component string `json:"component"`
+		Host      string `json:"host,omitempty"`
+	} `json:"source"`
+	FirstTimestamp time.Time `json:"firstTimestamp"`
+	LastTimestamp  time.Time `json:"lastTimestamp"`
+	Count          int       `json:"count"`
+}
+
+// NewNodeEvent returns an event of type 'eventType' about the node 'node'.
+// Events about cluster-scoped objects such as nodes are recorded in the default namespace.
+func NewNodeEvent(node string, eventType string, reason string, message string) *Event {
+	now := time.Now().UTC()
+	e := &Event{
+		Reason:         reason,
+		Message:        message,
+		Type:           eventType,
+		FirstTimestamp: now,
+		LastTimestamp:  now,
+		Count:          1,
+	}
+	e.Metadata.GenerateName = node + "."
+	e.Metadata.Namespace = "default"
+	e.InvolvedObject.Kind = "Node"
+	e.InvolvedObject.Name = node
+	e.Source.Component = "nvidia-device-plugin"
+	e.Source.Host = node
+	return e
+}
+
+// CreateEvent records 'event' in its namespace
+func (k *KubeClient) CreateEvent(ctx context.Context, event *Event) error {
+	path := fmt.Sprintf("/api/v1/namespaces/%s/events", event.Metadata.Namespace)
+	return k.do(ctx, http.MethodPost, path, "application/json", event, nil)
+}
+
+// microTimeFormat is the serialization format of timestamps with microsecond precision, such as those of leases
+const microTimeFormat = "2006-01-02T15:04:05.000000Z07:00"
+
+// MicroTime wraps time.Time so that it is serialized with microsecond precision as expected by the API server
+type MicroTime struct {
+	time.Time
+}
+
+// MarshalJSON encodes a MicroTime as a string, or null if it is not set
+func (t MicroTime) MarshalJSON() ([]byte, error) {
+	if t.IsZero() {
+		return []byte("null"), nil
+	}
+	return json.Marshal(t.UTC().Format(microTimeFormat))
+}
+
+// UnmarshalJSON decodes a MicroTime from a string
+func (t *MicroTime) UnmarshalJSON(b []byte) error {
+	var value *string
+	if err := json.Unmarshal(b, &value); err != nil {
+		return err
+	}
+	if value == nil {
+		t.Time = time.Time{}
+		return nil
+	}
+	parsed, err := time.Parse(microTimeFormat, *value)
+	if err != nil {
+		return err
+	}
+	t.Time = parsed
+	return nil
+}
+
+// Lease is the subset of a coordination.k8s.io/v1 Lease used for leader election
+type Lease struct {
+	APIVersion string `json:"apiVersion"`
+	Kind       string `json:"kind"`
+	Metadata   struct {
+		Name            string `json:"name"`
+		Namespace       string `json:"namespace"`
+		ResourceVersion string `json:"resourceVersion,omitempty"`
+	} `json:"metadata"`
+	Spec struct {
+		HolderIdentity       string    `json:"holderIdentity"`
+		LeaseDurationSeconds int       `json:"leaseDurationSeconds"`
+		AcquireTime          MicroTime `json:"acquireTime"`
+		RenewTime            MicroTime `json:"renewTime"`
+		LeaseTransitions     int       `json:"leaseTransitions"`
+	} `json:"spec"`
+}
+
+// NewLease returns an empty lease 'namespace/name'
+func NewLease(namespace string, name string) *Lease {
+	l := &Lease{
+		APIVersion: "coordination.k8s.io/v1",
+		Kind:       "Lease",
+	}
+	l.Metadata.Name = name
+	l.Metadata.Namespace = namespace
+	return l
+}
+
+func leasePath(namespace string, name string) string {
+	path := fmt.Sprintf("/apis/coordination.k8s.io/v1/namespaces/%s/leases", namespace)
+	if name != "" {
+		path += "/" + name
+	}
+	return path
+}
+
+// GetLease returns the lease 'namespace/name'
+func (k *KubeClient) GetLease(ctx context.Context, namespace string, name string) (*Lease, error) {
+	var lease Lease
+	if err := k.do(ctx, http.MethodGet, leasePath(namespace, name), "", nil, &lease); err != nil {
+		return nil, err
+	}
+	return &lease, nil
+}
+
+// CreateLease creates 'lease' and returns it as stored by the API server
+func (k *KubeClient) CreateLease(ctx context.Context, lease *Lease) (*Lease, error) {
+	var created Lease
+	if err := k.do(ctx, http.MethodPost, leasePath(lease.Metadata.Namespace, ""), "application/json", lease, &created); err != nil {
+		return nil, err
+	}
+	return &created, nil
+}
+
+// UpdateLease replaces 'lease' and returns it as stored by the API server.
+// The update fails with a conflict if the lease was modified since it was read.
+func (k *KubeClient) UpdateLease(ctx context.Context, lease *Lease) (*Lease, error) {
+	var updated Lease
+	if err := k.do(ctx, http.MethodPut, leasePath(lease.Metadata.Namespace, lease.Metadata.Name), "application/json", lease, &updated); err != nil {
+		return nil, err
+	}
+	return &updated, nil
+}
+
+// Container is the subset of a core/v1 Container used to count the devices it requests
+type Container struct {
+	Name      string `json:"name"`
+	Resources struct {
+		Limits   map[string]string `json:"limits,omitempty"`
+		Requests map[string]string `json:"requests,omitempty"`
+	} `json:"resources"`
+}
+
+// Pod is the subset of a core/v1 Pod used to count the devices it requests
+type Pod struct {
+	Metadata struct {
+		Name      string `json:"name"`
+		Namespace string `json:"namespace"`
+	} `json:"metadata"`
+	Spec struct {
+		NodeName   string       `json:"nodeName,omitempty"`
+		Containers []*Container `json:"containers"`
+	} `json:"spec"`
+	Status struct {
+		Phase string `json:"phase,omitempty"`
+	} `json:"status"`
+}
+
+// Node is the subset of a core/v1 Node used to count the devices it provides and match its labels
+type Node struct {
+	Metadata struct {
+		Name   string            `json:"name"`
+		Labels map[string]string `json:"labels,omitempty"`
+	} `json:"metadata"`
+	Status struct {
+		Allocatable map[string]string `json:"allocatable,omitempty"`
+	} `json:"status"`
+}
+
+// GetNode returns the node 'name'
+func (k *KubeClient) GetNode(ctx context.Context, name string) (*Node, error) {
+	var node Node
+	if err := k.do(ctx, http.MethodGet, "/api/v1/nodes/"+name, "", nil, &node); err != nil {
+		return nil, err
+	}
+	return &node, nil
+}
+
+// ListNodePods returns the pods of all namespaces scheduled on the node 'node'
+func (k *KubeClient) ListNodePods(ctx context.Context, node string) ([]*Pod, error) {
+	var list struct {
+		Items []*Pod `json:"items"`
+	}
+	path := "/api/v1/pods?fieldSelector=" + url.QueryEscape("spec.nodeName="+node)
+	if err := k.do(ctx, http.MethodGet, path, "", nil, &list); err != nil {
+		return nil, err
+	}
+	return list.Items, nil
+}
+
+// ConfigMap is the subset of a core/v1 ConfigMap set by the plugin
+type ConfigMap struct {
+	APIVersion string `json:"apiVersion"`
+	Kind       string `json:"kind"`
+	Metadata   struct {
+		Name            string `json:"name"`
+		Namespace       string `json:"namespace"`
+		ResourceVersion string `json:"resourceVersion,omitempty"`
+	} `json:"metadata"`
+	Data map[string]string `json:"data"`
+}
+
+// NewConfigMap returns an empty ConfigMap 'namespace/name'
+func NewConfigMap(namespace string, name string) *ConfigMap {
+	cm := &ConfigMap{APIVersion: "v1", Kind: "ConfigMap", Data: make(map[string]string)}
+	cm.Metadata.Name = name
+	cm.Metadata.Namespace = namespace
+	return cm
+}
+
+func configMapPath(namespace string, name string) string {
+	path := fmt.Sprintf("/api/v1/namespaces/%s/configmaps", namespace)
+	if name != "" {
+		path += "/" + name
+	}
+	return path
+}
+
+// GetConfigMap returns the ConfigMap 'namespace/name'
+func (k *KubeClient) GetConfigMap(ctx context.Context, namespace string, name string) (*ConfigMap, error) {
+	var cm ConfigMap
+	if err := k.do(ctx, http.MethodGet, configMapPath(namespace, name), "", nil, &cm); err != nil {
+		return nil, err
+	}
+	return &cm, nil
+}
+
+// CreateConfigMap creates 'cm' and returns it as stored by the API server
+func (k *KubeClient) CreateConfigMap(ctx context.Context, cm *ConfigMap) (*ConfigMap, error) {
+	var created ConfigMap
+	if err := k.do(ctx, http.MethodPost, configMapPath(cm.Metadata.Namespace, ""), "application/json", cm, &created); err != nil {
+		return nil, err
+	}
+	return &created, nil
+}
+
+// UpdateConfigMap replaces 'cm' and returns it as stored by the API server.
+// The update fails with a conflict if the ConfigMap was modified since it was read.
+func (k *KubeClient) UpdateConfigMap(ctx context.Context, cm *ConfigMap) (*ConfigMap, error) {
+	var updated ConfigMap
+	if err := k.do(ctx, http.MethodPut, configMapPath(cm.Metadata.Namespace, cm.Metadata.Name), "application/json", cm, &updated); err != nil {
+		return nil, err
+	}
+	return &updated, nil
+}
+
+// UpsertConfigMapData merges 'data' into the ConfigMap 'namespace/name', creating it if it does not exist.
+// Keys of the ConfigMap that are not in 'data' are left untouched.
+func (k *KubeClient) UpsertConfigMapData(ctx context.Context, namespace string, name string, data map[string]string) error {
+	patch := map[string]interface{}{"data": data}
+	err := k.do(ctx, http.MethodPatch, configMapPath(namespace, name), "application/merge-patch+json", patch, nil)
+
+	var apiErr *KubeAPIError
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusNotFound {
+		return err
+	}
+
+	cm := NewConfigMap(namespace, name)
+	cm.Data = data
+	_, err = k.CreateConfigMap(ctx, cm)
+	return err
+}
@@ -0,0 +1,373 @@
+/*
+ * Copyright (c) 2022, NVIDIA CORPORATION.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+// fakePod is the subset of a Pod object stored by the fake API server
+type fakePod struct {
+	Metadata struct {
+		Name      string            `json:"name"`
+		Namespace string            `json:"namespace"`
+		Labels    map[string]string `json:"labels,omitempty"`
+	} `json:"metadata"`
+}
+
+// fakeKubeAPI is a fake API server holding a set of pods, leases and ConfigMaps keyed by their path and the events created through it.
+// The first 'unavailable' requests are answered with 503 Service Unavailable.
+type fakeKubeAPI struct {
+	sync.Mutex
+	pods        map[string]*fakePod
+	leases      map[string]*Lease
+	configMaps  map[string]*ConfigMap
+	events      []*Event
+	unavailable int
+	requests    int
+}
+
+func newFakeKubeAPI() *fakeKubeAPI {
+	return &fakeKubeAPI{pods: make(map[string]*fakePod), leases: make(map[string]*Lease), configMaps: make(map[string]*ConfigMap)}
+}
+
+func (f *fakeKubeAPI) addPod(namespace, name string, labels map[string]string) {
+	pod := &fakePod{}
+	pod.Metadata.Name = name
+	pod.Metadata.Namespace = namespace
+	pod.Metadata.Labels = labels
+	f.pods["/api/v1/namespaces/"+namespace+"/pods/"+name] = pod
+}
+
+func (f *fakeKubeAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.Lock()
+	defer f.Unlock()
+
+	f.requests++
+	if f.requests <= f.unavailable {
+		http.Error(w, "leader election in progress", http.StatusServiceUnavailable)
+		return
+	}
+
+	if r.Method == http.MethodPost && strings.HasSuffix(r.URL.Path, "/events") {
+		var event Event
+		if err := json.NewDecoder(r.Body).Decode(&event); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if r.URL.Path != "/api/v1/namespaces/"+event.Metadata.Namespace+"/events" {
+			http.Error(w, "namespace mismatch", http.StatusBadRequest)
+			return
+		}
+		f.events = append(f.events, &event)
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(event)
+		return
+	}
+
+	if strings.HasPrefix(r.URL.Path, "/apis/coordination.k8s.io/v1/") {
+		f.serveLease(w, r)
+		return
+	}
+
+	if strings.Contains(r.URL.Path, "/configmaps") {
+		f.serveConfigMap(w, r)
+		return
+	}
+
+	pod, exists := f.pods[r.URL.Path]
+	if !exists {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPatch:
+		if r.Header.Get("Content-Type") != "application/merge-patch+json" {
+			http.Error(w, "unsupported patch type", http.StatusUnsupportedMediaType)
+			return
+		}
+		var patch fakePod
+		if err := json.NewDecoder(r.Body).Decode(&patch); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if pod.Metadata.Labels == nil {
+			pod.Metadata.Labels = make(map[string]string)
+		}
+		for k, v := range patch.Metadata.Labels {
+			pod.Metadata.Labels[k] = v
+		}
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	json.NewEncoder(w).Encode(pod)
+}
+
+// serveLease implements the lease API, rejecting updates to leases modified since they were read
+func (f *fakeKubeAPI) serveLease(w http.ResponseWriter, r *http.Request) {
+	var lease *Lease
+	if r.Method == http.MethodPost || r.Method == http.MethodPut {
+		lease = &Lease{}
+		if err := json.NewDecoder(r.Body).Decode(lease); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		stored, exists := f.leases[r.URL.Path]
+		if !exists {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		lease = stored
+	case http.MethodPost:
+		path := leasePath(lease.Metadata.Namespace, lease.Metadata.Name)
+		if _, exists := f.leases[path]; exists {
+			http.Error(w, "already exists", http.StatusConflict)
+			return
+		}
+		lease.Metadata.ResourceVersion = "1"
+		f.leases[path] = lease
+	case http.MethodPut:
+		stored, exists := f.leases[r.URL.Path]
+		if !exists {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		if lease.Metadata.ResourceVersion != stored.Metadata.ResourceVersion {
+			http.Error(w, "the object has been modified", http.StatusConflict)
+			return
+		}
+		version, _ := strconv.Atoi(stored.Metadata.ResourceVersion)
+		lease.Metadata.ResourceVersion = strconv.Itoa(version + 1)
+		f.leases[r.URL.Path] = lease
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	json.NewEncoder(w).Encode(lease)
+}
+
+// serveConfigMap implements the ConfigMap API, rejecting updates to ConfigMaps modified since they were read
+func (f *fakeKubeAPI) serveConfigMap(w http.ResponseWriter, r *http.Request) {
+	cm := &ConfigMap{}
+	if r.Method != http.MethodGet {
+		if err := json.NewDecoder(r.Body).Decode(cm); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		stored, exists := f.configMaps[r.URL.Path]
+		if !exists {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		cm = stored
+	case http.MethodPost:
+		path := r.URL.Path + "/" + cm.Metadata.Name
+		if _, exists := f.configMaps[path]; exists {
+			http.Error(w, "already exists", http.StatusConflict)
+			return
+		}
+		cm.Metadata.ResourceVersion = "1"
+		f.configMaps[path] = cm
+	case http.MethodPut:
+		stored, exists := f.configMaps[r.URL.Path]
+		if !exists {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		if cm.Metadata.ResourceVersion != stored.Metadata.ResourceVersion {
+			http.Error(w, "the object has been modified", http.StatusConflict)
+			return
+		}
+		cm.Metadata.ResourceVersion = nextResourceVersion(stored.Metadata.ResourceVersion)
+		f.configMaps[r.URL.Path] = cm
+	case http.MethodPatch:
+		stored, exists := f.configMaps[r.URL.Path]
+		if !exists {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		for k, v := range cm.Data {
+			stored.Data[k] = v
+		}
+		stored.Metadata.ResourceVersion = nextResourceVersion(stored.Metadata.ResourceVersion)
+		cm = stored
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	json.NewEncoder(w).Encode(cm)
+}
+
+func nextResourceVersion(version string) string {
+	v, _ := strconv.Atoi(version)
+	return strconv.Itoa(v + 1)
+}
+
+func TestPatchPodLabels(t *testing.T) {
+	api := newFakeKubeAPI()
+	api.addPod("kube-system", "nvidia-device-plugin-abcde", map[string]string{"app": "nvidia-device-plugin"})
+	server := httptest.NewServer(api)
+	defer server.Close()
+
+	client := NewKubeClient(server.URL, "", server.Client())
+
+	labels, err := parsePluginLabels([]string{"nvidia.com/resource=gpu", "tier = shared"})
+	require.NoError(t, err)
+
+	err = client.PatchPodLabels(context.Background(), "kube-system", "nvidia-device-plugin-abcde", labels)
+	require.NoError(t, err)
+
+	pod := api.pods["/api/v1/namespaces/kube-system/pods/nvidia-device-plugin-abcde"]
+	require.Equal(t, map[string]string{
+		"app":                 "nvidia-device-plugin",
+		"nvidia.com/resource": "gpu",
+		"tier":                "shared",
+	}, pod.Metadata.Labels)
+
+	err = client.PatchPodLabels(context.Background(), "kube-system", "missing", labels)
+	require.Error(t, err)
+	apiErr, ok := err.(*KubeAPIError)
+	require.True(t, ok)
+	require.Equal(t, http.StatusNotFound, apiErr.StatusCode)
+}
+
+func TestKubeClientRetriesTransientErrors(t *testing.T) {
+	defer func(backoff time.Duration) { kubeAPIRetryBackoff = backoff }(kubeAPIRetryBackoff)
+	kubeAPIRetryBackoff = time.Millisecond
+
+	api := newFakeKubeAPI()
+	api.addPod("default", "gpu-pod", nil)
+	api.unavailable = 2
+	server := httptest.NewServer(api)
+	defer server.Close()
+
+	client := NewKubeClient(server.URL, "", server.Client())
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	err := client.PatchPodLabels(ctx, "default", "gpu-pod", map[string]string{"nvidia.com/gpu": "GPU-a"})
+	require.NoError(t, err)
+	require.Equal(t, 3, api.requests)
+	require.Equal(t, map[string]string{"nvidia.com/gpu": "GPU-a"}, api.pods["/api/v1/namespaces/default/pods/gpu-pod"].Metadata.Labels)
+
+	// Once the deadline is exceeded the last error is returned
+	api.requests = 0
+	api.unavailable = 1000
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	err = client.PatchPodLabels(ctx, "default", "gpu-pod", map[string]string{"nvidia.com/gpu": "GPU-b"})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "giving up after")
+	require.Greater(t, api.requests, 1)
+	require.Equal(t, "GPU-a", api.pods["/api/v1/namespaces/default/pods/gpu-pod"].Metadata.Labels["nvidia.com/gpu"])
+}
+
+func TestKubeClientRetriesPostsOnlyBeforeCreation(t *testing.T) {
+	defer func(backoff time.Duration) { kubeAPIRetryBackoff = backoff }(kubeAPIRetryBackoff)
+	kubeAPIRetryBackoff = time.Millisecond
+
+	// A POST answered with 503 was not processed, so it is retried
+	api := newFakeKubeAPI()
+	api.unavailable = 2
+	server := httptest.NewServer(api)
+	defer server.Close()
+
+	client := NewKubeClient(server.URL, "", server.Client())
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	err := client.CreateEvent(ctx, NewNodeEvent("node-1", "Normal", "GPUAllocated", "Device GPU-0 allocated"))
+	require.NoError(t, err)
+	require.Equal(t, 3, api.requests)
+	require.Len(t, api.events, 1)
+
+	// A POST failing with another server error may have created the object, so it is not retried
+	var requests int
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		http.Error(w, "internal error", http.StatusInternalServerError)
+	}))
+	defer failing.Close()
+
+	client = NewKubeClient(failing.URL, "", failing.Client())
+	err = client.CreateEvent(ctx, NewNodeEvent("node-1", "Normal", "GPUAllocated", "Device GPU-0 allocated"))
+	require.True(t, isKubeAPIStatus(err, http.StatusInternalServerError))
+	require.Equal(t, 1, requests)
+
+	// A POST whose connection could not be established was never sent, so it is retried
+	closed := httptest.NewServer(api)
+	closed.Close()
+	client = NewKubeClient(closed.URL, "", closed.Client())
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	err = client.CreateEvent(ctx, NewNodeEvent("node-1", "Normal", "GPUAllocated", "Device GPU-0 allocated"))
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "giving up after")
+}
+
+func TestCreateEvent(t *testing.T) {
+	api := newFakeKubeAPI()
+	server := httptest.NewServer(api)
+	defer server.Close()
+
+	client := NewKubeClient(server.URL, "", server.Client())
+	err := client.CreateEvent(context.Background(), NewNodeEvent("node-1", "Warning", "GPUXidError", "Device GPU-0 reported Xid 79"))
+	require.NoError(t, err)
+
+	require.Len(t, api.events, 1)
+	event := api.events[0]
+	require.Equal(t, "default", event.Metadata.Namespace)
+	require.Equal(t, "Node", event.InvolvedObject.Kind)
+	require.Equal(t, "node-1", event.InvolvedObject.Name)
+	require.Equal(t, "Warning", event.Type)
+	require.Equal(t, "GPUXidError", event.Reason)
+}
+
+func TestParsePluginLabels(t *testing.T) {
+	_, err := parsePluginLabels([]string{"novalue"})
+	require.Error(t, err)
+
+	_, err = parsePluginLabels([]string{"=value"})
+	require.Error(t, err)
+
+	labels, err := parsePluginLabels([]string{"a=b", "c="})
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{"a": "b", "c": ""}, labels)
+}
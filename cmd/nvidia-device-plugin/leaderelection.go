@@ -0,0 +1,231 @@
+/*
+ * Copyright (c) 2022, NVIDIA CORPORATION.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	config "github.com/NVIDIA/k8s-device-plugin/api/config/v1"
+	"golang.org/x/net/context"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+// Timings of the leader election enabled with --leader-election. The leader steps down once it could not
+// renew the lease for the renew deadline, before another pod may take it over at the end of the lease duration.
+const (
+	leaderElectionLeaseDuration = 15 * time.Second
+	leaderElectionRenewDeadline = 10 * time.Second
+	leaderElectionRetryPeriod   = 2 * time.Second
+)
+
+// leaderElectionLeaseName returns the name of the lease electing the active plugin on 'node'
+func leaderElectionLeaseName(node string) string {
+	return "gpu-sharing-plugin-" + node
+}
+
+// LeaderElector elects a single active plugin among the plugin pods running on a node through a Lease.
+// The lease is held by the leader as long as it keeps renewing it within the lease duration.
+type LeaderElector struct {
+	client        *KubeClient
+	namespace     string
+	name          string
+	identity      string
+	leaseDuration time.Duration
+	renewDeadline time.Duration
+	now           func() time.Time
+}
+
+// NewLeaderElector returns a LeaderElector competing for the lease 'namespace/name' as 'identity'
+func NewLeaderElector(client *KubeClient, namespace string, name string, identity string) *LeaderElector {
+	return &LeaderElector{
+		client:        client,
+		namespace:     namespace,
+		name:          name,
+		identity:      identity,
+		leaseDuration: leaderElectionLeaseDuration,
+		renewDeadline: leaderElectionRenewDeadline,
+		now:           time.Now,
+	}
+}
+
+// NewInClusterLeaderElector returns a LeaderElector for the node and pod named by the environment
+func NewInClusterLeaderElector() (*LeaderElector, error) {
+	node, namespace := os.Getenv(envNodeName), os.Getenv(envPodNamespace)
+	if node == "" || namespace == "" {
+		return nil, fmt.Errorf("%s and %s must be set", envNodeName, envPodNamespace)
+	}
+
+	identity := os.Getenv(envPodName)
+	if identity == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return nil, fmt.Errorf("unable to determine identity: %v", err)
+		}
+		identity = hostname
+	}
+
+	client, err := NewInClusterKubeClient()
+	if err != nil {
+		return nil, err
+	}
+	return NewLeaderElector(client, namespace, leaderElectionLeaseName(node), identity), nil
+}
+
+// tryAcquireOrRenew attempts to acquire the lease, or to renew it if it is already held.
+// It returns whether the lease is held once the attempt completes.
+func (e *LeaderElector) tryAcquireOrRenew(ctx context.Context) (bool, error) {
+	now := MicroTime{e.now()}
+
+	lease, err := e.client.GetLease(ctx, e.namespace, e.name)
+	var apiErr *KubeAPIError
+	if errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusNotFound {
+		lease = NewLease(e.namespace, e.name)
+		lease.Spec.HolderIdentity = e.identity
+		lease.Spec.LeaseDurationSeconds = int(e.leaseDuration / time.Second)
+		lease.Spec.AcquireTime = now
+		lease.Spec.RenewTime = now
+		if _, err := e.client.CreateLease(ctx, lease); err != nil {
+			return false, fmt.Errorf("unable to create lease: %v", err)
+		}
+		return true, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("unable to get lease: %v", err)
+	}
+
+	if lease.Spec.HolderIdentity != e.identity {
+		duration := time.Duration(lease.Spec.LeaseDurationSeconds) * time.Second
+		if lease.Spec.HolderIdentity != "" && lease.Spec.RenewTime.Add(duration).After(now.Time) {
+			return false, nil
+		}
+		lease.Spec.HolderIdentity = e.identity
+		lease.Spec.AcquireTime = now
+		lease.Spec.LeaseTransitions++
+	}
+	lease.Spec.LeaseDurationSeconds = int(e.leaseDuration / time.Second)
+	lease.Spec.RenewTime = now
+
+	if _, err := e.client.UpdateLease(ctx, lease); err != nil {
+		if errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusConflict {
+			return false, nil
+		}
+		return false, fmt.Errorf("unable to update lease: %v", err)
+	}
+	return true, nil
+}
+
+// Run competes for the lease every 'interval' until 'stop' is closed. 'started' is called once the
+// lease is acquired. 'stopped' is called, and Run returns, once the lease is lost, i.e. once it is
+// taken over by another pod or could not be renewed within the renew deadline.
+func (e *LeaderElector) Run(stop <-chan interface{}, interval time.Duration, started func(), stopped func()) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	leading := false
+	var renewed time.Time
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), interval)
+		held, err := e.tryAcquireOrRenew(ctx)
+		cancel()
+		if err != nil {
+			slog.Warn("Leader election failed", logKeyEventType, "leader_election_failed", "lease", e.namespace+"/"+e.name, "error", err)
+		}
+
+		switch {
+		case held:
+			renewed = e.now()
+			if !leading {
+				slog.Info("Acquired lease", logKeyEventType, "leader_elected", "lease", e.namespace+"/"+e.name, "identity", e.identity)
+				leading = true
+				started()
+			}
+		case leading && (err == nil || e.now().Sub(renewed) > e.renewDeadline):
+			slog.Warn("Lost lease", logKeyEventType, "leadership_lost", "lease", e.namespace+"/"+e.name)
+			stopped()
+			return
+		}
+
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Standby runs the health checks of the plugin without serving it until 'stop' is closed, so that a pod
+// waiting to become the leader under --leader-election logs the failing devices and records their events
+// before it takes over. The health of the devices is not carried over once the plugin is started.
+func (m *NvidiaDevicePlugin) Standby(stop <-chan struct{}) {
+	m.initialize()
+	defer func() {
+		close(m.stop)
+		m.cleanup()
+	}()
+
+	if (m.config.Flags.WatchXIDErrors || m.config.Flags.EmitK8sDeviceEvents) && m.events == nil {
+		m.events = sharedNodeEventRecorder()
+	}
+	m.startHealthChecks()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case d := <-m.health:
+			m.setHealth(d, pluginapi.Unhealthy, "health check failed")
+			m.logger.Warn("Device marked unhealthy on standby", logKeyEventType, "device_unhealthy", logKeyDeviceUUID, d.ID)
+			m.recordUnhealthyEvent(d)
+		}
+	}
+}
+
+// startStandby runs the health checks of the plugins with devices to serve in the background until the
+// returned function is called, which waits for them to stop
+func startStandby(config *config.Config) (func(), error) {
+	migStrategy, err := NewMigStrategy(config, resourceConfig)
+	if err != nil {
+		return nil, fmt.Errorf("error creating MIG strategy: %v", err)
+	}
+	plugins, err := migStrategy.GetPlugins()
+	if err != nil {
+		return nil, fmt.Errorf("error creating plugins: %v", err)
+	}
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for _, p := range plugins {
+		if p.servedDeviceCount() == 0 {
+			continue
+		}
+		wg.Add(1)
+		go func(p *NvidiaDevicePlugin) {
+			defer wg.Done()
+			p.Standby(stop)
+		}(p)
+	}
+	return func() {
+		close(stop)
+		wg.Wait()
+	}, nil
+}
@@ -0,0 +1,235 @@
+/*
+ * Copyright (c) 2022, NVIDIA CORPORATION.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	config "github.com/NVIDIA/k8s-device-plugin/api/config/v1"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+// fakeClock is a manually advanced clock shared by the electors of a test
+type fakeClock struct {
+	sync.Mutex
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.Lock()
+	defer c.Unlock()
+	return c.now
+}
+
+// advance moves the clock forward while electors may be reading it
+func (c *fakeClock) advance(d time.Duration) {
+	c.Lock()
+	defer c.Unlock()
+	c.now = c.now.Add(d)
+}
+
+func newTestLeaderElector(client *KubeClient, identity string, clock *fakeClock) *LeaderElector {
+	e := NewLeaderElector(client, "kube-system", leaderElectionLeaseName("node-1"), identity)
+	e.now = clock.Now
+	return e
+}
+
+func TestLeaderElectionTransition(t *testing.T) {
+	api := newFakeKubeAPI()
+	server := httptest.NewServer(api)
+	defer server.Close()
+
+	client := NewKubeClient(server.URL, "", server.Client())
+	clock := &fakeClock{now: time.Date(2022, 6, 1, 12, 0, 0, 0, time.UTC)}
+	a := newTestLeaderElector(client, "plugin-a", clock)
+	b := newTestLeaderElector(client, "plugin-b", clock)
+	ctx := context.Background()
+
+	held, err := a.tryAcquireOrRenew(ctx)
+	require.NoError(t, err)
+	require.True(t, held)
+
+	held, err = b.tryAcquireOrRenew(ctx)
+	require.NoError(t, err)
+	require.False(t, held)
+
+	// The leader keeps the lease as long as it renews it
+	clock.now = clock.now.Add(10 * time.Second)
+	held, err = a.tryAcquireOrRenew(ctx)
+	require.NoError(t, err)
+	require.True(t, held)
+
+	clock.now = clock.now.Add(10 * time.Second)
+	held, err = b.tryAcquireOrRenew(ctx)
+	require.NoError(t, err)
+	require.False(t, held)
+
+	// Once the leader stops renewing, the lease expires and the standby takes over
+	clock.now = clock.now.Add(leaderElectionLeaseDuration)
+	held, err = b.tryAcquireOrRenew(ctx)
+	require.NoError(t, err)
+	require.True(t, held)
+
+	held, err = a.tryAcquireOrRenew(ctx)
+	require.NoError(t, err)
+	require.False(t, held)
+
+	lease, err := client.GetLease(ctx, "kube-system", "gpu-sharing-plugin-node-1")
+	require.NoError(t, err)
+	require.Equal(t, "plugin-b", lease.Spec.HolderIdentity)
+	require.Equal(t, 1, lease.Spec.LeaseTransitions)
+	require.True(t, clock.now.Equal(lease.Spec.AcquireTime.Time))
+	require.Equal(t, int(leaderElectionLeaseDuration/time.Second), lease.Spec.LeaseDurationSeconds)
+}
+
+func TestLeaderElectorRun(t *testing.T) {
+	api := newFakeKubeAPI()
+	server := httptest.NewServer(api)
+	defer server.Close()
+
+	client := NewKubeClient(server.URL, "", server.Client())
+	clock := &fakeClock{now: time.Date(2022, 6, 1, 12, 0, 0, 0, time.UTC)}
+	a := newTestLeaderElector(client, "plugin-a", clock)
+	b := newTestLeaderElector(client, "plugin-b", clock)
+
+	stop := make(chan interface{})
+	close(stop)
+
+	// With a closed stop channel, Run makes a single attempt
+	var started, stopped int
+	a.Run(stop, time.Hour, func() { started++ }, func() { stopped++ })
+	require.Equal(t, 1, started)
+	require.Equal(t, 0, stopped)
+
+	b.Run(stop, time.Hour, func() { started++ }, func() { stopped++ })
+	require.Equal(t, 1, started)
+
+	// The lease expires and the standby takes over
+	clock.now = clock.now.Add(2 * leaderElectionLeaseDuration)
+	b.Run(stop, time.Hour, func() { started++ }, func() { stopped++ })
+	require.Equal(t, 2, started)
+	require.Equal(t, 0, stopped)
+}
+
+func TestLeaderElectorStepsDown(t *testing.T) {
+	api := newFakeKubeAPI()
+	server := httptest.NewServer(api)
+	defer server.Close()
+
+	client := NewKubeClient(server.URL, "", server.Client())
+	clock := &fakeClock{now: time.Date(2022, 6, 1, 12, 0, 0, 0, time.UTC)}
+	a := newTestLeaderElector(client, "plugin-a", clock)
+
+	started, stopped := make(chan struct{}), make(chan struct{})
+	go a.Run(make(chan interface{}), time.Millisecond, func() { close(started) }, func() { close(stopped) })
+	<-started
+
+	// Another pod takes over the lease behind the back of the leader
+	require.Eventually(t, func() bool {
+		lease, err := client.GetLease(context.Background(), "kube-system", "gpu-sharing-plugin-node-1")
+		if err != nil {
+			return false
+		}
+		lease.Spec.HolderIdentity = "plugin-b"
+		_, err = client.UpdateLease(context.Background(), lease)
+		return err == nil
+	}, 10*time.Second, time.Millisecond)
+
+	select {
+	case <-stopped:
+	case <-time.After(10 * time.Second):
+		t.Fatal("leader did not step down")
+	}
+}
+
+func TestLeaderElectorRenewDeadline(t *testing.T) {
+	api := newFakeKubeAPI()
+	var failing atomic.Bool
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if failing.Load() {
+			http.Error(w, "etcd unavailable", http.StatusInternalServerError)
+			return
+		}
+		api.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+
+	client := NewKubeClient(server.URL, "", server.Client())
+	clock := &fakeClock{now: time.Date(2022, 6, 1, 12, 0, 0, 0, time.UTC)}
+	a := newTestLeaderElector(client, "plugin-a", clock)
+
+	started, stopped := make(chan struct{}), make(chan struct{})
+	go a.Run(make(chan interface{}), time.Millisecond, func() { close(started) }, func() { close(stopped) })
+	<-started
+
+	// Failing renewals are retried up to the renew deadline
+	failing.Store(true)
+	clock.advance(leaderElectionRenewDeadline / 2)
+	select {
+	case <-stopped:
+		t.Fatal("leader stepped down before the renew deadline")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// The leader steps down before the lease expires and another pod may take over
+	clock.advance(leaderElectionRenewDeadline/2 + time.Second)
+	select {
+	case <-stopped:
+	case <-time.After(10 * time.Second):
+		t.Fatal("leader did not step down at the renew deadline")
+	}
+}
+
+func TestStandbyRunsHealthChecks(t *testing.T) {
+	m := newTestPlugin(config.CommandLineFlags{EmitK8sDeviceEvents: true}, 2,
+		&Device{Device: newPluginDevice("GPU-a")}, &Device{Device: newPluginDevice("GPU-b")})
+	m.cleanup()
+	events := &fakeEventRecorder{}
+	m.events = events
+	m.ResourceManager.(*testResourceManager).unhealthy = []string{"GPU-a"}
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		m.Standby(stop)
+		close(done)
+	}()
+
+	require.Eventually(t, func() bool {
+		events.Lock()
+		defer events.Unlock()
+		return len(events.warnings) == 1
+	}, 5*time.Second, time.Millisecond)
+	require.Equal(t, "GPUDeviceUnhealthy: Device GPU-a of 'nvidia.com/gpu' is unhealthy", events.warnings[0])
+
+	// The plugin is neither served nor registered, and is left clean for the leader to start it
+	require.False(t, m.registered.Load())
+	close(stop)
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("standby did not stop")
+	}
+	require.Nil(t, m.server)
+	require.Nil(t, m.cachedDevices)
+}
@@ -0,0 +1,91 @@
+/*
+ * Copyright (c) 2022, NVIDIA CORPORATION.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+)
+
+// Formats of the plugin logs, set with --log-format
+const (
+	LogFormatText = "text"
+	LogFormatJSON = "json"
+)
+
+// Keys of the structured fields of the plugin logs, which log pipelines can filter on
+const (
+	logKeyEventType    = "event_type"
+	logKeyResourceName = "resource_name"
+	logKeyDeviceUUID   = "device_uuid"
+	logKeyReplicaIndex = "replica_index"
+)
+
+// parseLogLevel parses the --log-level option
+func parseLogLevel(level string) (slog.Level, error) {
+	switch level {
+	case "debug":
+		return slog.LevelDebug, nil
+	case "info":
+		return slog.LevelInfo, nil
+	case "warn":
+		return slog.LevelWarn, nil
+	case "error":
+		return slog.LevelError, nil
+	}
+	return 0, fmt.Errorf("unknown log level: %v", level)
+}
+
+// newLogHandler returns a handler writing the records of at least 'level' to 'w' in 'format'
+func newLogHandler(w io.Writer, format string, level string) (slog.Handler, error) {
+	l, err := parseLogLevel(level)
+	if err != nil {
+		return nil, err
+	}
+	opts := &slog.HandlerOptions{Level: l}
+	switch format {
+	case LogFormatText:
+		return slog.NewTextHandler(w, opts), nil
+	case LogFormatJSON:
+		return slog.NewJSONHandler(w, opts), nil
+	}
+	return nil, fmt.Errorf("unknown log format: %v", format)
+}
+
+// setupLogging sends the plugin logs to 'w' in 'format', dropping those below 'level'. The output of the
+// log package goes through the same handler at the info level, so that all logs share the same format.
+func setupLogging(w io.Writer, format string, level string) error {
+	handler, err := newLogHandler(w, format, level)
+	if err != nil {
+		return err
+	}
+	slog.SetDefault(slog.New(handler))
+	return nil
+}
+
+// logAllocation logs the allocation of each of the device replicas 'ids' to a container
+func (m *NvidiaDevicePlugin) logAllocation(ids []string) {
+	for _, id := range ids {
+		uuid, index, err := m.replicaCodec.Decode(id)
+		if err != nil {
+			m.logger.Info("Allocated device", logKeyEventType, "device_allocated", logKeyDeviceUUID, id)
+			continue
+		}
+		m.logger.Info("Allocated device replica", logKeyEventType, "device_allocated", logKeyDeviceUUID, uuid, logKeyReplicaIndex, index)
+	}
+}
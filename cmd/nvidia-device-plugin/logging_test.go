@@ -0,0 +1,143 @@
+/*
+ * Copyright (c) 2022, NVIDIA CORPORATION.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"log"
+	"log/slog"
+	"os"
+	"testing"
+
+	config "github.com/NVIDIA/k8s-device-plugin/api/config/v1"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+// captureStructuredLog sends the logs to the returned buffer as JSON for the duration of the test
+func captureStructuredLog(t *testing.T, level string) *bytes.Buffer {
+	var buf bytes.Buffer
+	previous := slog.Default()
+	require.NoError(t, setupLogging(&buf, LogFormatJSON, level))
+	t.Cleanup(func() {
+		slog.SetDefault(previous)
+		log.SetOutput(os.Stderr)
+		log.SetFlags(log.LstdFlags)
+	})
+	return &buf
+}
+
+// parseLogRecords parses the JSON records written to 'buf', one per line
+func parseLogRecords(t *testing.T, buf *bytes.Buffer) []map[string]interface{} {
+	var records []map[string]interface{}
+	scanner := bufio.NewScanner(buf)
+	for scanner.Scan() {
+		record := make(map[string]interface{})
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &record), scanner.Text())
+		records = append(records, record)
+	}
+	return records
+}
+
+func TestNewLogHandler(t *testing.T) {
+	testCases := []struct {
+		description string
+		format      string
+		level       string
+		valid       bool
+	}{
+		{"text", LogFormatText, "info", true},
+		{"json", LogFormatJSON, "debug", true},
+		{"warn level", LogFormatJSON, "warn", true},
+		{"error level", LogFormatText, "error", true},
+		{"unknown format", "logfmt", "info", false},
+		{"unknown level", LogFormatJSON, "verbose", false},
+		{"upper case level", LogFormatJSON, "INFO", false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.description, func(t *testing.T) {
+			_, err := newLogHandler(&bytes.Buffer{}, tc.format, tc.level)
+			if tc.valid {
+				require.NoError(t, err)
+			} else {
+				require.Error(t, err)
+			}
+		})
+	}
+}
+
+func TestStructuredAllocateLogs(t *testing.T) {
+	logs := captureStructuredLog(t, "info")
+	m := newTestPlugin(config.CommandLineFlags{}, 2,
+		&Device{Device: newPluginDevice("GPU-0"), Index: "0"},
+	)
+
+	_, err := m.Allocate(context.Background(), &pluginapi.AllocateRequest{
+		ContainerRequests: []*pluginapi.ContainerAllocateRequest{
+			{DevicesIDs: []string{"GPU-0-replica-1"}},
+		},
+	})
+	require.NoError(t, err)
+
+	var allocated []map[string]interface{}
+	for _, record := range parseLogRecords(t, logs) {
+		if record[logKeyEventType] == "device_allocated" {
+			allocated = append(allocated, record)
+		}
+	}
+	require.Len(t, allocated, 1)
+	require.Equal(t, "INFO", allocated[0]["level"])
+	require.Equal(t, "nvidia.com/gpu", allocated[0][logKeyResourceName])
+	require.Equal(t, "GPU-0", allocated[0][logKeyDeviceUUID])
+	require.Equal(t, float64(1), allocated[0][logKeyReplicaIndex])
+}
+
+func TestStructuredLogLevel(t *testing.T) {
+	logs := captureStructuredLog(t, "warn")
+	m := newTestPlugin(config.CommandLineFlags{}, 2,
+		&Device{Device: newPluginDevice("GPU-0"), Index: "0"},
+	)
+
+	log.Printf("Not a warning")
+	_, err := m.Allocate(context.Background(), &pluginapi.AllocateRequest{
+		ContainerRequests: []*pluginapi.ContainerAllocateRequest{
+			{DevicesIDs: []string{"GPU-0-replica-1"}},
+		},
+	})
+	require.NoError(t, err)
+	m.logger.Warn("Device marked unhealthy", logKeyEventType, "device_unhealthy", logKeyDeviceUUID, "GPU-0")
+
+	records := parseLogRecords(t, logs)
+	require.Len(t, records, 1)
+	require.Equal(t, "WARN", records[0]["level"])
+	require.Equal(t, "device_unhealthy", records[0][logKeyEventType])
+}
+
+func TestLogPackageUsesStructuredHandler(t *testing.T) {
+	logs := captureStructuredLog(t, "info")
+
+	log.Printf("Loading NVML")
+
+	records := parseLogRecords(t, logs)
+	require.Len(t, records, 1)
+	require.Equal(t, "INFO", records[0]["level"])
+	require.Equal(t, "Loading NVML", records[0]["msg"])
+}
@@ -20,18 +20,24 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"log"
+	"log/slog"
 	"os"
+	"reflect"
+	"regexp"
+	"runtime"
 	"strconv"
 	"strings"
+	"sync"
 	"syscall"
+	"time"
 
 	"github.com/NVIDIA/gpu-monitoring-tools/bindings/go/nvml"
 	config "github.com/NVIDIA/k8s-device-plugin/api/config/v1"
+	topology "github.com/NVIDIA/k8s-device-plugin/api/topology/v1"
 	"github.com/fsnotify/fsnotify"
 	cli "github.com/urfave/cli/v2"
 	altsrc "github.com/urfave/cli/v2/altsrc"
-	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+	"golang.org/x/net/context"
 )
 
 var resourceConfigFlag string
@@ -50,10 +56,11 @@ func main() {
 	c.Version = version
 	c.Before = func(ctx *cli.Context) error {
 		cfg, err := setup(ctx, c.Flags)
-		if err == nil {
-			config = *cfg
+		if err != nil {
+			return err
 		}
-		return err
+		config = *cfg
+		return setupLogging(os.Stderr, config.Flags.LogFormat, config.Flags.LogLevel)
 	}
 	c.Action = func(ctx *cli.Context) error {
 		return start(ctx, &config)
@@ -63,10 +70,11 @@ func main() {
 		altsrc.NewStringFlag(
 			&cli.StringFlag{
 				Name:        "mig-strategy",
+				Aliases:     []string{"enable-mig-strategy"},
 				Value:       "none",
 				Usage:       "the desired strategy for exposing MIG devices on GPUs that support it:\n\t\t[none | single | mixed]",
 				Destination: &flags.MigStrategy,
-				EnvVars:     []string{"MIG_STRATEGY"},
+				EnvVars:     []string{"MIG_STRATEGY", "ENABLE_MIG_STRATEGY"},
 			},
 		),
 		altsrc.NewBoolFlag(
@@ -91,7 +99,7 @@ func main() {
 			&cli.StringFlag{
 				Name:        "device-list-strategy",
 				Value:       "envvar",
-				Usage:       "the desired strategy for passing the device list to the underlying runtime:\n\t\t[envvar | volume-mounts]",
+				Usage:       "the desired strategy for passing the device list to the underlying runtime:\n\t\t[envvar | volume-mounts | annotation]",
 				Destination: &flags.DeviceListStrategy,
 				EnvVars:     []string{"DEVICE_LIST_STRATEGY"},
 			},
@@ -100,7 +108,7 @@ func main() {
 			&cli.StringFlag{
 				Name:        "device-id-strategy",
 				Value:       "uuid",
-				Usage:       "the desired strategy for passing device IDs to the underlying runtime:\n\t\t[uuid | index]",
+				Usage:       "the desired strategy for passing device IDs to the underlying runtime:\n\t\t[uuid | index | pci-address]",
 				Destination: &flags.DeviceIDStrategy,
 				EnvVars:     []string{"DEVICE_ID_STRATEGY"},
 			},
@@ -114,6 +122,763 @@ func main() {
 				EnvVars:     []string{"NVIDIA_DRIVER_ROOT"},
 			},
 		),
+		altsrc.NewStringSliceFlag(
+			&cli.StringSliceFlag{
+				Name:    "plugin-label",
+				Usage:   "a label (key=value) to add to the plugin's own pod once registered with the kubelet; may be repeated",
+				EnvVars: []string{"PLUGIN_LABELS"},
+			},
+		),
+		altsrc.NewBoolFlag(
+			&cli.BoolFlag{
+				Name:        "no-self-label",
+				Value:       false,
+				Usage:       "do not patch the plugin's own pod with the labels from --plugin-label",
+				Destination: &flags.NoSelfLabel,
+				EnvVars:     []string{"NO_SELF_LABEL"},
+			},
+		),
+		altsrc.NewIntFlag(
+			&cli.IntFlag{
+				Name:        "set-power-limit-watts",
+				Value:       0,
+				Usage:       "the power limit in watts to set on each device at startup; 0 leaves the current limit untouched",
+				Destination: &flags.SetPowerLimitWatts,
+				EnvVars:     []string{"SET_POWER_LIMIT_WATTS"},
+			},
+		),
+		altsrc.NewBoolFlag(
+			&cli.BoolFlag{
+				Name:        "dry-run-allocate",
+				Value:       false,
+				Usage:       "log the response computed by Allocate() but return it without any envvars, mounts or device specs",
+				Destination: &flags.DryRunAllocate,
+				EnvVars:     []string{"DRY_RUN_ALLOCATE"},
+			},
+		),
+		altsrc.NewDurationFlag(
+			&cli.DurationFlag{
+				Name:    "clock-throttle-poll-interval",
+				Value:   0,
+				Usage:   "the interval at which to poll each device for clock throttle reasons; 0 disables polling",
+				EnvVars: []string{"CLOCK_THROTTLE_POLL_INTERVAL"},
+			},
+		),
+		altsrc.NewStringFlag(
+			&cli.StringFlag{
+				Name:        "debug-addr",
+				Value:       "",
+				Usage:       "the address to serve the /debug/state and /metrics endpoints on (e.g. ':2114'); empty disables the endpoints",
+				Destination: &flags.DebugAddr,
+				EnvVars:     []string{"DEBUG_ADDR"},
+			},
+		),
+		altsrc.NewIntFlag(
+			&cli.IntFlag{
+				Name:        "graceful-period-on-unhealthy",
+				Value:       3,
+				Usage:       "the number of consecutive failed health checks before a device is marked unhealthy; the errors reported by NVML events are counted within --health-event-window instead",
+				Destination: &flags.GracefulPeriodOnUnhealthy,
+				EnvVars:     []string{"GRACEFUL_PERIOD_ON_UNHEALTHY"},
+			},
+		),
+		altsrc.NewDurationFlag(
+			&cli.DurationFlag{
+				Name:    "health-event-window",
+				Value:   10 * time.Minute,
+				Usage:   "the window within which the critical Xid and ECC errors reported by NVML events count towards --graceful-period-on-unhealthy, as events never report a passing check; 0 counts them all",
+				EnvVars: []string{"HEALTH_EVENT_WINDOW"},
+			},
+		),
+		altsrc.NewBoolFlag(
+			&cli.BoolFlag{
+				Name:        "prefer-same-numa-socket",
+				Value:       false,
+				Usage:       "when handing out replicas of several GPUs, prefer GPUs attached to the same NUMA node (same as --topology-policy=single-numa-node)",
+				Destination: &flags.PreferSameNUMASocket,
+				EnvVars:     []string{"PREFER_SAME_NUMA_SOCKET"},
+			},
+		),
+		altsrc.NewBoolFlag(
+			&cli.BoolFlag{
+				Name:        "no-health-check",
+				Aliases:     []string{"disable-healthcheck"},
+				Value:       false,
+				Usage:       "disable device health checks, e.g. where NVML health queries fail for healthy vGPUs; all devices are reported as permanently healthy",
+				Destination: &flags.NoHealthCheck,
+				EnvVars:     []string{"NO_HEALTH_CHECK", "DISABLE_HEALTHCHECK"},
+			},
+		),
+		altsrc.NewBoolFlag(
+			&cli.BoolFlag{
+				Name:        "watch-xid-errors",
+				Value:       false,
+				Usage:       "periodically read the Xid error counts of each GPU from the kernel log and emit a warning event on the node when they increase",
+				Destination: &flags.WatchXIDErrors,
+				EnvVars:     []string{"WATCH_XID_ERRORS"},
+			},
+		),
+		altsrc.NewStringFlag(
+			&cli.StringFlag{
+				Name:        "allocate-retry-policy",
+				Value:       "",
+				Usage:       "check in Allocate that the driver still responds to queries about each device, retrying transient NVML failures according to this policy as JSON, e.g. {\"maxRetries\": 3, \"backoffBase\": \"100ms\"}",
+				Destination: &flags.AllocateRetryPolicy,
+				EnvVars:     []string{"ALLOCATE_RETRY_POLICY"},
+			},
+		),
+		altsrc.NewDurationFlag(
+			&cli.DurationFlag{
+				Name:    "socket-watch-interval",
+				Value:   0,
+				Usage:   "poll for the plugin sockets at this interval instead of watching the kubelet socket with inotify; polling is used with a 5s interval when inotify is unavailable",
+				EnvVars: []string{"SOCKET_WATCH_INTERVAL"},
+			},
+		),
+		altsrc.NewStringFlag(
+			&cli.StringFlag{
+				Name:        "export-prometheus-textfile",
+				Value:       "",
+				Usage:       "periodically write the plugin metrics in the Prometheus text format to this file for the node-exporter textfile collector",
+				Destination: &flags.ExportPrometheusTextfile,
+				EnvVars:     []string{"EXPORT_PROMETHEUS_TEXTFILE"},
+			},
+		),
+		altsrc.NewDurationFlag(
+			&cli.DurationFlag{
+				Name:    "energy-poll-interval",
+				Value:   0,
+				Usage:   "interval at which the total energy consumption of each GPU is read and exported as a metric; 0 disables it",
+				EnvVars: []string{"ENERGY_POLL_INTERVAL"},
+			},
+		),
+		altsrc.NewBoolFlag(
+			&cli.BoolFlag{
+				Name:        "reset-gpu-on-release",
+				Value:       false,
+				Usage:       "reset a GPU with nvidia-smi once all of its allocated replicas have been released; disruptive if a workload still uses the GPU. After the plugin starts, a GPU is only reset once each of its replicas has been allocated again",
+				Destination: &flags.ResetGPUOnRelease,
+				EnvVars:     []string{"RESET_GPU_ON_RELEASE"},
+			},
+		),
+		altsrc.NewBoolFlag(
+			&cli.BoolFlag{
+				Name:        "enable-sentinel-device",
+				Value:       false,
+				Usage:       "reserve one replica of each GPU for the plugin itself and periodically probe the GPU through it, marking the GPU unhealthy as soon as a probe fails",
+				Destination: &flags.EnableSentinelDevice,
+				EnvVars:     []string{"ENABLE_SENTINEL_DEVICE"},
+			},
+		),
+		altsrc.NewStringSliceFlag(
+			&cli.StringSliceFlag{
+				Name:    "ignore-device-uuids",
+				Usage:   "UUIDs of GPUs to exclude from the devices advertised by the plugin",
+				EnvVars: []string{"IGNORE_DEVICE_UUIDS"},
+			},
+		),
+		altsrc.NewStringFlag(
+			&cli.StringFlag{
+				Name:        "healthcheck-exec",
+				Value:       "",
+				Usage:       "script run for each device on every health check cycle instead of the NVML health checks; it receives the device UUID as its first argument and must exit 0 if the device is healthy",
+				Destination: &flags.HealthcheckExec,
+				EnvVars:     []string{"HEALTHCHECK_EXEC"},
+			},
+		),
+		altsrc.NewDurationFlag(
+			&cli.DurationFlag{
+				Name:    "healthcheck-exec-timeout",
+				Value:   30 * time.Second,
+				Usage:   "time after which a --healthcheck-exec script is killed and the device considered to have failed the check",
+				EnvVars: []string{"HEALTHCHECK_EXEC_TIMEOUT"},
+			},
+		),
+		altsrc.NewBoolFlag(
+			&cli.BoolFlag{
+				Name:        "emit-k8s-device-events",
+				Value:       false,
+				Usage:       "record a Normal event on the node whenever devices are allocated or released, and a Warning event when a device becomes unhealthy",
+				Destination: &flags.EmitK8sDeviceEvents,
+				EnvVars:     []string{"EMIT_K8S_DEVICE_EVENTS"},
+			},
+		),
+		altsrc.NewBoolFlag(
+			&cli.BoolFlag{
+				Name:        "topology-hints-enabled",
+				Value:       true,
+				Usage:       "advertise the NUMA node of each device so that the topology manager can align CPU and memory allocations with it",
+				Destination: &flags.TopologyHintsEnabled,
+				EnvVars:     []string{"TOPOLOGY_HINTS_ENABLED"},
+			},
+		),
+		altsrc.NewIntFlag(
+			&cli.IntFlag{
+				Name:        "health-history-size",
+				Value:       100,
+				Usage:       "the number of health transitions kept per device for the /debug/state endpoint",
+				Destination: &flags.HealthHistorySize,
+				EnvVars:     []string{"HEALTH_HISTORY_SIZE"},
+			},
+		),
+		altsrc.NewBoolFlag(
+			&cli.BoolFlag{
+				Name:        "leader-election",
+				Value:       false,
+				Usage:       "only serve the plugins from the pod holding the gpu-sharing-plugin-<node> lease, letting other pods on the node take over when it fails. The other pods run the health checks while they wait",
+				Destination: &flags.LeaderElection,
+				EnvVars:     []string{"LEADER_ELECTION"},
+			},
+		),
+		altsrc.NewBoolFlag(
+			&cli.BoolFlag{
+				Name:        "scale-down-on-low-memory",
+				Value:       false,
+				Usage:       "withhold replicas of a GPU from the kubelet while its free memory is below --min-free-memory-mib",
+				Destination: &flags.ScaleDownOnLowMemory,
+				EnvVars:     []string{"SCALE_DOWN_ON_LOW_MEMORY"},
+			},
+		),
+		altsrc.NewIntFlag(
+			&cli.IntFlag{
+				Name:        "min-free-memory-mib",
+				Value:       1024,
+				Usage:       "the free memory of a GPU, in MiB, below which --scale-down-on-low-memory withholds replicas",
+				Destination: &flags.MinFreeMemoryMiB,
+				EnvVars:     []string{"MIN_FREE_MEMORY_MIB"},
+			},
+		),
+		altsrc.NewStringFlag(
+			&cli.StringFlag{
+				Name:        "replica-id-codec",
+				Value:       "default",
+				Usage:       "the scheme used to build replica IDs from physical device IDs: [default | base64]",
+				Destination: &flags.ReplicaIDCodec,
+				EnvVars:     []string{"REPLICA_ID_CODEC"},
+			},
+		),
+		altsrc.NewDurationFlag(
+			&cli.DurationFlag{
+				Name:    "prestop-timeout",
+				Value:   10 * time.Second,
+				Usage:   "the longest time a request to the /prestop/ debug endpoint waits for the memory of its GPUs to be flushed",
+				EnvVars: []string{"PRESTOP_TIMEOUT"},
+			},
+		),
+		altsrc.NewIntFlag(
+			&cli.IntFlag{
+				Name:        "prestop-memory-utilization-threshold",
+				Value:       5,
+				Usage:       "the memory utilization, in percent, below which the /prestop/ debug endpoint considers the memory of a GPU flushed",
+				Destination: &flags.PreStopMemoryUtilizationThreshold,
+				EnvVars:     []string{"PRESTOP_MEMORY_UTILIZATION_THRESHOLD"},
+			},
+		),
+		altsrc.NewIntFlag(
+			&cli.IntFlag{
+				Name:        "max-grpc-message-size",
+				Value:       16 * 1024 * 1024,
+				Usage:       "the maximum size in bytes of the gRPC messages exchanged with the kubelet, e.g. of ListAndWatch responses advertising many replicas",
+				Destination: &flags.MaxGRPCMessageSize,
+				EnvVars:     []string{"MAX_GRPC_MESSAGE_SIZE"},
+			},
+		),
+		altsrc.NewBoolFlag(
+			&cli.BoolFlag{
+				Name:        "sm-weighted-allocation",
+				Value:       false,
+				Usage:       "prefer replicas of the GPUs with the fewest replicas in use per streaming multiprocessor (SM) when replicating GPUs",
+				Destination: &flags.SMWeightedAllocation,
+				EnvVars:     []string{"SM_WEIGHTED_ALLOCATION"},
+			},
+		),
+		altsrc.NewBoolFlag(
+			&cli.BoolFlag{
+				Name:        "socket-cleanup-on-exit",
+				Value:       false,
+				Usage:       "remove the plugin sockets when exiting because the gRPC server repeatedly crashed",
+				Destination: &flags.SocketCleanupOnExit,
+				EnvVars:     []string{"SOCKET_CLEANUP_ON_EXIT"},
+			},
+		),
+		altsrc.NewStringSliceFlag(
+			&cli.StringSliceFlag{
+				Name:    "gpu-model-filter",
+				Usage:   "only advertise the GPUs whose model name contains one of these substrings, ignoring case",
+				EnvVars: []string{"GPU_MODEL_FILTER"},
+			},
+		),
+		altsrc.NewIntFlag(
+			&cli.IntFlag{
+				Name:        "goroutine-alert-threshold",
+				Value:       100,
+				Usage:       "log a warning when the number of goroutines exceeds this threshold, 0 to disable",
+				Destination: &flags.GoroutineAlertThreshold,
+				EnvVars:     []string{"GOROUTINE_ALERT_THRESHOLD"},
+			},
+		),
+		altsrc.NewDurationFlag(
+			&cli.DurationFlag{
+				Name:    "grpc-stop-timeout",
+				Aliases: []string{"graceful-stop-timeout"},
+				Value:   30 * time.Second,
+				Usage:   "how long to wait for in-flight gRPC requests to complete when stopping a plugin before aborting them, 0 to abort them immediately",
+				EnvVars: []string{"GRPC_STOP_TIMEOUT", "GRACEFUL_STOP_TIMEOUT"},
+			},
+		),
+		altsrc.NewStringFlag(
+			&cli.StringFlag{
+				Name:        "require-vbios-version",
+				Value:       "",
+				Usage:       "fail to start unless all GPUs run this VBIOS version",
+				Destination: &flags.RequireVBIOSVersion,
+				EnvVars:     []string{"REQUIRE_VBIOS_VERSION"},
+			},
+		),
+		altsrc.NewBoolFlag(
+			&cli.BoolFlag{
+				Name:        "extender-mode",
+				Value:       false,
+				Usage:       "instead of serving GPUs, run a scheduler extender filtering and scoring nodes by their free GPU replicas",
+				Destination: &flags.ExtenderMode,
+				EnvVars:     []string{"EXTENDER_MODE"},
+			},
+		),
+		altsrc.NewStringFlag(
+			&cli.StringFlag{
+				Name:        "extender-addr",
+				Value:       ":8888",
+				Usage:       "the address the scheduler extender listens on with --extender-mode",
+				Destination: &flags.ExtenderAddr,
+				EnvVars:     []string{"EXTENDER_ADDR"},
+			},
+		),
+		altsrc.NewStringFlag(
+			&cli.StringFlag{
+				Name:        "otel-endpoint",
+				Value:       "",
+				Usage:       "the OTLP/HTTP endpoint of an OpenTelemetry collector to export traces of the allocation requests to, e.g. http://collector:4318",
+				Destination: &flags.OTelEndpoint,
+				EnvVars:     []string{"OTEL_ENDPOINT"},
+			},
+		),
+		altsrc.NewDurationFlag(
+			&cli.DurationFlag{
+				Name:    "rolling-restart-drain-timeout",
+				Value:   5 * time.Minute,
+				Usage:   "on SIGUSR1, the plugins are restarted one at a time: how long to wait for the RPCs in flight of a stopped plugin to complete before aborting them and starting it again",
+				EnvVars: []string{"ROLLING_RESTART_DRAIN_TIMEOUT"},
+			},
+		),
+		altsrc.NewStringFlag(
+			&cli.StringFlag{
+				Name:        "sync-config-to-configmap",
+				Value:       "",
+				Usage:       "the name of a ConfigMap in the namespace of the plugin pod to which the configuration of each plugin is written whenever it starts",
+				Destination: &flags.SyncConfigToConfigMap,
+				EnvVars:     []string{"SYNC_CONFIG_TO_CONFIGMAP"},
+			},
+		),
+		altsrc.NewDurationFlag(
+			&cli.DurationFlag{
+				Name:    "health-recovery-interval",
+				Value:   0,
+				Usage:   "how often the check that failed is run again for devices marked unhealthy, marking them healthy once they pass it; 0 to never recover them. Devices hit by critical Xid or ECC errors are never recovered",
+				EnvVars: []string{"HEALTH_RECOVERY_INTERVAL"},
+			},
+		),
+		altsrc.NewIntFlag(
+			&cli.IntFlag{
+				Name:        "memory-slice-mb",
+				Value:       1000,
+				Usage:       "the memory in MiB backing each replica of a device when replicas are derived from its memory ('auto' replicas)",
+				Destination: &flags.MemorySliceMB,
+				EnvVars:     []string{"MEMORY_SLICE_MB"},
+			},
+		),
+		altsrc.NewIntFlag(
+			&cli.IntFlag{
+				Name:        "max-auto-replicas",
+				Value:       64000,
+				Usage:       "the maximum number of replicas of a device when replicas are derived from its memory ('auto' replicas), as the kubelet does not handle much more than 64K devices",
+				Destination: &flags.MaxAutoReplicas,
+				EnvVars:     []string{"MAX_AUTO_REPLICAS"},
+			},
+		),
+		altsrc.NewStringFlag(
+			&cli.StringFlag{
+				Name:        "metrics-addr",
+				Value:       ":2112",
+				Usage:       "the address to serve the /metrics endpoint on, separately from --debug-addr; empty disables it",
+				Destination: &flags.MetricsAddr,
+				EnvVars:     []string{"METRICS_ADDR"},
+			},
+		),
+		altsrc.NewIntFlag(
+			&cli.IntFlag{
+				Name:        "max-replicas-per-device",
+				Value:       0,
+				Usage:       "the maximum number of replicas of each device, whether fixed or derived from its memory ('auto' replicas); 0 for no maximum",
+				Destination: &flags.MaxReplicasPerDevice,
+				EnvVars:     []string{"MAX_REPLICAS_PER_DEVICE"},
+			},
+		),
+		altsrc.NewStringFlag(
+			&cli.StringFlag{
+				Name:        "replica-id-separator",
+				Value:       "-replica-",
+				Usage:       "the separator between the physical device ID and the replica index in the replica IDs of the default --replica-id-codec; no device ID may contain it",
+				Destination: &flags.ReplicaIDSeparator,
+				EnvVars:     []string{"REPLICA_ID_SEPARATOR"},
+			},
+		),
+		altsrc.NewBoolFlag(
+			&cli.BoolFlag{
+				Name:        "prestart-validate",
+				Value:       false,
+				Usage:       "ask the kubelet to call PreStartContainer before starting each container and fail it unless nvidia-smi can query its devices",
+				Destination: &flags.PrestartValidate,
+				EnvVars:     []string{"PRESTART_VALIDATE"},
+			},
+		),
+		altsrc.NewStringFlag(
+			&cli.StringFlag{
+				Name:        "prestart-validate-nvidia-smi",
+				Value:       "nvidia-smi",
+				Usage:       "the path of the nvidia-smi binary used by --prestart-validate",
+				Destination: &flags.PrestartValidateNvidiaSMI,
+				EnvVars:     []string{"PRESTART_VALIDATE_NVIDIA_SMI"},
+			},
+		),
+		altsrc.NewDurationFlag(
+			&cli.DurationFlag{
+				Name:    "prestart-validate-timeout",
+				Value:   5 * time.Second,
+				Usage:   "how long nvidia-smi may take to query a device with --prestart-validate before the container fails to start",
+				EnvVars: []string{"PRESTART_VALIDATE_TIMEOUT"},
+			},
+		),
+		altsrc.NewStringFlag(
+			&cli.StringFlag{
+				Name:        "log-format",
+				Value:       "text",
+				Usage:       "the format of the plugin logs:\n\t\t[text | json]",
+				Destination: &flags.LogFormat,
+				EnvVars:     []string{"LOG_FORMAT"},
+			},
+		),
+		altsrc.NewStringFlag(
+			&cli.StringFlag{
+				Name:        "log-level",
+				Value:       "info",
+				Usage:       "the minimum level of the plugin logs:\n\t\t[debug | info | warn | error]",
+				Destination: &flags.LogLevel,
+				EnvVars:     []string{"LOG_LEVEL"},
+			},
+		),
+		altsrc.NewStringFlag(
+			&cli.StringFlag{
+				Name:        "healthz-addr",
+				Value:       ":2113",
+				Usage:       "the address serving /healthz, failing when a plugin is not registered with the kubelet or has not sent it the device list within --healthz-window, and /readyz, also failing without any healthy device (empty to disable)",
+				Destination: &flags.HealthzAddr,
+				EnvVars:     []string{"HEALTHZ_ADDR"},
+			},
+		),
+		altsrc.NewDurationFlag(
+			&cli.DurationFlag{
+				Name:    "healthz-window",
+				Value:   2 * time.Minute,
+				Usage:   "how recently each plugin must have sent the device list to the kubelet for /healthz to succeed, the list being sent again every half of it",
+				EnvVars: []string{"HEALTHZ_WINDOW"},
+			},
+		),
+		altsrc.NewStringFlag(
+			&cli.StringFlag{
+				Name:        "audit-log-file",
+				Value:       "",
+				Usage:       "the file to which a JSON line is appended for each allocation, recording the replicas and physical devices handed to a container (empty to disable)",
+				Destination: &flags.AuditLogFile,
+				EnvVars:     []string{"AUDIT_LOG_FILE"},
+			},
+		),
+		altsrc.NewIntFlag(
+			&cli.IntFlag{
+				Name:        "audit-log-max-size-mb",
+				Value:       100,
+				Usage:       "the size in MiB above which the --audit-log-file is rotated",
+				Destination: &flags.AuditLogMaxSizeMB,
+				EnvVars:     []string{"AUDIT_LOG_MAX_SIZE_MB"},
+			},
+		),
+		altsrc.NewIntFlag(
+			&cli.IntFlag{
+				Name:        "audit-log-max-backups",
+				Value:       5,
+				Usage:       "the number of rotated --audit-log-file files to keep, as <file>.1 (the most recent) to <file>.<n>",
+				Destination: &flags.AuditLogMaxBackups,
+				EnvVars:     []string{"AUDIT_LOG_MAX_BACKUPS"},
+			},
+		),
+		altsrc.NewBoolFlag(
+			&cli.BoolFlag{
+				Name:        "dry-run",
+				Value:       false,
+				Usage:       "print the devices and replicas each plugin would advertise as JSON, then exit without serving them",
+				Destination: &flags.DryRun,
+				EnvVars:     []string{"DRY_RUN"},
+			},
+		),
+		altsrc.NewStringFlag(
+			&cli.StringFlag{
+				Name:        "topology-policy",
+				Value:       "none",
+				Usage:       "how GetPreferredAllocation aligns the GPUs of a request on NUMA nodes:\n\t\t[none | single-numa-node | best-effort]",
+				Destination: &flags.TopologyPolicy,
+				EnvVars:     []string{"TOPOLOGY_POLICY"},
+			},
+		),
+		altsrc.NewStringSliceFlag(
+			&cli.StringSliceFlag{
+				Name:    "extra-device-envvars",
+				Usage:   "additional environment variables, e.g. for runtimes not reading NVIDIA_VISIBLE_DEVICES, set to the device list of the containers along with the main one; comma-separated or repeated",
+				EnvVars: []string{"EXTRA_DEVICE_ENVVARS"},
+			},
+		),
+		altsrc.NewIntFlag(
+			&cli.IntFlag{
+				Name:        "reserved-memory-per-gpu-mb",
+				Value:       -1,
+				Usage:       "the memory in MiB of each GPU not to share among auto replicas, -1 for the memory already used on the GPU when the plugin starts",
+				Destination: &flags.ReservedMemoryPerGPUMB,
+				EnvVars:     []string{"RESERVED_MEMORY_PER_GPU_MB"},
+			},
+		),
+		altsrc.NewDurationFlag(
+			&cli.DurationFlag{
+				Name:    "restart-stable-duration",
+				Value:   5 * time.Minute,
+				Usage:   "how long the gRPC server of a plugin must serve without crashing for the backoff between its restarts to start over from 1s",
+				EnvVars: []string{"RESTART_STABLE_DURATION"},
+			},
+		),
+		altsrc.NewStringFlag(
+			&cli.StringFlag{
+				Name:        "resource-name",
+				Value:       "nvidia.com/gpu",
+				Usage:       "the extended resource name under which the full GPUs are advertised, e.g. example.com/virtual-gpu; its domain also prefixes the names of the MIG resources",
+				Destination: &flags.ResourceName,
+				EnvVars:     []string{"RESOURCE_NAME"},
+			},
+		),
+		altsrc.NewStringFlag(
+			&cli.StringFlag{
+				Name:        "device-list-envvar",
+				Value:       "NVIDIA_VISIBLE_DEVICES",
+				Usage:       "the environment variable passing the device list to the containers, whatever the resource name",
+				Destination: &flags.DeviceListEnvvar,
+				EnvVars:     []string{"DEVICE_LIST_ENVVAR"},
+			},
+		),
+		altsrc.NewDurationFlag(
+			&cli.DurationFlag{
+				Name:    "health-check-interval",
+				Value:   60 * time.Second,
+				Usage:   "how often the health of the devices for which NVML events are unavailable is polled instead",
+				EnvVars: []string{"HEALTH_CHECK_INTERVAL"},
+			},
+		),
+		altsrc.NewStringFlag(
+			&cli.StringFlag{
+				Name:        "node-label-selector",
+				Value:       "",
+				Usage:       "only run the plugin on the nodes whose labels match this selector, e.g. nvidia.com/gpu.present=true, exiting successfully on other nodes; requires NODE_NAME",
+				Destination: &flags.NodeLabelSelector,
+				EnvVars:     []string{"NODE_LABEL_SELECTOR"},
+			},
+		),
+		altsrc.NewBoolFlag(
+			&cli.BoolFlag{
+				Name:        "no-replicas",
+				Value:       false,
+				Usage:       "disable sharing: advertise each device exactly once under its own ID, whatever the number of replicas configured",
+				Destination: &flags.NoReplicas,
+				EnvVars:     []string{"NO_REPLICAS"},
+			},
+		),
+		altsrc.NewStringFlag(
+			&cli.StringFlag{
+				Name:        "socket-dir",
+				Value:       "/var/lib/kubelet/device-plugins",
+				Usage:       "the directory of the kubelet socket, in which the plugin sockets are created, e.g. /var/lib/rancher/k3s/agent/kubelet/device-plugins on K3s",
+				Destination: &flags.SocketDir,
+				EnvVars:     []string{"SOCKET_DIR"},
+			},
+		),
+		altsrc.NewStringFlag(
+			&cli.StringFlag{
+				Name:        "tiered-resources",
+				Value:       "",
+				Usage:       "advertise the full GPUs as one resource per memory tier, e.g. small:16384,large for <resource-name>-small up to 16384 MiB and <resource-name>-large above",
+				Destination: &flags.TieredResources,
+				EnvVars:     []string{"TIERED_RESOURCES"},
+			},
+		),
+		altsrc.NewDurationFlag(
+			&cli.DurationFlag{
+				Name:    "grpc-dial-timeout",
+				Value:   5 * time.Second,
+				Usage:   "how long to wait for the gRPC server of a plugin to accept connections on its socket once started",
+				EnvVars: []string{"GRPC_DIAL_TIMEOUT"},
+			},
+		),
+		altsrc.NewDurationFlag(
+			&cli.DurationFlag{
+				Name:    "kubelet-registration-timeout",
+				Value:   5 * time.Second,
+				Usage:   "how long to wait for the kubelet to accept connections on its registration socket",
+				EnvVars: []string{"KUBELET_REGISTRATION_TIMEOUT"},
+			},
+		),
+		altsrc.NewStringFlag(
+			&cli.StringFlag{
+				Name:        "device-filter-uuid-regex",
+				Value:       "",
+				Usage:       "do not advertise the devices whose UUID matches this regular expression, e.g. for a GPU reserved for display",
+				Destination: &flags.DeviceFilterUUIDRegex,
+				EnvVars:     []string{"DEVICE_FILTER_UUID_REGEX"},
+			},
+		),
+		altsrc.NewStringSliceFlag(
+			&cli.StringSliceFlag{
+				Name:    "device-filter-index",
+				Usage:   "do not advertise the devices with these indices, as listed by nvidia-smi; comma-separated or repeated",
+				EnvVars: []string{"DEVICE_FILTER_INDEX"},
+			},
+		),
+		altsrc.NewDurationFlag(
+			&cli.DurationFlag{
+				Name:    "allocation-timeout",
+				Value:   10 * time.Second,
+				Usage:   "bound how long Allocate may take before failing with DeadlineExceeded",
+				EnvVars: []string{"ALLOCATION_TIMEOUT"},
+			},
+		),
+		altsrc.NewStringFlag(
+			&cli.StringFlag{
+				Name:        "topology-file",
+				Value:       "",
+				Usage:       "JSON file describing the links between the GPUs, used for topology-aware allocation when they cannot be queried through NVML",
+				Destination: &flags.TopologyFile,
+				EnvVars:     []string{"TOPOLOGY_FILE"},
+			},
+		),
+		altsrc.NewStringFlag(
+			&cli.StringFlag{
+				Name:        "lease-configmap",
+				Value:       "",
+				Usage:       "name of a ConfigMap in the namespace of the plugin pod recording the allocated replicas, so that several instances of the plugin on a node never hand out the same replica. Claims not renewed for 2 minutes, e.g. of a killed pod, expire",
+				Destination: &flags.LeaseConfigMap,
+				EnvVars:     []string{"LEASE_CONFIGMAP"},
+			},
+		),
+		altsrc.NewDurationFlag(
+			&cli.DurationFlag{
+				Name:    "startup-timeout",
+				Value:   2 * time.Minute,
+				Usage:   "exit with an error if the plugins are not registered with the kubelet within this time of starting, so that the pod is restarted",
+				EnvVars: []string{"STARTUP_TIMEOUT"},
+			},
+		),
+		altsrc.NewBoolFlag(
+			&cli.BoolFlag{
+				Name:        "enforce-same-gpu",
+				Value:       false,
+				Usage:       "reject allocation requests whose replicas belong to more than one physical GPU",
+				Destination: &flags.EnforceSameGPU,
+				EnvVars:     []string{"ENFORCE_SAME_GPU"},
+			},
+		),
+		altsrc.NewStringFlag(
+			&cli.StringFlag{
+				Name:        "device-cache-file",
+				Value:       "",
+				Usage:       "file in which the devices of each resource are saved when the plugin stops, restored on restart if NVML reports no devices",
+				Destination: &flags.DeviceCacheFile,
+				EnvVars:     []string{"DEVICE_CACHE_FILE"},
+			},
+		),
+		altsrc.NewDurationFlag(
+			&cli.DurationFlag{
+				Name:    "device-cache-ttl",
+				Value:   5 * time.Minute,
+				Usage:   "maximum age of the device cache file for it to be restored",
+				EnvVars: []string{"DEVICE_CACHE_TTL"},
+			},
+		),
+		altsrc.NewStringFlag(
+			&cli.StringFlag{
+				Name:        "volume-mount-source-strategy",
+				Value:       "devnull",
+				Usage:       "the host path mounted for each device by the 'volume-mounts' device list strategy:\n\t\t[devnull | device-node]",
+				Destination: &flags.VolumeMountSourceStrategy,
+				EnvVars:     []string{"VOLUME_MOUNT_SOURCE_STRATEGY"},
+			},
+		),
+		altsrc.NewIntFlag(
+			&cli.IntFlag{
+				Name:        "health-debounce-ms",
+				Value:       500,
+				Usage:       "milliseconds during which the health changes of devices are batched into a single update of the kubelet, 0 to send each change right away",
+				Destination: &flags.HealthDebounceMs,
+				EnvVars:     []string{"HEALTH_DEBOUNCE_MS"},
+			},
+		),
+		altsrc.NewStringFlag(
+			&cli.StringFlag{
+				Name:        "resource-namespace",
+				Value:       "",
+				Usage:       "domain replacing that of --resource-name for all the advertised resources, e.g. team-a.example.com",
+				Destination: &flags.ResourceNamespace,
+				EnvVars:     []string{"RESOURCE_NAMESPACE"},
+			},
+		),
+		altsrc.NewBoolFlag(
+			&cli.BoolFlag{
+				Name:        "wsl2-mode",
+				Value:       false,
+				Usage:       "pass /dev/dxg to the containers as on WSL2, where it is otherwise only passed when present",
+				Destination: &flags.WSL2Mode,
+				EnvVars:     []string{"WSL2_MODE"},
+			},
+		),
+		altsrc.NewIntFlag(
+			&cli.IntFlag{
+				Name:        "min-replicas",
+				Value:       1,
+				Usage:       "the minimum number of 'auto' replicas of a device, however little memory it has",
+				Destination: &flags.MinReplicas,
+				EnvVars:     []string{"MIN_REPLICAS"},
+			},
+		),
+		altsrc.NewIntFlag(
+			&cli.IntFlag{
+				Name:        "max-replicas",
+				Value:       0,
+				Usage:       "the maximum number of 'auto' replicas of a device, 0 for no other limit than --max-auto-replicas",
+				Destination: &flags.MaxReplicas,
+				EnvVars:     []string{"MAX_REPLICAS"},
+			},
+		),
+		altsrc.NewStringFlag(
+			&cli.StringFlag{
+				Name:        "watch-configmap",
+				Value:       "",
+				Usage:       "the ConfigMap 'namespace/name' holding a config file under the 'config.yaml' key, whose resources are applied to the running plugins whenever it changes",
+				Destination: &flags.WatchConfigMap,
+				EnvVars:     []string{"WATCH_CONFIGMAP"},
+			},
+		),
 		&cli.StringFlag{
 			Name:        "config-file",
 			Usage:       "the path to a config file as an alternative to command line options or environment variables",
@@ -128,30 +893,230 @@ func main() {
 			EnvVars:     []string{"NVIDIA_DRIVER_RESOURCE_CONFIG"},
 		},
 	}
+	c.Flags = append(c.Flags, testingFlags...)
 
 	err := c.Run(os.Args)
 	if err != nil {
-		log.SetOutput(os.Stderr)
-		log.Printf("Error: %v", err)
+		slog.Error("Exiting on error", "error", err)
 		os.Exit(1)
 	}
 }
 
 func validateFlags(config *config.Config) error {
-	if config.Flags.DeviceListStrategy != DeviceListStrategyEnvvar && config.Flags.DeviceListStrategy != DeviceListStrategyVolumeMounts {
+	switch config.Flags.DeviceListStrategy {
+	case DeviceListStrategyEnvvar, DeviceListStrategyVolumeMounts, DeviceListStrategyAnnotation:
+	default:
 		return fmt.Errorf("invalid --device-list-strategy option: %v", config.Flags.DeviceListStrategy)
 	}
 
-	if config.Flags.DeviceIDStrategy != DeviceIDStrategyUUID && config.Flags.DeviceIDStrategy != DeviceIDStrategyIndex {
+	switch config.Flags.DeviceIDStrategy {
+	case DeviceIDStrategyUUID, DeviceIDStrategyIndex, DeviceIDStrategyPCIAddress:
+	default:
 		return fmt.Errorf("invalid --device-id-strategy option: %v", config.Flags.DeviceIDStrategy)
 	}
 
+	switch config.Flags.VolumeMountSourceStrategy {
+	case VolumeMountSourceStrategyDevNull, VolumeMountSourceStrategyDeviceNode:
+	default:
+		return fmt.Errorf("invalid --volume-mount-source-strategy option: %v", config.Flags.VolumeMountSourceStrategy)
+	}
+
+	if config.Flags.PreStopMemoryUtilizationThreshold < 0 || config.Flags.PreStopMemoryUtilizationThreshold > 100 {
+		return fmt.Errorf("invalid --prestop-memory-utilization-threshold option: %v", config.Flags.PreStopMemoryUtilizationThreshold)
+	}
+
+	if _, err := newReplicaIDCodec(config.Flags.ReplicaIDCodec, config.Flags.ReplicaIDSeparator); err != nil {
+		return fmt.Errorf("invalid --replica-id-codec option: %v", err)
+	}
+
+	switch config.Flags.TopologyPolicy {
+	case TopologyPolicyNone, TopologyPolicySingleNUMANode, TopologyPolicyBestEffort:
+	default:
+		return fmt.Errorf("invalid --topology-policy option: %v", config.Flags.TopologyPolicy)
+	}
+
+	switch config.Flags.LogFormat {
+	case LogFormatText, LogFormatJSON:
+	default:
+		return fmt.Errorf("invalid --log-format option: %v", config.Flags.LogFormat)
+	}
+
+	if _, err := parseLogLevel(config.Flags.LogLevel); err != nil {
+		return fmt.Errorf("invalid --log-level option: %v", config.Flags.LogLevel)
+	}
+
+	if config.Flags.GracefulPeriodOnUnhealthy < 1 {
+		return fmt.Errorf("invalid --graceful-period-on-unhealthy option: %v", config.Flags.GracefulPeriodOnUnhealthy)
+	}
+
+	if config.Flags.HealthEventWindow < 0 {
+		return fmt.Errorf("invalid --health-event-window option: %v", time.Duration(config.Flags.HealthEventWindow))
+	}
+
+	if config.Flags.HealthcheckExec != "" && config.Flags.HealthcheckExecTimeout <= 0 {
+		return fmt.Errorf("invalid --healthcheck-exec-timeout option: %v", time.Duration(config.Flags.HealthcheckExecTimeout))
+	}
+
+	if config.Flags.GRPCDialTimeout <= 0 {
+		return fmt.Errorf("invalid --grpc-dial-timeout option: %v", time.Duration(config.Flags.GRPCDialTimeout))
+	}
+
+	if config.Flags.KubeletRegistrationTimeout <= 0 {
+		return fmt.Errorf("invalid --kubelet-registration-timeout option: %v", time.Duration(config.Flags.KubeletRegistrationTimeout))
+	}
+
+	if config.Flags.SimulateNGPUs < 0 {
+		return fmt.Errorf("invalid --simulate-n-gpus option: %v", config.Flags.SimulateNGPUs)
+	}
+
+	if config.Flags.SimulateNGPUs > 0 {
+		if config.Flags.MigStrategy != MigStrategyNone {
+			return fmt.Errorf("invalid --simulate-n-gpus option: only supported with --mig-strategy=%s", MigStrategyNone)
+		}
+		if config.Flags.SimulateGPUMemoryMB <= 0 {
+			return fmt.Errorf("invalid --simulate-gpu-memory-mb option: %v", config.Flags.SimulateGPUMemoryMB)
+		}
+	}
+
+	if config.Flags.StartupTimeout <= 0 {
+		return fmt.Errorf("invalid --startup-timeout option: %v", time.Duration(config.Flags.StartupTimeout))
+	}
+
+	if config.Flags.AllocationTimeout <= 0 {
+		return fmt.Errorf("invalid --allocation-timeout option: %v", time.Duration(config.Flags.AllocationTimeout))
+	}
+
+	if config.Flags.HealthCheckInterval <= 0 {
+		return fmt.Errorf("invalid --health-check-interval option: %v", time.Duration(config.Flags.HealthCheckInterval))
+	}
+
+	if config.Flags.RestartStableDuration <= 0 {
+		return fmt.Errorf("invalid --restart-stable-duration option: %v", time.Duration(config.Flags.RestartStableDuration))
+	}
+
+	if config.Flags.HealthzAddr != "" && config.Flags.HealthzWindow <= 0 {
+		return fmt.Errorf("invalid --healthz-window option: %v", time.Duration(config.Flags.HealthzWindow))
+	}
+
+	if config.Flags.AuditLogMaxSizeMB < 1 {
+		return fmt.Errorf("invalid --audit-log-max-size-mb option: %v", config.Flags.AuditLogMaxSizeMB)
+	}
+
+	if config.Flags.AuditLogMaxBackups < 0 {
+		return fmt.Errorf("invalid --audit-log-max-backups option: %v", config.Flags.AuditLogMaxBackups)
+	}
+
+	if config.Flags.SetPowerLimitWatts < 0 {
+		return fmt.Errorf("invalid --set-power-limit-watts option: %v", config.Flags.SetPowerLimitWatts)
+	}
+
+	if config.Flags.MemorySliceMB < 1 {
+		return fmt.Errorf("invalid --memory-slice-mb option: %v", config.Flags.MemorySliceMB)
+	}
+
+	if config.Flags.ReservedMemoryPerGPUMB < -1 {
+		return fmt.Errorf("invalid --reserved-memory-per-gpu-mb option: %v", config.Flags.ReservedMemoryPerGPUMB)
+	}
+
+	if config.Flags.MaxAutoReplicas < 1 {
+		return fmt.Errorf("invalid --max-auto-replicas option: %v", config.Flags.MaxAutoReplicas)
+	}
+
+	if err := validateReplicaBounds(config.Flags.MinReplicas, config.Flags.MaxReplicas); err != nil {
+		return err
+	}
+
+	if config.Flags.WatchConfigMap != "" {
+		if _, _, err := parseNamespacedName(config.Flags.WatchConfigMap); err != nil {
+			return fmt.Errorf("invalid --watch-configmap option: %v", err)
+		}
+	}
+
+	if config.Flags.MaxReplicasPerDevice < 0 {
+		return fmt.Errorf("invalid --max-replicas-per-device option: %v", config.Flags.MaxReplicasPerDevice)
+	}
+
+	if config.Flags.GoroutineAlertThreshold < 0 {
+		return fmt.Errorf("invalid --goroutine-alert-threshold option: %v", config.Flags.GoroutineAlertThreshold)
+	}
+
+	if _, err := parseRetryPolicy(config.Flags.AllocateRetryPolicy); err != nil {
+		return fmt.Errorf("invalid --allocate-retry-policy option: %v", err)
+	}
+
+	if err := validateResourceName(config.Flags.ResourceName); err != nil {
+		return fmt.Errorf("invalid --resource-name option: %v", err)
+	}
+
+	if config.Flags.ResourceNamespace != "" {
+		if err := validateResourceName(gpuResourceName(config, nil)); err != nil {
+			return fmt.Errorf("invalid --resource-namespace option: %v", err)
+		}
+	}
+
+	if err := validateEnvVarName(config.Flags.DeviceListEnvvar); err != nil {
+		return fmt.Errorf("invalid --device-list-envvar option: %v", err)
+	}
+
+	for _, name := range config.Flags.ExtraDeviceEnvvars {
+		if err := validateEnvVarName(name); err != nil {
+			return fmt.Errorf("invalid --extra-device-envvars option: %v", err)
+		}
+	}
+
+	if _, err := regexp.Compile(config.Flags.DeviceFilterUUIDRegex); err != nil {
+		return fmt.Errorf("invalid --device-filter-uuid-regex option: %v", err)
+	}
+
+	for _, index := range config.Flags.DeviceFilterIndex {
+		if _, err := strconv.ParseUint(strings.TrimSpace(index), 10, 0); err != nil {
+			return fmt.Errorf("invalid --device-filter-index option: %q is not a device index", index)
+		}
+	}
+
+	if config.Flags.TopologyFile != "" {
+		if _, err := topology.Load(config.Flags.TopologyFile); err != nil {
+			return fmt.Errorf("invalid --topology-file option: %v", err)
+		}
+	}
+
+	if config.Flags.HealthDebounceMs < 0 {
+		return fmt.Errorf("invalid --health-debounce-ms option: %v", config.Flags.HealthDebounceMs)
+	}
+
+	if config.Flags.DeviceCacheTTL <= 0 {
+		return fmt.Errorf("invalid --device-cache-ttl option: %v", time.Duration(config.Flags.DeviceCacheTTL))
+	}
+
+	if _, err := parseTieredResources(config.Flags.TieredResources); err != nil {
+		return fmt.Errorf("invalid --tiered-resources option: %v", err)
+	}
+
+	if config.Flags.NodeLabelSelector != "" {
+		if _, err := parseLabelSelector(config.Flags.NodeLabelSelector); err != nil {
+			return fmt.Errorf("invalid --node-label-selector option: %v", err)
+		}
+	}
+
+	if _, err := parsePluginLabels(config.Flags.PluginLabels); err != nil {
+		return fmt.Errorf("invalid --plugin-label option: %v", err)
+	}
+
+	if len(config.Resources) > 0 {
+		if resourceConfigFlag != "" {
+			slog.Warn("Ignoring --resource-config in favor of the resources of the config file")
+		}
+		resourceConfig = resourceConfigFromResources(config.Resources)
+		slog.Info("Using variant config", "resource_config", resourceConfig)
+		return nil
+	}
+
 	var err error
 	resourceConfig, err = parseResourceConfig(resourceConfigFlag)
 	if err != nil {
 		return fmt.Errorf("Invalid --resource-config option: '%s' %w", resourceConfigFlag, err)
 	}
-	log.Printf("Using variant config: %v", resourceConfig)
+	slog.Info("Using variant config", "resource_config", resourceConfig)
 
 	return nil
 }
@@ -202,85 +1167,336 @@ func parseResourceConfig(config string) (resourceConfiguration, error) {
 	return resourceConfig, nil
 }
 
+// resourceConfigFromResources returns the variants of the resources of the config file, which keep their name
+func resourceConfigFromResources(resources config.Resources) resourceConfiguration {
+	resourceConfig := resourceConfiguration{}
+	for name, replicas := range resources {
+		v := variant{Name: name, Replicas: replicas.Count}
+		if replicas.Auto {
+			v.Replicas = 1
+			v.AutoReplicas = true
+		}
+		resourceConfig[name] = v
+	}
+	return resourceConfig
+}
+
+// parsePluginLabels parses a list of key=value pairs into a map of labels
+func parsePluginLabels(pluginLabels []string) (map[string]string, error) {
+	labels := make(map[string]string)
+	for _, label := range pluginLabels {
+		parts := strings.SplitN(label, "=", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+			return nil, fmt.Errorf("label '%s' must be of the form key=value", label)
+		}
+		labels[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
+	}
+	return labels, nil
+}
+
+// startPlugins starts the plugins concurrently, returning the error each of them failed to start with, if any.
+// The registration of the plugins with the kubelet is given up once 'ctx' is done.
+func startPlugins(ctx context.Context, plugins []*NvidiaDevicePlugin) []error {
+	errs := make([]error, len(plugins))
+	var wg sync.WaitGroup
+	for i, p := range plugins {
+		wg.Add(1)
+		go func(i int, p *NvidiaDevicePlugin) {
+			defer wg.Done()
+			errs[i] = p.StartWithContext(ctx)
+		}(i, p)
+	}
+	wg.Wait()
+	return errs
+}
+
+// labelPluginPod adds the labels passed via --plugin-label to the pod the plugin is running in.
+// Errors are logged but not fatal since the labels are only a convenience for operators.
+func labelPluginPod(config *config.Config) {
+	if len(config.Flags.PluginLabels) == 0 || config.Flags.NoSelfLabel {
+		return
+	}
+
+	name, namespace := os.Getenv(envPodName), os.Getenv(envPodNamespace)
+	if name == "" || namespace == "" {
+		slog.Warn("Not labelling plugin pod, " + envPodName + " and " + envPodNamespace + " must be set")
+		return
+	}
+
+	labels, err := parsePluginLabels(config.Flags.PluginLabels)
+	if err != nil {
+		slog.Warn("Not labelling plugin pod", "error", err)
+		return
+	}
+
+	client, err := NewInClusterKubeClient()
+	if err != nil {
+		slog.Warn("Not labelling plugin pod", "error", err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	if err := client.PatchPodLabels(ctx, namespace, name, labels); err != nil {
+		slog.Error("Failed to label plugin pod", "pod", namespace+"/"+name, "error", err)
+		return
+	}
+	slog.Info("Labelled plugin pod", "pod", namespace+"/"+name, "labels", labels)
+}
+
 func start(c *cli.Context, config *config.Config) error {
-	configJSON, err := json.MarshalIndent(config, "", "  ")
+	configJSON, err := json.Marshal(config)
 	if err != nil {
 		return fmt.Errorf("failed to marshal config to JSON: %v", err)
 	}
-	log.Printf("\nRunning with config:\n%v", string(configJSON))
+	slog.Info("Running with config", "config", string(configJSON))
 
-	resourceConfigJSON, err := json.MarshalIndent(resourceConfig, "", "  ")
+	resourceConfigJSON, err := json.Marshal(resourceConfig)
 	if err != nil {
 		return fmt.Errorf("failed to marshal config to JSON: %v", err)
 	}
+	slog.Info("Running with resource config", "resource_config", string(resourceConfigJSON))
+
+	if config.Flags.NoHealthCheck {
+		slog.Warn("Device health checks are disabled, failing devices will keep being reported healthy and allocated to pods")
+	}
+
+	if config.Flags.ExtenderMode {
+		return runExtender(config)
+	}
 
-	log.Printf("\nRunning with resource config:\n%v", string(resourceConfigJSON))
+	if config.Flags.NodeLabelSelector != "" {
+		matches, err := checkNodeLabelSelector(config.Flags.NodeLabelSelector)
+		if err != nil {
+			return fmt.Errorf("failed to match the node labels against --node-label-selector: %v", err)
+		}
+		if !matches {
+			slog.Info("The node labels do not match --node-label-selector, exiting", "selector", config.Flags.NodeLabelSelector)
+			return nil
+		}
+	}
 
-	log.Println("Loading NVML")
-	if err := nvml.Init(); err != nil {
-		log.SetOutput(os.Stderr)
-		log.Printf("Failed to initialize NVML: %v.", err)
-		log.Printf("If this is a GPU node, did you set the docker default runtime to `nvidia`?")
-		log.Printf("You can check the prerequisites at: https://github.com/NVIDIA/k8s-device-plugin#prerequisites")
-		log.Printf("You can learn how to set the runtime at: https://github.com/NVIDIA/k8s-device-plugin#quick-start")
-		log.Printf("If this is not a GPU node, you should set up a toleration or nodeSelector to only deploy this plugin on GPU nodes")
-		if config.Flags.FailOnInitError {
-			return fmt.Errorf("failed to initialize NVML: %v", err)
+	if simulatingGPUs(config) {
+		slog.Info("Simulating GPUs instead of loading NVML", "gpus", config.Flags.SimulateNGPUs)
+	} else {
+		slog.Info("Loading NVML")
+		if err := nvml.Init(); err != nil {
+			slog.Error("Failed to initialize NVML", logKeyEventType, "nvml_init_failed", "error", err)
+			slog.Info("If this is a GPU node, did you set the docker default runtime to `nvidia`?")
+			slog.Info("You can check the prerequisites at: https://github.com/NVIDIA/k8s-device-plugin#prerequisites")
+			slog.Info("You can learn how to set the runtime at: https://github.com/NVIDIA/k8s-device-plugin#quick-start")
+			slog.Info("If this is not a GPU node, you should set up a toleration or nodeSelector to only deploy this plugin on GPU nodes")
+			if config.Flags.FailOnInitError || config.Flags.DryRun {
+				return fmt.Errorf("failed to initialize NVML: %v", err)
+			}
+			select {}
 		}
-		select {}
+		defer func() { slog.Info("Shut down NVML", "result", nvml.Shutdown()) }()
 	}
-	defer func() { log.Println("Shutdown of NVML returned:", nvml.Shutdown()) }()
 
-	log.Println("Starting FS watcher.")
-	watcher, err := newFSWatcher(pluginapi.DevicePluginPath)
-	if err != nil {
-		return fmt.Errorf("failed to create FS watcher: %v", err)
+	if config.Flags.DryRun {
+		migStrategy, err := NewMigStrategy(config, resourceConfig)
+		if err != nil {
+			return fmt.Errorf("error creating MIG strategy: %v", err)
+		}
+		return dryRun(os.Stdout, migStrategy)
+	}
+
+	if err := checkSocketDir(config.Flags.SocketDir); err != nil {
+		return fmt.Errorf("invalid --socket-dir option: %v", err)
+	}
+
+	// Without inotify, fall back to polling for the plugin sockets to detect kubelet restarts
+	var fsEvents chan fsnotify.Event
+	var fsErrors chan error
+	socketWatchInterval := time.Duration(config.Flags.SocketWatchInterval)
+	if socketWatchInterval == 0 {
+		slog.Info("Starting FS watcher")
+		watcher, err := newFSWatcher(config.Flags.SocketDir)
+		if err != nil {
+			slog.Warn("Failed to create FS watcher, polling for sockets instead", "interval", defaultSocketWatchInterval, "error", err)
+			socketWatchInterval = defaultSocketWatchInterval
+		} else {
+			defer watcher.Close()
+			fsEvents, fsErrors = watcher.Events, watcher.Errors
+		}
+	}
+	var socketWatcher *socketWatcher
+	defer func() { socketWatcher.Close() }()
+
+	slog.Info("Starting OS watcher")
+	sigs := newOSWatcher(syscall.SIGHUP, syscall.SIGUSR1, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
+
+	var debugServer *DebugServer
+	if config.Flags.DebugAddr != "" {
+		debugServer = NewDebugServer()
+		debugServer.HandlePreStop(time.Duration(config.Flags.PreStopTimeout), uint(config.Flags.PreStopMemoryUtilizationThreshold))
+		debugServer.ListenAndServe(config.Flags.DebugAddr)
+	}
+
+	if addr := config.Flags.MetricsAddr; addr != "" {
+		metrics.ListenAndServe(addr)
+	}
+
+	var healthzServer *HealthzServer
+	if addr := config.Flags.HealthzAddr; addr != "" {
+		healthzServer = NewHealthzServer(time.Duration(config.Flags.HealthzWindow))
+		healthzServer.ListenAndServe(addr)
+	}
+
+	if path := config.Flags.ExportPrometheusTextfile; path != "" {
+		slog.Info("Exporting metrics", "path", path, "interval", textfileExportInterval)
+		stopExport := make(chan struct{})
+		defer close(stopExport)
+		go metrics.ExportTextfile(stopExport, path, textfileExportInterval)
 	}
-	defer watcher.Close()
 
-	log.Println("Starting OS watcher.")
-	sigs := newOSWatcher(syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
+	if endpoint := config.Flags.OTelEndpoint; endpoint != "" {
+		slog.Info("Exporting traces", "endpoint", endpoint, "interval", traceExportInterval)
+		exporter := NewOTLPExporter(endpoint, traceExportInterval)
+		defer exporter.Shutdown()
+		tracer = NewTracer(tracerName, exporter)
+	}
+
+	if path := config.Flags.AuditLogFile; path != "" {
+		slog.Info("Recording allocations", "path", path)
+		a, err := NewAuditLog(path, int64(config.Flags.AuditLogMaxSizeMB)*1024*1024, config.Flags.AuditLogMaxBackups)
+		if err != nil {
+			return err
+		}
+		defer a.Close()
+		auditLog = a
+	}
+
+	if threshold := config.Flags.GoroutineAlertThreshold; threshold > 0 {
+		goroutineWatch := newGoroutineWatcher(threshold, goroutineCheckInterval, runtime.NumGoroutine)
+		defer goroutineWatch.Stop()
+	}
+
+	// With leader election, only the pod holding the lease of the node serves the plugins.
+	// The other pods run the health checks while they wait to take over, and the leader exits once it loses the lease.
+	var leadershipLost chan struct{}
+	if config.Flags.LeaderElection {
+		elector, err := NewInClusterLeaderElector()
+		if err != nil {
+			return fmt.Errorf("unable to set up leader election: %v", err)
+		}
+		leading := make(chan struct{})
+		leadershipLost = make(chan struct{})
+		stopElection := make(chan interface{})
+		defer close(stopElection)
+
+		slog.Info("Waiting to become the leader")
+		go elector.Run(stopElection, leaderElectionRetryPeriod, func() { close(leading) }, func() { close(leadershipLost) })
+		stopStandby, err := startStandby(config)
+		if err != nil {
+			return err
+		}
+		select {
+		case <-leading:
+			stopStandby()
+		case s := <-sigs:
+			stopStandby()
+			slog.Info("Received signal while waiting to become the leader, shutting down", "signal", s)
+			return nil
+		}
+	}
+
+	var configMapWatcher *configMapWatcher
+	if ref := config.Flags.WatchConfigMap; ref != "" {
+		namespace, name, _ := parseNamespacedName(ref) // validated by validateFlags
+		client, err := NewInClusterKubeClient()
+		if err != nil {
+			return fmt.Errorf("unable to watch ConfigMap %s: %v", ref, err)
+		}
+		slog.Info("Watching ConfigMap for changes to the resources", "configmap", ref, "interval", configMapWatchInterval)
+		configMapWatcher = newConfigMapWatcher(client, namespace, name, configMapWatchInterval)
+		defer configMapWatcher.Close()
+	}
+
+	// The plugins must be registered within --startup-timeout, rather than retrying forever if the kubelet is down
+	startupCtx, confirmStartup := startupWatchdog(time.Duration(config.Flags.StartupTimeout), exitOnStartupTimeout)
+	defer confirmStartup()
 
 	var plugins []*NvidiaDevicePlugin
+	var rollingRestart *backgroundRollingRestart
+	startRetryBackoff := newExponentialBackoff(initialStartRetryBackoff, maxStartRetryBackoff)
+	var serveFailures chan *NvidiaDevicePlugin
+	var devicesFound chan *NvidiaDevicePlugin
+	configs := newConfigHolder(config)
 restart:
 	// If we are restarting, idempotently stop any running plugins before
 	// recreating them below.
+	rollingRestart.Cancel()
+	rollingRestart = nil
 	for _, p := range plugins {
 		p.Stop()
 	}
+	socketWatcher.Close()
+	socketWatcher = nil
 
-	log.Println("Retreiving plugins.")
+	config = configs.Get()
+	slog.Info("Retrieving plugins")
 	migStrategy, err := NewMigStrategy(config, resourceConfig)
 	if err != nil {
 		return fmt.Errorf("error creating MIG strategy: %v", err)
 	}
-	plugins = migStrategy.GetPlugins()
-
-	// Loop through all plugins, starting them if they have any devices
-	// to serve. If even one plugin fails to start properly, try
-	// starting them all again.
-	started := 0
-	pluginStartError := make(chan struct{})
+	plugins, err = migStrategy.GetPlugins()
+	if err != nil {
+		return fmt.Errorf("error creating plugins: %v", err)
+	}
+	serveFailures = make(chan *NvidiaDevicePlugin, len(plugins))
+	devicesFound = make(chan *NvidiaDevicePlugin, len(plugins))
 	for _, p := range plugins {
-		// Just continue if there are no devices to serve for plugin p.
-		if len(p.Devices()) == 0 {
-			continue
-		}
+		p.serveFailures = serveFailures
+		p.devicesFound = devicesFound
+	}
+	if debugServer != nil {
+		debugServer.SetPlugins(plugins)
+	}
+	if healthzServer != nil {
+		healthzServer.SetPlugins(nil)
+	}
 
-		// Start the gRPC server for plugin p and connect it with the kubelet.
-		if err := p.Start(); err != nil {
-			log.SetOutput(os.Stderr)
-			log.Println("Could not contact Kubelet, retrying. Did you enable the device plugin feature gate?")
-			log.Printf("You can check the prerequisites at: https://github.com/NVIDIA/k8s-device-plugin#prerequisites")
-			log.Printf("You can learn how to set the runtime at: https://github.com/NVIDIA/k8s-device-plugin#quick-start")
-			close(pluginStartError)
+	// Start all plugins that have any devices to serve concurrently, including those restored from
+	// --device-cache-file while NVML reports none. If even one plugin fails to start properly, try
+	// starting them all again.
+	var sockets []string
+	var pluginStartRetry <-chan time.Time
+	warnUnknownIgnoredDevices(plugins, config.Flags.IgnoreDeviceUUIDs)
+	served := pluginsToServe(plugins)
+	for _, p := range served {
+		sockets = append(sockets, p.socket)
+	}
+	if healthzServer != nil {
+		healthzServer.SetPlugins(served)
+	}
+	for _, err := range startPlugins(startupCtx, served) {
+		if err != nil {
+			slog.Error("Could not contact Kubelet, retrying. Did you enable the device plugin feature gate?", logKeyEventType, "plugin_start_failed", "error", err)
+			slog.Info("You can check the prerequisites at: https://github.com/NVIDIA/k8s-device-plugin#prerequisites")
+			slog.Info("You can learn how to set the runtime at: https://github.com/NVIDIA/k8s-device-plugin#quick-start")
+			delay := startRetryBackoff.Next()
+			slog.Info("Restarting the plugins", "delay", delay)
+			pluginStartRetry = time.After(delay)
 			goto events
 		}
-		started++
+	}
+	startRetryBackoff.Reset()
+	// Later restarts, e.g. of the kubelet, are not bounded by --startup-timeout
+	confirmStartup()
+	startupCtx = context.Background()
+
+	if socketWatchInterval > 0 && len(served) > 0 {
+		slog.Info("Polling for plugin sockets", "interval", socketWatchInterval)
+		socketWatcher = newSocketWatcher(socketWatchInterval, sockets...)
 	}
 
-	if started == 0 {
-		log.Println("No devices found. Waiting indefinitely.")
+	if len(served) == 0 {
+		slog.Warn("No devices found, waiting indefinitely", logKeyEventType, "no_devices")
+	} else {
+		labelPluginPod(config)
 	}
 
 events:
@@ -288,33 +1504,130 @@ events:
 	// some messages, trigger a restart of the plugins, or exit the program.
 	for {
 		select {
-		// If there was an error starting any plugins, restart them all.
-		case <-pluginStartError:
+		// If there was an error starting any plugins, restart them all once the backoff elapsed.
+		case <-pluginStartRetry:
+			goto restart
+
+		// If the gRPC server of a plugin gave up after crashing repeatedly, restart that plugin alone
+		// so that the others keep serving.
+		case p := <-serveFailures:
+			if rollingRestart != nil {
+				p.logger.Warn("GRPC server gave up during a rolling restart, restarting all plugins")
+				goto restart
+			}
+			if p.server == nil {
+				// The plugin was stopped in the meantime
+				continue
+			}
+			p.logger.Warn("Restarting plugin after its GRPC server gave up")
+			// Its socket disappears while it restarts, which must not be taken for a kubelet restart
+			socketWatcher.Close()
+			socketWatcher = nil
+			p.Stop()
+			if err := p.Start(); err != nil {
+				p.logger.Error("Could not restart plugin, restarting all plugins", "error", err)
+				goto restart
+			}
+			if socketWatchInterval > 0 && len(sockets) > 0 {
+				socketWatcher = newSocketWatcher(socketWatchInterval, sockets...)
+			}
+
+		// NVML reports devices again for a plugin serving those restored from --device-cache-file.
+		// Restart all plugins, as the others may have found devices again as well.
+		case p := <-devicesFound:
+			p.logger.Info("Restarting all plugins with the devices reported by NVML")
 			goto restart
 
 		// Detect a kubelet restart by watching for a newly created
-		// 'pluginapi.KubeletSocket' file. When this occurs, restart this loop,
+		// kubelet socket file. When this occurs, restart this loop,
 		// restarting all of the plugins in the process.
-		case event := <-watcher.Events:
-			if event.Name == pluginapi.KubeletSocket && event.Op&fsnotify.Create == fsnotify.Create {
-				log.Printf("inotify: %s created, restarting.", pluginapi.KubeletSocket)
+		case event := <-fsEvents:
+			if event.Name == kubeletSocketPath(config.Flags.SocketDir) && event.Op&fsnotify.Create == fsnotify.Create {
+				slog.Info("Kubelet socket created, restarting", "socket", event.Name)
 				goto restart
 			}
 
 		// Watch for any other fs errors and log them.
-		case err := <-watcher.Errors:
-			log.Printf("inotify: %s", err)
+		case err := <-fsErrors:
+			slog.Warn("inotify failed", "error", err)
+
+		// When polling, a plugin socket disappearing means the kubelet restarted
+		// and cleaned up its plugin directory.
+		case socket := <-socketWatcher.events():
+			slog.Info("Plugin socket removed, restarting", "socket", socket)
+			goto restart
 
-		// Watch for any signals from the OS. On SIGHUP, restart this loop,
-		// restarting all of the plugins in the process. On all other
-		// signals, exit the loop and exit the program.
+		// The resources of the watched ConfigMap changed. New numbers of replicas are applied to the
+		// running plugins, which are only restarted if the resources to advertise changed otherwise.
+		case resources := <-configMapWatcher.events():
+			updated := resourceConfigFromResources(resources)
+			if reflect.DeepEqual(updated, resourceConfig) {
+				continue
+			}
+			slog.Info("ConfigMap changed", logKeyEventType, "configmap_changed", "configmap", config.Flags.WatchConfigMap, "resource_config", updated)
+			resourceConfig = updated
+			if rollingRestart != nil {
+				slog.Info("Interrupting the rolling restart to apply the new config, restarting all plugins")
+				goto restart
+			}
+			if err := resizePlugins(config, resourceConfig, plugins); err != nil {
+				slog.Warn("Unable to resize the running plugins, restarting", "error", err)
+				goto restart
+			}
+
+		// The rolling restart started on SIGUSR1 completed. It runs in the background so that other events,
+		// e.g. SIGTERM, are still handled in the meantime.
+		case err := <-rollingRestart.done():
+			rollingRestart = nil
+			if err != nil {
+				slog.Error("Rolling restart failed, restarting all plugins", logKeyEventType, "rolling_restart", "error", err)
+				goto restart
+			}
+			slog.Info("Rolling restart completed", logKeyEventType, "rolling_restart")
+			if socketWatchInterval > 0 && len(sockets) > 0 {
+				socketWatcher = newSocketWatcher(socketWatchInterval, sockets...)
+			}
+
+		// Another pod took over the lease, stop serving the plugins.
+		case <-leadershipLost:
+			rollingRestart.Cancel()
+			for _, p := range plugins {
+				p.Stop()
+			}
+			return fmt.Errorf("lost leadership")
+
+		// Watch for any signals from the OS. On SIGHUP, reload the config and
+		// restart this loop, restarting all of the plugins in the process with
+		// the new config (e.g. new replica counts). On SIGUSR1, restart
+		// the running plugins one at a time. On all other signals, exit the
+		// loop and exit the program.
 		case s := <-sigs:
 			switch s {
 			case syscall.SIGHUP:
-				log.Println("Received SIGHUP, restarting.")
+				slog.Info("Received SIGHUP, reloading config and restarting")
+				if err := configs.Reload(c); err != nil {
+					slog.Error("Failed to reload config, restarting with the previous one", logKeyEventType, "config_reload_failed", "error", err)
+				}
 				goto restart
+			case syscall.SIGUSR1:
+				if rollingRestart != nil {
+					slog.Info("Received SIGUSR1, a rolling restart is already in progress")
+					continue
+				}
+				slog.Info("Received SIGUSR1, restarting plugins one at a time", logKeyEventType, "rolling_restart")
+				var running []*NvidiaDevicePlugin
+				for _, p := range plugins {
+					if p.server != nil {
+						running = append(running, p)
+					}
+				}
+				// The sockets of the plugins disappear while they restart, which must not be taken for a kubelet restart
+				socketWatcher.Close()
+				socketWatcher = nil
+				rollingRestart = NewDevicePluginWatcher(running, time.Duration(config.Flags.RollingRestartDrainTimeout)).Background()
 			default:
-				log.Printf("Received signal \"%v\", shutting down.", s)
+				slog.Info("Received signal, shutting down", "signal", s)
+				rollingRestart.Cancel()
 				for _, p := range plugins {
 					p.Stop()
 				}
@@ -324,3 +1637,27 @@ events:
 	}
 	return nil
 }
+
+// runExtender serves the scheduler extender verbs until the process is signalled to exit.
+// The extender does not need any GPU and is meant to run alongside the scheduler rather than on GPU nodes.
+func runExtender(config *config.Config) error {
+	client, err := NewInClusterKubeClient()
+	if err != nil {
+		return fmt.Errorf("unable to create Kubernetes client for the scheduler extender: %v", err)
+	}
+	extender := NewExtender(gpuResourceName(config, resourceConfig), client)
+
+	errs := make(chan error, 1)
+	go func() {
+		errs <- extender.ListenAndServe(config.Flags.ExtenderAddr)
+	}()
+
+	sigs := newOSWatcher(syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
+	select {
+	case err := <-errs:
+		return fmt.Errorf("scheduler extender stopped: %v", err)
+	case s := <-sigs:
+		slog.Info("Received signal, shutting down", "signal", s)
+		return nil
+	}
+}
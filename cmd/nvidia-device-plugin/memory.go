@@ -0,0 +1,229 @@
+/*
+ * Copyright (c) 2022, NVIDIA CORPORATION.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/NVIDIA/gpu-monitoring-tools/bindings/go/nvml"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+// lowMemoryPollInterval is how often the free memory of each GPU is read when --scale-down-on-low-memory is set
+const lowMemoryPollInterval = 30 * time.Second
+
+// replicaScaling is the number of replicas of a physical device to withhold from the kubelet
+type replicaScaling struct {
+	device   *Device
+	withheld int
+}
+
+// queryFreeMemory returns the free memory of a device in MiB
+func queryFreeMemory(uuid string) (uint64, error) {
+	dev, err := nvml.NewDeviceLiteByUUID(uuid)
+	if err != nil {
+		return 0, err
+	}
+	status, err := dev.Status()
+	if err != nil {
+		return 0, err
+	}
+	if status.Memory.Global.Free == nil {
+		return 0, fmt.Errorf("free memory of device %s is not available", uuid)
+	}
+	return *status.Memory.Global.Free, nil
+}
+
+// queryUsedMemory returns the memory of a device in use by the driver and by processes in MiB
+func queryUsedMemory(uuid string) (uint64, error) {
+	dev, err := nvml.NewDeviceLiteByUUID(uuid)
+	if err != nil {
+		return 0, err
+	}
+	status, err := dev.Status()
+	if err != nil {
+		return 0, err
+	}
+	if status.Memory.Global.Used == nil {
+		return 0, fmt.Errorf("used memory of device %s is not available", uuid)
+	}
+	return *status.Memory.Global.Used, nil
+}
+
+// availableMemory returns the memory of the device in MiB that is shared among its auto replicas
+func (d *Device) availableMemory() uint {
+	if d.ReservedMemoryMB >= d.TotalMemory {
+		return 0
+	}
+	return d.TotalMemory - d.ReservedMemoryMB
+}
+
+// setReservedMemory sets the memory of each device not to share among auto replicas: the
+// --reserved-memory-per-gpu-mb, or when it is -1, the memory already used when the plugin starts
+func (m *NvidiaDevicePlugin) setReservedMemory() {
+	for _, d := range m.cachedDevices {
+		reserved := uint64(m.config.Flags.ReservedMemoryPerGPUMB)
+		if m.config.Flags.ReservedMemoryPerGPUMB < 0 {
+			used, err := m.queryUsedMemory(d.ID)
+			if err != nil {
+				m.logger.Warn("Unable to determine the used memory of device, not reserving any", logKeyEventType, "memory_query_failed", logKeyDeviceUUID, d.ID, "error", err)
+			}
+			reserved = used
+		}
+		d.ReservedMemoryMB = uint(reserved)
+		m.logger.Info("Device memory", logKeyEventType, "device_memory", logKeyDeviceUUID, d.ID,
+			"total_memory_mib", d.TotalMemory, "reserved_memory_mib", d.ReservedMemoryMB, "available_memory_mib", d.availableMemory())
+	}
+}
+
+// withheldReplicasForFreeMemory returns how many of the 'replicas' of a device with 'total' MiB of memory
+// to withhold so that the free memory is back above 'minFree' MiB. Each replica is assumed to use an
+// equal share of the total memory of the device.
+func withheldReplicasForFreeMemory(total uint64, free uint64, minFree uint64, replicas int) int {
+	if free >= minFree || replicas == 0 {
+		return 0
+	}
+
+	perReplica := total / uint64(replicas)
+	if perReplica == 0 {
+		perReplica = 1
+	}
+	withheld := int((minFree - free + perReplica - 1) / perReplica)
+	if withheld > replicas {
+		withheld = replicas
+	}
+	return withheld
+}
+
+// replicasOf returns the replicas advertised for a physical device. The caller must hold m.mu.
+func (m *NvidiaDevicePlugin) replicasOf(d *Device) []*Device {
+	var replicas []*Device
+	for _, r := range m.deviceReplicas {
+		if stripReplica(r.ID, m.replicaCodec) == d.ID {
+			replicas = append(replicas, r)
+		}
+	}
+	return replicas
+}
+
+// watchFreeMemory polls each device for its free memory until 'stop' is closed and sends the number of
+// replicas to withhold to ListAndWatch whenever it changes
+func (m *NvidiaDevicePlugin) watchFreeMemory(stop <-chan interface{}, devices []*Device, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	minFree := uint64(m.config.Flags.MinFreeMemoryMiB)
+	withheld := make(map[string]int)
+	for {
+		for _, d := range devices {
+			free, err := m.queryFreeMemory(d.ID)
+			if err != nil {
+				m.logger.Warn("Unable to read free memory of device", logKeyEventType, "memory_query_failed", logKeyDeviceUUID, d.ID, "error", err)
+				continue
+			}
+			m.mu.RLock()
+			replicas := len(m.replicasOf(d))
+			m.mu.RUnlock()
+			n := withheldReplicasForFreeMemory(uint64(d.TotalMemory), free, minFree, replicas)
+			if n == withheld[d.ID] {
+				continue
+			}
+			m.logger.Info("Withholding replicas for the free memory of the device", logKeyEventType, "replicas_withheld", logKeyDeviceUUID, d.ID, "free_memory_mib", free, "min_free_memory_mib", minFree, "withheld", n)
+			withheld[d.ID] = n
+
+			select {
+			case m.scaling <- replicaScaling{device: d, withheld: n}:
+			case <-stop:
+				return
+			}
+		}
+
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// updateReplicaHealth sets the health of the replicas of a physical device to its own health,
+// except for the replicas withheld due to low memory and the retired ones which are reported unhealthy
+func (m *NvidiaDevicePlugin) updateReplicaHealth(d *Device) {
+	var replicas []*Device
+	for _, r := range m.replicasOf(d) {
+		if _, retired := m.retiredReplicas[r.ID]; retired {
+			r.Health = pluginapi.Unhealthy
+			continue
+		}
+		replicas = append(replicas, r)
+	}
+	withheld := m.withheldReplicas[d.ID]
+	for i, r := range replicas {
+		r.Health = d.Health
+		if i >= len(replicas)-withheld {
+			r.Health = pluginapi.Unhealthy
+		}
+	}
+}
+
+// replicaCount returns the number of replicas of a device, capped at --max-replicas-per-device
+func (m *NvidiaDevicePlugin) replicaCount(d *Device) uint {
+	replicas := m.replicas
+	if m.autoReplicas {
+		replicas = m.autoReplicaCount(d)
+	}
+	if max := uint(m.config.Flags.MaxReplicasPerDevice); max > 0 && replicas > max {
+		m.logger.Warn("Capping replicas to --max-replicas-per-device", logKeyEventType, "replicas_capped", logKeyDeviceUUID, d.ID, "replicas", replicas, "max", max)
+		replicas = max
+	}
+	return replicas
+}
+
+// validateReplicaBounds checks the --min-replicas and --max-replicas options clamping the number of auto replicas
+func validateReplicaBounds(min int, max int) error {
+	if min < 0 {
+		return fmt.Errorf("invalid --min-replicas option: %v", min)
+	}
+	if max < 0 {
+		return fmt.Errorf("invalid --max-replicas option: %v", max)
+	}
+	if max > 0 && min > max {
+		return fmt.Errorf("invalid --min-replicas option: %v exceeds --max-replicas %v", min, max)
+	}
+	return nil
+}
+
+// autoReplicaCount returns the number of replicas of a device when they are derived from its memory: one
+// replica per --memory-slice-mb MiB of its memory not reserved, capped at --max-auto-replicas to stay
+// below the ~64K devices the kubelet can handle, then clamped between --min-replicas and --max-replicas
+func (m *NvidiaDevicePlugin) autoReplicaCount(d *Device) uint {
+	replicas := d.availableMemory() / uint(m.config.Flags.MemorySliceMB)
+	if max := uint(m.config.Flags.MaxAutoReplicas); replicas > max {
+		m.logger.Warn("Capping replicas to --max-auto-replicas", logKeyEventType, "replicas_capped", logKeyDeviceUUID, d.ID, "replicas", replicas, "slice_mib", m.config.Flags.MemorySliceMB, "max", max)
+		replicas = max
+	}
+	if min := uint(m.config.Flags.MinReplicas); replicas < min {
+		m.logger.Info("Raising replicas to --min-replicas", logKeyEventType, "replicas_clamped", logKeyDeviceUUID, d.ID, "replicas", replicas, "slice_mib", m.config.Flags.MemorySliceMB, "min", min)
+		replicas = min
+	}
+	if max := uint(m.config.Flags.MaxReplicas); max > 0 && replicas > max {
+		m.logger.Info("Lowering replicas to --max-replicas", logKeyEventType, "replicas_clamped", logKeyDeviceUUID, d.ID, "replicas", replicas, "slice_mib", m.config.Flags.MemorySliceMB, "max", max)
+		replicas = max
+	}
+	return replicas
+}
@@ -0,0 +1,225 @@
+/*
+ * Copyright (c) 2022, NVIDIA CORPORATION.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	config "github.com/NVIDIA/k8s-device-plugin/api/config/v1"
+	"github.com/stretchr/testify/require"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+func TestWithheldReplicasForFreeMemory(t *testing.T) {
+	testCases := []struct {
+		total, free, minFree uint64
+		replicas             int
+		expected             int
+	}{
+		{16000, 8000, 1024, 4, 0},
+		{16000, 1024, 1024, 4, 0},
+		{16000, 1000, 1024, 4, 1},
+		{16000, 0, 1024, 4, 1},
+		{16000, 0, 4001, 4, 2},
+		{16000, 0, 64000, 4, 4},
+		{16000, 0, 1024, 0, 0},
+	}
+
+	for _, tc := range testCases {
+		require.Equal(t, tc.expected, withheldReplicasForFreeMemory(tc.total, tc.free, tc.minFree, tc.replicas), "%+v", tc)
+	}
+}
+
+func TestAutoReplicas(t *testing.T) {
+	m := newTestPlugin(config.CommandLineFlags{MemorySliceMB: 512, MaxAutoReplicas: 100}, 1,
+		&Device{Device: newPluginDevice("GPU-0"), TotalMemory: 16000},
+		&Device{Device: newPluginDevice("GPU-1"), TotalMemory: 81920},
+	)
+	logs := captureLog(t)
+
+	m.autoReplicas = true
+	m.cleanup()
+	m.initialize()
+
+	require.Len(t, m.replicasOf(m.cachedDevices[0]), 31)
+	require.Len(t, m.replicasOf(m.cachedDevices[1]), 100)
+	require.Contains(t, logs.String(), "device_uuid=GPU-1 replicas=160 slice_mib=512 max=100")
+	require.NotContains(t, logs.String(), "event_type=replicas_capped device_uuid=GPU-0")
+}
+
+func TestAutoReplicasReservedMemory(t *testing.T) {
+	testCases := []struct {
+		description string
+		reserved    int
+		used        map[string]uint64
+		expected    []int
+	}{
+		{"no reserved memory", 0, nil, []int{31, 32}},
+		{"memory used when starting", -1, map[string]uint64{"GPU-0": 1000, "GPU-1": 16384}, []int{29, 0}},
+		{"used memory unknown", -1, map[string]uint64{"GPU-0": 1000}, []int{29, 32}},
+		{"manual override", 4000, map[string]uint64{"GPU-0": 1000}, []int{23, 24}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.description, func(t *testing.T) {
+			m := newTestPlugin(config.CommandLineFlags{MemorySliceMB: 512, MaxAutoReplicas: 100, ReservedMemoryPerGPUMB: tc.reserved}, 1,
+				&Device{Device: newPluginDevice("GPU-0"), TotalMemory: 16000},
+				&Device{Device: newPluginDevice("GPU-1"), TotalMemory: 16384},
+			)
+			m.queryUsedMemory = func(uuid string) (uint64, error) {
+				used, exists := tc.used[uuid]
+				if !exists {
+					return 0, fmt.Errorf("unknown used memory")
+				}
+				return used, nil
+			}
+			logs := captureLog(t)
+
+			m.autoReplicas = true
+			m.cleanup()
+			m.initialize()
+
+			require.Len(t, m.replicasOf(m.cachedDevices[0]), tc.expected[0])
+			require.Len(t, m.replicasOf(m.cachedDevices[1]), tc.expected[1])
+			require.Contains(t, logs.String(), "total_memory_mib=16000")
+		})
+	}
+}
+
+func TestMaxReplicasPerDevice(t *testing.T) {
+	testCases := []struct {
+		description  string
+		replicas     uint
+		autoReplicas bool
+		max          int
+		expected     int
+		warning      string
+	}{
+		{"fixed replicas without maximum", 8, false, 0, 8, ""},
+		{"fixed replicas below the maximum", 8, false, 10, 8, ""},
+		{"fixed replicas above the maximum", 8, false, 4, 4, "Capping replicas to --max-replicas-per-device resource_name=nvidia.com/gpu event_type=replicas_capped device_uuid=GPU-0 replicas=8 max=4"},
+		{"auto replicas without maximum", 0, true, 0, 80, ""},
+		{"auto replicas below the maximum", 0, true, 100, 80, ""},
+		{"auto replicas above the maximum", 0, true, 16, 16, "Capping replicas to --max-replicas-per-device resource_name=nvidia.com/gpu event_type=replicas_capped device_uuid=GPU-0 replicas=80 max=16"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.description, func(t *testing.T) {
+			m := newTestPlugin(config.CommandLineFlags{MemorySliceMB: 1000, MaxAutoReplicas: 64000, MaxReplicasPerDevice: tc.max}, tc.replicas,
+				&Device{Device: newPluginDevice("GPU-0"), TotalMemory: 80000},
+			)
+			logs := captureLog(t)
+
+			m.autoReplicas = tc.autoReplicas
+			m.cleanup()
+			m.initialize()
+
+			require.Len(t, m.replicasOf(m.cachedDevices[0]), tc.expected)
+			if tc.warning != "" {
+				require.Contains(t, logs.String(), tc.warning)
+			} else {
+				require.NotContains(t, logs.String(), "replicas_capped")
+			}
+		})
+	}
+}
+
+func TestMinMaxReplicas(t *testing.T) {
+	testCases := []struct {
+		description  string
+		autoReplicas bool
+		min          int
+		max          int
+		expected     int
+	}{
+		{"within the bounds", true, 1, 0, 4},
+		{"minimum above the computed replicas", true, 8, 0, 8},
+		{"computed replicas above the maximum", true, 1, 2, 2},
+		{"minimum equal to the maximum", true, 3, 3, 3},
+		{"fixed replicas ignore the bounds", false, 8, 2, 4},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.description, func(t *testing.T) {
+			m := newTestPlugin(config.CommandLineFlags{MemorySliceMB: 1000, MaxAutoReplicas: 64000, MinReplicas: tc.min, MaxReplicas: tc.max}, 4,
+				&Device{Device: newPluginDevice("GPU-0"), TotalMemory: 4096},
+			)
+
+			m.autoReplicas = tc.autoReplicas
+			m.cleanup()
+			m.initialize()
+
+			require.Len(t, m.replicasOf(m.cachedDevices[0]), tc.expected)
+		})
+	}
+}
+
+func TestValidateReplicaBounds(t *testing.T) {
+	require.NoError(t, validateReplicaBounds(1, 0))
+	require.NoError(t, validateReplicaBounds(4, 4))
+	require.NoError(t, validateReplicaBounds(16, 0))
+	require.Error(t, validateReplicaBounds(8, 4))
+	require.Error(t, validateReplicaBounds(-1, 0))
+	require.Error(t, validateReplicaBounds(1, -1))
+}
+
+func TestScaleDownOnLowMemory(t *testing.T) {
+	m := newTestPlugin(config.CommandLineFlags{ScaleDownOnLowMemory: true, MinFreeMemoryMiB: 6000}, 4,
+		&Device{Device: newPluginDevice("GPU-0"), TotalMemory: 16000},
+		&Device{Device: newPluginDevice("GPU-1"), TotalMemory: 16000},
+	)
+
+	var lock sync.Mutex
+	free := map[string]uint64{"GPU-0": 10000, "GPU-1": 1000}
+	m.queryFreeMemory = func(uuid string) (uint64, error) {
+		lock.Lock()
+		defer lock.Unlock()
+		return free[uuid], nil
+	}
+
+	stream := newFakeListAndWatchServer()
+	go m.ListAndWatch(&pluginapi.Empty{}, stream)
+	defer close(m.stop)
+	require.NotNil(t, stream.next(time.Second))
+
+	unhealthy := func(resp *pluginapi.ListAndWatchResponse) []string {
+		ids := []string{}
+		for _, d := range resp.Devices {
+			if d.Health == pluginapi.Unhealthy {
+				ids = append(ids, d.ID)
+			}
+		}
+		return ids
+	}
+
+	// 5000 MiB are missing on GPU-1, i.e. the share of two of its replicas
+	go m.watchFreeMemory(m.stop, m.cachedDevices, time.Millisecond)
+	update := stream.next(time.Second)
+	require.NotNil(t, update, "low memory did not withhold any replica")
+	require.Equal(t, []string{"GPU-1-replica-2", "GPU-1-replica-3"}, unhealthy(update))
+
+	// Once the memory is freed, the replicas are advertised again
+	lock.Lock()
+	free["GPU-1"] = 8000
+	lock.Unlock()
+	update = stream.next(time.Second)
+	require.NotNil(t, update)
+	require.Empty(t, unhealthy(update))
+}
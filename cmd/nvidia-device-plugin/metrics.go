@@ -0,0 +1,230 @@
+/*
+ * Copyright (c) 2022, NVIDIA CORPORATION.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// textfileExportInterval is how often the metrics are written with --export-prometheus-textfile
+const textfileExportInterval = 15 * time.Second
+
+// Constants representing the metric types of the Prometheus text format
+const (
+	metricTypeCounter = "counter"
+	metricTypeGauge   = "gauge"
+)
+
+// MetricVec is a metric partitioned by a set of labels
+type MetricVec struct {
+	sync.Mutex
+	name       string
+	help       string
+	metricType string
+	labelNames []string
+	values     map[string]float64
+}
+
+// MetricsRegistry holds the set of metrics exported by the plugin
+type MetricsRegistry struct {
+	sync.Mutex
+	metrics []*MetricVec
+}
+
+// metrics is the registry all of the plugin's metrics are registered with
+var metrics = NewMetricsRegistry()
+
+// NewMetricsRegistry returns an empty MetricsRegistry
+func NewMetricsRegistry() *MetricsRegistry {
+	return &MetricsRegistry{}
+}
+
+// NewCounterVec registers and returns a new counter partitioned by 'labelNames'
+func (r *MetricsRegistry) NewCounterVec(name string, help string, labelNames ...string) *MetricVec {
+	return r.register(name, help, metricTypeCounter, labelNames)
+}
+
+// NewGaugeVec registers and returns a new gauge partitioned by 'labelNames'
+func (r *MetricsRegistry) NewGaugeVec(name string, help string, labelNames ...string) *MetricVec {
+	return r.register(name, help, metricTypeGauge, labelNames)
+}
+
+func (r *MetricsRegistry) register(name string, help string, metricType string, labelNames []string) *MetricVec {
+	r.Lock()
+	defer r.Unlock()
+
+	v := &MetricVec{
+		name:       name,
+		help:       help,
+		metricType: metricType,
+		labelNames: labelNames,
+		values:     make(map[string]float64),
+	}
+	r.metrics = append(r.metrics, v)
+	return v
+}
+
+// Add adds 'delta' to the metric with the given label values
+func (v *MetricVec) Add(delta float64, labelValues ...string) {
+	v.Lock()
+	defer v.Unlock()
+	v.values[v.key(labelValues)] += delta
+}
+
+// Inc increments the metric with the given label values by one
+func (v *MetricVec) Inc(labelValues ...string) {
+	v.Add(1, labelValues...)
+}
+
+// Set sets the metric with the given label values to 'value'
+func (v *MetricVec) Set(value float64, labelValues ...string) {
+	v.Lock()
+	defer v.Unlock()
+	v.values[v.key(labelValues)] = value
+}
+
+// Get returns the current value of the metric with the given label values
+func (v *MetricVec) Get(labelValues ...string) float64 {
+	v.Lock()
+	defer v.Unlock()
+	return v.values[v.key(labelValues)]
+}
+
+// Delete removes the metric with the given label values
+func (v *MetricVec) Delete(labelValues ...string) {
+	v.Lock()
+	defer v.Unlock()
+	delete(v.values, v.key(labelValues))
+}
+
+// key renders the label values in the form used by the Prometheus text format, e.g. {uuid="GPU-0"}
+func (v *MetricVec) key(labelValues []string) string {
+	if len(labelValues) != len(v.labelNames) {
+		panic(fmt.Sprintf("metric %s expects %d label values, got %d", v.name, len(v.labelNames), len(labelValues)))
+	}
+	if len(labelValues) == 0 {
+		return ""
+	}
+
+	var pairs []string
+	for i, name := range v.labelNames {
+		pairs = append(pairs, fmt.Sprintf("%s=%s", name, strconv.Quote(labelValues[i])))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// WriteTo writes all registered metrics to 'w' in the Prometheus text format
+func (r *MetricsRegistry) WriteTo(w io.Writer) (int64, error) {
+	r.Lock()
+	defer r.Unlock()
+
+	var written int64
+	for _, v := range r.metrics {
+		v.Lock()
+		keys := make([]string, 0, len(v.values))
+		for k := range v.values {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		var b strings.Builder
+		fmt.Fprintf(&b, "# HELP %s %s\n", v.name, v.help)
+		fmt.Fprintf(&b, "# TYPE %s %s\n", v.name, v.metricType)
+		for _, k := range keys {
+			fmt.Fprintf(&b, "%s%s %s\n", v.name, k, strconv.FormatFloat(v.values[k], 'g', -1, 64))
+		}
+		v.Unlock()
+
+		n, err := io.WriteString(w, b.String())
+		written += int64(n)
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+// ServeHTTP serves all registered metrics in the Prometheus text format
+func (r *MetricsRegistry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	r.WriteTo(w)
+}
+
+// ListenAndServe serves all registered metrics on 'addr' under /metrics in the background
+func (r *MetricsRegistry) ListenAndServe(addr string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", r)
+	go func() {
+		slog.Info("Starting metrics server", "addr", addr)
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			slog.Error("Metrics server stopped", "addr", addr, "error", err)
+		}
+	}()
+}
+
+// WriteFile atomically replaces 'path' with all registered metrics in the Prometheus text format.
+// The metrics are written to a temporary file in the same directory which is then renamed, so that
+// readers such as the node-exporter textfile collector never see a partially written file.
+func (r *MetricsRegistry) WriteFile(path string) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".")
+	if err != nil {
+		return fmt.Errorf("unable to create temporary file: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := r.WriteTo(tmp); err != nil {
+		tmp.Close()
+		return fmt.Errorf("unable to write metrics: %v", err)
+	}
+	if err := tmp.Chmod(0644); err != nil {
+		tmp.Close()
+		return fmt.Errorf("unable to set permissions: %v", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("unable to write metrics: %v", err)
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// ExportTextfile writes all registered metrics to 'path' every 'interval' until 'stop' is closed
+func (r *MetricsRegistry) ExportTextfile(stop <-chan struct{}, path string, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if err := r.WriteFile(path); err != nil {
+			slog.Warn("Failed to export metrics", "path", path, "error", err)
+		}
+
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,128 @@
+/*
+ * Copyright (c) 2022, NVIDIA CORPORATION.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+var sampleLine = regexp.MustCompile(`^([a-zA-Z_:][a-zA-Z0-9_:]*)(\{[^}]*\})? (\S+)$`)
+
+// parseTextFormat parses metrics in the Prometheus text format into a map from sample (name and labels) to value.
+// It checks that every sample belongs to a metric whose HELP and TYPE have been declared.
+func parseTextFormat(r io.Reader) (map[string]float64, error) {
+	samples := make(map[string]float64)
+	types := make(map[string]string)
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case strings.HasPrefix(line, "# HELP "):
+		case strings.HasPrefix(line, "# TYPE "):
+			fields := strings.Fields(line)
+			if len(fields) != 4 || (fields[3] != metricTypeCounter && fields[3] != metricTypeGauge) {
+				return nil, fmt.Errorf("invalid TYPE line: %q", line)
+			}
+			types[fields[2]] = fields[3]
+		default:
+			match := sampleLine.FindStringSubmatch(line)
+			if match == nil {
+				return nil, fmt.Errorf("invalid sample line: %q", line)
+			}
+			if _, exists := types[match[1]]; !exists {
+				return nil, fmt.Errorf("sample of undeclared metric: %q", line)
+			}
+			value, err := strconv.ParseFloat(match[3], 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid sample value: %q", line)
+			}
+			samples[match[1]+match[2]] = value
+		}
+	}
+	return samples, scanner.Err()
+}
+
+func TestMetricsWriteFile(t *testing.T) {
+	registry := NewMetricsRegistry()
+	counter := registry.NewCounterVec("test_events_total", "Number of test events.", "device_uuid")
+	gauge := registry.NewGaugeVec("test_temperature_celsius", "Temperature of a test device.", "device_uuid")
+	counter.Add(3, "GPU-0")
+	gauge.Set(42.5, "GPU-1")
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "gpu-sharing.prom")
+	require.NoError(t, registry.WriteFile(path))
+
+	file, err := os.Open(path)
+	require.NoError(t, err)
+	defer file.Close()
+
+	samples, err := parseTextFormat(file)
+	require.NoError(t, err)
+	require.Equal(t, map[string]float64{
+		`test_events_total{device_uuid="GPU-0"}`:        3,
+		`test_temperature_celsius{device_uuid="GPU-1"}`: 42.5,
+	}, samples)
+
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0644), info.Mode().Perm())
+
+	// No temporary files are left behind
+	entries, err := ioutil.ReadDir(dir)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+}
+
+func TestMetricsExportTextfile(t *testing.T) {
+	registry := NewMetricsRegistry()
+	counter := registry.NewCounterVec("test_events_total", "Number of test events.")
+	path := filepath.Join(t.TempDir(), "gpu-sharing.prom")
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		registry.ExportTextfile(stop, path, time.Millisecond)
+		close(done)
+	}()
+
+	counter.Inc()
+	require.Eventually(t, func() bool {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return false
+		}
+		samples, err := parseTextFormat(strings.NewReader(string(data)))
+		return err == nil && samples["test_events_total"] == 1
+	}, time.Second, time.Millisecond)
+
+	close(stop)
+	<-done
+}
@@ -18,12 +18,13 @@ package main
 
 import (
 	"fmt"
-	"log"
+	"log/slog"
+	"path/filepath"
+	"strings"
 
 	"github.com/NVIDIA/go-gpuallocator/gpuallocator"
 	"github.com/NVIDIA/gpu-monitoring-tools/bindings/go/nvml"
 	config "github.com/NVIDIA/k8s-device-plugin/api/config/v1"
-	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
 )
 
 // Constants representing the various MIG strategies
@@ -33,12 +34,17 @@ const (
 	MigStrategyMixed  = "mixed"
 )
 
+// isMigDevice returns whether a device is a MIG device rather than a full GPU, going by its UUID
+func isMigDevice(d *Device) bool {
+	return strings.HasPrefix(d.ID, "MIG-")
+}
+
 // MigStrategyResourceSet holds a set of resource names for a given MIG strategy
 type MigStrategyResourceSet map[string]struct{}
 
 // MigStrategy provides an interface for building the set of plugins required to implement a given MIG strategy
 type MigStrategy interface {
-	GetPlugins() []*NvidiaDevicePlugin
+	GetPlugins() ([]*NvidiaDevicePlugin, error)
 	MatchesResource(mig *nvml.Device, resource string) bool
 }
 
@@ -91,19 +97,13 @@ type migStrategyMixed struct {
 }
 
 // migStrategyNone
-func (s *migStrategyNone) GetPlugins() []*NvidiaDevicePlugin {
-	rc := s.ResourceConfig.Get("gpu")
-
-	return []*NvidiaDevicePlugin{
-		NewNvidiaDevicePlugin(
-			s.config,
-			"nvidia.com/"+rc.Name,
-			NewGpuDeviceManager(false), // Enumerate device even if MIG enabled
-			"NVIDIA_VISIBLE_DEVICES",
-			gpuallocator.NewBestEffortPolicy(),
-			pluginapi.DevicePluginPath+"nvidia-gpu.sock",
-			rc.Replicas, rc.AutoReplicas),
+func (s *migStrategyNone) GetPlugins() ([]*NvidiaDevicePlugin, error) {
+	if simulatingGPUs(s.config) {
+		return newSimulatedGPUPlugins(s.config, s.ResourceConfig)
 	}
+	// Enumerate device even if MIG enabled
+	newResourceManager := func() ResourceManager { return NewGpuDeviceManager(s.config, false) }
+	return newGPUPlugins(s.config, s.ResourceConfig, newResourceManager, gpuallocator.NewBestEffortPolicy())
 }
 
 func (s *migStrategyNone) MatchesResource(mig *nvml.Device, resource string) bool {
@@ -111,7 +111,7 @@ func (s *migStrategyNone) MatchesResource(mig *nvml.Device, resource string) boo
 }
 
 // migStrategySingle
-func (s *migStrategySingle) GetPlugins() []*NvidiaDevicePlugin {
+func (s *migStrategySingle) GetPlugins() ([]*NvidiaDevicePlugin, error) {
 	devices := NewMIGCapableDevices()
 
 	migEnabledDevices, err := devices.GetDevicesWithMigEnabled()
@@ -122,7 +122,7 @@ func (s *migStrategySingle) GetPlugins() []*NvidiaDevicePlugin {
 	// If no MIG devices are available fallback to "none" strategy
 	if len(migEnabledDevices) == 0 {
 		none, _ := NewMigStrategy(s.config, s.ResourceConfig)
-		log.Printf("No MIG devices found. Falling back to mig.strategy=%v", none)
+		slog.Info("No MIG devices found, falling back to mig.strategy=none")
 		return none.GetPlugins()
 	}
 
@@ -161,16 +161,18 @@ func (s *migStrategySingle) GetPlugins() []*NvidiaDevicePlugin {
 	}
 
 	rc := s.ResourceConfig.Get("gpu")
-	return []*NvidiaDevicePlugin{
-		NewNvidiaDevicePlugin(
-			s.config,
-			"nvidia.com/"+rc.Name,
-			NewMigDeviceManager(s, "gpu"),
-			"NVIDIA_VISIBLE_DEVICES",
-			gpuallocator.Policy(nil),
-			pluginapi.DevicePluginPath+"nvidia-gpu.sock",
-			rc.Replicas, rc.AutoReplicas),
+	plugin, err := NewNvidiaDevicePlugin(
+		s.config,
+		gpuResourceName(s.config, s.ResourceConfig),
+		NewMigDeviceManager(s.config, s, "gpu"),
+		s.config.Flags.DeviceListEnvvar,
+		gpuallocator.Policy(nil),
+		filepath.Join(s.config.Flags.SocketDir, "nvidia-gpu.sock"),
+		rc.Replicas, rc.AutoReplicas, nil)
+	if err != nil {
+		return nil, err
 	}
+	return []*NvidiaDevicePlugin{plugin}, nil
 }
 
 func (s *migStrategySingle) validMigDevice(mig *nvml.Device) bool {
@@ -203,7 +205,7 @@ func (s *migStrategySingle) MatchesResource(mig *nvml.Device, resource string) b
 }
 
 // migStrategyMixed
-func (s *migStrategyMixed) GetPlugins() []*NvidiaDevicePlugin {
+func (s *migStrategyMixed) GetPlugins() ([]*NvidiaDevicePlugin, error) {
 	devices := NewMIGCapableDevices()
 
 	if err := devices.AssertAllMigEnabledDevicesAreValid(); err != nil {
@@ -218,38 +220,35 @@ func (s *migStrategyMixed) GetPlugins() []*NvidiaDevicePlugin {
 	for _, mig := range migs {
 		r := s.getResourceName(mig)
 		if !s.validMigDevice(mig) {
-			log.Printf("Skipping unsupported MIG device: %v", r)
+			slog.Warn("Skipping unsupported MIG device", logKeyResourceName, r)
 			continue
 		}
 		resources[r] = struct{}{}
 	}
 
-	rc := s.ResourceConfig.Get("gpu")
-	plugins := []*NvidiaDevicePlugin{
-		NewNvidiaDevicePlugin(
-			s.config,
-			"nvidia.com/"+rc.Name,
-			NewGpuDeviceManager(true),
-			"NVIDIA_VISIBLE_DEVICES",
-			gpuallocator.NewBestEffortPolicy(),
-			pluginapi.DevicePluginPath+"nvidia-gpu.sock",
-			rc.Replicas, rc.AutoReplicas),
+	newResourceManager := func() ResourceManager { return NewGpuDeviceManager(s.config, true) }
+	plugins, err := newGPUPlugins(s.config, s.ResourceConfig, newResourceManager, gpuallocator.NewBestEffortPolicy())
+	if err != nil {
+		return nil, err
 	}
 
 	for resource := range resources {
 		rc := s.ResourceConfig.Get(resource)
-		plugin := NewNvidiaDevicePlugin(
+		plugin, err := NewNvidiaDevicePlugin(
 			s.config,
-			"nvidia.com/"+resource,
-			NewMigDeviceManager(s, resource),
-			"NVIDIA_VISIBLE_DEVICES",
+			resourceDomain(s.config)+"/"+resource,
+			NewMigDeviceManager(s.config, s, resource),
+			s.config.Flags.DeviceListEnvvar,
 			gpuallocator.Policy(nil),
-			pluginapi.DevicePluginPath+"nvidia-"+resource+".sock",
-			rc.Replicas, rc.AutoReplicas)
+			filepath.Join(s.config.Flags.SocketDir, "nvidia-"+resource+".sock"),
+			rc.Replicas, rc.AutoReplicas, nil)
+		if err != nil {
+			return nil, err
+		}
 		plugins = append(plugins, plugin)
 	}
 
-	return plugins
+	return plugins, nil
 }
 
 func (s *migStrategyMixed) validMigDevice(mig *nvml.Device) bool {
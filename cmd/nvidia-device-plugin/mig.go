@@ -5,7 +5,7 @@ package main
 import (
 	"bufio"
 	"fmt"
-	"log"
+	"log/slog"
 	"os"
 
 	"github.com/NVIDIA/gpu-monitoring-tools/bindings/go/nvml"
@@ -175,7 +175,7 @@ func GetMigCapabilityDevicePaths() (map[string]string, error) {
 	for scanner.Scan() {
 		capPath, migMinor, err := processLine(scanner.Text())
 		if err != nil {
-			log.Printf("Skipping line in MIG minors file: %v", err)
+			slog.Warn("Skipping line in MIG minors file", "error", err)
 			continue
 		}
 		capsDevicePaths[capPath] = fmt.Sprintf(nvcapsDevicePath+"/nvidia-cap%d", migMinor)
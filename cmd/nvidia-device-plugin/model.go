@@ -0,0 +1,63 @@
+/*
+ * Copyright (c) 2022, NVIDIA CORPORATION.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"strings"
+)
+
+// queryDeviceModel returns the product name of a GPU, e.g. "NVIDIA A10"
+func queryDeviceModel(d *Device) (string, error) {
+	values, err := queryNvidiaSMI(d.ID, "name")
+	if err != nil {
+		return "", err
+	}
+	return values[0], nil
+}
+
+// filterDevicesByModel removes the devices whose model name does not contain any of 'filters', ignoring case.
+// Devices whose model cannot be determined are removed as well.
+func (m *NvidiaDevicePlugin) filterDevicesByModel(devices []*Device, filters []string) []*Device {
+	if len(filters) == 0 {
+		return devices
+	}
+
+	var filtered []*Device
+	for _, d := range devices {
+		model, err := m.queryModel(d)
+		if err != nil {
+			m.logger.Warn("Unable to determine the model of device, not advertising it", logKeyEventType, "device_excluded", logKeyDeviceUUID, d.ID, "error", err)
+			continue
+		}
+		d.Model = model
+		if matchesModelFilter(model, filters) {
+			filtered = append(filtered, d)
+		}
+	}
+
+	m.logger.Info("Filtered devices by --gpu-model-filter", logKeyEventType, "devices_filtered", "filters", filters, "excluded", len(devices)-len(filtered), "remaining", len(filtered))
+	return filtered
+}
+
+func matchesModelFilter(model string, filters []string) bool {
+	for _, filter := range filters {
+		if strings.Contains(strings.ToLower(model), strings.ToLower(filter)) {
+			return true
+		}
+	}
+	return false
+}
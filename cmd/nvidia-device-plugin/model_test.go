@@ -0,0 +1,70 @@
+/*
+ * Copyright (c) 2022, NVIDIA CORPORATION.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"testing"
+
+	config "github.com/NVIDIA/k8s-device-plugin/api/config/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func newModelDevice(id string, model string) *Device {
+	return &Device{Device: newPluginDevice(id), Model: model}
+}
+
+func TestGPUModelFilter(t *testing.T) {
+	devices := func() []*Device {
+		return []*Device{
+			newModelDevice("GPU-0", "Tesla T4"),
+			newModelDevice("GPU-1", "NVIDIA A10"),
+			newModelDevice("GPU-2", "NVIDIA A100-SXM4-40GB"),
+			newModelDevice("GPU-3", ""),
+		}
+	}
+
+	testCases := []struct {
+		description string
+		filter      []string
+		expected    []string
+	}{
+		{"no filter", nil, []string{"GPU-0", "GPU-1", "GPU-2", "GPU-3"}},
+		{"single model", []string{"T4"}, []string{"GPU-0"}},
+		{"case-insensitive substring", []string{"a10"}, []string{"GPU-1", "GPU-2"}},
+		{"several models", []string{"t4", "A100"}, []string{"GPU-0", "GPU-2"}},
+		{"no matching model", []string{"V100"}, nil},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.description, func(t *testing.T) {
+			logs := captureLog(t)
+			m := newTestPlugin(config.CommandLineFlags{GPUModelFilter: tc.filter}, 1, devices()...)
+
+			var cached []string
+			for _, d := range m.cachedDevices {
+				cached = append(cached, d.ID)
+			}
+			require.Equal(t, tc.expected, cached)
+			require.Len(t, m.apiDevices(), len(tc.expected))
+
+			if tc.filter != nil {
+				require.Contains(t, logs.String(), "Unable to determine the model of device, not advertising it resource_name=nvidia.com/gpu event_type=device_excluded device_uuid=GPU-3")
+				require.Contains(t, logs.String(), "remaining")
+			}
+		})
+	}
+}
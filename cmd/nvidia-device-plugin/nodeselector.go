@@ -0,0 +1,125 @@
+/*
+ * Copyright (c) 2022, NVIDIA CORPORATION.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// labelRequirement is one of the comma-separated requirements of a --node-label-selector
+type labelRequirement struct {
+	key      string
+	operator string // "=", "!=", "exists" or "!exists"
+	value    string
+}
+
+// labelSelector matches labels meeting all of its requirements
+type labelSelector []labelRequirement
+
+// parseLabelSelector parses an equality-based label selector, e.g. "nvidia.com/gpu.present=true,!node-role.kubernetes.io/control-plane".
+// Requirements are comma-separated and either "key=value" (or "key==value"), "key!=value", "key" or "!key".
+func parseLabelSelector(s string) (labelSelector, error) {
+	var selector labelSelector
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		var r labelRequirement
+		switch {
+		case strings.Contains(part, "!="):
+			kv := strings.SplitN(part, "!=", 2)
+			r = labelRequirement{key: kv[0], operator: "!=", value: kv[1]}
+		case strings.Contains(part, "=="):
+			kv := strings.SplitN(part, "==", 2)
+			r = labelRequirement{key: kv[0], operator: "=", value: kv[1]}
+		case strings.Contains(part, "="):
+			kv := strings.SplitN(part, "=", 2)
+			r = labelRequirement{key: kv[0], operator: "=", value: kv[1]}
+		case strings.HasPrefix(part, "!"):
+			r = labelRequirement{key: part[1:], operator: "!exists"}
+		default:
+			r = labelRequirement{key: part, operator: "exists"}
+		}
+		r.key, r.value = strings.TrimSpace(r.key), strings.TrimSpace(r.value)
+		if r.key == "" || strings.ContainsAny(r.key, "!= ") || strings.ContainsAny(r.value, "!= ") {
+			return nil, fmt.Errorf("invalid requirement %q", part)
+		}
+		selector = append(selector, r)
+	}
+	return selector, nil
+}
+
+// Matches returns whether 'labels' meet all the requirements of the selector
+func (s labelSelector) Matches(labels map[string]string) bool {
+	for _, r := range s {
+		value, exists := labels[r.key]
+		switch r.operator {
+		case "=":
+			if !exists || value != r.value {
+				return false
+			}
+		case "!=":
+			if exists && value == r.value {
+				return false
+			}
+		case "exists":
+			if !exists {
+				return false
+			}
+		case "!exists":
+			if exists {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// nodeMatchesLabelSelector returns whether the labels of the node 'name' match 'selector', as read from the API server
+func nodeMatchesLabelSelector(ctx context.Context, client *KubeClient, name string, selector labelSelector) (bool, error) {
+	node, err := client.GetNode(ctx, name)
+	if err != nil {
+		return false, fmt.Errorf("unable to get node %s: %v", name, err)
+	}
+	return selector.Matches(node.Metadata.Labels), nil
+}
+
+// checkNodeLabelSelector returns whether the plugin should run on the node it was scheduled to, going by --node-label-selector.
+// The node is identified through the NODE_NAME environment variable, to be set with the downward API.
+func checkNodeLabelSelector(s string) (bool, error) {
+	selector, err := parseLabelSelector(s)
+	if err != nil {
+		return false, err
+	}
+
+	name := os.Getenv(envNodeName)
+	if name == "" {
+		return false, fmt.Errorf("%s must be set to match --node-label-selector", envNodeName)
+	}
+
+	client, err := NewInClusterKubeClient()
+	if err != nil {
+		return false, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	return nodeMatchesLabelSelector(ctx, client, name, selector)
+}
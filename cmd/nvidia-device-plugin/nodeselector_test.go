@@ -0,0 +1,88 @@
+/*
+ * Copyright (c) 2022, NVIDIA CORPORATION.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+func TestParseLabelSelector(t *testing.T) {
+	selector, err := parseLabelSelector("nvidia.com/gpu.present=true, tier==shared,zone!=edge,gpu-node,!cpu-only")
+	require.NoError(t, err)
+	require.Equal(t, labelSelector{
+		{key: "nvidia.com/gpu.present", operator: "=", value: "true"},
+		{key: "tier", operator: "=", value: "shared"},
+		{key: "zone", operator: "!=", value: "edge"},
+		{key: "gpu-node", operator: "exists"},
+		{key: "cpu-only", operator: "!exists"},
+	}, selector)
+
+	for _, s := range []string{"", "a=b,", "=b", "!", "a!=b=c", "a b"} {
+		_, err := parseLabelSelector(s)
+		require.Error(t, err, s)
+	}
+}
+
+func TestLabelSelectorMatches(t *testing.T) {
+	selector, err := parseLabelSelector("nvidia.com/gpu.present=true,zone!=edge,!cpu-only")
+	require.NoError(t, err)
+
+	require.True(t, selector.Matches(map[string]string{"nvidia.com/gpu.present": "true"}))
+	require.True(t, selector.Matches(map[string]string{"nvidia.com/gpu.present": "true", "zone": "core"}))
+	require.False(t, selector.Matches(map[string]string{"nvidia.com/gpu.present": "false"}))
+	require.False(t, selector.Matches(map[string]string{"nvidia.com/gpu.present": "true", "zone": "edge"}))
+	require.False(t, selector.Matches(map[string]string{"nvidia.com/gpu.present": "true", "cpu-only": ""}))
+	require.False(t, selector.Matches(nil))
+}
+
+func TestNodeMatchesLabelSelector(t *testing.T) {
+	api := http.NewServeMux()
+	api.HandleFunc("/api/v1/nodes/gpu-node", func(w http.ResponseWriter, r *http.Request) {
+		var node Node
+		node.Metadata.Name = "gpu-node"
+		node.Metadata.Labels = map[string]string{"nvidia.com/gpu.present": "true"}
+		json.NewEncoder(w).Encode(node)
+	})
+	api.HandleFunc("/api/v1/nodes/cpu-node", func(w http.ResponseWriter, r *http.Request) {
+		var node Node
+		node.Metadata.Name = "cpu-node"
+		json.NewEncoder(w).Encode(node)
+	})
+	server := httptest.NewServer(api)
+	defer server.Close()
+
+	client := NewKubeClient(server.URL, "", nil)
+	selector, err := parseLabelSelector("nvidia.com/gpu.present=true")
+	require.NoError(t, err)
+
+	matches, err := nodeMatchesLabelSelector(context.Background(), client, "gpu-node", selector)
+	require.NoError(t, err)
+	require.True(t, matches)
+
+	matches, err = nodeMatchesLabelSelector(context.Background(), client, "cpu-node", selector)
+	require.NoError(t, err)
+	require.False(t, matches)
+
+	_, err = nodeMatchesLabelSelector(context.Background(), client, "missing-node", selector)
+	require.Error(t, err)
+}
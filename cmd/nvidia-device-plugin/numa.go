@@ -0,0 +1,132 @@
+/*
+ * Copyright (c) 2022, NVIDIA CORPORATION.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"sort"
+)
+
+// unknownNUMANode is used for devices whose NUMA node is not known
+const unknownNUMANode = int64(-1)
+
+// Policies of --topology-policy for aligning the GPUs of a request on NUMA nodes
+const (
+	TopologyPolicyNone           = "none"
+	TopologyPolicySingleNUMANode = "single-numa-node"
+	TopologyPolicyBestEffort     = "best-effort"
+)
+
+// numaNode returns the NUMA node a device is attached to, or unknownNUMANode
+func numaNode(d *Device) int64 {
+	if d.Topology == nil || len(d.Topology.Nodes) == 0 {
+		return unknownNUMANode
+	}
+	return d.Topology.Nodes[0].ID
+}
+
+// numaGroup holds the available replicas attached to a single NUMA node
+type numaGroup struct {
+	node       int64
+	replicaIDs []string
+	physical   map[string]bool
+	required   int
+}
+
+// groupByNUMANode partitions the available replica IDs by the NUMA node of their physical device.
+// The groups are sorted by locality preference: groups holding the replicas that must be included
+// first, then the groups spanning the most physical GPUs, then the groups with the most replicas.
+func (m *NvidiaDevicePlugin) groupByNUMANode(availableDeviceIDs []string, mustIncludeDeviceIDs []string) []*numaGroup {
+	nodes := make(map[string]int64)
+	for _, d := range m.cachedDevices {
+		nodes[d.ID] = numaNode(d)
+	}
+
+	groups := make(map[int64]*numaGroup)
+	for _, id := range availableDeviceIDs {
+		physical := stripReplica(id, m.replicaCodec)
+		node, exists := nodes[physical]
+		if !exists {
+			node = unknownNUMANode
+		}
+		if _, exists := groups[node]; !exists {
+			groups[node] = &numaGroup{node: node, physical: make(map[string]bool)}
+		}
+		groups[node].replicaIDs = append(groups[node].replicaIDs, id)
+		groups[node].physical[physical] = true
+	}
+
+	for _, id := range mustIncludeDeviceIDs {
+		if node, exists := nodes[stripReplica(id, m.replicaCodec)]; exists && groups[node] != nil {
+			groups[node].required++
+		}
+	}
+
+	var sorted []*numaGroup
+	for _, g := range groups {
+		sorted = append(sorted, g)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		a, b := sorted[i], sorted[j]
+		if a.required != b.required {
+			return a.required > b.required
+		}
+		if len(a.physical) != len(b.physical) {
+			return len(a.physical) > len(b.physical)
+		}
+		if len(a.replicaIDs) != len(b.replicaIDs) {
+			return len(a.replicaIDs) > len(b.replicaIDs)
+		}
+		return a.node < b.node
+	})
+	return sorted
+}
+
+// topologyPolicy returns the --topology-policy, --prefer-same-numa-socket standing for single-numa-node
+func (m *NvidiaDevicePlugin) topologyPolicy() string {
+	policy := m.config.Flags.TopologyPolicy
+	if (policy == "" || policy == TopologyPolicyNone) && m.config.Flags.PreferSameNUMASocket {
+		return TopologyPolicySingleNUMANode
+	}
+	return policy
+}
+
+// numaAlignedDeviceIDs restricts the available replicas of a request to those of GPUs attached to as
+// few NUMA nodes as possible. With single-numa-node, the first NUMA node where the request can be
+// satisfied with unique physical GPUs is chosen. Without such a NUMA node, or with best-effort, NUMA
+// nodes are added in order of preference until they hold enough GPUs and all the required replicas.
+func (m *NvidiaDevicePlugin) numaAlignedDeviceIDs(policy string, availableDeviceIDs []string, mustIncludeDeviceIDs []string, allocationSize int) []string {
+	groups := m.groupByNUMANode(availableDeviceIDs, mustIncludeDeviceIDs)
+	if policy == TopologyPolicySingleNUMANode {
+		for _, g := range groups {
+			if g.node != unknownNUMANode && g.required == len(mustIncludeDeviceIDs) && len(g.physical) >= allocationSize {
+				return g.replicaIDs
+			}
+		}
+	}
+
+	var aligned []string
+	physical, required := 0, 0
+	for _, g := range groups {
+		if physical >= allocationSize && required == len(mustIncludeDeviceIDs) {
+			break
+		}
+		aligned = append(aligned, g.replicaIDs...)
+		physical += len(g.physical)
+		required += g.required
+	}
+	return aligned
+}
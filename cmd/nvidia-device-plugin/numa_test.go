@@ -0,0 +1,208 @@
+/*
+ * Copyright (c) 2022, NVIDIA CORPORATION.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"testing"
+
+	config "github.com/NVIDIA/k8s-device-plugin/api/config/v1"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+// newNUMADevice returns a device attached to the given NUMA node
+func newNUMADevice(id string, node int64) *Device {
+	d := &Device{Device: newPluginDevice(id)}
+	d.Topology = &pluginapi.TopologyInfo{Nodes: []*pluginapi.NUMANode{{ID: node}}}
+	return d
+}
+
+func TestPreferSameNUMASocket(t *testing.T) {
+	// GPU-a and GPU-c are attached to NUMA node 0, GPU-b and GPU-d to NUMA node 1
+	m := newTestPlugin(config.CommandLineFlags{PreferSameNUMASocket: true}, 2,
+		newNUMADevice("GPU-a", 0),
+		newNUMADevice("GPU-b", 1),
+		newNUMADevice("GPU-c", 0),
+		newNUMADevice("GPU-d", 1),
+	)
+	all := []string{
+		"GPU-a-replica-0", "GPU-a-replica-1",
+		"GPU-b-replica-0", "GPU-b-replica-1",
+		"GPU-c-replica-0", "GPU-c-replica-1",
+		"GPU-d-replica-0", "GPU-d-replica-1",
+	}
+
+	testCases := []struct {
+		description string
+		available   []string
+		mustInclude []string
+		size        int
+		expected    []string
+	}{
+		{
+			"two GPUs from the first NUMA node",
+			all, nil, 2,
+			[]string{"GPU-a-replica-0", "GPU-c-replica-0"},
+		},
+		{
+			"must include pins the NUMA node",
+			all, []string{"GPU-d-replica-1"}, 2,
+			[]string{"GPU-b-replica-0", "GPU-d-replica-1"},
+		},
+		{
+			"NUMA node with the most free GPUs",
+			[]string{"GPU-a-replica-0", "GPU-b-replica-0", "GPU-b-replica-1", "GPU-d-replica-0"}, nil, 2,
+			[]string{"GPU-b-replica-0", "GPU-d-replica-0"},
+		},
+		{
+			"fall back across NUMA nodes",
+			all, nil, 3,
+			[]string{"GPU-a-replica-0", "GPU-b-replica-0", "GPU-c-replica-0"},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.description, func(t *testing.T) {
+			resp, err := m.GetPreferredAllocation(context.Background(), &pluginapi.PreferredAllocationRequest{
+				ContainerRequests: []*pluginapi.ContainerPreferredAllocationRequest{
+					{
+						AvailableDeviceIDs:   tc.available,
+						MustIncludeDeviceIDs: tc.mustInclude,
+						AllocationSize:       int32(tc.size),
+					},
+				},
+			})
+			require.NoError(t, err)
+			require.Equal(t, tc.expected, resp.ContainerResponses[0].DeviceIDs)
+		})
+	}
+}
+
+func TestTopologyHintsEnabled(t *testing.T) {
+	devices := []*Device{newNUMADevice("GPU-a", 0), newNUMADevice("GPU-b", 1)}
+
+	m := newTestPlugin(config.CommandLineFlags{TopologyHintsEnabled: true}, 2, devices...)
+	nodes := make(map[string]int64)
+	for _, d := range m.apiDevices() {
+		require.NotNil(t, d.Topology, "device %s", d.ID)
+		require.Len(t, d.Topology.Nodes, 1)
+		nodes[d.ID] = d.Topology.Nodes[0].ID
+	}
+	require.Equal(t, map[string]int64{
+		"GPU-a-replica-0": 0,
+		"GPU-a-replica-1": 0,
+		"GPU-b-replica-0": 1,
+		"GPU-b-replica-1": 1,
+	}, nodes)
+
+	m = newTestPlugin(config.CommandLineFlags{TopologyHintsEnabled: false}, 2, devices...)
+	for _, d := range m.apiDevices() {
+		require.Nil(t, d.Topology, "device %s", d.ID)
+	}
+	// The NUMA node is still known to the plugin itself
+	require.Equal(t, int64(1), numaNode(m.deviceReplicas[2]))
+}
+
+func TestTopologyPolicy(t *testing.T) {
+	// GPU-a is attached to NUMA node 0, GPU-b and GPU-c to NUMA node 1, GPU-d, GPU-e and GPU-f to NUMA node 2
+	devices := []*Device{
+		newNUMADevice("GPU-a", 0),
+		newNUMADevice("GPU-b", 1),
+		newNUMADevice("GPU-c", 1),
+		newNUMADevice("GPU-d", 2),
+		newNUMADevice("GPU-e", 2),
+		newNUMADevice("GPU-f", 2),
+	}
+	var all []string
+	for _, d := range devices {
+		all = append(all, d.ID+"-replica-0", d.ID+"-replica-1")
+	}
+
+	testCases := []struct {
+		description string
+		policy      string
+		size        int
+		expected    []string
+	}{
+		{
+			"none ignores NUMA nodes",
+			TopologyPolicyNone, 2,
+			[]string{"GPU-a-replica-0", "GPU-b-replica-0"},
+		},
+		{
+			"single-numa-node",
+			TopologyPolicySingleNUMANode, 2,
+			[]string{"GPU-d-replica-0", "GPU-e-replica-0"},
+		},
+		{
+			"single-numa-node falls back to best-effort",
+			TopologyPolicySingleNUMANode, 4,
+			[]string{"GPU-b-replica-0", "GPU-c-replica-0", "GPU-d-replica-0", "GPU-e-replica-0"},
+		},
+		{
+			"best-effort spans the fewest NUMA nodes",
+			TopologyPolicyBestEffort, 5,
+			[]string{"GPU-b-replica-0", "GPU-c-replica-0", "GPU-d-replica-0", "GPU-e-replica-0", "GPU-f-replica-0"},
+		},
+		{
+			"best-effort uses all NUMA nodes when needed",
+			TopologyPolicyBestEffort, 6,
+			[]string{"GPU-a-replica-0", "GPU-b-replica-0", "GPU-c-replica-0", "GPU-d-replica-0", "GPU-e-replica-0", "GPU-f-replica-0"},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.description, func(t *testing.T) {
+			m := newTestPlugin(config.CommandLineFlags{TopologyPolicy: tc.policy}, 2, devices...)
+			resp, err := m.GetPreferredAllocation(context.Background(), &pluginapi.PreferredAllocationRequest{
+				ContainerRequests: []*pluginapi.ContainerPreferredAllocationRequest{
+					{
+						AvailableDeviceIDs: all,
+						AllocationSize:     int32(tc.size),
+					},
+				},
+			})
+			require.NoError(t, err)
+			require.ElementsMatch(t, tc.expected, resp.ContainerResponses[0].DeviceIDs)
+		})
+	}
+}
+
+func TestTopologyPolicyMustInclude(t *testing.T) {
+	m := newTestPlugin(config.CommandLineFlags{TopologyPolicy: TopologyPolicyBestEffort}, 2,
+		newNUMADevice("GPU-a", 0),
+		newNUMADevice("GPU-b", 1),
+		newNUMADevice("GPU-c", 1),
+		newNUMADevice("GPU-d", 2),
+	)
+	available := []string{"GPU-a-replica-0", "GPU-b-replica-0", "GPU-c-replica-0", "GPU-d-replica-0"}
+
+	// The NUMA nodes of the required replicas come first, even when others hold more GPUs
+	require.ElementsMatch(t,
+		[]string{"GPU-a-replica-0", "GPU-d-replica-0"},
+		m.numaAlignedDeviceIDs(TopologyPolicyBestEffort, available, []string{"GPU-a-replica-0", "GPU-d-replica-0"}, 2),
+	)
+	require.ElementsMatch(t,
+		[]string{"GPU-a-replica-0", "GPU-b-replica-0", "GPU-c-replica-0", "GPU-d-replica-0"},
+		m.numaAlignedDeviceIDs(TopologyPolicyBestEffort, available, []string{"GPU-a-replica-0", "GPU-d-replica-0"}, 3),
+	)
+	require.ElementsMatch(t,
+		[]string{"GPU-b-replica-0", "GPU-c-replica-0"},
+		m.numaAlignedDeviceIDs(TopologyPolicySingleNUMANode, available, []string{"GPU-c-replica-0"}, 2),
+	)
+}
@@ -19,11 +19,15 @@ package main
 import (
 	"fmt"
 	"log"
+	"log/slog"
 	"os"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/NVIDIA/gpu-monitoring-tools/bindings/go/nvml"
+	config "github.com/NVIDIA/k8s-device-plugin/api/config/v1"
 
 	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
 )
@@ -40,26 +44,48 @@ const (
 // Device couples an underlying pluginapi.Device type with its device node paths
 type Device struct {
 	pluginapi.Device
-	Paths       []string
-	Index       string
-	TotalMemory uint
+	Paths                  []string
+	Index                  string
+	TotalMemory            uint
+	ReservedMemoryMB       uint // not shared among auto replicas, only set with auto replicas
+	PowerLimitWatts        uint // current power cap, 0 if unknown
+	DefaultPowerLimitWatts uint // default power cap (TDP), 0 if unknown
+	ClockThrottleReasons   uint64
+	EnergyConsumption      uint64 // in millijoules
+	IsVirtual              bool
+	VirtualType            string
+	BusID                  string
+	PCIAddress             string // e.g. 0000:3b:00.0, empty if unknown
+	NUMANode               int    // from the CPU affinity reported by NVML, -1 if unknown
+	XIDErrors              map[uint]uint64
+	SMCount                uint   // 0 if unknown
+	Model                  string // only set with --gpu-model-filter
+	VBIOSVersion           string
 }
 
 // ResourceManager provides an interface for listing a set of Devices and checking health on them
 type ResourceManager interface {
 	Devices() []*Device
+	DeviceCount() int
+	GetDeviceByUUID(uuid string) (*Device, error)
 	CheckHealth(stop <-chan interface{}, devices []*Device, unhealthy chan<- *Device)
 }
 
 // GpuDeviceManager implements the ResourceManager interface for full GPU devices
 type GpuDeviceManager struct {
+	config             *config.Config
 	skipMigEnabledGPUs bool
+	mutex              sync.Mutex // guards 'devices', read by Allocate while the plugin enumerates the devices
+	devices            deviceMap
 }
 
 // MigDeviceManager implements the ResourceManager interface for MIG devices
 type MigDeviceManager struct {
+	config   *config.Config
 	strategy MigStrategy
 	resource string
+	mutex    sync.Mutex // guards 'devices', read by Allocate while the plugin enumerates the devices
+	devices  deviceMap
 }
 
 func check(err error) {
@@ -69,15 +95,17 @@ func check(err error) {
 }
 
 // NewGpuDeviceManager returns a reference to a new GpuDeviceManager
-func NewGpuDeviceManager(skipMigEnabledGPUs bool) *GpuDeviceManager {
+func NewGpuDeviceManager(config *config.Config, skipMigEnabledGPUs bool) *GpuDeviceManager {
 	return &GpuDeviceManager{
+		config:             config,
 		skipMigEnabledGPUs: skipMigEnabledGPUs,
 	}
 }
 
 // NewMigDeviceManager returns a reference to a new MigDeviceManager
-func NewMigDeviceManager(strategy MigStrategy, resource string) *MigDeviceManager {
+func NewMigDeviceManager(config *config.Config, strategy MigStrategy, resource string) *MigDeviceManager {
 	return &MigDeviceManager{
+		config:   config,
 		strategy: strategy,
 		resource: resource,
 	}
@@ -107,6 +135,9 @@ func (g *GpuDeviceManager) Devices() []*Device {
 		devs = append(devs, buildDevice(d, []string{d.Path}, fmt.Sprintf("%v", i), totalMemory))
 	}
 
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	g.devices = newDeviceMap(devs)
 	return devs
 }
 
@@ -146,17 +177,115 @@ func (m *MigDeviceManager) Devices() []*Device {
 		}
 	}
 
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.devices = newDeviceMap(devs)
 	return devs
 }
 
+// DeviceCount returns the number of devices of the GpuDeviceManager.
+// Unless MIG enabled GPUs are skipped, this is the number of GPUs reported by NVML and does not require enumerating them.
+func (g *GpuDeviceManager) DeviceCount() int {
+	if g.skipMigEnabledGPUs {
+		return len(g.Devices())
+	}
+	n, err := nvml.GetDeviceCount()
+	check(err)
+	return int(n)
+}
+
+// DeviceCount returns the number of devices of the MigDeviceManager
+func (m *MigDeviceManager) DeviceCount() int {
+	return len(m.Devices())
+}
+
+// GetDeviceByUUID returns the device with the given UUID from the last call to Devices()
+func (g *GpuDeviceManager) GetDeviceByUUID(uuid string) (*Device, error) {
+	g.mutex.Lock()
+	devices := g.devices
+	g.mutex.Unlock()
+	if devices == nil {
+		g.Devices()
+		g.mutex.Lock()
+		devices = g.devices
+		g.mutex.Unlock()
+	}
+	return devices.get(uuid)
+}
+
+// GetDeviceByUUID returns the device with the given UUID from the last call to Devices()
+func (m *MigDeviceManager) GetDeviceByUUID(uuid string) (*Device, error) {
+	m.mutex.Lock()
+	devices := m.devices
+	m.mutex.Unlock()
+	if devices == nil {
+		m.Devices()
+		m.mutex.Lock()
+		devices = m.devices
+		m.mutex.Unlock()
+	}
+	return devices.get(uuid)
+}
+
 // CheckHealth performs health checks on a set of devices, writing to the 'unhealthy' channel with any unhealthy devices
 func (g *GpuDeviceManager) CheckHealth(stop <-chan interface{}, devices []*Device, unhealthy chan<- *Device) {
-	checkHealth(stop, devices, unhealthy)
+	if script := g.config.Flags.HealthcheckExec; script != "" {
+		checkHealthExec(stop, devices, unhealthy, script, time.Duration(g.config.Flags.HealthcheckExecTimeout), healthCheckExecInterval, g.config.Flags.GracefulPeriodOnUnhealthy)
+		return
+	}
+	checkHealth(stop, devices, unhealthy, g.config.Flags.GracefulPeriodOnUnhealthy, time.Duration(g.config.Flags.HealthEventWindow), time.Duration(g.config.Flags.HealthCheckInterval))
 }
 
 // CheckHealth performs health checks on a set of devices, writing to the 'unhealthy' channel with any unhealthy devices
 func (m *MigDeviceManager) CheckHealth(stop <-chan interface{}, devices []*Device, unhealthy chan<- *Device) {
-	checkHealth(stop, devices, unhealthy)
+	if script := m.config.Flags.HealthcheckExec; script != "" {
+		checkHealthExec(stop, devices, unhealthy, script, time.Duration(m.config.Flags.HealthcheckExecTimeout), healthCheckExecInterval, m.config.Flags.GracefulPeriodOnUnhealthy)
+		return
+	}
+	checkHealth(stop, devices, unhealthy, m.config.Flags.GracefulPeriodOnUnhealthy, time.Duration(m.config.Flags.HealthEventWindow), time.Duration(m.config.Flags.HealthCheckInterval))
+}
+
+// UnknownDeviceError is returned when looking up a device that is not managed by a ResourceManager
+type UnknownDeviceError struct {
+	UUID string
+}
+
+var _ error = &UnknownDeviceError{}
+
+func (e *UnknownDeviceError) Error() string {
+	return fmt.Sprintf("unknown device: %s", e.UUID)
+}
+
+// getDeviceByUUID returns the device with the given UUID by searching a list of devices.
+// It can serve as the implementation of GetDeviceByUUID for any ResourceManager by passing it the result of Devices().
+func getDeviceByUUID(devices []*Device, uuid string) (*Device, error) {
+	for _, d := range devices {
+		if d.ID == uuid {
+			return d, nil
+		}
+	}
+	return nil, &UnknownDeviceError{uuid}
+}
+
+// deviceMap indexes a list of devices by UUID.
+// The NVML bindings do not expose the index of a device looked up by UUID, so the
+// device managers build this map while enumerating devices instead.
+type deviceMap map[string]*Device
+
+func newDeviceMap(devices []*Device) deviceMap {
+	m := make(deviceMap)
+	for _, d := range devices {
+		m[d.ID] = d
+	}
+	return m
+}
+
+func (m deviceMap) get(uuid string) (*Device, error) {
+	d, exists := m[uuid]
+	if !exists {
+		return nil, &UnknownDeviceError{uuid}
+	}
+	return d, nil
 }
 
 func buildDevice(d *nvml.Device, paths []string, index string, totalMemory uint) *Device {
@@ -166,11 +295,20 @@ func buildDevice(d *nvml.Device, paths []string, index string, totalMemory uint)
 	dev.Paths = paths
 	dev.Index = index
 	dev.TotalMemory = totalMemory
+	dev.BusID = d.PCI.BusID
+	if d.PCI.BusID != "" {
+		dev.PCIAddress = procBusID(d.PCI.BusID)
+	}
+	if attributes, err := d.GetAttributes(); err == nil {
+		dev.SMCount = uint(attributes.MultiprocessorCount)
+	}
+	dev.NUMANode = int(unknownNUMANode)
 	if d.CPUAffinity != nil {
+		dev.NUMANode = int(*(d.CPUAffinity))
 		dev.Topology = &pluginapi.TopologyInfo{
 			Nodes: []*pluginapi.NUMANode{
 				{
-					ID: int64(*(d.CPUAffinity)),
+					ID: int64(dev.NUMANode),
 				},
 			},
 		}
@@ -178,7 +316,88 @@ func buildDevice(d *nvml.Device, paths []string, index string, totalMemory uint)
 	return &dev
 }
 
-func checkHealth(stop <-chan interface{}, devices []*Device, unhealthy chan<- *Device) {
+// healthGracePeriod tracks the failed health checks of each device so that transient failures do not
+// immediately mark a device unhealthy. Only the failures within 'window' of each other are counted, if set.
+type healthGracePeriod struct {
+	threshold int
+	window    time.Duration
+	now       func() time.Time
+	failures  map[string][]time.Time
+}
+
+func newHealthGracePeriod(threshold int, window time.Duration) *healthGracePeriod {
+	if threshold < 1 {
+		threshold = 1
+	}
+	return &healthGracePeriod{
+		threshold: threshold,
+		window:    window,
+		now:       time.Now,
+		failures:  make(map[string][]time.Time),
+	}
+}
+
+// fail records a failed health check for the device and returns true when the device has just
+// reached the threshold of failures. Further failures are not reported until the count drops again.
+func (h *healthGracePeriod) fail(id string) bool {
+	now := h.now()
+	failures := append(h.failures[id], now)
+	if h.window > 0 {
+		for len(failures) > 0 && now.Sub(failures[0]) > h.window {
+			failures = failures[1:]
+		}
+	}
+	// Only whether the count is past the threshold matters beyond it
+	if len(failures) > h.threshold+1 {
+		failures = failures[len(failures)-h.threshold-1:]
+	}
+	h.failures[id] = failures
+	return len(failures) == h.threshold
+}
+
+// count returns the number of failures recorded for the device
+func (h *healthGracePeriod) count(id string) int {
+	return len(h.failures[id])
+}
+
+// pass records a successful health check for the device, resetting its failure count
+func (h *healthGracePeriod) pass(id string) {
+	delete(h.failures, id)
+}
+
+// healthEventSource delivers the critical errors of the devices, as NVML events do
+type healthEventSource interface {
+	// Register subscribes to the events of the given type for the GPU with the given UUID
+	Register(eventType int, uuid string) error
+	// Wait returns the next event, or an error if none occurred within 'timeout' milliseconds
+	Wait(timeout uint) (nvml.Event, error)
+	Close()
+}
+
+// nvmlEventSource is the healthEventSource backed by an NVML event set
+type nvmlEventSource struct {
+	set nvml.EventSet
+}
+
+func newNVMLEventSource() *nvmlEventSource {
+	return &nvmlEventSource{set: nvml.NewEventSet()}
+}
+
+func (s *nvmlEventSource) Register(eventType int, uuid string) error {
+	return nvml.RegisterEventForDevice(s.set, eventType, uuid)
+}
+
+func (s *nvmlEventSource) Wait(timeout uint) (nvml.Event, error) {
+	return nvml.WaitForEvent(s.set, timeout)
+}
+
+func (s *nvmlEventSource) Close() {
+	nvml.DeleteEventSet(s.set)
+}
+
+// checkHealth reports the devices hit by critical Xid errors or double bit ECC errors as unhealthy, as delivered
+// by NVML events. The devices for which NVML events are unavailable are polled every 'interval' instead.
+func checkHealth(stop <-chan interface{}, devices []*Device, unhealthy chan<- *Device, gracePeriod int, eventWindow time.Duration, interval time.Duration) {
 	disableHealthChecks := strings.ToLower(os.Getenv(envDisableHealthChecks))
 	if disableHealthChecks == "all" {
 		disableHealthChecks = allHealthChecks
@@ -207,22 +426,63 @@ func checkHealth(stop <-chan interface{}, devices []*Device, unhealthy chan<- *D
 		skippedXids[additionalXid] = true
 	}
 
-	eventSet := nvml.NewEventSet()
-	defer nvml.DeleteEventSet(eventSet)
+	events := newNVMLEventSource()
+	defer events.Close()
+
+	poll := func(polled []*Device) {
+		pollHealth(stop, polled, unhealthy, skippedXids, interval, gracePeriod, probeDevice, readXIDErrors)
+	}
+	watchHealthEvents(stop, devices, unhealthy, events, skippedXids, gracePeriod, eventWindow, poll)
+}
 
+// watchHealthEvents reports the devices hit by critical errors delivered by 'events' as unhealthy until 'stop' is
+// closed. Events only report failures, never passing checks, so devices are reported once they failed the number
+// of checks set by --graceful-period-on-unhealthy within 'window'. The devices whose events are unavailable are
+// passed to 'poll' instead.
+func watchHealthEvents(stop <-chan interface{}, devices []*Device, unhealthy chan<- *Device, events healthEventSource, skippedXids map[uint64]bool, gracePeriod int, window time.Duration, poll func(polled []*Device)) {
+	var watched, polled []*Device
 	for _, d := range devices {
-		gpu, _, _, err := nvml.ParseMigDeviceUUID(d.ID)
+		gpu, _, _ := eventInstance(d)
+		err := events.Register(nvml.XidCriticalError, gpu)
 		if err != nil {
-			gpu = d.ID
+			slog.Warn("NVML events are unavailable, polling the health of the device instead", logKeyEventType, "health_check_polled", logKeyDeviceUUID, d.ID, "error", err)
+			polled = append(polled, d)
+			continue
 		}
+		watched = append(watched, d)
 
-		err = nvml.RegisterEventForDevice(eventSet, nvml.XidCriticalError, gpu)
-		if err != nil && strings.HasSuffix(err.Error(), "Not Supported") {
-			log.Printf("Warning: %s is too old to support healthchecking: %s. Marking it unhealthy.", d.ID, err)
-			unhealthy <- d
-			continue
+		// Not all devices support ECC, in which case only Xid errors are watched
+		if err := events.Register(eventTypeDoubleBitEccError, gpu); err != nil {
+			slog.Debug("Double bit ECC error events are unavailable", logKeyDeviceUUID, d.ID, "error", err)
+		}
+	}
+
+	if len(polled) > 0 {
+		if len(watched) == 0 {
+			poll(polled)
+			return
+		}
+		go poll(polled)
+	}
+
+	grace := newHealthGracePeriod(gracePeriod, window)
+	markFailed := func(d *Device, e nvml.Event) bool {
+		reason := "XidCriticalError"
+		if e.Etype == eventTypeDoubleBitEccError {
+			reason = "DoubleBitEccError"
+		}
+		if !grace.fail(d.ID) {
+			slog.Warn(reason, logKeyEventType, "health_check_failed", logKeyDeviceUUID, d.ID, "xid", e.Edata, "failures", grace.count(d.ID), "threshold", grace.threshold)
+			return true
+		}
+		slog.Error(reason+", the device will go unhealthy", logKeyEventType, "health_check_failed", logKeyDeviceUUID, d.ID, "xid", e.Edata)
+		setHealthRecheck(d.ID, nil)
+		select {
+		case unhealthy <- d:
+			return true
+		case <-stop:
+			return false
 		}
-		check(err)
 	}
 
 	for {
@@ -232,42 +492,51 @@ func checkHealth(stop <-chan interface{}, devices []*Device, unhealthy chan<- *D
 		default:
 		}
 
-		e, err := nvml.WaitForEvent(eventSet, 5000)
-		if err != nil && e.Etype != nvml.XidCriticalError {
+		// Timeouts only mean that no error occurred, they do not reset the failure counts
+		e, err := events.Wait(5000)
+		if err != nil {
 			continue
 		}
 
-		if skippedXids[e.Edata] {
+		if e.Etype == nvml.XidCriticalError && skippedXids[e.Edata] {
 			continue
 		}
 
 		if e.UUID == nil || len(*e.UUID) == 0 {
 			// All devices are unhealthy
-			log.Printf("XidCriticalError: Xid=%d, All devices will go unhealthy.", e.Edata)
-			for _, d := range devices {
-				unhealthy <- d
+			slog.Error("Critical error, all devices have failed a health check", logKeyEventType, "health_check_failed", "xid", e.Edata)
+			for _, d := range watched {
+				if !markFailed(d, e) {
+					return
+				}
 			}
 			continue
 		}
 
-		for _, d := range devices {
-			// Please see https://github.com/NVIDIA/gpu-monitoring-tools/blob/148415f505c96052cb3b7fdf443b34ac853139ec/bindings/go/nvml/nvml.h#L1424
-			// for the rationale why gi and ci can be set as such when the UUID is a full GPU UUID and not a MIG device UUID.
-			gpu, gi, ci, err := nvml.ParseMigDeviceUUID(d.ID)
-			if err != nil {
-				gpu = d.ID
-				gi = 0xFFFFFFFF
-				ci = 0xFFFFFFFF
-			}
-
+		for _, d := range watched {
+			gpu, gi, ci := eventInstance(d)
 			if gpu == *e.UUID && gi == *e.GpuInstanceId && ci == *e.ComputeInstanceId {
-				log.Printf("XidCriticalError: Xid=%d on Device=%s, the device will go unhealthy.", e.Edata, d.ID)
-				unhealthy <- d
+				if !markFailed(d, e) {
+					return
+				}
 			}
 		}
 	}
 }
 
+// eventInstance returns the UUID of the GPU of a device along with the IDs of its GPU and compute instances,
+// as reported by NVML events.
+func eventInstance(d *Device) (string, uint, uint) {
+	if isMigDevice(d) {
+		if gpu, gi, ci, err := nvml.ParseMigDeviceUUID(d.ID); err == nil {
+			return gpu, gi, ci
+		}
+	}
+	// Please see https://github.com/NVIDIA/gpu-monitoring-tools/blob/148415f505c96052cb3b7fdf443b34ac853139ec/bindings/go/nvml/nvml.h#L1424
+	// for the rationale why gi and ci can be set as such when the UUID is a full GPU UUID and not a MIG device UUID.
+	return d.ID, 0xFFFFFFFF, 0xFFFFFFFF
+}
+
 // getAdditionalXids returns a list of additional Xids to skip from the specified string.
 // The input is treaded as a comma-separated string and all valid uint64 values are considered as Xid values. Invalid values
 // are ignored.
@@ -284,7 +553,7 @@ func getAdditionalXids(input string) []uint64 {
 		}
 		xid, err := strconv.ParseUint(trimmed, 10, 64)
 		if err != nil {
-			log.Printf("Ignoring malformed Xid value %v: %v", trimmed, err)
+			slog.Warn("Ignoring malformed Xid value", "xid", trimmed, "error", err)
 			continue
 		}
 		additionalXids = append(additionalXids, xid)
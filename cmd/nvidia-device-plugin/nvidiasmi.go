@@ -0,0 +1,80 @@
+/*
+ * Copyright (c) 2022, NVIDIA CORPORATION.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// nvidiaSMIPath is the nvidia-smi binary used for the NVML operations not exposed by the go bindings
+var nvidiaSMIPath = "nvidia-smi"
+
+// execCommand is overridden in tests to avoid running real binaries
+var execCommand = exec.Command
+
+// runNvidiaSMI runs nvidia-smi with the given arguments and returns its trimmed standard output
+func runNvidiaSMI(args ...string) (string, error) {
+	out, err := execCommand(nvidiaSMIPath, args...).CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("%s %s failed: %v: %s", nvidiaSMIPath, strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// runCommandWithTimeout runs a command, failing if it exits with a non-zero status or does not exit within
+// 'timeout', in which case it is killed
+func runCommandWithTimeout(timeout time.Duration, name string, args ...string) error {
+	cmd := execCommand(name, args...)
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case err := <-done:
+		return err
+	case <-timer.C:
+		cmd.Process.Kill()
+		<-done
+		return fmt.Errorf("timed out after %v", timeout)
+	}
+}
+
+// queryNvidiaSMI queries the given fields for the device 'uuid' and returns their values in order
+func queryNvidiaSMI(uuid string, fields ...string) ([]string, error) {
+	out, err := runNvidiaSMI("--id="+uuid, "--query-gpu="+strings.Join(fields, ","), "--format=csv,noheader,nounits")
+	if err != nil {
+		return nil, err
+	}
+
+	values := strings.Split(out, ",")
+	if len(values) != len(fields) {
+		return nil, fmt.Errorf("unexpected output from %s for fields %v: %q", nvidiaSMIPath, fields, out)
+	}
+	for i := range values {
+		values[i] = strings.TrimSpace(values[i])
+	}
+	return values, nil
+}
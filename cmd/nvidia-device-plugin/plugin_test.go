@@ -0,0 +1,123 @@
+/*
+ * Copyright (c) 2022, NVIDIA CORPORATION.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	config "github.com/NVIDIA/k8s-device-plugin/api/config/v1"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+// TestPluginEdgeCases runs the device plugin API of a plugin over unusual device lists
+func TestPluginEdgeCases(t *testing.T) {
+	testCases := []struct {
+		description string
+		devices     []*Device
+		unhealthy   []string
+		replicas    []string // advertised replica IDs
+		allocate    string   // replica to allocate, failing if empty
+		visible     string   // devices visible to the container allocated 'allocate'
+	}{
+		{
+			description: "zero devices",
+		},
+		{
+			description: "all devices unhealthy",
+			devices:     []*Device{{Device: newPluginDevice("GPU-a")}, {Device: newPluginDevice("GPU-b")}},
+			unhealthy:   []string{"GPU-a", "GPU-b"},
+			replicas:    []string{"GPU-a-replica-0", "GPU-a-replica-1", "GPU-b-replica-0", "GPU-b-replica-1"},
+			allocate:    "GPU-b-replica-1",
+			visible:     "GPU-b",
+		},
+		{
+			description: "duplicate device UUIDs",
+			devices:     []*Device{{Device: newPluginDevice("GPU-a")}, {Device: newPluginDevice("GPU-b")}, {Device: newPluginDevice("GPU-a")}},
+			replicas:    []string{"GPU-a-replica-0", "GPU-a-replica-1", "GPU-b-replica-0", "GPU-b-replica-1"},
+			allocate:    "GPU-a-replica-1",
+			visible:     "GPU-a",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.description, func(t *testing.T) {
+			m := newTestPlugin(config.CommandLineFlags{}, 2, tc.devices...)
+			m.ResourceManager.(*testResourceManager).unhealthy = tc.unhealthy
+			defer close(m.stop)
+
+			// initialize
+			var replicas []string
+			for _, d := range m.deviceReplicas {
+				replicas = append(replicas, d.ID)
+			}
+			require.Equal(t, tc.replicas, replicas)
+
+			// ListAndWatch, first listing all devices healthy, then sending the device list again for
+			// every device reported unhealthy
+			s := newFakeListAndWatchServer()
+			go m.ListAndWatch(&pluginapi.Empty{}, s)
+			resp := s.next(5 * time.Second)
+			require.NotNil(t, resp)
+			require.Len(t, resp.Devices, len(tc.replicas))
+			for _, d := range resp.Devices {
+				require.Equal(t, pluginapi.Healthy, d.Health)
+			}
+			m.startHealthChecks()
+			for range tc.unhealthy {
+				resp = s.next(5 * time.Second)
+				require.NotNil(t, resp)
+			}
+			for _, d := range resp.Devices {
+				expected := pluginapi.Healthy
+				if len(tc.unhealthy) > 0 {
+					expected = pluginapi.Unhealthy
+				}
+				require.Equal(t, expected, d.Health, d.ID)
+			}
+
+			// GetPreferredAllocation, only picking from the available devices
+			preferred, err := m.GetPreferredAllocation(context.Background(), &pluginapi.PreferredAllocationRequest{
+				ContainerRequests: []*pluginapi.ContainerPreferredAllocationRequest{
+					{AvailableDeviceIDs: tc.replicas, AllocationSize: int32(len(tc.replicas))},
+				},
+			})
+			require.NoError(t, err)
+			require.ElementsMatch(t, tc.replicas, preferred.ContainerResponses[0].DeviceIDs)
+
+			// Allocate, failing for devices that are not advertised
+			_, err = m.Allocate(context.Background(), &pluginapi.AllocateRequest{
+				ContainerRequests: []*pluginapi.ContainerAllocateRequest{
+					{DevicesIDs: []string{"GPU-unknown-replica-0"}},
+				},
+			})
+			require.Error(t, err)
+			if tc.allocate == "" {
+				return
+			}
+			allocated, err := m.Allocate(context.Background(), &pluginapi.AllocateRequest{
+				ContainerRequests: []*pluginapi.ContainerAllocateRequest{
+					{DevicesIDs: []string{tc.allocate}},
+				},
+			})
+			require.NoError(t, err)
+			require.Equal(t, tc.visible, allocated.ContainerResponses[0].Envs["NVIDIA_VISIBLE_DEVICES"])
+		})
+	}
+}
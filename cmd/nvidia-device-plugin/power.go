@@ -0,0 +1,183 @@
+/*
+ * Copyright (c) 2022, NVIDIA CORPORATION.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/NVIDIA/gpu-monitoring-tools/bindings/go/nvml"
+)
+
+var (
+	powerLimitWatts = metrics.NewGaugeVec(
+		"gpu_sharing_power_limit_watts",
+		"Power limit of a device in watts, as of the start of the plugin.",
+		"device_uuid",
+	)
+	defaultPowerLimitWatts = metrics.NewGaugeVec(
+		"gpu_sharing_default_power_limit_watts",
+		"Default power limit (TDP) of a device in watts.",
+		"device_uuid",
+	)
+)
+
+// PowerLimits holds the current and default power limits of a device and the range it may be set to, in watts
+type PowerLimits struct {
+	Current uint
+	Default uint
+	Min     uint
+	Max     uint
+}
+
+// PowerManager provides an interface for querying and setting the power limit of a device
+type PowerManager interface {
+	PowerLimit(uuid string) (uint, error)
+	DefaultPowerLimit(uuid string) (uint, error)
+	PowerLimits(uuid string) (*PowerLimits, error)
+	SetPowerLimit(uuid string, watts uint) error
+}
+
+// nvmlPowerManager implements the PowerManager interface. The NVML go bindings only expose
+// nvmlDeviceGetPowerManagementLimit(), through a full query of the device, so nvidia-smi is run for
+// nvmlDeviceGetPowerManagementDefaultLimit(), nvmlDeviceGetPowerManagementLimitConstraints() and
+// nvmlDeviceSetPowerManagementLimit().
+type nvmlPowerManager struct{}
+
+// PowerLimit returns the current power limit of a device
+func (p *nvmlPowerManager) PowerLimit(uuid string) (uint, error) {
+	dev, err := nvml.NewDeviceByUUID(uuid)
+	if err != nil {
+		return 0, err
+	}
+	if dev.Power == nil {
+		return 0, fmt.Errorf("power limit of device %s is not available", uuid)
+	}
+	return *dev.Power, nil
+}
+
+// DefaultPowerLimit returns the default power limit (TDP) of a device
+func (p *nvmlPowerManager) DefaultPowerLimit(uuid string) (uint, error) {
+	watts, err := queryPowerLimits(uuid, "power.default_limit")
+	if err != nil {
+		return 0, err
+	}
+	return watts[0], nil
+}
+
+// PowerLimits returns the current and default power limits of a device along with its allowable range
+func (p *nvmlPowerManager) PowerLimits(uuid string) (*PowerLimits, error) {
+	watts, err := queryPowerLimits(uuid, "power.limit", "power.default_limit", "power.min_limit", "power.max_limit")
+	if err != nil {
+		return nil, err
+	}
+	return &PowerLimits{Current: watts[0], Default: watts[1], Min: watts[2], Max: watts[3]}, nil
+}
+
+// queryPowerLimits returns the power limits named by 'fields' of a device in watts, as reported by nvidia-smi
+func queryPowerLimits(uuid string, fields ...string) ([]uint, error) {
+	values, err := queryNvidiaSMI(uuid, fields...)
+	if err != nil {
+		return nil, err
+	}
+
+	var watts []uint
+	for _, v := range values {
+		w, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse power limit '%s' for device %s: %v", v, uuid, err)
+		}
+		watts = append(watts, uint(w))
+	}
+	return watts, nil
+}
+
+// SetPowerLimit sets the power limit of a device
+func (p *nvmlPowerManager) SetPowerLimit(uuid string, watts uint) error {
+	_, err := runNvidiaSMI("--id="+uuid, fmt.Sprintf("--power-limit=%d", watts))
+	return err
+}
+
+// setPowerLimitInfo populates the current and default power limits of all physical devices.
+// MIG devices share the power of their parent GPU and are left alone.
+func (m *NvidiaDevicePlugin) setPowerLimitInfo() {
+	for _, dev := range m.physicalDevices() {
+		if isMigDevice(dev) {
+			continue
+		}
+		watts, err := m.powerManager.PowerLimit(dev.ID)
+		if err != nil {
+			m.logger.Info("Unable to determine the power limit of device", logKeyEventType, "power_query_failed", logKeyDeviceUUID, dev.ID, "error", err)
+			continue
+		}
+		dev.PowerLimitWatts = watts
+
+		watts, err = m.powerManager.DefaultPowerLimit(dev.ID)
+		if err != nil {
+			m.logger.Info("Unable to determine the default power limit of device", logKeyEventType, "power_query_failed", logKeyDeviceUUID, dev.ID, "error", err)
+			continue
+		}
+		dev.DefaultPowerLimitWatts = watts
+	}
+}
+
+// initPowerLimitMetrics sets the power limit metrics of the devices whose limits are known.
+// TODO: update the metrics when the power limits change at runtime, e.g. through nvidia-smi.
+func (m *NvidiaDevicePlugin) initPowerLimitMetrics() {
+	for _, dev := range m.cachedDevices {
+		if dev.PowerLimitWatts > 0 {
+			powerLimitWatts.Set(float64(dev.PowerLimitWatts), dev.ID)
+		}
+		if dev.DefaultPowerLimitWatts > 0 {
+			defaultPowerLimitWatts.Set(float64(dev.DefaultPowerLimitWatts), dev.ID)
+		}
+	}
+}
+
+// deletePowerLimitMetrics removes the power limit metrics of all devices of the plugin, e.g. once it is stopped
+func (m *NvidiaDevicePlugin) deletePowerLimitMetrics() {
+	for _, dev := range m.cachedDevices {
+		powerLimitWatts.Delete(dev.ID)
+		defaultPowerLimitWatts.Delete(dev.ID)
+	}
+}
+
+// setPowerLimits applies the power limit from --set-power-limit-watts to all physical devices and records
+// the resulting limit in each Device. Devices for which the limit cannot be applied are left untouched.
+func (m *NvidiaDevicePlugin) setPowerLimits(watts uint) {
+	for _, dev := range m.physicalDevices() {
+		limits, err := m.powerManager.PowerLimits(dev.ID)
+		if err != nil {
+			m.logger.Warn("Unable to query power limits of device", logKeyEventType, "power_query_failed", logKeyDeviceUUID, dev.ID, "error", err)
+			continue
+		}
+		dev.PowerLimitWatts = limits.Current
+		dev.DefaultPowerLimitWatts = limits.Default
+
+		if watts < limits.Min || watts > limits.Max {
+			m.logger.Warn("Not setting power limit outside of the allowable range", logKeyEventType, "power_limit_skipped", logKeyDeviceUUID, dev.ID, "watts", watts, "min_watts", limits.Min, "max_watts", limits.Max)
+			continue
+		}
+
+		if err := m.powerManager.SetPowerLimit(dev.ID, watts); err != nil {
+			m.logger.Error("Unable to set power limit of device", logKeyEventType, "power_limit_failed", logKeyDeviceUUID, dev.ID, "error", err)
+			continue
+		}
+		m.logger.Info("Changed power limit of device", logKeyEventType, "power_limit_set", logKeyDeviceUUID, dev.ID, "from_watts", limits.Current, "to_watts", watts)
+		dev.PowerLimitWatts = watts
+	}
+}
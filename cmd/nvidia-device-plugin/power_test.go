@@ -0,0 +1,142 @@
+/*
+ * Copyright (c) 2022, NVIDIA CORPORATION.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	config "github.com/NVIDIA/k8s-device-plugin/api/config/v1"
+	"github.com/stretchr/testify/require"
+)
+
+type fakePowerManager struct {
+	limits  map[string]*PowerLimits
+	set     map[string]uint
+	queried int // number of calls to PowerLimits
+}
+
+func (p *fakePowerManager) PowerLimit(uuid string) (uint, error) {
+	limits, exists := p.limits[uuid]
+	if !exists {
+		return 0, fmt.Errorf("unknown device %s", uuid)
+	}
+	return limits.Current, nil
+}
+
+func (p *fakePowerManager) DefaultPowerLimit(uuid string) (uint, error) {
+	limits, exists := p.limits[uuid]
+	if !exists {
+		return 0, fmt.Errorf("unknown device %s", uuid)
+	}
+	return limits.Default, nil
+}
+
+func (p *fakePowerManager) PowerLimits(uuid string) (*PowerLimits, error) {
+	p.queried++
+	limits, exists := p.limits[uuid]
+	if !exists {
+		return nil, fmt.Errorf("unknown device %s", uuid)
+	}
+	return limits, nil
+}
+
+func (p *fakePowerManager) SetPowerLimit(uuid string, watts uint) error {
+	p.set[uuid] = watts
+	return nil
+}
+
+func TestSetPowerLimits(t *testing.T) {
+	pm := &fakePowerManager{
+		limits: map[string]*PowerLimits{
+			"GPU-0": {Current: 300, Min: 100, Max: 300},
+			"GPU-1": {Current: 70, Min: 60, Max: 70},
+			"GPU-3": {Current: 300, Min: 100, Max: 300},
+		},
+		set: make(map[string]uint),
+	}
+
+	m := &NvidiaDevicePlugin{
+		logger:       slog.Default(),
+		powerManager: pm,
+		cachedDevices: []*Device{
+			{Device: newPluginDevice("GPU-0"), VirtualType: VirtualTypePhysical},
+			{Device: newPluginDevice("GPU-1"), VirtualType: VirtualTypePhysical},
+			{Device: newPluginDevice("GPU-2"), VirtualType: VirtualTypePhysical},
+			{Device: newPluginDevice("GPU-3"), VirtualType: VirtualTypeVGPU, IsVirtual: true},
+		},
+	}
+
+	m.setPowerLimits(250)
+
+	require.Equal(t, map[string]uint{"GPU-0": 250}, pm.set)
+	require.Equal(t, uint(250), m.cachedDevices[0].PowerLimitWatts)
+	require.Equal(t, uint(70), m.cachedDevices[1].PowerLimitWatts, "out of range limit should not be applied")
+	require.Equal(t, uint(0), m.cachedDevices[2].PowerLimitWatts, "unknown device should be left untouched")
+	require.Equal(t, uint(0), m.cachedDevices[3].PowerLimitWatts, "virtual device should be left untouched")
+}
+
+func TestPowerLimitMetrics(t *testing.T) {
+	m := newTestPlugin(config.CommandLineFlags{}, 2,
+		&Device{Device: newPluginDevice("GPU-power-0"), PowerLimitWatts: 250, DefaultPowerLimitWatts: 300},
+		&Device{Device: newPluginDevice("GPU-power-1")},
+	)
+	require.Equal(t, uint(250), m.cachedDevices[0].PowerLimitWatts)
+	require.Equal(t, uint(300), m.cachedDevices[0].DefaultPowerLimitWatts)
+	// The allowable range is only queried with --set-power-limit-watts
+	require.Zero(t, m.powerManager.(*fakePowerManager).queried)
+
+	scrape := func() map[string]float64 {
+		rec := httptest.NewRecorder()
+		metrics.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+		samples, err := parseTextFormat(rec.Body)
+		require.NoError(t, err)
+		return samples
+	}
+
+	samples := scrape()
+	require.Equal(t, 250.0, samples[`gpu_sharing_power_limit_watts{device_uuid="GPU-power-0"}`])
+	require.Equal(t, 300.0, samples[`gpu_sharing_default_power_limit_watts{device_uuid="GPU-power-0"}`])
+	// Devices whose power limits cannot be determined have no metrics
+	require.NotContains(t, samples, `gpu_sharing_power_limit_watts{device_uuid="GPU-power-1"}`)
+	require.NotContains(t, samples, `gpu_sharing_default_power_limit_watts{device_uuid="GPU-power-1"}`)
+
+	m.cleanup()
+	samples = scrape()
+	require.NotContains(t, samples, `gpu_sharing_power_limit_watts{device_uuid="GPU-power-0"}`)
+}
+
+func TestSetPowerLimitMetrics(t *testing.T) {
+	m := newTestPlugin(config.CommandLineFlags{SetPowerLimitWatts: 200}, 0,
+		&Device{Device: newPluginDevice("GPU-power-2"), PowerLimitWatts: 300, DefaultPowerLimitWatts: 300},
+	)
+	defer m.cleanup()
+
+	// The metric reports the limit applied with --set-power-limit-watts
+	require.Equal(t, uint(200), m.cachedDevices[0].PowerLimitWatts)
+	require.Equal(t, uint(300), m.cachedDevices[0].DefaultPowerLimitWatts)
+
+	rec := httptest.NewRecorder()
+	metrics.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	samples, err := parseTextFormat(rec.Body)
+	require.NoError(t, err)
+	require.Equal(t, 200.0, samples[`gpu_sharing_power_limit_watts{device_uuid="GPU-power-2"}`])
+	require.Equal(t, 300.0, samples[`gpu_sharing_default_power_limit_watts{device_uuid="GPU-power-2"}`])
+}
@@ -0,0 +1,52 @@
+/*
+ * Copyright (c) 2022, NVIDIA CORPORATION.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"golang.org/x/net/context"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+// validateDeviceAccess checks with the nvidia-smi binary at 'nvidiaSMI' that the device 'uuid' can be queried.
+// nvidia-smi is killed if it does not answer within 'timeout' so that container startup is never blocked for long.
+func validateDeviceAccess(nvidiaSMI string, uuid string, timeout time.Duration) error {
+	return runCommandWithTimeout(timeout, nvidiaSMI, "--id="+uuid, "--query-gpu=name", "--format=csv,noheader")
+}
+
+// PreStartContainer is called by the kubelet before starting a container when --prestart-validate is set.
+// It fails the container unless each of its physical devices can be queried with nvidia-smi. The devices are
+// queried from the plugin's own namespace, which catches devices lost by the driver but not runtime issues.
+func (m *NvidiaDevicePlugin) PreStartContainer(ctx context.Context, r *pluginapi.PreStartContainerRequest) (*pluginapi.PreStartContainerResponse, error) {
+	if !m.config.Flags.PrestartValidate {
+		return &pluginapi.PreStartContainerResponse{}, nil
+	}
+
+	uuids, err := m.stripReplicas(r.DevicesIDs)
+	if err != nil {
+		return nil, fmt.Errorf("invalid devices for '%s': %v", m.resourceName, err)
+	}
+	for _, uuid := range uuids {
+		if err := m.validateDeviceAccess(uuid); err != nil {
+			m.logger.Error("Device failed validation before starting a container", logKeyEventType, "prestart_validation_failed", logKeyDeviceUUID, uuid, "error", err)
+			return nil, fmt.Errorf("device %s of '%s' is not accessible: %v", uuid, m.resourceName, err)
+		}
+	}
+	return &pluginapi.PreStartContainerResponse{}, nil
+}
@@ -0,0 +1,79 @@
+/*
+ * Copyright (c) 2022, NVIDIA CORPORATION.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	config "github.com/NVIDIA/k8s-device-plugin/api/config/v1"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+func TestPreStartValidate(t *testing.T) {
+	nvidiaSMI := writeHealthCheckScript(t, `case "$1" in
+--id=GPU-slow) exec sleep 10 ;;
+--id=GPU-lost) echo "No devices were found"; exit 6 ;;
+esac`)
+	m := newTestPlugin(config.CommandLineFlags{
+		PrestartValidate:          true,
+		PrestartValidateNvidiaSMI: nvidiaSMI,
+		PrestartValidateTimeout:   config.Duration(100 * time.Millisecond),
+	}, 2,
+		&Device{Device: newPluginDevice("GPU-ok")},
+		&Device{Device: newPluginDevice("GPU-slow")},
+		&Device{Device: newPluginDevice("GPU-lost")},
+	)
+
+	options, err := m.GetDevicePluginOptions(context.Background(), &pluginapi.Empty{})
+	require.NoError(t, err)
+	require.True(t, options.PreStartRequired)
+
+	preStart := func(ids ...string) error {
+		_, err := m.PreStartContainer(context.Background(), &pluginapi.PreStartContainerRequest{DevicesIDs: ids})
+		return err
+	}
+
+	require.NoError(t, preStart("GPU-ok-replica-0", "GPU-ok-replica-1"))
+
+	err = preStart("GPU-ok-replica-0", "GPU-lost-replica-1")
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "GPU-lost")
+
+	start := time.Now()
+	err = preStart("GPU-slow-replica-0")
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "timed out after 100ms")
+	require.True(t, time.Since(start) < 5*time.Second)
+}
+
+func TestPreStartValidateDisabled(t *testing.T) {
+	m := newTestPlugin(config.CommandLineFlags{}, 1, &Device{Device: newPluginDevice("GPU-0")})
+	m.validateDeviceAccess = func(uuid string) error {
+		t.Fatalf("device %s validated without --prestart-validate", uuid)
+		return nil
+	}
+
+	options, err := m.GetDevicePluginOptions(context.Background(), &pluginapi.Empty{})
+	require.NoError(t, err)
+	require.False(t, options.PreStartRequired)
+
+	_, err = m.PreStartContainer(context.Background(), &pluginapi.PreStartContainerRequest{DevicesIDs: []string{"GPU-0-replica-0"}})
+	require.NoError(t, err)
+}
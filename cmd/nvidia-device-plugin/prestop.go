@@ -0,0 +1,129 @@
+/*
+ * Copyright (c) 2022, NVIDIA CORPORATION.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/NVIDIA/gpu-monitoring-tools/bindings/go/nvml"
+)
+
+// preStopPollInterval is how often the memory utilization of the GPUs is read while a pre-stop request waits
+const preStopPollInterval = time.Second
+
+// queryMemoryUtilization returns the percentage of time over the last sample period during which
+// the memory of a device was being read or written
+func queryMemoryUtilization(uuid string) (uint, error) {
+	dev, err := nvml.NewDeviceLiteByUUID(uuid)
+	if err != nil {
+		return 0, err
+	}
+	status, err := dev.Status()
+	if err != nil {
+		return 0, err
+	}
+	if status.Utilization.Memory == nil {
+		return 0, fmt.Errorf("memory utilization of device %s is not available", uuid)
+	}
+	return *status.Utilization.Memory, nil
+}
+
+// preStopHandler serves 'POST /prestop/<uuid>[,<uuid>...]' for the pre-stop hooks of workloads that
+// need their GPU memory flushed before they exit. Allocate is not told which container it allocates
+// devices to, so the workload passes the UUIDs it was given in NVIDIA_VISIBLE_DEVICES. The request
+// returns once the memory utilization of all of these GPUs is below the threshold, or on timeout.
+type preStopHandler struct {
+	timeout          time.Duration
+	threshold        uint
+	pollInterval     time.Duration
+	queryUtilization func(uuid string) (uint, error)
+}
+
+func (h *preStopHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var uuids []string
+	for _, uuid := range strings.Split(strings.TrimPrefix(r.URL.Path, "/prestop/"), ",") {
+		if uuid != "" {
+			uuids = append(uuids, uuid)
+		}
+	}
+	if len(uuids) == 0 {
+		http.Error(w, "no devices given", http.StatusBadRequest)
+		return
+	}
+
+	if h.wait(r, uuids) {
+		fmt.Fprintf(w, "memory of devices %s flushed\n", strings.Join(uuids, ","))
+		return
+	}
+	slog.Warn("Timed out waiting for the memory of devices to be flushed", logKeyEventType, "prestop_timeout", "timeout", h.timeout, "devices", uuids)
+	fmt.Fprintf(w, "timed out waiting for the memory of devices %s to be flushed\n", strings.Join(uuids, ","))
+}
+
+// wait polls the memory utilization of 'uuids' until all of them are below the threshold, returning
+// false if the timeout expires first. Devices whose utilization cannot be read are not waited for.
+func (h *preStopHandler) wait(r *http.Request, uuids []string) bool {
+	timeout := time.NewTimer(h.timeout)
+	defer timeout.Stop()
+	ticker := time.NewTicker(h.pollInterval)
+	defer ticker.Stop()
+
+	for {
+		var busy []string
+		for _, uuid := range uuids {
+			utilization, err := h.queryUtilization(uuid)
+			if err != nil {
+				slog.Warn("Unable to read memory utilization of device, not waiting for it", logKeyDeviceUUID, uuid, "error", err)
+				continue
+			}
+			if utilization >= h.threshold {
+				busy = append(busy, uuid)
+			}
+		}
+		if len(busy) == 0 {
+			return true
+		}
+		uuids = busy
+
+		select {
+		case <-r.Context().Done():
+			return false
+		case <-timeout.C:
+			return false
+		case <-ticker.C:
+		}
+	}
+}
+
+// HandlePreStop serves the /prestop/ endpoint, waiting at most 'timeout' for the memory utilization
+// of the given GPUs to drop below 'threshold' percent
+func (s *DebugServer) HandlePreStop(timeout time.Duration, threshold uint) {
+	s.mux.Handle("/prestop/", &preStopHandler{
+		timeout:          timeout,
+		threshold:        threshold,
+		pollInterval:     preStopPollInterval,
+		queryUtilization: queryMemoryUtilization,
+	})
+}
@@ -0,0 +1,77 @@
+/*
+ * Copyright (c) 2022, NVIDIA CORPORATION.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPreStopHandler(t *testing.T) {
+	var lock sync.Mutex
+	utilization := map[string][]uint{
+		"GPU-a": {80, 40, 3},
+		"GPU-b": {10, 2},
+	}
+	h := &preStopHandler{
+		timeout:      10 * time.Second,
+		threshold:    5,
+		pollInterval: time.Millisecond,
+		queryUtilization: func(uuid string) (uint, error) {
+			lock.Lock()
+			defer lock.Unlock()
+			samples, exists := utilization[uuid]
+			if !exists {
+				return 0, fmt.Errorf("unknown device")
+			}
+			if len(samples) > 1 {
+				utilization[uuid] = samples[1:]
+			}
+			return samples[0], nil
+		},
+	}
+
+	// Waits until both GPUs are below the threshold
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/prestop/GPU-a,GPU-b,GPU-missing", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Contains(t, rec.Body.String(), "flushed")
+	require.Equal(t, []uint{3}, utilization["GPU-a"])
+	require.Equal(t, []uint{2}, utilization["GPU-b"])
+
+	// Gives up after the timeout
+	utilization["GPU-a"] = []uint{90}
+	h.timeout = 20 * time.Millisecond
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/prestop/GPU-a", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Contains(t, rec.Body.String(), "timed out")
+
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/prestop/", nil))
+	require.Equal(t, http.StatusBadRequest, rec.Code)
+
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/prestop/GPU-a", nil))
+	require.Equal(t, http.StatusMethodNotAllowed, rec.Code)
+}
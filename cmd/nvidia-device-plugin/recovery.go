@@ -0,0 +1,83 @@
+/*
+ * Copyright (c) 2022, NVIDIA CORPORATION.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"sync"
+
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+// healthRechecks holds, by UUID, the check that failed for each device reported unhealthy by a check that can
+// be run again, e.g. the --healthcheck-exec script. Devices reported unhealthy by other checks, e.g. on critical
+// Xid errors, have none and are never recovered: only resetting the GPU clears these errors.
+var healthRechecks = struct {
+	sync.Mutex
+	checks map[string]func() error
+}{checks: make(map[string]func() error)}
+
+// setHealthRecheck records the check to run again before recovering the device 'uuid' about to be reported
+// unhealthy. A nil check means that the device cannot recover.
+func setHealthRecheck(uuid string, recheck func() error) {
+	healthRechecks.Lock()
+	defer healthRechecks.Unlock()
+	if recheck == nil {
+		delete(healthRechecks.checks, uuid)
+		return
+	}
+	healthRechecks.checks[uuid] = recheck
+}
+
+// healthRecheck returns the check to run again before recovering the device 'uuid', or nil if it cannot recover
+func healthRecheck(uuid string) func() error {
+	healthRechecks.Lock()
+	defer healthRechecks.Unlock()
+	return healthRechecks.checks[uuid]
+}
+
+// unhealthyDevices returns the devices currently marked unhealthy
+func (m *NvidiaDevicePlugin) unhealthyDevices() []*Device {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var devices []*Device
+	for _, d := range m.cachedDevices {
+		if d.Health == pluginapi.Unhealthy {
+			devices = append(devices, d)
+		}
+	}
+	return devices
+}
+
+// probeRecoveredDevices runs the check that failed again for each of the given unhealthy devices and returns
+// those passing it. It only reads the ID of the devices, so it is safe to call while ListAndWatch updates their health.
+func (m *NvidiaDevicePlugin) probeRecoveredDevices(devices []*Device) []*Device {
+	var recovered []*Device
+	for _, d := range devices {
+		recheck := healthRecheck(d.ID)
+		if recheck == nil {
+			continue
+		}
+		if err := recheck(); err != nil {
+			m.logger.Info("Device is still unhealthy", logKeyEventType, "device_recovery_failed", logKeyDeviceUUID, d.ID, "error", err)
+			continue
+		}
+		setHealthRecheck(d.ID, nil)
+		recovered = append(recovered, d)
+	}
+	return recovered
+}
@@ -0,0 +1,101 @@
+/*
+ * Copyright (c) 2022, NVIDIA CORPORATION.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	config "github.com/NVIDIA/k8s-device-plugin/api/config/v1"
+	"github.com/stretchr/testify/require"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+func resetHealthRechecks() {
+	healthRechecks.Lock()
+	defer healthRechecks.Unlock()
+	healthRechecks.checks = make(map[string]func() error)
+}
+
+func TestHealthRecovery(t *testing.T) {
+	resetHealthRechecks()
+	defer resetHealthRechecks()
+
+	m := newTestPlugin(config.CommandLineFlags{HealthRecoveryInterval: config.Duration(10 * time.Millisecond)}, 3,
+		&Device{Device: newPluginDevice("GPU-0")},
+		&Device{Device: newPluginDevice("GPU-1")},
+		&Device{Device: newPluginDevice("GPU-2")},
+	)
+	var lost atomic.Value
+	lost.Store(true)
+	m.probeDevice = func(d *Device) error {
+		if d.ID == "GPU-1" && lost.Load().(bool) {
+			return fmt.Errorf("GPU is lost")
+		}
+		return nil
+	}
+
+	stream := newFakeListAndWatchServer()
+	go m.ListAndWatch(&pluginapi.Empty{}, stream)
+	defer close(m.stop)
+	require.NotNil(t, stream.next(time.Second))
+
+	health := func(resp *pluginapi.ListAndWatchResponse) map[string]string {
+		health := make(map[string]string)
+		for _, d := range resp.Devices {
+			health[d.ID] = d.Health
+		}
+		return health
+	}
+
+	// GPU-1 failed a probe, which is run again to recover it. GPU-2 was hit by a critical Xid error.
+	setHealthRecheck("GPU-1", func() error { return m.probeDevice(m.cachedDevices[1]) })
+	m.health <- m.cachedDevices[1]
+	m.health <- m.cachedDevices[2]
+	var update *pluginapi.ListAndWatchResponse
+	require.Eventually(t, func() bool {
+		update = stream.next(time.Second)
+		return update != nil && health(update)["GPU-2-replica-0"] == pluginapi.Unhealthy && health(update)["GPU-1-replica-0"] == pluginapi.Unhealthy
+	}, 5*time.Second, time.Millisecond)
+	for id, h := range health(update) {
+		expected := pluginapi.Unhealthy
+		if stripReplica(id, defaultReplicaIDCodec) == "GPU-0" {
+			expected = pluginapi.Healthy
+		}
+		require.Equal(t, expected, h, id)
+	}
+
+	// The device is not reported again while it does not pass the check
+	require.Nil(t, stream.next(50*time.Millisecond))
+
+	// All replicas of the device recover at once, the device hit by the Xid error does not
+	lost.Store(false)
+	update = stream.next(time.Second)
+	require.NotNil(t, update, "the recovered device was not marked healthy")
+	for id, h := range health(update) {
+		expected := pluginapi.Healthy
+		if stripReplica(id, defaultReplicaIDCodec) == "GPU-2" {
+			expected = pluginapi.Unhealthy
+		}
+		require.Equal(t, expected, h, id)
+	}
+	require.Equal(t, pluginapi.Healthy, m.cachedDevices[1].Health)
+	require.Nil(t, stream.next(50*time.Millisecond))
+	require.Equal(t, pluginapi.Unhealthy, m.cachedDevices[2].Health)
+}
@@ -0,0 +1,104 @@
+/*
+ * Copyright (c) 2022, NVIDIA CORPORATION.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"log/slog"
+	"math/rand"
+	"sync"
+	"time"
+
+	config "github.com/NVIDIA/k8s-device-plugin/api/config/v1"
+	cli "github.com/urfave/cli/v2"
+)
+
+// Bounds of the delay before starting the plugins again after one of them failed to start or register
+const (
+	initialStartRetryBackoff = time.Second
+	maxStartRetryBackoff     = time.Minute
+)
+
+// exponentialBackoff returns delays doubling from 'initial' up to 'max'
+type exponentialBackoff struct {
+	initial time.Duration
+	max     time.Duration
+	next    time.Duration
+	jitter  float64 // fraction by which each delay is randomly lengthened or shortened
+}
+
+func newExponentialBackoff(initial time.Duration, max time.Duration) *exponentialBackoff {
+	return &exponentialBackoff{initial: initial, max: max, next: initial}
+}
+
+// withJitter randomly spreads the delays by up to +/- 'fraction' of their value
+func (b *exponentialBackoff) withJitter(fraction float64) *exponentialBackoff {
+	b.jitter = fraction
+	return b
+}
+
+// Next returns the current delay and doubles the following one
+func (b *exponentialBackoff) Next() time.Duration {
+	delay := b.next
+	b.next *= 2
+	if b.next > b.max {
+		b.next = b.max
+	}
+	if b.jitter > 0 {
+		delay = time.Duration(float64(delay) * (1 + b.jitter*(2*rand.Float64()-1)))
+	}
+	return delay
+}
+
+// Reset makes the next delay the initial one again
+func (b *exponentialBackoff) Reset() {
+	b.next = b.initial
+}
+
+// configHolder holds the config the plugins are started with. Reloading the config swaps the held pointer rather
+// than overwriting the config in place, as the plugins being stopped may still read the previous one.
+type configHolder struct {
+	sync.RWMutex
+	config *config.Config
+}
+
+func newConfigHolder(cfg *config.Config) *configHolder {
+	return &configHolder{config: cfg}
+}
+
+// Get returns the current config, which is never modified once returned
+func (h *configHolder) Get() *config.Config {
+	h.RLock()
+	defer h.RUnlock()
+	return h.config
+}
+
+// Reload reads the config file again so that new numbers of replicas in its resources apply once the plugins
+// restart. On error, the current config is kept. Flags keep the value they were first given, as the command line
+// and environment take precedence over the config file.
+func (h *configHolder) Reload(c *cli.Context) error {
+	previous := resourceConfig
+	cfg, err := setup(c, c.App.Flags)
+	if err != nil {
+		resourceConfig = previous
+		return err
+	}
+	h.Lock()
+	h.config = cfg
+	h.Unlock()
+	slog.Info("Reloaded config", logKeyEventType, "config_reloaded", "resource_config", resourceConfig)
+	return nil
+}
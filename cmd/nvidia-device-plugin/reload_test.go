@@ -0,0 +1,128 @@
+/*
+ * Copyright (c) 2022, NVIDIA CORPORATION.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	config "github.com/NVIDIA/k8s-device-plugin/api/config/v1"
+	"github.com/stretchr/testify/require"
+	cli "github.com/urfave/cli/v2"
+	altsrc "github.com/urfave/cli/v2/altsrc"
+)
+
+func TestExponentialBackoff(t *testing.T) {
+	b := newExponentialBackoff(time.Second, 5*time.Second)
+	var delays []time.Duration
+	for i := 0; i < 5; i++ {
+		delays = append(delays, b.Next())
+	}
+	require.Equal(t, []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second}, delays)
+
+	b.Reset()
+	require.Equal(t, time.Second, b.Next())
+}
+
+func TestExponentialBackoffJitter(t *testing.T) {
+	b := newExponentialBackoff(time.Second, 30*time.Second).withJitter(0.1)
+	for _, expected := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 16 * time.Second, 30 * time.Second, 30 * time.Second} {
+		delay := b.Next()
+		require.True(t, delay >= expected*9/10, "%v is below %v", delay, expected)
+		require.True(t, delay <= expected*11/10, "%v is above %v", delay, expected)
+	}
+}
+
+// reloadTestFlags returns the flags required to set up the config from 'configFile'
+func reloadTestFlags(configFile string) []cli.Flag {
+	return []cli.Flag{
+		&cli.StringFlag{Name: "config-file", Value: configFile},
+		altsrc.NewStringFlag(&cli.StringFlag{Name: "mig-strategy", Value: "none"}),
+		&cli.StringFlag{Name: "device-list-strategy", Value: DeviceListStrategyEnvvar},
+		&cli.StringFlag{Name: "device-id-strategy", Value: DeviceIDStrategyUUID},
+		&cli.StringFlag{Name: "volume-mount-source-strategy", Value: VolumeMountSourceStrategyDevNull},
+		&cli.IntFlag{Name: "graceful-period-on-unhealthy", Value: 1},
+		&cli.IntFlag{Name: "memory-slice-mb", Value: 1000},
+		&cli.IntFlag{Name: "max-auto-replicas", Value: 64000},
+		&cli.IntFlag{Name: "min-replicas", Value: 1},
+		&cli.StringFlag{Name: "topology-policy", Value: TopologyPolicyNone},
+		&cli.StringFlag{Name: "log-format", Value: LogFormatText},
+		&cli.StringFlag{Name: "log-level", Value: "info"},
+		&cli.IntFlag{Name: "audit-log-max-size-mb", Value: 100},
+		&cli.DurationFlag{Name: "restart-stable-duration", Value: 5 * time.Minute},
+		&cli.DurationFlag{Name: "health-check-interval", Value: time.Minute},
+		&cli.DurationFlag{Name: "grpc-dial-timeout", Value: 5 * time.Second},
+		&cli.DurationFlag{Name: "kubelet-registration-timeout", Value: 5 * time.Second},
+		&cli.DurationFlag{Name: "allocation-timeout", Value: 10 * time.Second},
+		&cli.DurationFlag{Name: "startup-timeout", Value: 2 * time.Minute},
+		&cli.DurationFlag{Name: "device-cache-ttl", Value: 5 * time.Minute},
+		&cli.StringFlag{Name: "resource-name", Value: "nvidia.com/gpu"},
+		&cli.StringFlag{Name: "device-list-envvar", Value: "NVIDIA_VISIBLE_DEVICES"},
+	}
+}
+
+// writeReloadTestConfig writes a config file with the given 'resources' section
+func writeReloadTestConfig(t *testing.T, configFile string, resources string) {
+	require.NoError(t, ioutil.WriteFile(configFile, []byte("version: v1\nflags:\n  migStrategy: none\nresources:\n"+resources), 0644))
+}
+
+func TestReloadConfig(t *testing.T) {
+	defer func(rc resourceConfiguration) { resourceConfig = rc }(resourceConfig)
+
+	configFile := filepath.Join(t.TempDir(), "config.yaml")
+	writeReloadTestConfig(t, configFile, "  gpu: 2\n")
+
+	var configs *configHolder
+	var reloads []error
+	app := cli.NewApp()
+	app.Flags = reloadTestFlags(configFile)
+	app.Before = func(c *cli.Context) error {
+		cfg, err := setup(c, c.App.Flags)
+		if err == nil {
+			configs = newConfigHolder(cfg)
+		}
+		return err
+	}
+	app.Action = func(c *cli.Context) error {
+		require.Equal(t, variant{Name: "gpu", Replicas: 2}, resourceConfig.Get("gpu"))
+		initial := configs.Get()
+
+		// The operator changes the replica count, then sends SIGHUP
+		writeReloadTestConfig(t, configFile, "  gpu: 4\n  mig-1g.5gb: auto\n")
+		reloads = append(reloads, configs.Reload(c))
+		require.Equal(t, variant{Name: "gpu", Replicas: 4}, resourceConfig.Get("gpu"))
+		require.Equal(t, variant{Name: "mig-1g.5gb", Replicas: 1, AutoReplicas: true}, resourceConfig.Get("mig-1g.5gb"))
+		require.Equal(t, config.Replicas{Count: 4}, configs.Get().Resources["gpu"])
+
+		// The config the previous plugins were started with is left untouched
+		require.Equal(t, config.Replicas{Count: 2}, initial.Resources["gpu"])
+
+		// An invalid config file keeps the previous config
+		writeReloadTestConfig(t, configFile, "  gpu: none\n")
+		reloads = append(reloads, configs.Reload(c))
+		require.Equal(t, variant{Name: "gpu", Replicas: 4}, resourceConfig.Get("gpu"))
+		require.Equal(t, config.Replicas{Count: 4}, configs.Get().Resources["gpu"])
+		return nil
+	}
+
+	require.NoError(t, app.Run([]string{"nvidia-device-plugin"}))
+	require.Len(t, reloads, 2)
+	require.NoError(t, reloads[0])
+	require.Error(t, reloads[1])
+}
@@ -17,31 +17,168 @@
 package main
 
 import (
+	"encoding/base64"
 	"errors"
 	"fmt"
 	"sort"
+	"strconv"
 	"strings"
 )
 
-const joinStr = "-replica-"
+// Constants to represent the various replica ID codecs
+const (
+	ReplicaIDCodecDefault = "default"
+	ReplicaIDCodecBase64  = "base64"
+)
+
+// defaultReplicaSeparator separates the physical device ID from the replica index in a replica ID
+const defaultReplicaSeparator = "-replica-"
+
+// ReplicaIDCodec builds the IDs of the replicas advertised for a physical device and parses them back.
+// Decode must be the inverse of Encode.
+type ReplicaIDCodec interface {
+	Encode(physicalID string, index uint) string
+	Decode(replicaID string) (physicalID string, index uint, err error)
+}
+
+// DefaultCodec encodes replica IDs as <physical ID><separator><index>
+type DefaultCodec struct {
+	Separator string
+}
+
+var defaultReplicaIDCodec ReplicaIDCodec = DefaultCodec{Separator: defaultReplicaSeparator}
+
+// Encode returns the ID of replica 'index' of the device 'physicalID'
+func (c DefaultCodec) Encode(physicalID string, index uint) string {
+	return fmt.Sprintf("%s%s%d", physicalID, c.Separator, index)
+}
+
+// Decode returns the physical device ID and replica index encoded in 'replicaID'
+func (c DefaultCodec) Decode(replicaID string) (string, uint, error) {
+	i := strings.LastIndex(replicaID, c.Separator)
+	if i < 0 {
+		return "", 0, fmt.Errorf("invalid replica ID %q: missing separator %q", replicaID, c.Separator)
+	}
+	index, err := strconv.ParseUint(replicaID[i+len(c.Separator):], 10, 0)
+	if err != nil {
+		return "", 0, fmt.Errorf("invalid replica ID %q: %v", replicaID, err)
+	}
+	return replicaID[:i], uint(index), nil
+}
+
+// Base64Codec encodes replica IDs as the unpadded URL-safe base64 encoding of <physical ID>:<index>
+type Base64Codec struct{}
+
+// Encode returns the ID of replica 'index' of the device 'physicalID'
+func (c Base64Codec) Encode(physicalID string, index uint) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf("%s:%d", physicalID, index)))
+}
+
+// Decode returns the physical device ID and replica index encoded in 'replicaID'
+func (c Base64Codec) Decode(replicaID string) (string, uint, error) {
+	decoded, err := base64.RawURLEncoding.DecodeString(replicaID)
+	if err != nil {
+		return "", 0, fmt.Errorf("invalid replica ID %q: %v", replicaID, err)
+	}
+	return DefaultCodec{Separator: ":"}.Decode(string(decoded))
+}
+
+// identityCodec is the codec of plugins without replicas, which advertise each device under its own ID
+type identityCodec struct{}
+
+// Encode returns 'physicalID' as is, a device having no other replica than itself
+func (c identityCodec) Encode(physicalID string, index uint) string {
+	return physicalID
+}
+
+// Decode returns 'replicaID' as is, being the ID of a physical device
+func (c identityCodec) Decode(replicaID string) (string, uint, error) {
+	return replicaID, 0, nil
+}
 
-func stripReplica(deviceReplica string) string {
-	return strings.Split(deviceReplica, joinStr)[0]
+// replicasDisabled returns whether the plugin advertises each device exactly once under its own ID, i.e. with
+// --no-replicas or when no replicas are configured
+func (m *NvidiaDevicePlugin) replicasDisabled() bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.replicasDisabledLocked()
 }
 
-func stripReplicas(deviceReplicaIDs []string) []string {
+// replicasDisabledLocked is replicasDisabled for callers holding m.mu, which guards the number of replicas
+func (m *NvidiaDevicePlugin) replicasDisabledLocked() bool {
+	return m.replicas == 0 && !m.autoReplicas
+}
+
+// sharesDevices returns whether a device may be advertised as several replicas
+func (m *NvidiaDevicePlugin) sharesDevices() bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.replicas > 1 || m.autoReplicas
+}
+
+// newReplicaIDCodec returns the codec named 'name'. 'separator' is the separator of the default codec,
+// defaultReplicaSeparator if empty.
+func newReplicaIDCodec(name string, separator string) (ReplicaIDCodec, error) {
+	switch name {
+	case "", ReplicaIDCodecDefault:
+		if separator == "" {
+			return defaultReplicaIDCodec, nil
+		}
+		// A separator made of digits only could not be told apart from the replica index
+		if strings.Trim(separator, "0123456789") == "" {
+			return nil, fmt.Errorf("invalid replica ID separator %q: must not only contain digits", separator)
+		}
+		return DefaultCodec{Separator: separator}, nil
+	case ReplicaIDCodecBase64:
+		return Base64Codec{}, nil
+	}
+	return nil, fmt.Errorf("unknown replica ID codec: %v", name)
+}
+
+// checkReplicaSeparator returns an error if the ID of a device contains the separator of the default codec,
+// as the ID of the device itself could then be mistaken for the ID of one of its replicas
+func (m *NvidiaDevicePlugin) checkReplicaSeparator() error {
+	codec, ok := m.replicaCodec.(DefaultCodec)
+	if !ok {
+		return nil
+	}
+	for _, dev := range m.cachedDevices {
+		if strings.Contains(dev.ID, codec.Separator) {
+			return fmt.Errorf("device %s contains the replica ID separator %q, use another --replica-id-separator", dev.ID, codec.Separator)
+		}
+	}
+	return nil
+}
+
+// stripReplica returns the physical device ID backing a replica. IDs that are not
+// replica IDs of 'codec' are returned unchanged.
+func stripReplica(deviceReplica string, codec ReplicaIDCodec) string {
+	physicalID, _, err := codec.Decode(deviceReplica)
+	if err != nil {
+		return deviceReplica
+	}
+	return physicalID
+}
+
+// stripReplicas returns the sorted, unique list of physical device IDs backing the given replica IDs. It fails
+// if any of them is not a replica ID of 'codec', e.g. if its suffix after the last separator is not an index,
+// rather than taking it for the ID of a physical device.
+func stripReplicas(deviceReplicaIDs []string, codec ReplicaIDCodec) ([]string, error) {
 	deviceIDs := make([]string, 0, len(deviceReplicaIDs))
 	// remove replicas. We only want the raw devices now.
 	devices := make(map[string]bool)
 	for _, id := range deviceReplicaIDs {
-		devID := stripReplica(id)
+		devID, _, err := codec.Decode(id)
+		if err != nil {
+			return nil, err
+		}
 		if _, exists := devices[devID]; !exists {
 			devices[devID] = true
 			deviceIDs = append(deviceIDs, devID)
 		}
 	}
 	sort.Strings(deviceIDs)
-	return deviceIDs
+	return deviceIDs, nil
 }
 
 func find(a []string, x string) int {
@@ -93,13 +230,17 @@ func (m NonUniqueError) Error() string {
 }
 
 // Generate a list of devices in order in which they should be used.
-func prioritizeDevices(availableDeviceIDs []string, mustIncludeDeviceIDs []string, allocationSize int) ([]string, error) {
+// The result only depends on the set of available and required replicas, not on their order: ties between
+// GPUs are broken by picking the lexicographically first one, and the replicas of a GPU are handed out in
+// lexicographic order. This also holds when no unique assignment exists, so that the kubelet gets the same
+// preferred allocation for the same request however many times it asks.
+func prioritizeDevices(availableDeviceIDs []string, mustIncludeDeviceIDs []string, allocationSize int, codec ReplicaIDCodec) ([]string, error) {
 
 	rawDeviceCount := make(map[string]*devCount)
 
 	// Get the counts by raw device
 	for _, id := range availableDeviceIDs {
-		dev := stripReplica(id)
+		dev := stripReplica(id, codec)
 		deviceCount, exists := rawDeviceCount[dev]
 		if exists {
 			deviceCount.ReplicaDeviceNames = append(deviceCount.ReplicaDeviceNames, id)
@@ -124,7 +265,7 @@ func prioritizeDevices(availableDeviceIDs []string, mustIncludeDeviceIDs []strin
 
 	// allocate all the replicas that must be included
 	for i, deviceID := range mustIncludeDeviceIDs {
-		deviceCount, exists := rawDeviceCount[stripReplica(deviceID)]
+		deviceCount, exists := rawDeviceCount[stripReplica(deviceID, codec)]
 		if !exists {
 			return nil, fmt.Errorf("device '%s' in mustIncludeDeviceIDs is missing from availableDeviceIDs", deviceID)
 		}
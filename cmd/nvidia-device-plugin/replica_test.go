@@ -18,8 +18,18 @@ package main
 
 import (
 	"fmt"
+	"math/rand"
 	"reflect"
+	"sort"
+	"strconv"
+	"strings"
 	"testing"
+	"testing/quick"
+
+	config "github.com/NVIDIA/k8s-device-plugin/api/config/v1"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
 )
 
 func Test_prioritizeDevices(t *testing.T) {
@@ -97,7 +107,7 @@ func Test_prioritizeDevices(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			got, got1 := prioritizeDevices(tt.args.availableDeviceIDs, tt.args.mustIncludeDeviceIDs, tt.args.allocationSize)
+			got, got1 := prioritizeDevices(tt.args.availableDeviceIDs, tt.args.mustIncludeDeviceIDs, tt.args.allocationSize, defaultReplicaIDCodec)
 			if !reflect.DeepEqual(got, tt.want) {
 				t.Errorf("prioritizeDevices() got = %v, want %v", got, tt.want)
 			}
@@ -113,19 +123,341 @@ func Test_stripReplicas(t *testing.T) {
 		deviceReplicaIDs []string
 	}
 	tests := []struct {
-		name string
-		args args
-		want []string
+		name    string
+		args    args
+		want    []string
+		wantErr bool
 	}{
-		{"Simple", args{[]string{"b-replica-5", "a-replica-1", "a-replica-0"}}, []string{"a", "b"}},
-		{"Simple2", args{[]string{"b-replica-0", "a-replica-1", "a-replica-2", "c-replica-2"}}, []string{"a", "b", "c"}},
-		{"Empty", args{[]string{}}, []string{}},
+		{"Simple", args{[]string{"b-replica-5", "a-replica-1", "a-replica-0"}}, []string{"a", "b"}, false},
+		{"Simple2", args{[]string{"b-replica-0", "a-replica-1", "a-replica-2", "c-replica-2"}}, []string{"a", "b", "c"}, false},
+		{"Empty", args{[]string{}}, []string{}, false},
+		{"NoReplica", args{[]string{"a-replica-0", "b"}}, nil, true},
+		{"EmptyIndex", args{[]string{"a-replica-"}}, nil, true},
+		{"NegativeIndex", args{[]string{"a-replica--1"}}, nil, true},
+		{"NonNumericIndex", args{[]string{"a-replica-0x"}}, nil, true},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			if got := stripReplicas(tt.args.deviceReplicaIDs); !reflect.DeepEqual(got, tt.want) {
+			got, err := stripReplicas(tt.args.deviceReplicaIDs, defaultReplicaIDCodec)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("stripReplicas() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
 				t.Errorf("stripReplicas() = %v, want %v", got, tt.want)
 			}
 		})
 	}
 }
+
+func FuzzStripReplicas(f *testing.F) {
+	for _, seed := range []string{"GPU-8b2c", "GPU-8b2c-replica-", "GPU-replica-0-x", "MIG-GPU-a/1/0", ""} {
+		f.Add(seed, uint(0))
+		f.Add(seed, uint(7))
+	}
+	codecs := []ReplicaIDCodec{defaultReplicaIDCodec, DefaultCodec{Separator: "::"}, Base64Codec{}}
+
+	f.Fuzz(func(t *testing.T, id string, index uint) {
+		for _, codec := range codecs {
+			// Encoded replica IDs are always stripped back to their device
+			got, err := stripReplicas([]string{codec.Encode(id, index)}, codec)
+			if err != nil {
+				t.Fatalf("stripReplicas(%T.Encode(%q, %d)) failed: %v", codec, id, index, err)
+			}
+			if len(got) != 1 || got[0] != id {
+				t.Fatalf("stripReplicas(%T.Encode(%q, %d)) = %q", codec, id, index, got)
+			}
+
+			// Any other ID is either rejected or stripped from a valid replica index suffix
+			got, err = stripReplicas([]string{id}, codec)
+			if err != nil {
+				continue
+			}
+			if len(got) != 1 {
+				t.Fatalf("stripReplicas(%q) = %q", id, got)
+			}
+			if c, ok := codec.(DefaultCodec); ok {
+				suffix, found := strings.CutPrefix(id, got[0]+c.Separator)
+				if !found {
+					t.Fatalf("stripReplicas(%q) = %q, not a prefix", id, got)
+				}
+				if _, err := strconv.ParseUint(suffix, 10, 0); err != nil {
+					t.Fatalf("stripReplicas(%q) = %q, invalid index %q", id, got, suffix)
+				}
+			}
+		}
+	})
+}
+
+func TestReplicaSeparator(t *testing.T) {
+	devices := []*Device{
+		{Device: newPluginDevice("GPU-a")},
+		{Device: newPluginDevice("GPU-b")},
+	}
+	cfg := &config.Config{Flags: config.Flags{CommandLineFlags: &config.CommandLineFlags{}}}
+	defaultPlugin, err := NewNvidiaDevicePlugin(cfg, "nvidia.com/gpu", &testResourceManager{devices: devices}, "NVIDIA_VISIBLE_DEVICES", nil, "", 2, false, nil)
+	require.NoError(t, err)
+	customPlugin, err := NewNvidiaDevicePlugin(cfg, "nvidia.com/gpu", &testResourceManager{devices: devices}, "NVIDIA_VISIBLE_DEVICES", nil, "", 2, false, DefaultCodec{Separator: "::"})
+	require.NoError(t, err)
+
+	for _, m := range []*NvidiaDevicePlugin{defaultPlugin, customPlugin} {
+		m.queryVirtualType = func(*Device) (string, error) { return VirtualTypePhysical, nil }
+		m.powerManager = &fakePowerManager{}
+		m.config.Flags.CommandLineFlags = &config.CommandLineFlags{}
+		m.initialize()
+	}
+
+	require.Equal(t, "GPU-a-replica-1", defaultPlugin.deviceReplicas[1].ID)
+	require.Equal(t, "GPU-a::1", customPlugin.deviceReplicas[1].ID)
+
+	uuids, err := defaultPlugin.stripReplicas([]string{"GPU-b-replica-0", "GPU-a-replica-1"})
+	require.NoError(t, err)
+	require.Equal(t, []string{"GPU-a", "GPU-b"}, uuids)
+	uuids, err = customPlugin.stripReplicas([]string{"GPU-b::0", "GPU-a::1"})
+	require.NoError(t, err)
+	require.Equal(t, []string{"GPU-a", "GPU-b"}, uuids)
+
+	// Each plugin only understands its own separator
+	_, err = defaultPlugin.stripReplicas([]string{"GPU-a::1"})
+	require.Error(t, err)
+	_, err = customPlugin.stripReplicas([]string{"GPU-a-replica-1"})
+	require.Error(t, err)
+}
+
+func TestReplicaSeparatorFlag(t *testing.T) {
+	m := newTestPlugin(config.CommandLineFlags{ReplicaIDSeparator: "#"}, 2,
+		&Device{Device: newPluginDevice("GPU-a")},
+		&Device{Device: newPluginDevice("GPU-b")},
+	)
+	require.NoError(t, m.checkReplicaSeparator())
+
+	require.Equal(t, "GPU-a#1", m.deviceReplicas[1].ID)
+	require.True(t, m.deviceReplicaExists("GPU-b#0"))
+	require.False(t, m.deviceReplicaExists("GPU-b-replica-0"))
+	uuids, err := m.stripReplicas([]string{"GPU-b#1", "GPU-a#0"})
+	require.NoError(t, err)
+	require.Equal(t, []string{"GPU-a", "GPU-b"}, uuids)
+}
+
+func TestReplicaSeparatorInDeviceID(t *testing.T) {
+	m := newTestPlugin(config.CommandLineFlags{ReplicaIDSeparator: "-"}, 2,
+		&Device{Device: newPluginDevice("a")},
+		&Device{Device: newPluginDevice("GPU-b")},
+	)
+	err := m.checkReplicaSeparator()
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "GPU-b")
+
+	// Start fails before serving anything
+	m.cleanup()
+	require.Error(t, m.Start())
+	require.Nil(t, m.server)
+
+	// Other codecs do not use the separator
+	m = newTestPlugin(config.CommandLineFlags{ReplicaIDCodec: ReplicaIDCodecBase64, ReplicaIDSeparator: "-"}, 2, &Device{Device: newPluginDevice("GPU-b")})
+	require.NoError(t, m.checkReplicaSeparator())
+}
+
+func TestMigDevicesWithoutReplicas(t *testing.T) {
+	deviceIDs := func(m *NvidiaDevicePlugin) []string {
+		var ids []string
+		for _, d := range m.deviceReplicas {
+			ids = append(ids, d.ID)
+		}
+		return ids
+	}
+
+	// MIG devices that are not shared are advertised as is
+	m := newTestPlugin(config.CommandLineFlags{}, 1,
+		&Device{Device: newPluginDevice("MIG-a")},
+		&Device{Device: newPluginDevice("MIG-GPU-b/1/0")},
+		&Device{Device: newPluginDevice("GPU-c")},
+	)
+	require.Equal(t, []string{"MIG-a", "MIG-GPU-b/1/0", "GPU-c-replica-0"}, deviceIDs(m))
+
+	resp, err := m.Allocate(context.Background(), &pluginapi.AllocateRequest{
+		ContainerRequests: []*pluginapi.ContainerAllocateRequest{
+			{DevicesIDs: []string{"MIG-a"}},
+		},
+	})
+	require.NoError(t, err)
+	require.Equal(t, "MIG-a", resp.ContainerResponses[0].Envs["NVIDIA_VISIBLE_DEVICES"])
+
+	// Shared MIG devices are replicated like GPUs
+	m = newTestPlugin(config.CommandLineFlags{}, 2, &Device{Device: newPluginDevice("MIG-a")})
+	require.Equal(t, []string{"MIG-a-replica-0", "MIG-a-replica-1"}, deviceIDs(m))
+}
+
+func TestReplicasDisabled(t *testing.T) {
+	deviceIDs := func(m *NvidiaDevicePlugin) []string {
+		var ids []string
+		for _, d := range m.deviceReplicas {
+			ids = append(ids, d.ID)
+		}
+		return ids
+	}
+
+	for _, m := range []*NvidiaDevicePlugin{
+		newTestPlugin(config.CommandLineFlags{}, 0, &Device{Device: newPluginDevice("GPU-b")}, &Device{Device: newPluginDevice("GPU-a")}),
+		newTestPlugin(config.CommandLineFlags{NoReplicas: true}, 4, &Device{Device: newPluginDevice("GPU-b")}, &Device{Device: newPluginDevice("GPU-a")}),
+	} {
+		require.True(t, m.replicasDisabled())
+		require.Equal(t, []string{"GPU-b", "GPU-a"}, deviceIDs(m))
+		require.True(t, m.deviceReplicaExists("GPU-a"))
+		require.False(t, m.deviceReplicaExists("GPU-a-replica-0"))
+		uuids, err := m.stripReplicas([]string{"GPU-b", "GPU-a"})
+		require.NoError(t, err)
+		require.Equal(t, []string{"GPU-b", "GPU-a"}, uuids)
+
+		resp, err := m.Allocate(context.Background(), &pluginapi.AllocateRequest{
+			ContainerRequests: []*pluginapi.ContainerAllocateRequest{
+				{DevicesIDs: []string{"GPU-a"}},
+			},
+		})
+		require.NoError(t, err)
+		require.Equal(t, "GPU-a", resp.ContainerResponses[0].Envs["NVIDIA_VISIBLE_DEVICES"])
+	}
+}
+
+func TestReplicaIDCodecRoundTrip(t *testing.T) {
+	codecs := map[string]ReplicaIDCodec{
+		"default":   defaultReplicaIDCodec,
+		"custom":    DefaultCodec{Separator: "::"},
+		"base64":    Base64Codec{},
+		"separator": DefaultCodec{Separator: "-"},
+	}
+	physicalIDs := []string{
+		"GPU-8f6b4c5e-1b0b-4d6a-9a7c-3f4e2d1c0b9a",
+		"MIG-GPU-8f6b4c5e-1b0b-4d6a-9a7c-3f4e2d1c0b9a/1/0",
+		"a",
+		"GPU-a-replica-1",
+		"GPU:a",
+	}
+
+	for name, codec := range codecs {
+		for _, physicalID := range physicalIDs {
+			for _, index := range []uint{0, 1, 10, 8191} {
+				replicaID := codec.Encode(physicalID, index)
+				decodedID, decodedIndex, err := codec.Decode(replicaID)
+				require.NoError(t, err, "%s: %s", name, replicaID)
+				require.Equal(t, physicalID, decodedID, "%s: %s", name, replicaID)
+				require.Equal(t, index, decodedIndex, "%s: %s", name, replicaID)
+			}
+		}
+	}
+}
+
+func TestReplicaIDCodecDecodeErrors(t *testing.T) {
+	for _, id := range []string{"GPU-a", "GPU-a-replica-", "GPU-a-replica-x", "GPU-a-replica--1"} {
+		_, _, err := defaultReplicaIDCodec.Decode(id)
+		require.Error(t, err, id)
+	}
+	for _, id := range []string{"GPU-a-replica-0", "R1BVLWE"} {
+		_, _, err := Base64Codec{}.Decode(id)
+		require.Error(t, err, id)
+	}
+
+	_, err := newReplicaIDCodec("rot13", "")
+	require.Error(t, err)
+	_, err = newReplicaIDCodec(ReplicaIDCodecDefault, "42")
+	require.Error(t, err)
+}
+
+func TestBase64ReplicaIDCodec(t *testing.T) {
+	m := newTestPlugin(config.CommandLineFlags{ReplicaIDCodec: ReplicaIDCodecBase64}, 2,
+		&Device{Device: newPluginDevice("GPU-a")},
+		&Device{Device: newPluginDevice("GPU-b")},
+	)
+
+	require.Equal(t, "R1BVLWI6MQ", m.deviceReplicas[3].ID)
+	uuids, err := m.stripReplicas([]string{m.deviceReplicas[3].ID, m.deviceReplicas[0].ID})
+	require.NoError(t, err)
+	require.Equal(t, []string{"GPU-a", "GPU-b"}, uuids)
+}
+
+// preferredAllocationRequest is a random request for a preferred allocation among the replicas of a few GPUs
+type preferredAllocationRequest struct {
+	available      []string
+	mustInclude    []string
+	allocationSize int
+}
+
+func (preferredAllocationRequest) Generate(r *rand.Rand, size int) reflect.Value {
+	var req preferredAllocationRequest
+	for gpu := 0; gpu < 1+r.Intn(4); gpu++ {
+		for replica := 0; replica < 1+r.Intn(4); replica++ {
+			if r.Intn(4) > 0 {
+				req.available = append(req.available, fmt.Sprintf("GPU-%d-replica-%d", gpu, replica))
+			}
+		}
+	}
+	r.Shuffle(len(req.available), func(i, j int) { req.available[i], req.available[j] = req.available[j], req.available[i] })
+	if len(req.available) > 0 {
+		req.mustInclude = append([]string{}, req.available[:r.Intn(len(req.available)/2+1)]...)
+	}
+	req.allocationSize = len(req.mustInclude) + r.Intn(len(req.available)-len(req.mustInclude)+1)
+	return reflect.ValueOf(req)
+}
+
+func shuffled(r *rand.Rand, ids []string) []string {
+	s := append([]string{}, ids...)
+	r.Shuffle(len(s), func(i, j int) { s[i], s[j] = s[j], s[i] })
+	return s
+}
+
+func TestPrioritizeDevicesIsDeterministic(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	prioritizers := map[string]func(available, mustInclude []string, size int) ([]string, error){
+		"uniform": func(available, mustInclude []string, size int) ([]string, error) {
+			return prioritizeDevices(available, mustInclude, size, defaultReplicaIDCodec)
+		},
+		"SM weighted": func(available, mustInclude []string, size int) ([]string, error) {
+			replicas := map[string]int{"GPU-0": 4, "GPU-1": 4, "GPU-2": 4, "GPU-3": 4}
+			smCounts := map[string]uint{"GPU-0": 108, "GPU-1": 80, "GPU-2": 108, "GPU-3": 40}
+			return prioritizeDevicesBySMWeight(available, mustInclude, size, defaultReplicaIDCodec, replicas, smCounts)
+		},
+	}
+
+	for name, prioritize := range prioritizers {
+		t.Run(name, func(t *testing.T) {
+			property := func(req preferredAllocationRequest) bool {
+				first, err := prioritize(req.available, req.mustInclude, req.allocationSize)
+				if err != nil && !reflect.DeepEqual(err, &NonUniqueError{}) {
+					t.Logf("%+v: %v", req, err)
+					return false
+				}
+
+				// The allocation is complete and made of available replicas, including the required ones
+				if len(first) != req.allocationSize || !sort.StringsAreSorted(first) {
+					return false
+				}
+				available := make(map[string]bool)
+				for _, id := range req.available {
+					available[id] = true
+				}
+				allocated := make(map[string]bool)
+				for _, id := range first {
+					if !available[id] || allocated[id] {
+						return false
+					}
+					allocated[id] = true
+				}
+				for _, id := range req.mustInclude {
+					if !allocated[id] {
+						return false
+					}
+				}
+
+				// Asking again, even with the replicas listed in another order, gives the same allocation
+				for i := 0; i < 3; i++ {
+					again, againErr := prioritize(shuffled(r, req.available), shuffled(r, req.mustInclude), req.allocationSize)
+					if !reflect.DeepEqual(first, again) || !reflect.DeepEqual(err, againErr) {
+						t.Logf("%+v: got %v then %v", req, first, again)
+						return false
+					}
+				}
+				return true
+			}
+			require.NoError(t, quick.Check(property, &quick.Config{MaxCount: 500, Rand: r}))
+		})
+	}
+}
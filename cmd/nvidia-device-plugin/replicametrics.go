@@ -0,0 +1,73 @@
+/*
+ * Copyright (c) 2022, NVIDIA CORPORATION.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+var (
+	replicasTotal = metrics.NewGaugeVec(
+		"gpu_sharing_replicas_total",
+		"Number of replicas of a device advertised to the kubelet.",
+		"device_uuid",
+	)
+	replicasAllocated = metrics.NewGaugeVec(
+		"gpu_sharing_replicas_allocated",
+		"Number of replicas of a device currently allocated to containers.",
+		"device_uuid",
+	)
+	deviceHealthy = metrics.NewGaugeVec(
+		"gpu_sharing_device_healthy",
+		"Whether a device is healthy (1) or not (0).",
+		"device_uuid",
+	)
+)
+
+// initReplicaMetrics sets the replica and health metrics of all devices of the plugin
+func (m *NvidiaDevicePlugin) initReplicaMetrics() {
+	for _, d := range m.cachedDevices {
+		replicasTotal.Set(float64(len(m.replicasOf(d))), d.ID)
+		updateDeviceHealthMetric(d)
+	}
+	m.updateAllocatedReplicasMetric()
+}
+
+// updateAllocatedReplicasMetric sets the number of allocated replicas of all devices of the plugin
+func (m *NvidiaDevicePlugin) updateAllocatedReplicasMetric() {
+	for _, d := range m.cachedDevices {
+		replicasAllocated.Set(float64(m.allocations.AllocatedReplicas(d.ID)), d.ID)
+	}
+}
+
+// updateDeviceHealthMetric sets the health metric of a device to its current health
+func updateDeviceHealthMetric(d *Device) {
+	healthy := 0.0
+	if d.Health == pluginapi.Healthy {
+		healthy = 1
+	}
+	deviceHealthy.Set(healthy, d.ID)
+}
+
+// deleteReplicaMetrics removes the metrics of all devices of the plugin, e.g. once it is stopped
+func (m *NvidiaDevicePlugin) deleteReplicaMetrics() {
+	for _, d := range m.cachedDevices {
+		replicasTotal.Delete(d.ID)
+		replicasAllocated.Delete(d.ID)
+		deviceHealthy.Delete(d.ID)
+	}
+}
@@ -0,0 +1,69 @@
+/*
+ * Copyright (c) 2022, NVIDIA CORPORATION.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	config "github.com/NVIDIA/k8s-device-plugin/api/config/v1"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+func TestReplicaMetrics(t *testing.T) {
+	m := newTestPlugin(config.CommandLineFlags{}, 4,
+		&Device{Device: newPluginDevice("GPU-metrics-0")},
+		&Device{Device: newPluginDevice("GPU-metrics-1")},
+	)
+
+	scrape := func() map[string]float64 {
+		rec := httptest.NewRecorder()
+		metrics.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+		samples, err := parseTextFormat(rec.Body)
+		require.NoError(t, err)
+		return samples
+	}
+
+	samples := scrape()
+	require.Equal(t, 4.0, samples[`gpu_sharing_replicas_total{device_uuid="GPU-metrics-0"}`])
+	require.Equal(t, 0.0, samples[`gpu_sharing_replicas_allocated{device_uuid="GPU-metrics-0"}`])
+	require.Equal(t, 1.0, samples[`gpu_sharing_device_healthy{device_uuid="GPU-metrics-1"}`])
+
+	_, err := m.Allocate(context.Background(), &pluginapi.AllocateRequest{
+		ContainerRequests: []*pluginapi.ContainerAllocateRequest{
+			{DevicesIDs: []string{"GPU-metrics-0-replica-0", "GPU-metrics-0-replica-1", "GPU-metrics-1-replica-3"}},
+		},
+	})
+	require.NoError(t, err)
+
+	samples = scrape()
+	require.Equal(t, 2.0, samples[`gpu_sharing_replicas_allocated{device_uuid="GPU-metrics-0"}`])
+	require.Equal(t, 1.0, samples[`gpu_sharing_replicas_allocated{device_uuid="GPU-metrics-1"}`])
+
+	m.setHealth(m.cachedDevices[1], pluginapi.Unhealthy, "health check failed")
+	samples = scrape()
+	require.Equal(t, 0.0, samples[`gpu_sharing_device_healthy{device_uuid="GPU-metrics-1"}`])
+	require.Equal(t, 1.0, samples[`gpu_sharing_device_healthy{device_uuid="GPU-metrics-0"}`])
+
+	// The metrics of the devices go away along with the plugin
+	m.cleanup()
+	samples = scrape()
+	require.NotContains(t, samples, `gpu_sharing_replicas_total{device_uuid="GPU-metrics-0"}`)
+}
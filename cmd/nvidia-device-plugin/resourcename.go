@@ -0,0 +1,75 @@
+/*
+ * Copyright (c) 2022, NVIDIA CORPORATION.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	config "github.com/NVIDIA/k8s-device-plugin/api/config/v1"
+)
+
+var (
+	// resourceDomainRegexp matches a DNS subdomain, as required for the prefix of an extended resource name
+	resourceDomainRegexp = regexp.MustCompile(`^[a-z0-9]([-a-z0-9]*[a-z0-9])?(\.[a-z0-9]([-a-z0-9]*[a-z0-9])?)*$`)
+	// resourceNameRegexp matches the name part of a qualified Kubernetes name
+	resourceNameRegexp = regexp.MustCompile(`^[A-Za-z0-9]([-A-Za-z0-9_.]*[A-Za-z0-9])?$`)
+)
+
+// validateResourceName checks that 'name' is a valid Kubernetes extended resource name, i.e. of the form
+// domain/name outside of the kubernetes.io domain reserved for native resources.
+func validateResourceName(name string) error {
+	parts := strings.Split(name, "/")
+	if len(parts) != 2 {
+		return fmt.Errorf("invalid resource name %q: must be of the form domain/name", name)
+	}
+	domain, short := parts[0], parts[1]
+	if len(domain) > 253 || !resourceDomainRegexp.MatchString(domain) {
+		return fmt.Errorf("invalid resource name %q: %q is not a valid DNS subdomain", name, domain)
+	}
+	if domain == "kubernetes.io" || strings.HasSuffix(domain, ".kubernetes.io") {
+		return fmt.Errorf("invalid resource name %q: the kubernetes.io domain is reserved", name)
+	}
+	if len(short) > 63 || !resourceNameRegexp.MatchString(short) {
+		return fmt.Errorf("invalid resource name %q: %q must be at most 63 alphanumerics, '-', '_' or '.', starting and ending with an alphanumeric", name, short)
+	}
+	return nil
+}
+
+// resourceDomain returns the domain prefixing all the resources advertised by the plugin: --resource-namespace,
+// or else the domain of --resource-name
+func resourceDomain(config *config.Config) string {
+	if config.Flags.ResourceNamespace != "" {
+		return config.Flags.ResourceNamespace
+	}
+	return strings.SplitN(config.Flags.ResourceName, "/", 2)[0]
+}
+
+// gpuResourceName returns the resource name of the full GPUs: --resource-name, unless the resource config
+// renames the "gpu" resource, in which case the new name is kept in the domain of --resource-name. Either
+// name is moved to --resource-namespace when set.
+func gpuResourceName(config *config.Config, resourceConfig resourceConfiguration) string {
+	if rc, exists := resourceConfig["gpu"]; exists {
+		return resourceDomain(config) + "/" + rc.Name
+	}
+	if config.Flags.ResourceNamespace != "" {
+		parts := strings.SplitN(config.Flags.ResourceName, "/", 2)
+		return config.Flags.ResourceNamespace + "/" + parts[len(parts)-1]
+	}
+	return config.Flags.ResourceName
+}
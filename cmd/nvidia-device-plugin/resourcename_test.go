@@ -0,0 +1,66 @@
+/*
+ * Copyright (c) 2022, NVIDIA CORPORATION.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"testing"
+
+	config "github.com/NVIDIA/k8s-device-plugin/api/config/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidateResourceName(t *testing.T) {
+	for _, name := range []string{"nvidia.com/gpu", "example.com/virtual-gpu", "example.com/mig-1g.5gb", "gpu.example/GPU_shared"} {
+		require.NoError(t, validateResourceName(name), name)
+	}
+	for _, name := range []string{"", "gpu", "/gpu", "nvidia.com/", "nvidia.com/gpu/shared", "Example.com/gpu", "example..com/gpu", "-example.com/gpu",
+		"example.com/-gpu", "example.com/gpu shared", "kubernetes.io/gpu", "node.kubernetes.io/gpu"} {
+		require.Error(t, validateResourceName(name), name)
+	}
+}
+
+func TestGPUResourceName(t *testing.T) {
+	cfg := &config.Config{Flags: config.Flags{CommandLineFlags: &config.CommandLineFlags{ResourceName: "example.com/virtual-gpu"}}}
+	require.Equal(t, "example.com/virtual-gpu", gpuResourceName(cfg, resourceConfiguration{}))
+	require.Equal(t, "example.com/mig-1g.5gb", resourceDomain(cfg)+"/mig-1g.5gb")
+
+	// A resource config renaming the GPUs keeps the domain of --resource-name
+	rc := resourceConfiguration{"gpu": {Name: "shared-gpu", Replicas: 2}}
+	require.Equal(t, "example.com/shared-gpu", gpuResourceName(cfg, rc))
+}
+
+func TestResourceNamespace(t *testing.T) {
+	cfg := &config.Config{Flags: config.Flags{CommandLineFlags: &config.CommandLineFlags{
+		ResourceName:      "nvidia.com/gpu",
+		ResourceNamespace: "team-a.example.com",
+		SocketDir:         "/var/lib/kubelet/device-plugins",
+		DeviceListEnvvar:  "NVIDIA_VISIBLE_DEVICES",
+	}}}
+	require.Equal(t, "team-a.example.com/gpu", gpuResourceName(cfg, resourceConfiguration{}))
+	require.Equal(t, "team-a.example.com", resourceDomain(cfg))
+	rc := resourceConfiguration{"gpu": {Name: "shared-gpu", Replicas: 2}}
+	require.Equal(t, "team-a.example.com/shared-gpu", gpuResourceName(cfg, rc))
+
+	// The memory tiers are advertised in the namespace too
+	cfg.Flags.TieredResources = "small:16384,large"
+	newResourceManager := func() ResourceManager { return &testResourceManager{} }
+	plugins, err := newGPUPlugins(cfg, resourceConfiguration{}, newResourceManager, nil)
+	require.NoError(t, err)
+	require.Len(t, plugins, 2)
+	require.Equal(t, "team-a.example.com/gpu-small", plugins[0].resourceName)
+	require.Equal(t, "team-a.example.com/gpu-large", plugins[1].resourceName)
+}
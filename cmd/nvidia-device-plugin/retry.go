@@ -0,0 +1,100 @@
+/*
+ * Copyright (c) 2022, NVIDIA CORPORATION.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	config "github.com/NVIDIA/k8s-device-plugin/api/config/v1"
+)
+
+// RetryPolicy describes how often and how fast to retry an operation that failed with a transient error
+type RetryPolicy struct {
+	MaxRetries  int             `json:"maxRetries"`
+	BackoffBase config.Duration `json:"backoffBase"`
+
+	// sleep waits for a backoff; it is replaced in tests to avoid waiting
+	sleep func(ctx context.Context, d time.Duration) error
+}
+
+// sleepContext waits for 'd' unless 'ctx' is done first, in which case it returns the error of the context
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// parseRetryPolicy parses a RetryPolicy from its JSON representation. An empty string disables retries.
+func parseRetryPolicy(s string) (*RetryPolicy, error) {
+	policy := &RetryPolicy{}
+	if s == "" {
+		return policy, nil
+	}
+
+	decoder := json.NewDecoder(strings.NewReader(s))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(policy); err != nil {
+		return nil, err
+	}
+	if policy.MaxRetries < 0 {
+		return nil, fmt.Errorf("maxRetries must not be negative: %d", policy.MaxRetries)
+	}
+	if policy.BackoffBase < 0 {
+		return nil, fmt.Errorf("backoffBase must not be negative: %v", time.Duration(policy.BackoffBase))
+	}
+	return policy, nil
+}
+
+// isRetryable returns whether an error may go away when the failed operation is retried.
+// Looking up a device that does not exist never succeeds; every other error is assumed to be transient.
+func isRetryable(err error) bool {
+	var unknown *UnknownDeviceError
+	return !errors.As(err, &unknown)
+}
+
+// Do runs 'f' until it succeeds, fails with an error that is not retryable, has been retried MaxRetries times
+// or 'ctx' is done. The n-th retry is delayed by BackoffBase * 2^(n-1).
+func (p *RetryPolicy) Do(ctx context.Context, description string, f func() error) error {
+	sleep := p.sleep
+	if sleep == nil {
+		sleep = sleepContext
+	}
+
+	backoff := time.Duration(p.BackoffBase)
+	for retry := 0; ; retry++ {
+		err := f()
+		if err == nil || retry >= p.MaxRetries || !isRetryable(err) {
+			return err
+		}
+		slog.Warn(description+" failed, retrying", logKeyEventType, "retry", "backoff", backoff, "retry", retry+1, "max_retries", p.MaxRetries, "error", err)
+		if serr := sleep(ctx, backoff); serr != nil {
+			return fmt.Errorf("%w (retries interrupted: %v)", err, serr)
+		}
+		backoff *= 2
+	}
+}
@@ -0,0 +1,159 @@
+/*
+ * Copyright (c) 2022, NVIDIA CORPORATION.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	config "github.com/NVIDIA/k8s-device-plugin/api/config/v1"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+// flakyProbe returns a probeDevice function failing its first 'failures' calls with a transient NVML error
+func flakyProbe(failures int) func(d *Device) error {
+	probes := 0
+	return func(d *Device) error {
+		probes++
+		if probes <= failures {
+			return errors.New("nvml: timeout")
+		}
+		return nil
+	}
+}
+
+// recordSleeps replaces the sleep function of a retry policy and returns the recorded delays
+func recordSleeps(p *RetryPolicy) *[]time.Duration {
+	var sleeps []time.Duration
+	p.sleep = func(ctx context.Context, d time.Duration) error {
+		sleeps = append(sleeps, d)
+		return ctx.Err()
+	}
+	return &sleeps
+}
+
+func TestParseRetryPolicy(t *testing.T) {
+	testCases := []struct {
+		description string
+		input       string
+		expected    *RetryPolicy
+	}{
+		{"empty disables retries", "", &RetryPolicy{}},
+		{"string backoff", `{"maxRetries": 3, "backoffBase": "100ms"}`, &RetryPolicy{MaxRetries: 3, BackoffBase: config.Duration(100 * time.Millisecond)}},
+		{"negative retries", `{"maxRetries": -1}`, nil},
+		{"unknown field", `{"retries": 3}`, nil},
+		{"invalid json", `{"maxRetries": 3`, nil},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.description, func(t *testing.T) {
+			policy, err := parseRetryPolicy(tc.input)
+			if tc.expected == nil {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tc.expected, policy)
+		})
+	}
+}
+
+func TestAllocateRetryPolicy(t *testing.T) {
+	testCases := []struct {
+		description    string
+		policy         string
+		failures       int
+		device         string
+		expectedError  bool
+		expectedSleeps []time.Duration
+	}{
+		{
+			description:    "transient failures are retried",
+			policy:         `{"maxRetries": 3, "backoffBase": "10ms"}`,
+			failures:       3,
+			device:         "GPU-0-replica-0",
+			expectedSleeps: []time.Duration{10 * time.Millisecond, 20 * time.Millisecond, 40 * time.Millisecond},
+		},
+		{
+			description:    "retries are exhausted",
+			policy:         `{"maxRetries": 2, "backoffBase": "10ms"}`,
+			failures:       3,
+			device:         "GPU-0-replica-0",
+			expectedError:  true,
+			expectedSleeps: []time.Duration{10 * time.Millisecond, 20 * time.Millisecond},
+		},
+		{
+			description: "devices are not probed by default",
+			failures:    1,
+			device:      "GPU-0-replica-0",
+		},
+		{
+			description:   "unknown devices are not retried",
+			policy:        `{"maxRetries": 3, "backoffBase": "10ms"}`,
+			device:        "GPU-1",
+			expectedError: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.description, func(t *testing.T) {
+			m := newTestPlugin(config.CommandLineFlags{AllocateRetryPolicy: tc.policy}, 2, &Device{Device: newPluginDevice("GPU-0")})
+			// Replica IDs are validated before the lookup; let unknown devices through to test the lookup itself
+			m.deviceReplicas = append(m.deviceReplicas, &Device{Device: newPluginDevice("GPU-1")})
+			m.probeDevice = flakyProbe(tc.failures)
+			sleeps := recordSleeps(m.allocateRetryPolicy)
+
+			_, err := m.Allocate(context.Background(), &pluginapi.AllocateRequest{
+				ContainerRequests: []*pluginapi.ContainerAllocateRequest{
+					{DevicesIDs: []string{tc.device}},
+				},
+			})
+			if tc.expectedError {
+				require.Error(t, err)
+			} else {
+				require.NoError(t, err)
+			}
+			require.Equal(t, tc.expectedSleeps, *sleeps)
+		})
+	}
+}
+
+func TestAllocateRetryPolicyCanceled(t *testing.T) {
+	m := newTestPlugin(config.CommandLineFlags{AllocateRetryPolicy: `{"maxRetries": 3, "backoffBase": "1h"}`}, 2, &Device{Device: newPluginDevice("GPU-0")})
+	m.probeDevice = flakyProbe(1)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	done := make(chan error)
+	go func() {
+		_, err := m.getDeviceWithRetry(ctx, "GPU-0")
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		require.Error(t, err)
+		require.Contains(t, err.Error(), "nvml: timeout")
+		require.Contains(t, err.Error(), context.Canceled.Error())
+	case <-time.After(5 * time.Second):
+		t.Fatal("backoff did not stop when the context was canceled")
+	}
+}
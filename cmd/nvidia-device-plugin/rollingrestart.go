@@ -0,0 +1,163 @@
+/*
+ * Copyright (c) 2022, NVIDIA CORPORATION.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"time"
+
+	"golang.org/x/net/context"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+// rollingRestartPollInterval is how often a rolling restart checks whether a restarted plugin became healthy
+const rollingRestartPollInterval = time.Second
+
+// rollingRestartHealthTimeout is how long a rolling restart waits for a restarted plugin to be healthy
+const rollingRestartHealthTimeout = 2 * time.Minute
+
+// DevicePluginWatcher restarts a set of plugins one at a time so that, unlike a SIGHUP restarting all of them
+// at once, a driver update does not disrupt all GPU workloads simultaneously
+type DevicePluginWatcher struct {
+	plugins       []*NvidiaDevicePlugin
+	drainTimeout  time.Duration
+	healthTimeout time.Duration
+	pollInterval  time.Duration
+
+	stop    func(p *NvidiaDevicePlugin, ctx context.Context, drainTimeout time.Duration) error
+	start   func(p *NvidiaDevicePlugin) error
+	healthy func(p *NvidiaDevicePlugin) bool
+}
+
+// NewDevicePluginWatcher returns a DevicePluginWatcher giving the RPCs in flight of each stopped plugin up to
+// 'drainTimeout' to complete. The kubelet does not tell plugins when the containers using their devices are
+// gone, so the RPCs in flight are all there is to drain.
+func NewDevicePluginWatcher(plugins []*NvidiaDevicePlugin, drainTimeout time.Duration) *DevicePluginWatcher {
+	return &DevicePluginWatcher{
+		plugins:       plugins,
+		drainTimeout:  drainTimeout,
+		healthTimeout: rollingRestartHealthTimeout,
+		pollInterval:  rollingRestartPollInterval,
+		stop:          (*NvidiaDevicePlugin).stopWithin,
+		start:         (*NvidiaDevicePlugin).Start,
+		healthy:       (*NvidiaDevicePlugin).healthy,
+	}
+}
+
+// RollingRestart stops each plugin in turn once its RPCs in flight completed, the drain timeout elapsed or the
+// context is done, starts it again and waits for it to be healthy before proceeding to the next one.
+// It gives up on the first plugin failing to restart.
+func (w *DevicePluginWatcher) RollingRestart(ctx context.Context) error {
+	for _, p := range w.plugins {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		p.logger.Info("Rolling restart: stopping plugin", logKeyEventType, "rolling_restart")
+		if err := w.stop(p, ctx, w.drainTimeout); err != nil {
+			return fmt.Errorf("unable to stop '%s': %v", p.Name(), err)
+		}
+
+		p.logger.Info("Rolling restart: starting plugin", logKeyEventType, "rolling_restart")
+		if err := w.start(p); err != nil {
+			return fmt.Errorf("unable to start '%s': %v", p.Name(), err)
+		}
+
+		if !w.waitFor(ctx, w.healthTimeout, func() bool { return w.healthy(p) }) {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			return fmt.Errorf("'%s' did not become healthy within %v", p.Name(), w.healthTimeout)
+		}
+	}
+	return nil
+}
+
+// waitFor polls 'condition' until it holds, returning false if 'timeout' elapses or the context is done first
+func (w *DevicePluginWatcher) waitFor(ctx context.Context, timeout time.Duration, condition func() bool) bool {
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	ticker := time.NewTicker(w.pollInterval)
+	defer ticker.Stop()
+
+	for !condition() {
+		select {
+		case <-ctx.Done():
+			return false
+		case <-deadline.C:
+			return false
+		case <-ticker.C:
+		}
+	}
+	return true
+}
+
+// backgroundRollingRestart is a rolling restart running in the background of the event loop of main
+type backgroundRollingRestart struct {
+	cancel context.CancelFunc
+	result chan error
+}
+
+// Background runs RollingRestart in the background
+func (w *DevicePluginWatcher) Background() *backgroundRollingRestart {
+	ctx, cancel := context.WithCancel(context.Background())
+	r := &backgroundRollingRestart{
+		cancel: cancel,
+		result: make(chan error, 1),
+	}
+	go func() {
+		r.result <- w.RollingRestart(ctx)
+	}()
+	return r
+}
+
+// done returns the channel receiving the result of the rolling restart, which is nil for a nil restart
+func (r *backgroundRollingRestart) done() <-chan error {
+	if r == nil {
+		return nil
+	}
+	return r.result
+}
+
+// Cancel stops the rolling restart once the plugin it is restarting, if any, started again and waits for it
+func (r *backgroundRollingRestart) Cancel() {
+	if r == nil {
+		return
+	}
+	r.cancel()
+	if err := <-r.result; err != nil && err != context.Canceled {
+		slog.Warn("Rolling restart interrupted", logKeyEventType, "rolling_restart", "error", err)
+	}
+}
+
+// healthy returns whether the plugin is registered with the kubelet, sent it the device list since it started
+// and all of its devices are healthy
+func (m *NvidiaDevicePlugin) healthy() bool {
+	if !m.registered.Load() || m.lastListAndWatchSend.Load() == 0 {
+		return false
+	}
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	for _, d := range m.cachedDevices {
+		if d.Health != pluginapi.Healthy {
+			return false
+		}
+	}
+	return true
+}
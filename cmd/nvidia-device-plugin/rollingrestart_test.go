@@ -0,0 +1,182 @@
+/*
+ * Copyright (c) 2022, NVIDIA CORPORATION.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	config "github.com/NVIDIA/k8s-device-plugin/api/config/v1"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+// newTestPluginWatcher returns a DevicePluginWatcher over test plugins recording the order in which they are stopped and started.
+// Stopping one of the 'busy' plugins waits until the drain timeout elapses, as if an RPC were in flight.
+// Starting a plugin runs 'started' on it, if set. The plugins are healthy unless one of their devices is unhealthy.
+func newTestPluginWatcher(drainTimeout time.Duration, busy []*NvidiaDevicePlugin, started func(p *NvidiaDevicePlugin), plugins ...*NvidiaDevicePlugin) (*DevicePluginWatcher, func() []string) {
+	var mutex sync.Mutex
+	var steps []string
+
+	w := NewDevicePluginWatcher(plugins, drainTimeout)
+	w.pollInterval = 10 * time.Millisecond
+	w.healthTimeout = time.Second
+	w.stop = func(p *NvidiaDevicePlugin, ctx context.Context, drainTimeout time.Duration) error {
+		mutex.Lock()
+		steps = append(steps, "stop "+p.cachedDevices[0].ID)
+		mutex.Unlock()
+		for _, b := range busy {
+			if b == p {
+				select {
+				case <-ctx.Done():
+				case <-time.After(drainTimeout):
+				}
+			}
+		}
+		return nil
+	}
+	w.start = func(p *NvidiaDevicePlugin) error {
+		mutex.Lock()
+		steps = append(steps, "start "+p.cachedDevices[0].ID)
+		mutex.Unlock()
+		if started != nil {
+			started(p)
+		}
+		return nil
+	}
+	w.healthy = func(p *NvidiaDevicePlugin) bool {
+		return p.healthyDeviceCount() == len(p.cachedDevices)
+	}
+	return w, func() []string {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return append([]string(nil), steps...)
+	}
+}
+
+func TestRollingRestartOrder(t *testing.T) {
+	a := newTestPlugin(config.CommandLineFlags{}, 2, &Device{Device: newPluginDevice("GPU-a")})
+	b := newTestPlugin(config.CommandLineFlags{}, 2, &Device{Device: newPluginDevice("GPU-b")})
+	c := newTestPlugin(config.CommandLineFlags{}, 2, &Device{Device: newPluginDevice("GPU-c")})
+
+	// Allocations are never released from the point of view of the plugin, they do not hold up the restart
+	a.allocations.Add([]string{"GPU-a-replica-0"})
+
+	// An RPC in flight on GPU-b does not complete, its restart waits for the drain timeout
+	w, steps := newTestPluginWatcher(200*time.Millisecond, []*NvidiaDevicePlugin{b}, nil, a, b, c)
+	start := time.Now()
+	require.NoError(t, w.RollingRestart(context.Background()))
+	elapsed := time.Since(start)
+
+	require.Equal(t, []string{"stop GPU-a", "start GPU-a", "stop GPU-b", "start GPU-b", "stop GPU-c", "start GPU-c"}, steps())
+	require.True(t, elapsed >= 200*time.Millisecond, "restarted after %v", elapsed)
+	require.True(t, elapsed < time.Second, "restarted after %v", elapsed)
+}
+
+func TestRollingRestartWaitsForHealthyDevices(t *testing.T) {
+	a := newTestPlugin(config.CommandLineFlags{}, 1, &Device{Device: newPluginDevice("GPU-a")})
+	b := newTestPlugin(config.CommandLineFlags{}, 1, &Device{Device: newPluginDevice("GPU-b")})
+
+	// GPU-a only passes its health check 100ms after being restarted
+	var mutex sync.Mutex
+	var healthyAt time.Time
+	started := func(p *NvidiaDevicePlugin) {
+		if p == a {
+			mutex.Lock()
+			healthyAt = time.Now().Add(100 * time.Millisecond)
+			mutex.Unlock()
+		}
+	}
+
+	w, steps := newTestPluginWatcher(time.Minute, nil, started, a, b)
+	w.healthy = func(p *NvidiaDevicePlugin) bool {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return p != a || time.Now().After(healthyAt)
+	}
+	stop := w.stop
+	w.stop = func(p *NvidiaDevicePlugin, ctx context.Context, drainTimeout time.Duration) error {
+		if p == b && !w.healthy(a) {
+			t.Error("GPU-b stopped before GPU-a became healthy")
+		}
+		return stop(p, ctx, drainTimeout)
+	}
+
+	require.NoError(t, w.RollingRestart(context.Background()))
+	require.Equal(t, []string{"stop GPU-a", "start GPU-a", "stop GPU-b", "start GPU-b"}, steps())
+}
+
+func TestRollingRestartGivesUpOnUnhealthyDevices(t *testing.T) {
+	a := newTestPlugin(config.CommandLineFlags{}, 1, &Device{Device: newPluginDevice("GPU-a")})
+	b := newTestPlugin(config.CommandLineFlags{}, 1, &Device{Device: newPluginDevice("GPU-b")})
+	a.cachedDevices[0].Health = pluginapi.Unhealthy
+
+	w, steps := newTestPluginWatcher(time.Minute, nil, nil, a, b)
+	w.healthTimeout = 100 * time.Millisecond
+	err := w.RollingRestart(context.Background())
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "did not become healthy")
+	require.Equal(t, []string{"stop GPU-a", "start GPU-a"}, steps())
+}
+
+func TestRollingRestartInBackground(t *testing.T) {
+	a := newTestPlugin(config.CommandLineFlags{}, 1, &Device{Device: newPluginDevice("GPU-a")})
+	b := newTestPlugin(config.CommandLineFlags{}, 1, &Device{Device: newPluginDevice("GPU-b")})
+
+	// Cancelling interrupts the drain of GPU-a, which is started again before the restart returns
+	w, steps := newTestPluginWatcher(time.Minute, []*NvidiaDevicePlugin{a}, nil, a, b)
+	restart := w.Background()
+	require.Eventually(t, func() bool { return len(steps()) == 1 }, 5*time.Second, time.Millisecond)
+	select {
+	case err := <-restart.done():
+		t.Fatalf("rolling restart returned early: %v", err)
+	default:
+	}
+
+	cancelled := make(chan struct{})
+	go func() {
+		restart.Cancel()
+		close(cancelled)
+	}()
+	select {
+	case <-cancelled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("cancelling did not interrupt the rolling restart")
+	}
+	require.Equal(t, []string{"stop GPU-a", "start GPU-a"}, steps())
+
+	// Without a rolling restart in progress, there is nothing to wait for or cancel
+	var none *backgroundRollingRestart
+	require.Nil(t, none.done())
+	none.Cancel()
+}
+
+func TestPluginHealthy(t *testing.T) {
+	m := newTestPlugin(config.CommandLineFlags{}, 1, &Device{Device: newPluginDevice("GPU-a")}, &Device{Device: newPluginDevice("GPU-b")})
+
+	// A restarted plugin is not healthy before the kubelet received its device list
+	require.False(t, m.healthy())
+	m.registered.Store(true)
+	require.False(t, m.healthy())
+	m.lastListAndWatchSend.Store(time.Now().UnixNano())
+	require.True(t, m.healthy())
+
+	m.cachedDevices[1].Health = pluginapi.Unhealthy
+	require.False(t, m.healthy())
+}
@@ -0,0 +1,114 @@
+/*
+ * Copyright (c) 2022, NVIDIA CORPORATION.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/stats"
+)
+
+// rpcTracker is a gRPC stats.Handler keeping count of the RPCs in flight by method,
+// so that the RPCs aborted when a plugin is forcefully stopped can be reported
+type rpcTracker struct {
+	sync.Mutex
+	inFlight map[string]int
+}
+
+var _ stats.Handler = &rpcTracker{}
+
+type rpcMethodKey struct{}
+
+func newRPCTracker() *rpcTracker {
+	return &rpcTracker{inFlight: make(map[string]int)}
+}
+
+// TagRPC attaches the method of an RPC to its context for HandleRPC
+func (t *rpcTracker) TagRPC(ctx context.Context, info *stats.RPCTagInfo) context.Context {
+	return context.WithValue(ctx, rpcMethodKey{}, info.FullMethodName)
+}
+
+// HandleRPC counts an RPC as in flight from its beginning to its end
+func (t *rpcTracker) HandleRPC(ctx context.Context, s stats.RPCStats) {
+	method, _ := ctx.Value(rpcMethodKey{}).(string)
+
+	t.Lock()
+	defer t.Unlock()
+	switch s.(type) {
+	case *stats.Begin:
+		t.inFlight[method]++
+	case *stats.End:
+		t.inFlight[method]--
+		if t.inFlight[method] <= 0 {
+			delete(t.inFlight, method)
+		}
+	}
+}
+
+// TagConn leaves the context of connections untouched
+func (t *rpcTracker) TagConn(ctx context.Context, info *stats.ConnTagInfo) context.Context {
+	return ctx
+}
+
+// HandleConn ignores connection events
+func (t *rpcTracker) HandleConn(ctx context.Context, s stats.ConnStats) {}
+
+// String describes the RPCs in flight, e.g. "2 RPC(s): 1 /v1beta1.DevicePlugin/Allocate, 1 /v1beta1.DevicePlugin/ListAndWatch"
+func (t *rpcTracker) String() string {
+	t.Lock()
+	defer t.Unlock()
+
+	var methods []string
+	total := 0
+	for method, n := range t.inFlight {
+		methods = append(methods, fmt.Sprintf("%d %s", n, method))
+		total += n
+	}
+	sort.Strings(methods)
+	if total == 0 {
+		return "no RPC"
+	}
+	return fmt.Sprintf("%d RPC(s): %s", total, strings.Join(methods, ", "))
+}
+
+// stopServer stops the gRPC server of the plugin, waiting up to 'timeout' for the RPCs in flight to complete,
+// or until 'ctx' is done. The remaining RPCs are then aborted and logged.
+func (m *NvidiaDevicePlugin) stopServer(ctx context.Context, timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	stopped := make(chan struct{})
+	go func() {
+		m.server.GracefulStop()
+		close(stopped)
+	}()
+
+	select {
+	case <-stopped:
+		return
+	case <-ctx.Done():
+	}
+
+	m.logger.Warn("GRPC server did not stop in time, aborting in-flight RPCs", logKeyEventType, "grpc_stop_timeout", "timeout", timeout, "rpcs", m.rpcs.String())
+	m.server.Stop()
+	<-stopped
+}
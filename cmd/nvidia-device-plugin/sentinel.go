@@ -0,0 +1,142 @@
+/*
+ * Copyright (c) 2022, NVIDIA CORPORATION.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"time"
+
+	"github.com/NVIDIA/gpu-monitoring-tools/bindings/go/nvml"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+// sentinelCheckInterval is how often the sentinel replicas probe their GPU
+const sentinelCheckInterval = 30 * time.Second
+
+// SentinelDevice is a replica reserved by the plugin itself. It is never advertised to the kubelet
+// and is used to probe its GPU for driver issues before they affect user workloads.
+type SentinelDevice struct {
+	*Device
+	Parent *Device
+}
+
+// probeDevice checks that the driver still responds to queries about a device
+func probeDevice(d *Device) error {
+	dev, err := nvml.NewDeviceLiteByUUID(d.ID)
+	if err != nil {
+		return err
+	}
+	_, err = dev.Status()
+	return err
+}
+
+// reserveSentinels claims the last replica of each physical GPU as its sentinel. GPUs with a single
+// replica are left alone as reserving it would leave nothing to advertise to the kubelet.
+func (m *NvidiaDevicePlugin) reserveSentinels() {
+	m.sentinels = nil
+
+	physical := make(map[string]*Device)
+	for _, d := range m.physicalDevices() {
+		physical[d.ID] = d
+	}
+
+	replicas := make(map[string][]*Device)
+	var order []string
+	for _, r := range m.deviceReplicas {
+		id := stripReplica(r.ID, m.replicaCodec)
+		if _, exists := replicas[id]; !exists {
+			order = append(order, id)
+		}
+		replicas[id] = append(replicas[id], r)
+	}
+
+	reserved := make(map[*Device]bool)
+	for _, id := range order {
+		parent, exists := physical[id]
+		if !exists {
+			continue
+		}
+		if len(replicas[id]) < 2 {
+			m.logger.Warn("Not reserving a sentinel replica for a device with less than 2 replicas", logKeyEventType, "sentinel_skipped", logKeyDeviceUUID, id, "replicas", len(replicas[id]))
+			continue
+		}
+		sentinel := replicas[id][len(replicas[id])-1]
+		reserved[sentinel] = true
+		m.sentinels = append(m.sentinels, &SentinelDevice{Device: sentinel, Parent: parent})
+		m.logger.Info("Reserved sentinel replica", logKeyEventType, "sentinel_reserved", logKeyDeviceUUID, id, "sentinel", sentinel.ID)
+	}
+
+	var advertised []*Device
+	for _, r := range m.deviceReplicas {
+		if !reserved[r] {
+			advertised = append(advertised, r)
+		}
+	}
+	m.deviceReplicas = advertised
+}
+
+// watchSentinels probes the GPU of each sentinel until 'stop' is closed. A failed probe marks the
+// whole GPU unhealthy right away instead of waiting for the regular health checks.
+func (m *NvidiaDevicePlugin) watchSentinels(stop <-chan interface{}, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		for _, s := range m.sentinels {
+			// Unhealthy GPUs are probed again once they recovered, if ever
+			if m.deviceHealth(s.Parent) == pluginapi.Unhealthy {
+				continue
+			}
+			if err := m.probeDevice(s.Parent); err != nil {
+				m.logger.Error("Sentinel failed to probe device", logKeyEventType, "sentinel_probe_failed", logKeyDeviceUUID, s.Parent.ID, "sentinel", s.ID, "error", err)
+				parent := s.Parent
+				setHealthRecheck(parent.ID, func() error { return m.probeDevice(parent) })
+				select {
+				case m.health <- s.Parent:
+				case <-stop:
+					return
+				}
+			}
+		}
+
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// deviceHealth returns the health of a physical device
+func (m *NvidiaDevicePlugin) deviceHealth(d *Device) string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return d.Health
+}
+
+// setHealth sets the health of a physical device along with all of the replicas advertised for it.
+// Changes of the health are recorded in the plugin's health history along with their reason, and in its metrics.
+func (m *NvidiaDevicePlugin) setHealth(d *Device, health string, reason string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if d.Health != health {
+		m.healthHistory.Record(d.ID, d.Health, health, reason)
+	}
+	d.Health = health
+	m.updateReplicaHealth(d)
+	updateDeviceHealthMetric(d)
+}
@@ -0,0 +1,75 @@
+/*
+ * Copyright (c) 2022, NVIDIA CORPORATION.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	config "github.com/NVIDIA/k8s-device-plugin/api/config/v1"
+	"github.com/stretchr/testify/require"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+func TestSentinelDevice(t *testing.T) {
+	m := newTestPlugin(config.CommandLineFlags{EnableSentinelDevice: true}, 3,
+		&Device{Device: newPluginDevice("GPU-0")},
+		&Device{Device: newPluginDevice("GPU-1")},
+	)
+
+	// The last replica of each GPU is reserved and never advertised
+	require.Len(t, m.sentinels, 2)
+	require.Equal(t, "GPU-0-replica-2", m.sentinels[0].ID)
+	require.Equal(t, "GPU-1-replica-2", m.sentinels[1].ID)
+	var advertised []string
+	for _, d := range m.apiDevices() {
+		advertised = append(advertised, d.ID)
+	}
+	require.Equal(t, []string{"GPU-0-replica-0", "GPU-0-replica-1", "GPU-1-replica-0", "GPU-1-replica-1"}, advertised)
+	require.False(t, m.deviceReplicaExists("GPU-0-replica-2"))
+
+	m.probeDevice = func(d *Device) error {
+		if d.ID == "GPU-1" {
+			return fmt.Errorf("GPU is lost")
+		}
+		return nil
+	}
+
+	stream := newFakeListAndWatchServer()
+	go m.ListAndWatch(&pluginapi.Empty{}, stream)
+	defer close(m.stop)
+	require.NotNil(t, stream.next(time.Second))
+
+	go m.watchSentinels(m.stop, time.Hour)
+
+	update := stream.next(time.Second)
+	require.NotNil(t, update, "sentinel failure did not mark the device unhealthy")
+	for _, d := range update.Devices {
+		expected := pluginapi.Healthy
+		if stripReplica(d.ID, defaultReplicaIDCodec) == "GPU-1" {
+			expected = pluginapi.Unhealthy
+		}
+		require.Equal(t, expected, d.Health, d.ID)
+	}
+}
+
+func TestSentinelDeviceSingleReplica(t *testing.T) {
+	m := newTestPlugin(config.CommandLineFlags{EnableSentinelDevice: true}, 1, &Device{Device: newPluginDevice("GPU-0")})
+	require.Empty(t, m.sentinels)
+	require.Len(t, m.apiDevices(), 1)
+}
@@ -19,18 +19,26 @@ package main
 import (
 	"errors"
 	"fmt"
-	"log"
+	"log/slog"
 	"net"
 	"os"
 	"path"
 	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/NVIDIA/go-gpuallocator/gpuallocator"
 	config "github.com/NVIDIA/k8s-device-plugin/api/config/v1"
+	topology "github.com/NVIDIA/k8s-device-plugin/api/topology/v1"
 	"golang.org/x/net/context"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
 )
 
@@ -38,12 +46,14 @@ import (
 const (
 	DeviceListStrategyEnvvar       = "envvar"
 	DeviceListStrategyVolumeMounts = "volume-mounts"
+	DeviceListStrategyAnnotation   = "annotation"
 )
 
 // Constants to represent the various device id strategies
 const (
-	DeviceIDStrategyUUID  = "uuid"
-	DeviceIDStrategyIndex = "index"
+	DeviceIDStrategyUUID       = "uuid"
+	DeviceIDStrategyIndex      = "index"
+	DeviceIDStrategyPCIAddress = "pci-address"
 )
 
 // Constants for use by the 'volume-mounts' device list strategy
@@ -52,6 +62,32 @@ const (
 	deviceListAsVolumeMountsContainerPathRoot = "/var/run/nvidia-container-devices"
 )
 
+// Constants to represent the various sources of the mounts of the 'volume-mounts' device list strategy
+const (
+	VolumeMountSourceStrategyDevNull    = "devnull"
+	VolumeMountSourceStrategyDeviceNode = "device-node"
+)
+
+// deviceListAnnotation is the container annotation holding the comma-separated list of allocated device IDs
+// when using the 'annotation' device list strategy
+const deviceListAnnotation = "nvidia.com/allocated-devices"
+
+// Bounds and spread of the delay before restarting a crashed gRPC server, replaced in tests
+var (
+	initialServeRestartBackoff = time.Second
+	maxServeRestartBackoff     = 30 * time.Second
+	serveRestartJitter         = 0.1
+)
+
+// maxServeRestarts is how many times in a row the gRPC server is restarted without serving stably before giving up
+const maxServeRestarts = 10
+
+// devRoot is the root under which the presence of the NVIDIA control devices is checked
+var devRoot = "/"
+
+// wsl2DeviceNode is the device through which WSL2 exposes all the GPUs instead of /dev/nvidia*
+const wsl2DeviceNode = "/dev/dxg"
+
 // NvidiaDevicePlugin implements the Kubernetes device plugin API
 type NvidiaDevicePlugin struct {
 	ResourceManager
@@ -62,17 +98,102 @@ type NvidiaDevicePlugin struct {
 	socket           string
 	replicas         uint
 	autoReplicas     bool
-
-	server         *grpc.Server
-	cachedDevices  []*Device // raw devices
-	deviceReplicas []*Device // devices presented to k8s that include the replicas
-	health         chan *Device
-	stop           chan interface{}
+	replicaCodec     ReplicaIDCodec
+	powerManager     PowerManager
+
+	allocateRetryPolicy *RetryPolicy
+	allocations         *AllocationStore
+	healthHistory       *DeviceHealthStore
+
+	queryThrottleReasons func(uuid string) (uint64, error)
+	queryEnergy          func(uuid string) (uint64, error)
+	queryVirtualType     func(d *Device) (string, error)
+	queryModel           func(d *Device) (string, error)
+	queryVBIOSVersion    func(uuid string) (string, error)
+	queryFreeMemory      func(uuid string) (uint64, error)
+	queryUsedMemory      func(uuid string) (uint64, error)
+	readXIDErrors        func(busID string) (map[uint]uint64, error)
+	resetGPU             func(uuid string) error
+	probeDevice          func(d *Device) error
+	validateDeviceAccess func(uuid string) error
+	deviceIDsFromUUIDs   func(uuids []string) []string
+	events               EventRecorder
+	unhealthyEvents      *eventRateLimiter // survives restarts, so that a flapping device cannot flood the API server
+	leases               *AllocationLeases // records the allocations in the ConfigMap named by --lease-configmap
+	logger               *slog.Logger      // structured logger, annotating all records with the resource name
+
+	// Guards the devices and their replicas along with their health, which ListAndWatch updates while
+	// the RPCs and the debug endpoints read them
+	mu sync.RWMutex
+
+	server          *grpc.Server
+	rpcs            *rpcTracker
+	cachedDevices   []*Device // raw devices
+	devicesRestored bool      // the devices were restored from --device-cache-file as NVML reported none
+	deviceReplicas  []*Device // devices presented to k8s that include the replicas
+	sentinels       []*SentinelDevice
+	health          chan *Device
+	stop            chan interface{}
+	socketRemoval   *sync.Once                 // removes the socket once per start, on Stop() or when the gRPC server gives up
+	serveFailures   chan<- *NvidiaDevicePlugin // notified when the gRPC server gives up, so that the plugin is restarted
+	devicesFound    chan<- *NvidiaDevicePlugin // notified when NVML reports devices again while serving restored ones
+
+	scaling          chan replicaScaling
+	withheldReplicas map[string]int // physical device ID to number of replicas withheld due to low memory
+
+	resized         chan struct{}        // notifies ListAndWatch that the number of replicas changed
+	evictions       chan struct{}        // notifies ListAndWatch that allocations were evicted, possibly releasing retired replicas
+	retiredReplicas map[string]time.Time // replicas removed by a resize while allocated to the time they were retired, advertised unhealthy until released
+
+	// Call counters surviving plugin restarts, reported by the debug endpoint
+	allocateCallsTotal               atomic.Uint64
+	allocateErrorsTotal              atomic.Uint64
+	getPreferredAllocationCallsTotal atomic.Uint64
+
+	// Liveness reported by /healthz
+	registered           atomic.Bool
+	lastListAndWatchSend atomic.Int64 // Unix time in nanoseconds, 0 until the first successful send
 }
 
-// NewNvidiaDevicePlugin returns an initialized NvidiaDevicePlugin
-func NewNvidiaDevicePlugin(config *config.Config, resourceName string, resourceManager ResourceManager, deviceListEnvvar string, allocatePolicy gpuallocator.Policy, socket string, replicas uint, autoReplicas bool) *NvidiaDevicePlugin {
-	return &NvidiaDevicePlugin{
+// NewNvidiaDevicePlugin returns an initialized NvidiaDevicePlugin, or an error if its options are invalid
+func NewNvidiaDevicePlugin(config *config.Config, resourceName string, resourceManager ResourceManager, deviceListEnvvar string, allocatePolicy gpuallocator.Policy, socket string, replicas uint, autoReplicas bool, replicaCodec ReplicaIDCodec) (*NvidiaDevicePlugin, error) {
+	if err := validateEnvVarName(deviceListEnvvar); err != nil {
+		return nil, fmt.Errorf("invalid device list envvar for '%s': %v", resourceName, err)
+	}
+
+	if replicaCodec == nil {
+		codec, err := newReplicaIDCodec(config.Flags.ReplicaIDCodec, config.Flags.ReplicaIDSeparator)
+		if err != nil {
+			return nil, err
+		}
+		replicaCodec = codec
+	}
+
+	allocateRetryPolicy, err := parseRetryPolicy(config.Flags.AllocateRetryPolicy)
+	if err != nil {
+		return nil, err
+	}
+
+	if allocatePolicy != nil && config.Flags.TopologyFile != "" {
+		t, err := topology.Load(config.Flags.TopologyFile)
+		if err != nil {
+			return nil, err
+		}
+		allocatePolicy, err = newStaticTopologyPolicy(allocatePolicy, t)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Without replicas, device IDs are advertised and allocated as is
+	if config.Flags.NoReplicas {
+		replicas, autoReplicas = 0, false
+	}
+	if replicas == 0 && !autoReplicas {
+		replicaCodec = identityCodec{}
+	}
+
+	m := &NvidiaDevicePlugin{
 		ResourceManager:  resourceManager,
 		config:           *config,
 		resourceName:     resourceName,
@@ -81,6 +202,25 @@ func NewNvidiaDevicePlugin(config *config.Config, resourceName string, resourceM
 		socket:           socket,
 		replicas:         replicas,
 		autoReplicas:     autoReplicas,
+		replicaCodec:     replicaCodec,
+		powerManager:     &nvmlPowerManager{},
+
+		allocateRetryPolicy: allocateRetryPolicy,
+		allocations:         NewAllocationStore(replicaCodec),
+		healthHistory:       NewDeviceHealthStore(config.Flags.HealthHistorySize),
+
+		queryThrottleReasons: queryClocksThrottleReasons,
+		queryEnergy:          queryEnergyConsumption,
+		queryVirtualType:     queryDeviceVirtualType,
+		queryModel:           queryDeviceModel,
+		queryVBIOSVersion:    queryVBIOSVersion,
+		queryFreeMemory:      queryFreeMemory,
+		queryUsedMemory:      queryUsedMemory,
+		readXIDErrors:        readXIDErrors,
+		resetGPU:             resetGPU,
+		probeDevice:          probeDevice,
+		logger:               slog.Default().With(logKeyResourceName, resourceName),
+		unhealthyEvents:      newEventRateLimiter(unhealthyEventInterval),
 
 		// These will be reinitialized every
 		// time the plugin server is restarted.
@@ -89,81 +229,369 @@ func NewNvidiaDevicePlugin(config *config.Config, resourceName string, resourceM
 		server:         nil,
 		health:         nil,
 		stop:           nil,
+		socketRemoval:  nil,
+	}
+	m.validateDeviceAccess = func(uuid string) error {
+		return validateDeviceAccess(m.config.Flags.PrestartValidateNvidiaSMI, uuid, time.Duration(m.config.Flags.PrestartValidateTimeout))
 	}
+	m.deviceIDsFromUUIDs = m.lookupDeviceIDs
+	return m, nil
+}
+
+// Name returns an identifier of the plugin for logs and metrics, distinguishing
+// the plugins serving different resources from the same process
+func (m *NvidiaDevicePlugin) Name() string {
+	return m.resourceName + "@" + m.socket
 }
 
 func (m *NvidiaDevicePlugin) initialize() {
-	m.cachedDevices = m.Devices()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	devices := m.Devices()
+	if len(devices) == 0 {
+		devices = m.restoreDevices()
+	}
+	m.cachedDevices = m.ignoreDevices(devices, m.config.Flags.IgnoreDeviceUUIDs)
+	m.cachedDevices = m.filterDevices(m.cachedDevices, m.config.Flags.DeviceFilterUUIDRegex, m.config.Flags.DeviceFilterIndex)
+	m.cachedDevices = m.uniqueDevices(m.cachedDevices)
+	m.cachedDevices = m.filterDevicesByModel(m.cachedDevices, m.config.Flags.GPUModelFilter)
+	m.setVirtualTypes()
+	m.setVBIOSVersions()
+	m.setPowerLimitInfo()
+
+	if m.config.Flags.SetPowerLimitWatts > 0 && !m.config.Flags.DryRun {
+		m.setPowerLimits(uint(m.config.Flags.SetPowerLimitWatts))
+	}
+	m.initPowerLimitMetrics()
+
+	if m.autoReplicas {
+		m.setReservedMemory()
+	}
 
 	for _, dev := range m.cachedDevices {
-		replicas := m.replicas
-		if m.autoReplicas {
-			// Dividing the total memory to avoid reaching a limit of about 64K devices
-			replicas = uint(dev.TotalMemory / 1000)
-		}
+		m.deviceReplicas = append(m.deviceReplicas, m.newReplicas(dev)...)
+	}
 
-		log.Printf("Replicating device %v %v times", *dev, replicas)
-		for i := uint(0); i < replicas; i++ {
-			replicatedDev := *dev // This is replicating the Device struct
-			replicatedDev.ID = fmt.Sprintf("%s%s%d", dev.ID, joinStr, i)
-			m.deviceReplicas = append(m.deviceReplicas, &replicatedDev)
-		}
+	if m.config.Flags.EnableSentinelDevice {
+		m.reserveSentinels()
 	}
 
-	m.server = grpc.NewServer([]grpc.ServerOption{}...)
-	m.health = make(chan *Device)
+	m.rpcs = newRPCTracker()
+	options := []grpc.ServerOption{grpc.StatsHandler(m.rpcs)}
+	if size := m.config.Flags.MaxGRPCMessageSize; size > 0 {
+		options = append(options, grpc.MaxRecvMsgSize(size), grpc.MaxSendMsgSize(size))
+	}
+	m.server = grpc.NewServer(options...)
+	// Buffered so that the health checks are not held up by the transitions of all devices at once
+	m.health = make(chan *Device, len(m.cachedDevices))
+	m.scaling = make(chan replicaScaling)
+	m.withheldReplicas = make(map[string]int)
+	// Buffered so that notifying ListAndWatch never blocks, pending notifications being merged
+	m.resized = make(chan struct{}, 1)
+	m.evictions = make(chan struct{}, 1)
+	m.retiredReplicas = make(map[string]time.Time)
 	m.stop = make(chan interface{})
+	m.socketRemoval = &sync.Once{}
+	m.initReplicaMetrics()
+}
+
+// newReplicas returns the replicas to advertise for a physical device, or a copy of the device itself when it is not shared.
+// The caller must hold m.mu.
+func (m *NvidiaDevicePlugin) newReplicas(dev *Device) []*Device {
+	if m.replicasDisabledLocked() {
+		m.logger.Info("Advertising device without replicas", logKeyEventType, "device_replicated", logKeyDeviceUUID, dev.ID, "replicas", 0)
+		unreplicatedDev := *dev
+		return []*Device{&unreplicatedDev}
+	}
+	replicas := m.replicaCount(dev)
+	if replicas == 1 && isMigDevice(dev) {
+		// MIG devices already are partitions with UUIDs of their own, only shared ones get replica IDs
+		m.logger.Info("Advertising MIG device without replicas", logKeyEventType, "device_replicated", logKeyDeviceUUID, dev.ID, "replicas", 0)
+		migDev := *dev
+		return []*Device{&migDev}
+	}
+	m.logger.Info("Replicating device", logKeyEventType, "device_replicated", logKeyDeviceUUID, dev.ID, "replicas", replicas)
+	var devices []*Device
+	for i := uint(0); i < replicas; i++ {
+		replicatedDev := *dev // This is replicating the Device struct
+		replicatedDev.ID = m.replicaCodec.Encode(dev.ID, i)
+		devices = append(devices, &replicatedDev)
+	}
+	return devices
 }
 
 func (m *NvidiaDevicePlugin) cleanup() {
-	close(m.stop)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.deleteReplicaMetrics()
+	m.deletePowerLimitMetrics()
+	m.registered.Store(false)
+	m.lastListAndWatchSend.Store(0)
 	m.cachedDevices = nil
+	m.devicesRestored = false
 	m.deviceReplicas = nil
+	m.sentinels = nil
 	m.server = nil
+	m.rpcs = nil
 	m.health = nil
+	m.scaling = nil
+	m.withheldReplicas = nil
+	m.resized = nil
+	m.evictions = nil
+	m.retiredReplicas = nil
 	m.stop = nil
+	m.socketRemoval = nil
 }
 
 // Start starts the gRPC server, registers the device plugin with the Kubelet,
 // and starts the device healthchecks.
 func (m *NvidiaDevicePlugin) Start() error {
+	return m.StartWithContext(context.Background())
+}
+
+// StartWithContext starts the plugin as Start does, giving up on the registration with the kubelet once 'ctx' is done
+func (m *NvidiaDevicePlugin) StartWithContext(ctx context.Context) error {
 	m.initialize()
 
-	err := m.Serve()
+	err := m.checkVBIOSVersions(m.config.Flags.RequireVBIOSVersion)
+	if err == nil {
+		err = m.checkPCIAddresses()
+	}
+	if err == nil {
+		err = m.checkReplicaSeparator()
+	}
+	if err == nil {
+		err = m.setupAllocationLeases()
+	}
 	if err != nil {
-		log.Printf("Could not start device plugin for '%s': %s", m.resourceName, err)
+		m.logger.Error("Could not start device plugin", logKeyEventType, "plugin_start_failed", "socket", m.socket, "error", err)
+		close(m.stop)
 		m.cleanup()
 		return err
 	}
-	log.Printf("Starting to serve '%s' on %s", m.resourceName, m.socket)
 
-	err = m.Register()
+	if name := m.config.Flags.SyncConfigToConfigMap; name != "" {
+		go m.syncConfig(name)
+	}
+
+	err = m.Serve()
+	if err != nil {
+		m.logger.Error("Could not start device plugin", logKeyEventType, "plugin_start_failed", "socket", m.socket, "error", err)
+		close(m.stop)
+		m.cleanup()
+		return err
+	}
+	m.logger.Info("Starting to serve", logKeyEventType, "plugin_serving", "socket", m.socket)
+
+	err = m.Register(ctx)
 	if err != nil {
-		log.Printf("Could not register device plugin: %s", err)
+		m.logger.Error("Could not register device plugin", logKeyEventType, "plugin_registration_failed", "socket", m.socket, "error", err)
 		m.Stop()
 		return err
 	}
-	log.Printf("Registered device plugin for '%s' with Kubelet", m.resourceName)
+	m.logger.Info("Registered device plugin with Kubelet", logKeyEventType, "plugin_registered", "socket", m.socket)
+	m.registered.Store(true)
 
-	go m.CheckHealth(m.stop, m.cachedDevices, m.health)
+	m.startHealthChecks()
+
+	if interval := time.Duration(m.config.Flags.ClockThrottlePollInterval); interval > 0 {
+		go m.watchClocksThrottleReasons(m.stop, m.physicalDevices(), interval)
+	}
+
+	if interval := time.Duration(m.config.Flags.EnergyPollInterval); interval > 0 {
+		go m.watchEnergyConsumption(m.stop, m.physicalDevices(), interval)
+	}
+
+	if len(m.sentinels) > 0 {
+		go m.watchSentinels(m.stop, sentinelCheckInterval)
+	}
+
+	if m.config.Flags.ScaleDownOnLowMemory {
+		go m.watchFreeMemory(m.stop, m.physicalDevices(), lowMemoryPollInterval)
+	}
+
+	if (m.config.Flags.WatchXIDErrors || m.config.Flags.EmitK8sDeviceEvents) && m.events == nil {
+		m.events = sharedNodeEventRecorder()
+	}
+
+	if m.config.Flags.WatchXIDErrors {
+		go m.watchXIDErrors(m.stop, m.physicalDevices(), xidPollInterval)
+	}
+
+	if m.leases != nil {
+		go m.renewAllocationClaims(m.stop, allocationClaimRenewInterval)
+	}
+
+	if m.devicesRestored && m.devicesFound != nil {
+		go m.watchRestoredDevices(m.stop, restoredDevicesPollInterval)
+	}
 
 	return nil
 }
 
+// ignoreDevices removes the devices listed in --ignore-device-uuids from 'devices'
+func (m *NvidiaDevicePlugin) ignoreDevices(devices []*Device, uuids []string) []*Device {
+	if len(uuids) == 0 {
+		return devices
+	}
+
+	ignored := make(map[string]bool)
+	for _, uuid := range uuids {
+		ignored[uuid] = false
+	}
+
+	var filtered []*Device
+	for _, d := range devices {
+		if _, exists := ignored[d.ID]; exists {
+			m.logger.Info("Ignoring device listed in --ignore-device-uuids", logKeyEventType, "device_excluded", logKeyDeviceUUID, d.ID)
+			continue
+		}
+		filtered = append(filtered, d)
+	}
+	return filtered
+}
+
+// servedDeviceCount returns the number of devices of the plugin left once the devices listed in
+// --ignore-device-uuids are removed
+func (m *NvidiaDevicePlugin) servedDeviceCount() int {
+	uuids := m.config.Flags.IgnoreDeviceUUIDs
+	if len(uuids) == 0 {
+		return m.DeviceCount()
+	}
+
+	count := 0
+	for _, d := range m.Devices() {
+		if find(uuids, d.ID) == len(uuids) {
+			count++
+		}
+	}
+	return count
+}
+
+// pluginsToServe returns the plugins with devices to serve, be they reported by NVML or restored from --device-cache-file
+func pluginsToServe(plugins []*NvidiaDevicePlugin) []*NvidiaDevicePlugin {
+	var served []*NvidiaDevicePlugin
+	for _, p := range plugins {
+		if p.servedDeviceCount() > 0 || p.hasRestorableDevices() {
+			served = append(served, p)
+		}
+	}
+	return served
+}
+
+// warnUnknownIgnoredDevices logs a warning for each of 'uuids' from --ignore-device-uuids that is not a device of any of 'plugins'
+func warnUnknownIgnoredDevices(plugins []*NvidiaDevicePlugin, uuids []string) {
+	if len(uuids) == 0 {
+		return
+	}
+
+	found := make(map[string]bool)
+	for _, p := range plugins {
+		for _, d := range p.Devices() {
+			found[d.ID] = true
+		}
+	}
+	for _, uuid := range uuids {
+		if !found[uuid] {
+			slog.Warn("Device from --ignore-device-uuids not found", logKeyEventType, "ignored_device_not_found", logKeyDeviceUUID, uuid)
+		}
+	}
+}
+
+// uniqueDevices removes the devices with the same ID as a previous one from 'devices', as the kubelet
+// could not tell their replicas apart
+func (m *NvidiaDevicePlugin) uniqueDevices(devices []*Device) []*Device {
+	seen := make(map[string]bool)
+	var unique []*Device
+	for _, d := range devices {
+		if seen[d.ID] {
+			m.logger.Warn("Ignoring device with a duplicate ID", logKeyEventType, "device_duplicate", logKeyDeviceUUID, d.ID)
+			continue
+		}
+		seen[d.ID] = true
+		unique = append(unique, d)
+	}
+	return unique
+}
+
+// filterDevices removes the devices whose UUID matches --device-filter-uuid-regex or whose index is listed in
+// --device-filter-index from 'devices'
+func (m *NvidiaDevicePlugin) filterDevices(devices []*Device, uuidRegex string, indices []string) []*Device {
+	if uuidRegex == "" && len(indices) == 0 {
+		return devices
+	}
+
+	var re *regexp.Regexp
+	if uuidRegex != "" {
+		re = regexp.MustCompile(uuidRegex) // validated at startup
+	}
+	excludedIndices := make(map[string]bool)
+	for _, index := range indices {
+		excludedIndices[strings.TrimSpace(index)] = true
+	}
+
+	var filtered []*Device
+	for _, d := range devices {
+		switch {
+		case re != nil && re.MatchString(d.ID):
+			m.logger.Info("Excluding device matching --device-filter-uuid-regex", logKeyEventType, "device_excluded", logKeyDeviceUUID, d.ID, "regex", uuidRegex)
+		case excludedIndices[d.Index]:
+			m.logger.Info("Excluding device listed in --device-filter-index", logKeyEventType, "device_excluded", logKeyDeviceUUID, d.ID, "index", d.Index)
+		default:
+			filtered = append(filtered, d)
+		}
+	}
+	return filtered
+}
+
+// startHealthChecks monitors the health of the devices in the background unless disabled with --no-health-check.
+// The health channel is left in place either way so that ListAndWatch can keep selecting on it.
+func (m *NvidiaDevicePlugin) startHealthChecks() {
+	if m.config.Flags.NoHealthCheck {
+		m.logger.Warn("Health checks are disabled, all devices are reported healthy", logKeyEventType, "health_checks_disabled")
+		return
+	}
+	go m.CheckHealth(m.stop, m.cachedDevices, m.health)
+}
+
 // Stop stops the gRPC server.
+// The in-flight RPCs are given up to --grpc-stop-timeout to complete before being aborted.
 func (m *NvidiaDevicePlugin) Stop() error {
-	if m == nil || m.server == nil {
+	if m == nil {
+		return nil
+	}
+	return m.stopWithin(context.Background(), time.Duration(m.config.Flags.GRPCStopTimeout))
+}
+
+// stopWithin stops the gRPC server as Stop does, giving the in-flight RPCs up to 'timeout' to complete unless 'ctx' is done first
+func (m *NvidiaDevicePlugin) stopWithin(ctx context.Context, timeout time.Duration) error {
+	if m.server == nil {
 		return nil
 	}
-	log.Printf("Stopping to serve '%s' on %s", m.resourceName, m.socket)
-	m.server.Stop()
-	if err := os.Remove(m.socket); err != nil && !os.IsNotExist(err) {
+	m.logger.Info("Stopping to serve", logKeyEventType, "plugin_stopping", "socket", m.socket)
+	// Closing 'stop' ends the ListAndWatch streams, which would otherwise hold up the graceful stop
+	close(m.stop)
+	m.stopServer(ctx, timeout)
+	m.releaseAllocations()
+	m.saveDevices()
+	if err := m.removeSocket(); err != nil && !os.IsNotExist(err) {
 		return err
 	}
 	m.cleanup()
 	return nil
 }
 
+// removeSocket removes the socket of the plugin unless it was already removed since the last start
+func (m *NvidiaDevicePlugin) removeSocket() error {
+	var err error
+	m.socketRemoval.Do(func() {
+		err = os.Remove(m.socket)
+	})
+	return err
+}
+
 // Serve starts the gRPC server of the device plugin.
 func (m *NvidiaDevicePlugin) Serve() error {
 	os.Remove(m.socket)
@@ -175,37 +603,19 @@ func (m *NvidiaDevicePlugin) Serve() error {
 	pluginapi.RegisterDevicePluginServer(m.server, m)
 
 	go func() {
-		lastCrashTime := time.Now()
-		restartCount := 0
-		for {
-			log.Printf("Starting GRPC server for '%s'", m.resourceName)
-			err := m.server.Serve(sock)
-			if err == nil {
-				break
-			}
-
-			log.Printf("GRPC server for '%s' crashed with error: %v", m.resourceName, err)
-
-			// restart if it has not been too often
-			// i.e. if server has crashed more than 5 times and it didn't last more than one hour each time
-			if restartCount > 5 {
-				// quit
-				log.Fatalf("GRPC server for '%s' has repeatedly crashed recently. Quitting", m.resourceName)
-			}
-			timeSinceLastCrash := time.Since(lastCrashTime).Seconds()
-			lastCrashTime = time.Now()
-			if timeSinceLastCrash > 3600 {
-				// it has been one hour since the last crash.. reset the count
-				// to reflect on the frequency
-				restartCount = 1
-			} else {
-				restartCount++
+		if err := m.serveWithRestarts(sock); err != nil {
+			m.logger.Error("gRPC server gave up", "error", err)
+			if m.serveFailures != nil {
+				select {
+				case m.serveFailures <- m:
+				default:
+				}
 			}
 		}
 	}()
 
 	// Wait for server to start by launching a blocking connexion
-	conn, err := m.dial(m.socket, 5*time.Second)
+	conn, err := m.dial(m.socket, time.Duration(m.config.Flags.GRPCDialTimeout))
 	if err != nil {
 		return err
 	}
@@ -214,9 +624,61 @@ func (m *NvidiaDevicePlugin) Serve() error {
 	return nil
 }
 
+// serveWithRestarts serves gRPC requests on 'sock', restarting the server when it crashes after an exponential
+// backoff. The backoff starts over once the server served for --restart-stable-duration without crashing.
+// An error is returned if the server crashes too often: with --socket-cleanup-on-exit, the socket is removed
+// beforehand so that the kubelet does not keep dialing a dead plugin until it is restarted.
+func (m *NvidiaDevicePlugin) serveWithRestarts(sock net.Listener) error {
+	stop := m.stop
+	backoff := newExponentialBackoff(initialServeRestartBackoff, maxServeRestartBackoff).withJitter(serveRestartJitter)
+	restartCount := 0
+	for {
+		m.logger.Info("Starting GRPC server", "socket", m.socket)
+		started := time.Now()
+		err := m.server.Serve(sock)
+		if err == nil {
+			return nil
+		}
+
+		m.logger.Error("GRPC server crashed", logKeyEventType, "grpc_server_crashed", "error", err)
+
+		if time.Since(started) >= time.Duration(m.config.Flags.RestartStableDuration) {
+			backoff.Reset()
+			restartCount = 0
+		}
+		if restartCount >= maxServeRestarts {
+			if m.config.Flags.SocketCleanupOnExit {
+				if err := m.removeSocket(); err != nil && !os.IsNotExist(err) {
+					m.logger.Warn("Unable to remove socket", "socket", m.socket, "error", err)
+				}
+			}
+			return fmt.Errorf("GRPC server for '%s' has repeatedly crashed recently: %v", m.Name(), err)
+		}
+		restartCount++
+
+		delay := backoff.Next()
+		m.logger.Info("Restarting GRPC server", logKeyEventType, "grpc_server_restarting", "delay", delay)
+		select {
+		case <-stop:
+			return nil
+		case <-time.After(delay):
+		}
+	}
+}
+
 // Register registers the device plugin for the given resourceName with Kubelet.
-func (m *NvidiaDevicePlugin) Register() error {
-	conn, err := m.dial(pluginapi.KubeletSocket, 5*time.Second)
+func (m *NvidiaDevicePlugin) Register(ctx context.Context) error {
+	timeout := time.Duration(m.config.Flags.KubeletRegistrationTimeout)
+	if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < timeout {
+		timeout = time.Until(deadline)
+	}
+	if timeout <= 0 {
+		return fmt.Errorf("unable to register with the kubelet: %v", context.DeadlineExceeded)
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	conn, err := m.dial(kubeletSocketPath(filepath.Dir(m.socket)), timeout)
 	if err != nil {
 		return err
 	}
@@ -227,80 +689,193 @@ func (m *NvidiaDevicePlugin) Register() error {
 		Version:      pluginapi.Version,
 		Endpoint:     path.Base(m.socket),
 		ResourceName: m.resourceName,
-		Options: &pluginapi.DevicePluginOptions{
-			GetPreferredAllocationAvailable: (m.allocatePolicy != nil || m.replicas > 1 || m.autoReplicas),
-		},
+		Options:      m.devicePluginOptions(),
 	}
 
-	_, err = client.Register(context.Background(), reqt)
+	_, err = client.Register(ctx, reqt)
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
+// needsPreferredAllocation returns whether the plugin implements GetPreferredAllocation and should
+// advertise it to the kubelet. This is the case when devices are replicated, so that replicas of distinct
+// GPUs are preferred, or when an allocation policy is configured. In simple mode, i.e. without replicas
+// and without an allocation policy, the kubelet picks the devices itself.
+func (m *NvidiaDevicePlugin) needsPreferredAllocation() bool {
+	return m.sharesDevices() || m.allocatePolicy != nil
+}
+
+// devicePluginOptions returns the optional features of the device plugin API used by this plugin
+func (m *NvidiaDevicePlugin) devicePluginOptions() *pluginapi.DevicePluginOptions {
+	return &pluginapi.DevicePluginOptions{
+		PreStartRequired:                m.config.Flags.PrestartValidate,
+		GetPreferredAllocationAvailable: m.needsPreferredAllocation(),
+	}
+}
+
 // GetDevicePluginOptions returns the values of the optional settings for this plugin
 func (m *NvidiaDevicePlugin) GetDevicePluginOptions(context.Context, *pluginapi.Empty) (*pluginapi.DevicePluginOptions, error) {
-	options := &pluginapi.DevicePluginOptions{
-		GetPreferredAllocationAvailable: (m.allocatePolicy != nil || m.replicas > 1 || m.autoReplicas),
-	}
-	return options, nil
+	return m.devicePluginOptions(), nil
 }
 
-// ListAndWatch lists devices and update that list according to the health status
+// ListAndWatch lists devices and update that list according to the health status.
+// Unhealthy devices are probed again every --health-recovery-interval and marked healthy, along with
+// all of their replicas, once they respond.
 func (m *NvidiaDevicePlugin) ListAndWatch(e *pluginapi.Empty, s pluginapi.DevicePlugin_ListAndWatchServer) error {
-	s.Send(&pluginapi.ListAndWatchResponse{Devices: m.apiDevices()})
+	m.logger.Debug("Kubelet started to watch the devices", logKeyEventType, "list_and_watch_started", "devices", len(m.deviceReplicas))
+	m.sendDevices(s)
+
+	var recoveryTicks <-chan time.Time
+	if interval := time.Duration(m.config.Flags.HealthRecoveryInterval); interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		recoveryTicks = ticker.C
+	}
+	// The device list is sent again periodically so that /healthz can tell a stuck stream from an idle one
+	var resyncTicks <-chan time.Time
+	if window := time.Duration(m.config.Flags.HealthzWindow); m.config.Flags.HealthzAddr != "" && window > 0 {
+		ticker := time.NewTicker(window / 2)
+		defer ticker.Stop()
+		resyncTicks = ticker.C
+	}
+	// Probing runs in the background so that it does not delay health updates. The channel is buffered
+	// so that a probe still running when ListAndWatch returns does not block forever.
+	recovered := make(chan []*Device, 1)
+	probing := false
+	// Health changes are batched for --health-debounce-ms, so that a driver reset marking all the devices
+	// unhealthy at once results in a single update of the kubelet
+	debounce := time.Duration(m.config.Flags.HealthDebounceMs) * time.Millisecond
+	var debounced <-chan time.Time
+	// Retired replicas allocated on their own are never evicted, so they are also pruned once they time out
+	retiredTicks := time.NewTicker(retiredReplicaPruneInterval)
+	defer retiredTicks.Stop()
 
 	for {
 		select {
 		case <-m.stop:
 			return nil
 		case d := <-m.health:
-			// FIXME: there is no way to recover from the Unhealthy state.
-			d.Health = pluginapi.Unhealthy
-			log.Printf("'%s' device marked unhealthy: %s", m.resourceName, d.ID)
-			s.Send(&pluginapi.ListAndWatchResponse{Devices: m.apiDevices()})
+			m.setHealth(d, pluginapi.Unhealthy, "health check failed")
+			m.logger.Warn("Device marked unhealthy", logKeyEventType, "device_unhealthy", logKeyDeviceUUID, d.ID)
+			m.recordUnhealthyEvent(d)
+			if debounce <= 0 {
+				m.sendDevices(s)
+			} else if debounced == nil {
+				debounced = time.After(debounce)
+			}
+		case <-debounced:
+			debounced = nil
+			m.sendDevices(s)
+		case <-resyncTicks:
+			m.sendDevices(s)
+		case <-recoveryTicks:
+			unhealthy := m.unhealthyDevices()
+			if probing || len(unhealthy) == 0 {
+				continue
+			}
+			probing = true
+			go func() { recovered <- m.probeRecoveredDevices(unhealthy) }()
+		case devices := <-recovered:
+			probing = false
+			if len(devices) == 0 {
+				continue
+			}
+			for _, d := range devices {
+				m.setHealth(d, pluginapi.Healthy, "device recovered")
+				m.logger.Info("Device marked healthy", logKeyEventType, "device_recovered", logKeyDeviceUUID, d.ID)
+			}
+			m.sendDevices(s)
+		case scaling := <-m.scaling:
+			m.mu.Lock()
+			m.withheldReplicas[scaling.device.ID] = scaling.withheld
+			m.updateReplicaHealth(scaling.device)
+			m.mu.Unlock()
+			m.sendDevices(s)
+		case <-m.resized:
+			m.updateReplicas()
+			m.sendDevices(s)
+		case <-m.evictions:
+			if m.pruneRetiredReplicas(time.Now()) {
+				m.sendDevices(s)
+			}
+		case now := <-retiredTicks.C:
+			if m.pruneRetiredReplicas(now) {
+				m.sendDevices(s)
+			}
 		}
 	}
 }
 
 // GetPreferredAllocation returns the preferred allocation from the set of devices specified in the request
-func (m *NvidiaDevicePlugin) GetPreferredAllocation(ctx context.Context, r *pluginapi.PreferredAllocationRequest) (*pluginapi.PreferredAllocationResponse, error) {
-	// Note there should only be -replica-0 and not any -replica-1 or -replica-2, etc.
-	// since this function is only called when we have no replicas.
+func (m *NvidiaDevicePlugin) GetPreferredAllocation(ctx context.Context, r *pluginapi.PreferredAllocationRequest) (_ *pluginapi.PreferredAllocationResponse, err error) {
+	m.getPreferredAllocationCallsTotal.Add(1)
+	ctx, span := tracer.Start(ctx, "GetPreferredAllocation")
+	span.SetAttribute("resource", m.resourceName)
+	defer func() { span.End(err) }()
+
+	// The topology policy narrows the available devices first. When the devices are shared, the allocate policy
+	// then picks the GPUs and prioritizeDevices picks their replicas.
 
 	response := &pluginapi.PreferredAllocationResponse{}
 	for _, req := range r.ContainerRequests {
-		available, err := gpuallocator.NewDevicesFrom(stripReplicas(req.AvailableDeviceIDs))
-		if err != nil {
-			return nil, fmt.Errorf("unable to retrieve list of available devices: %v", err)
-		}
-
-		required, err := gpuallocator.NewDevicesFrom(stripReplicas(req.MustIncludeDeviceIDs))
-		if err != nil {
-			return nil, fmt.Errorf("unable to retrieve list of required devices: %v", err)
-		}
-
 		var deviceIds []string
-		if m.replicas > 1 || m.autoReplicas {
-			ids, err := prioritizeDevices(req.AvailableDeviceIDs, req.MustIncludeDeviceIDs, int(req.AllocationSize))
+		available := req.AvailableDeviceIDs
+		if policy := m.topologyPolicy(); policy != "" && policy != TopologyPolicyNone {
+			available = m.numaAlignedDeviceIDs(policy, available, req.MustIncludeDeviceIDs, int(req.AllocationSize))
+		}
+		if m.sharesDevices() {
+			var ids []string
+			var err error
+			if m.config.Flags.SMWeightedAllocation {
+				ids, err = m.prioritizeDevicesBySMCount(available, req.MustIncludeDeviceIDs, int(req.AllocationSize))
+			} else {
+				if m.allocatePolicy != nil {
+					if ids, err = m.prioritizeDevicesByPolicy(available, req.MustIncludeDeviceIDs, int(req.AllocationSize)); err != nil {
+						return nil, err
+					}
+				}
+				if ids == nil {
+					ids, err = prioritizeDevices(available, req.MustIncludeDeviceIDs, int(req.AllocationSize), m.replicaCodec)
+				}
+			}
 			if err != nil {
 				var nonUnique *NonUniqueError
 				if errors.As(err, &nonUnique) {
 					// non unique assignment is not fatal however sub-optimal
-					log.Print("Ignoring: ", nonUnique)
+					traceLog(ctx, m.logger, "Ignoring non-unique preferred allocation", "error", nonUnique)
 				} else {
-					return nil, err
+					return nil, status.Errorf(codes.InvalidArgument, "invalid preferred allocation request for '%s': %v", m.resourceName, err)
 				}
 			}
 			deviceIds = ids
 		} else if m.allocatePolicy != nil {
-			allocated := m.allocatePolicy.Allocate(available, required, int(req.AllocationSize))
+			availableUUIDs, err := m.stripReplicas(available)
+			if err != nil {
+				return nil, status.Errorf(codes.InvalidArgument, "invalid preferred allocation request for '%s': %v", m.resourceName, err)
+			}
+			requiredUUIDs, err := m.stripReplicas(req.MustIncludeDeviceIDs)
+			if err != nil {
+				return nil, status.Errorf(codes.InvalidArgument, "invalid preferred allocation request for '%s': %v", m.resourceName, err)
+			}
+
+			availableDevices, err := m.allocatorDevices(availableUUIDs)
+			if err != nil {
+				return nil, status.Errorf(codes.NotFound, "unable to retrieve list of available devices: %v", err)
+			}
+
+			required, err := m.allocatorDevices(requiredUUIDs)
+			if err != nil {
+				return nil, status.Errorf(codes.NotFound, "unable to retrieve list of required devices: %v", err)
+			}
+
+			allocated := m.allocatePolicy.Allocate(availableDevices, required, int(req.AllocationSize))
 			for _, device := range allocated {
 				deviceIds = append(deviceIds, device.UUID)
 			}
 		} else {
-			return nil, errors.New("GetPreferredAllocation() not implemented in this case")
+			return nil, status.Error(codes.Unimplemented, "GetPreferredAllocation() not implemented in this case")
 		}
 
 		resp := &pluginapi.ContainerPreferredAllocationResponse{
@@ -312,59 +887,243 @@ func (m *NvidiaDevicePlugin) GetPreferredAllocation(ctx context.Context, r *plug
 	return response, nil
 }
 
+// prioritizeDevicesByPolicy picks the physical GPUs of a replica allocation with the allocate policy, then leaves
+// the choice of their replicas to prioritizeDevices. It returns no devices when the policy has no say, i.e. when
+// the allocation holds a single replica or cannot be spread over distinct GPUs, leaving the choice to prioritizeDevices.
+func (m *NvidiaDevicePlugin) prioritizeDevicesByPolicy(availableDeviceIDs []string, mustIncludeDeviceIDs []string, allocationSize int) ([]string, error) {
+	if allocationSize <= 1 {
+		return nil, nil
+	}
+
+	uuidOf := func(id string) (string, error) {
+		uuids, err := m.stripReplicas([]string{id})
+		if err != nil {
+			return "", status.Errorf(codes.InvalidArgument, "invalid preferred allocation request for '%s': %v", m.resourceName, err)
+		}
+		return uuids[0], nil
+	}
+
+	replicasByGPU := make(map[string][]string)
+	for _, id := range availableDeviceIDs {
+		uuid, err := uuidOf(id)
+		if err != nil {
+			return nil, err
+		}
+		replicasByGPU[uuid] = append(replicasByGPU[uuid], id)
+	}
+	if allocationSize > len(replicasByGPU) {
+		return nil, nil
+	}
+	required := make(map[string]bool)
+	for _, id := range mustIncludeDeviceIDs {
+		uuid, err := uuidOf(id)
+		if err != nil {
+			return nil, err
+		}
+		if required[uuid] || find(replicasByGPU[uuid], id) == len(replicasByGPU[uuid]) {
+			return nil, nil
+		}
+		required[uuid] = true
+	}
+
+	var availableUUIDs, requiredUUIDs []string
+	for uuid := range replicasByGPU {
+		availableUUIDs = append(availableUUIDs, uuid)
+	}
+	for uuid := range required {
+		requiredUUIDs = append(requiredUUIDs, uuid)
+	}
+	sort.Strings(availableUUIDs)
+	sort.Strings(requiredUUIDs)
+
+	availableDevices, err := m.allocatorDevices(availableUUIDs)
+	if err != nil {
+		return nil, status.Errorf(codes.NotFound, "unable to retrieve list of available devices: %v", err)
+	}
+	requiredDevices, err := m.allocatorDevices(requiredUUIDs)
+	if err != nil {
+		return nil, status.Errorf(codes.NotFound, "unable to retrieve list of required devices: %v", err)
+	}
+
+	allocated := m.allocatePolicy.Allocate(availableDevices, requiredDevices, allocationSize)
+	if len(allocated) != allocationSize {
+		return nil, nil
+	}
+	var candidates []string
+	for _, device := range allocated {
+		candidates = append(candidates, replicasByGPU[device.UUID]...)
+	}
+	// The GPUs are distinct, so prioritizeDevices picks one replica of each
+	return prioritizeDevices(candidates, mustIncludeDeviceIDs, allocationSize, m.replicaCodec)
+}
+
 // Allocate which return list of devices.
-func (m *NvidiaDevicePlugin) Allocate(ctx context.Context, reqs *pluginapi.AllocateRequest) (*pluginapi.AllocateResponse, error) {
+func (m *NvidiaDevicePlugin) Allocate(ctx context.Context, reqs *pluginapi.AllocateRequest) (_ *pluginapi.AllocateResponse, err error) {
+	m.allocateCallsTotal.Add(1)
+	ctx, span := tracer.Start(ctx, "Allocate")
+	span.SetAttribute("resource", m.resourceName)
+	m.delayAllocate(ctx)
+	defer func() {
+		if err != nil {
+			m.allocateErrorsTotal.Add(1)
+		}
+		span.End(err)
+	}()
+
+	if id, found := findDoubleAllocation(reqs); found {
+		m.doubleAllocated(id)
+		return nil, status.Errorf(codes.InvalidArgument, "invalid allocation request for '%s': device %s requested more than once", m.resourceName, id)
+	}
+
+	if m.config.Flags.EnforceSameGPU {
+		if err := m.checkSameGPU(reqs); err != nil {
+			return nil, err
+		}
+	}
+
+	responses, err := m.allocateResponsesWithTimeout(ctx, reqs)
+	if err != nil {
+		return nil, err
+	}
+	if m.leases != nil {
+		if err := m.claimAllocations(ctx, reqs); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, req := range reqs.ContainerRequests {
+		evicted, released := m.allocations.Add(req.DevicesIDs)
+		if len(evicted) > 0 {
+			m.notifyEvictions()
+		}
+		m.recordAllocationEvents(req.DevicesIDs, evicted)
+		m.resetReleasedGPUs(released)
+		m.logAllocation(req.DevicesIDs)
+		uuids, _ := m.stripReplicas(req.DevicesIDs) // validated when building the responses
+		auditLog.Record(m.resourceName, req.DevicesIDs, uuids)
+	}
+	m.updateAllocatedReplicasMetric()
+
+	return responses, nil
+}
+
+// allocateResponsesWithTimeout builds the responses to 'reqs', failing with DeadlineExceeded if it takes longer
+// than --allocation-timeout. The responses are built in the background, so that a hung NVML call cannot hold
+// the kubelet's call.
+func (m *NvidiaDevicePlugin) allocateResponsesWithTimeout(ctx context.Context, reqs *pluginapi.AllocateRequest) (*pluginapi.AllocateResponse, error) {
+	timeout := time.Duration(m.config.Flags.AllocationTimeout)
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	if ctx.Err() != nil {
+		return nil, status.Errorf(codes.DeadlineExceeded, "allocation request for '%s' expired before being processed", m.resourceName)
+	}
+
+	type result struct {
+		responses *pluginapi.AllocateResponse
+		err       error
+	}
+	done := make(chan result, 1)
+	go func() {
+		responses, err := m.allocateResponses(ctx, reqs)
+		done <- result{responses, err}
+	}()
+
+	select {
+	case r := <-done:
+		return r.responses, r.err
+	case <-ctx.Done():
+		m.logger.Warn("Allocation timed out", logKeyEventType, "allocation_timeout", "timeout", timeout)
+		return nil, status.Errorf(codes.DeadlineExceeded, "allocation request for '%s' timed out after %v", m.resourceName, timeout)
+	}
+}
+
+// allocateResponses validates the devices of 'reqs' and builds the response handing them to each container
+func (m *NvidiaDevicePlugin) allocateResponses(ctx context.Context, reqs *pluginapi.AllocateRequest) (*pluginapi.AllocateResponse, error) {
+	// The containers of a pod frequently share the same physical GPUs, so the
+	// response for each distinct set of physical GPUs is only built once.
+	built := make(map[string]*pluginapi.ContainerAllocateResponse)
+
 	responses := pluginapi.AllocateResponse{}
 	for _, req := range reqs.ContainerRequests {
 		for _, id := range req.DevicesIDs {
-			if !m.deviceReplicaExists(id) {
-				return nil, fmt.Errorf("invalid allocation request for '%s': unknown device: %s", m.resourceName, id)
+			if err := m.checkAllocatable(id); err != nil {
+				return nil, err
 			}
 		}
 
-		uuids := stripReplicas(req.DevicesIDs)
-		log.Printf("kubelet is requesting devices %s, but using raw devices %s", req.DevicesIDs, uuids)
+		uuids, err := m.stripReplicas(req.DevicesIDs)
+		if err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "invalid allocation request for '%s': %v", m.resourceName, err)
+		}
+		traceLog(ctx, m.logger, "Kubelet is requesting device replicas, using raw devices", "device_ids", req.DevicesIDs, "uuids", uuids)
 
-		for _, id := range uuids {
-			if !m.deviceExists(id) {
-				return nil, fmt.Errorf("invalid allocation request for '%s': unknown device: %s", m.resourceName, id)
+		key := strings.Join(uuids, ",")
+		if _, exists := built[key]; !exists {
+			response, err := m.containerAllocateResponse(ctx, uuids)
+			if err != nil {
+				return nil, err
 			}
+			built[key] = response
 		}
+		response := *built[key]
 
-		response := pluginapi.ContainerAllocateResponse{}
-
-		deviceIDs := m.deviceIDsFromUUIDs(uuids)
-
-		if m.config.Flags.DeviceListStrategy == DeviceListStrategyEnvvar {
-			response.Envs = m.apiEnvs(m.deviceListEnvvar, deviceIDs)
-		}
-		if m.config.Flags.DeviceListStrategy == DeviceListStrategyVolumeMounts {
-			response.Envs = m.apiEnvs(m.deviceListEnvvar, []string{deviceListAsVolumeMountsContainerPathRoot})
-			response.Mounts = m.apiMounts(deviceIDs)
-		}
-		if m.config.Flags.PassDeviceSpecs {
-			response.Devices = m.apiDeviceSpecs(m.config.Flags.NvidiaDriverRoot, uuids)
+		if m.config.Flags.DryRunAllocate {
+			m.logger.Info("Dry run: not passing allocation to kubelet", logKeyEventType, "allocation_dry_run", "device_ids", req.DevicesIDs, "response", response.String())
+			response = pluginapi.ContainerAllocateResponse{}
 		}
 
 		responses.ContainerResponses = append(responses.ContainerResponses, &response)
 	}
-
 	return &responses, nil
 }
 
-// PreStartContainer is unimplemented for this plugin
-func (m *NvidiaDevicePlugin) PreStartContainer(context.Context, *pluginapi.PreStartContainerRequest) (*pluginapi.PreStartContainerResponse, error) {
-	return &pluginapi.PreStartContainerResponse{}, nil
+// containerAllocateResponse validates the physical devices 'uuids' and builds the response handing them to a container
+func (m *NvidiaDevicePlugin) containerAllocateResponse(ctx context.Context, uuids []string) (*pluginapi.ContainerAllocateResponse, error) {
+	for _, id := range uuids {
+		if _, err := m.getDeviceWithRetry(ctx, id); err != nil {
+			return nil, status.Errorf(codes.NotFound, "invalid allocation request for '%s': %v", m.resourceName, err)
+		}
+	}
+
+	response := &pluginapi.ContainerAllocateResponse{}
+
+	deviceIDs := m.deviceIDsFromUUIDs(uuids)
+
+	// The annotation alone does not make the devices available to the container, the runtime still needs the envvar
+	if m.config.Flags.DeviceListStrategy == DeviceListStrategyEnvvar || m.config.Flags.DeviceListStrategy == DeviceListStrategyAnnotation {
+		response.Envs = m.apiEnvs(m.deviceListEnvvar, deviceIDs)
+	}
+	if m.config.Flags.DeviceListStrategy == DeviceListStrategyVolumeMounts {
+		response.Envs = m.apiEnvs(m.deviceListEnvvar, []string{deviceListAsVolumeMountsContainerPathRoot})
+		mounts, err := m.apiMounts(deviceIDs, uuids)
+		if err != nil {
+			return nil, status.Errorf(codes.NotFound, "invalid allocation request for '%s': %v", m.resourceName, err)
+		}
+		response.Mounts = mounts
+	}
+	if m.config.Flags.DeviceListStrategy == DeviceListStrategyAnnotation {
+		response.Annotations = map[string]string{deviceListAnnotation: strings.Join(deviceIDs, ",")}
+	}
+	if m.config.Flags.PassDeviceSpecs {
+		response.Devices = m.apiDeviceSpecs(m.config.Flags.NvidiaDriverRoot, uuids)
+	}
+
+	return response, nil
 }
 
 // dial establishes the gRPC communication with the registered device plugin.
 func (m *NvidiaDevicePlugin) dial(unixSocketPath string, timeout time.Duration) (*grpc.ClientConn, error) {
-	c, err := grpc.Dial(unixSocketPath, grpc.WithInsecure(), grpc.WithBlock(),
+	options := []grpc.DialOption{grpc.WithInsecure(), grpc.WithBlock(),
 		grpc.WithTimeout(timeout),
 		grpc.WithDialer(func(addr string, timeout time.Duration) (net.Conn, error) {
 			return net.DialTimeout("unix", addr, timeout)
 		}),
-	)
+	}
+	if size := m.config.Flags.MaxGRPCMessageSize; size > 0 {
+		options = append(options, grpc.WithDefaultCallOptions(grpc.MaxCallRecvMsgSize(size), grpc.MaxCallSendMsgSize(size)))
+	}
+
+	c, err := grpc.Dial(unixSocketPath, options...)
 
 	if err != nil {
 		return nil, err
@@ -373,18 +1132,63 @@ func (m *NvidiaDevicePlugin) dial(unixSocketPath string, timeout time.Duration)
 	return c, nil
 }
 
-// deviceExists checks if a k8s device exists
-func (m *NvidiaDevicePlugin) deviceExists(id string) bool {
-	for _, d := range m.cachedDevices {
-		if d.ID == id {
-			return true
+// stripReplicas returns the sorted, unique list of physical device IDs backing the given replica IDs, failing
+// on malformed replica IDs. Without replicas, the IDs are the physical device IDs and are returned unchanged.
+func (m *NvidiaDevicePlugin) stripReplicas(deviceReplicaIDs []string) ([]string, error) {
+	if m.replicasDisabled() {
+		return append([]string(nil), deviceReplicaIDs...), nil
+	}
+	ids := make([]string, 0, len(deviceReplicaIDs))
+	for _, id := range deviceReplicaIDs {
+		// MIG devices which are not shared are advertised under their own ID among the replicas
+		if _, _, err := m.replicaCodec.Decode(id); err != nil && m.deviceReplicaExists(id) {
+			id = m.replicaCodec.Encode(id, 0)
 		}
+		ids = append(ids, id)
 	}
-	return false
+	return stripReplicas(ids, m.replicaCodec)
+}
+
+// getDeviceWithRetry looks up a device. With --allocate-retry-policy, it also checks that the driver still
+// responds to queries about the device, retrying transient NVML failures according to the policy.
+func (m *NvidiaDevicePlugin) getDeviceWithRetry(ctx context.Context, uuid string) (*Device, error) {
+	_, span := tracer.Start(ctx, "GetDeviceByUUID")
+	span.SetAttribute("device", uuid)
+	device, err := m.GetDeviceByUUID(uuid)
+	span.End(err)
+	if err != nil || m.allocateRetryPolicy.MaxRetries == 0 {
+		return device, err
+	}
+
+	err = m.allocateRetryPolicy.Do(ctx, fmt.Sprintf("Probing device %s", uuid), func() error {
+		_, span := tracer.Start(ctx, "ProbeDevice")
+		span.SetAttribute("device", uuid)
+		err := m.probeDevice(device)
+		span.End(err)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return device, nil
+}
+
+// checkAllocatable returns a gRPC status error if the k8s device replica 'id' is unknown: InvalidArgument if it
+// is not a well-formed replica ID, NotFound otherwise
+func (m *NvidiaDevicePlugin) checkAllocatable(id string) error {
+	if m.deviceReplicaExists(id) {
+		return nil
+	}
+	if _, _, err := m.replicaCodec.Decode(id); err != nil && !m.replicasDisabled() {
+		return status.Errorf(codes.InvalidArgument, "invalid allocation request for '%s': malformed device ID: %v", m.resourceName, err)
+	}
+	return status.Errorf(codes.NotFound, "invalid allocation request for '%s': unknown device: %s", m.resourceName, id)
 }
 
 // deviceReplicaExists checks if a k8s device replica exists
 func (m *NvidiaDevicePlugin) deviceReplicaExists(id string) bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
 	for _, d := range m.deviceReplicas {
 		if d.ID == id {
 			return true
@@ -393,51 +1197,133 @@ func (m *NvidiaDevicePlugin) deviceReplicaExists(id string) bool {
 	return false
 }
 
-// apiDevices returns the K8S API Device type. This includes replicas
-func (m *NvidiaDevicePlugin) deviceIDsFromUUIDs(uuids []string) []string {
+// lookupDeviceIDs returns the IDs passed to containers for the physical devices 'uuids', according to --device-id-strategy
+func (m *NvidiaDevicePlugin) lookupDeviceIDs(uuids []string) []string {
 	if m.config.Flags.DeviceIDStrategy == DeviceIDStrategyUUID {
 		return uuids
 	}
 
 	var deviceIDs []string
 	if m.config.Flags.DeviceIDStrategy == DeviceIDStrategyIndex {
-		for _, d := range m.cachedDevices {
-			for _, id := range uuids {
-				if d.ID == id {
-					deviceIDs = append(deviceIDs, d.Index)
-				}
+		for _, id := range uuids {
+			d, err := m.GetDeviceByUUID(id)
+			if err != nil {
+				continue
+			}
+			deviceIDs = append(deviceIDs, d.Index)
+		}
+	}
+	if m.config.Flags.DeviceIDStrategy == DeviceIDStrategyPCIAddress {
+		for _, id := range uuids {
+			d, err := m.GetDeviceByUUID(id)
+			if err != nil {
+				continue
 			}
+			deviceIDs = append(deviceIDs, d.PCIAddress)
 		}
 	}
 	return deviceIDs
 }
 
+// checkPCIAddresses returns an error if the 'pci-address' device ID strategy is used while NVML does not
+// provide the PCI address of some device, e.g. of MIG devices
+func (m *NvidiaDevicePlugin) checkPCIAddresses() error {
+	if m.config.Flags.DeviceIDStrategy != DeviceIDStrategyPCIAddress {
+		return nil
+	}
+	for _, dev := range m.cachedDevices {
+		if dev.PCIAddress == "" {
+			return fmt.Errorf("the PCI address of device %s is unknown, --device-id-strategy=%s cannot be used", dev.ID, DeviceIDStrategyPCIAddress)
+		}
+	}
+	return nil
+}
+
+// apiDevices returns a copy of the advertised devices, so that their health can change while they are sent to the kubelet
 func (m *NvidiaDevicePlugin) apiDevices() []*pluginapi.Device {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
 	var pdevs []*pluginapi.Device
 	for _, d := range m.deviceReplicas {
-		pdevs = append(pdevs, &d.Device)
+		pdev := d.Device
+		if !m.config.Flags.TopologyHintsEnabled {
+			pdev.Topology = nil
+		}
+		pdevs = append(pdevs, &pdev)
 	}
 	return pdevs
 }
 
+// validateEnvVarName checks that 'name' is a valid POSIX environment variable name,
+// i.e. that it only consists of ASCII letters, digits and underscores and does not start with a digit.
+func validateEnvVarName(name string) error {
+	if name == "" {
+		return errors.New("environment variable name must not be empty")
+	}
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		switch {
+		case c == '_', c >= 'A' && c <= 'Z', c >= 'a' && c <= 'z':
+		case c >= '0' && c <= '9' && i > 0:
+		default:
+			return fmt.Errorf("invalid environment variable name %q: invalid character %q at position %d", name, c, i)
+		}
+	}
+	return nil
+}
+
+// apiEnvs returns the environment variables passing the device list to a container: 'envvar',
+// along with the --extra-device-envvars
 func (m *NvidiaDevicePlugin) apiEnvs(envvar string, deviceIDs []string) map[string]string {
-	return map[string]string{
-		envvar: strings.Join(deviceIDs, ","),
+	value := strings.Join(deviceIDs, ",")
+	envs := map[string]string{
+		envvar: value,
 	}
+	for _, extra := range m.config.Flags.ExtraDeviceEnvvars {
+		envs[extra] = value
+	}
+	return envs
 }
 
-func (m *NvidiaDevicePlugin) apiMounts(deviceIDs []string) []*pluginapi.Mount {
+func (m *NvidiaDevicePlugin) apiMounts(deviceIDs []string, uuids []string) ([]*pluginapi.Mount, error) {
+	deviceNodes := m.config.Flags.VolumeMountSourceStrategy == VolumeMountSourceStrategyDeviceNode
+	if deviceNodes && len(deviceIDs) != len(uuids) {
+		return nil, fmt.Errorf("unable to look up the IDs of devices %v", uuids)
+	}
+
 	var mounts []*pluginapi.Mount
 
-	for _, id := range deviceIDs {
+	for i, id := range deviceIDs {
 		mount := &pluginapi.Mount{
 			HostPath:      deviceListAsVolumeMountsHostPath,
 			ContainerPath: filepath.Join(deviceListAsVolumeMountsContainerPathRoot, id),
 		}
+		if deviceNodes {
+			path, err := m.deviceNodePath(uuids[i])
+			if err != nil {
+				return nil, err
+			}
+			mount.HostPath = path
+		}
 		mounts = append(mounts, mount)
 	}
 
-	return mounts
+	return mounts, nil
+}
+
+// deviceNodePath returns the /dev/nvidiaN node of the GPU with the given UUID. MIG devices, indexed as
+// <gpu>:<mig>, map to the node of their parent GPU.
+func (m *NvidiaDevicePlugin) deviceNodePath(uuid string) (string, error) {
+	d, err := m.GetDeviceByUUID(uuid)
+	if err != nil {
+		return "", err
+	}
+	index := strings.SplitN(d.Index, ":", 2)[0]
+	if _, err := strconv.ParseUint(index, 10, 0); err != nil {
+		return "", fmt.Errorf("device %s has no valid index: %q", uuid, d.Index)
+	}
+	return "/dev/nvidia" + index, nil
 }
 
 func (m *NvidiaDevicePlugin) apiDeviceSpecs(driverRoot string, uuids []string) []*pluginapi.DeviceSpec {
@@ -450,8 +1336,17 @@ func (m *NvidiaDevicePlugin) apiDeviceSpecs(driverRoot string, uuids []string) [
 		"/dev/nvidia-modeset",
 	}
 
+	wsl2 := m.config.Flags.WSL2Mode || devicePresent(wsl2DeviceNode)
+	if wsl2 {
+		specs = append(specs, &pluginapi.DeviceSpec{
+			ContainerPath: wsl2DeviceNode,
+			HostPath:      filepath.Join(driverRoot, wsl2DeviceNode),
+			Permissions:   "rw",
+		})
+	}
+
 	for _, p := range paths {
-		if _, err := os.Stat(p); err == nil {
+		if devicePresent(p) {
 			spec := &pluginapi.DeviceSpec{
 				ContainerPath: p,
 				HostPath:      filepath.Join(driverRoot, p),
@@ -461,20 +1356,30 @@ func (m *NvidiaDevicePlugin) apiDeviceSpecs(driverRoot string, uuids []string) [
 		}
 	}
 
-	for _, d := range m.cachedDevices {
-		for _, id := range uuids {
-			if d.ID == id {
-				for _, p := range d.Paths {
-					spec := &pluginapi.DeviceSpec{
-						ContainerPath: p,
-						HostPath:      filepath.Join(driverRoot, p),
-						Permissions:   "rw",
-					}
-					specs = append(specs, spec)
-				}
+	for _, id := range uuids {
+		d, err := m.GetDeviceByUUID(id)
+		if err != nil {
+			continue
+		}
+		for _, p := range d.Paths {
+			// WSL2 has no /dev/nvidia* nodes, which NVML may still report
+			if wsl2 && !devicePresent(p) {
+				continue
+			}
+			spec := &pluginapi.DeviceSpec{
+				ContainerPath: p,
+				HostPath:      filepath.Join(driverRoot, p),
+				Permissions:   "rw",
 			}
+			specs = append(specs, spec)
 		}
 	}
 
 	return specs
 }
+
+// devicePresent returns whether the device node 'p' exists under devRoot
+func devicePresent(p string) bool {
+	_, err := os.Stat(filepath.Join(devRoot, p))
+	return err == nil
+}
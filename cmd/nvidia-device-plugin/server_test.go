@@ -0,0 +1,1222 @@
+/*
+ * Copyright (c) 2022, NVIDIA CORPORATION.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/NVIDIA/go-gpuallocator/gpuallocator"
+	"github.com/NVIDIA/gpu-monitoring-tools/bindings/go/nvml"
+	config "github.com/NVIDIA/k8s-device-plugin/api/config/v1"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+// testResourceManager implements the ResourceManager interface over a static list of devices.
+// Its health checks report the devices listed in 'unhealthy' as unhealthy.
+type testResourceManager struct {
+	devices          []*Device
+	unhealthy        []string
+	checkHealthCalls int32
+}
+
+func (r *testResourceManager) Devices() []*Device {
+	var devs []*Device
+	for _, d := range r.devices {
+		dev := *d
+		devs = append(devs, &dev)
+	}
+	return devs
+}
+
+func (r *testResourceManager) DeviceCount() int {
+	return len(r.devices)
+}
+
+func (r *testResourceManager) GetDeviceByUUID(uuid string) (*Device, error) {
+	return getDeviceByUUID(r.Devices(), uuid)
+}
+
+func (r *testResourceManager) CheckHealth(stop <-chan interface{}, devices []*Device, unhealthy chan<- *Device) {
+	atomic.AddInt32(&r.checkHealthCalls, 1)
+	for _, d := range devices {
+		if find(r.unhealthy, d.ID) == len(r.unhealthy) {
+			continue
+		}
+		select {
+		case unhealthy <- d:
+		case <-stop:
+			return
+		}
+	}
+}
+
+// fakeListAndWatchServer records the responses sent by ListAndWatch
+type fakeListAndWatchServer struct {
+	grpc.ServerStream
+	responses chan *pluginapi.ListAndWatchResponse
+}
+
+func newFakeListAndWatchServer() *fakeListAndWatchServer {
+	return &fakeListAndWatchServer{responses: make(chan *pluginapi.ListAndWatchResponse, 16)}
+}
+
+func (s *fakeListAndWatchServer) Send(resp *pluginapi.ListAndWatchResponse) error {
+	s.responses <- resp
+	return nil
+}
+
+// next returns the next response sent by ListAndWatch, or nil if none is sent within the timeout
+func (s *fakeListAndWatchServer) next(timeout time.Duration) *pluginapi.ListAndWatchResponse {
+	select {
+	case resp := <-s.responses:
+		return resp
+	case <-time.After(timeout):
+		return nil
+	}
+}
+
+// newPluginDevice returns a healthy pluginapi.Device with the given ID
+func newPluginDevice(id string) pluginapi.Device {
+	return pluginapi.Device{ID: id, Health: pluginapi.Healthy}
+}
+
+// newTestPlugin returns an initialized plugin serving 'replicas' replicas of each of the given devices
+func newTestPlugin(flags config.CommandLineFlags, replicas uint, devices ...*Device) *NvidiaDevicePlugin {
+	if flags.DeviceListStrategy == "" {
+		flags.DeviceListStrategy = DeviceListStrategyEnvvar
+	}
+	if flags.DeviceIDStrategy == "" {
+		flags.DeviceIDStrategy = DeviceIDStrategyUUID
+	}
+	if flags.GRPCDialTimeout == 0 {
+		flags.GRPCDialTimeout = config.Duration(5 * time.Second)
+	}
+	if flags.AllocationTimeout == 0 {
+		flags.AllocationTimeout = config.Duration(10 * time.Second)
+	}
+	cfg := &config.Config{
+		Version: config.Version,
+		Flags:   config.Flags{CommandLineFlags: &flags},
+	}
+	// The power limits of the devices are only reported by the power manager
+	var listed []*Device
+	for _, d := range devices {
+		dev := *d
+		dev.PowerLimitWatts, dev.DefaultPowerLimitWatts = 0, 0
+		listed = append(listed, &dev)
+	}
+	m, err := NewNvidiaDevicePlugin(cfg, "nvidia.com/gpu", &testResourceManager{devices: listed}, "NVIDIA_VISIBLE_DEVICES", nil, "", replicas, false, nil)
+	check(err)
+	m.queryVirtualType = func(d *Device) (string, error) {
+		if d.VirtualType != "" {
+			return d.VirtualType, nil
+		}
+		return VirtualTypePhysical, nil
+	}
+	m.queryVBIOSVersion = func(uuid string) (string, error) {
+		for _, d := range devices {
+			if d.ID == uuid && d.VBIOSVersion != "" {
+				return d.VBIOSVersion, nil
+			}
+		}
+		return "", fmt.Errorf("unknown VBIOS version")
+	}
+	m.queryModel = func(d *Device) (string, error) {
+		if d.Model != "" {
+			return d.Model, nil
+		}
+		return "", fmt.Errorf("unknown model")
+	}
+	limits := make(map[string]*PowerLimits)
+	for _, d := range devices {
+		if d.PowerLimitWatts > 0 {
+			limits[d.ID] = &PowerLimits{Current: d.PowerLimitWatts, Default: d.DefaultPowerLimitWatts, Max: d.DefaultPowerLimitWatts}
+		}
+	}
+	m.powerManager = &fakePowerManager{limits: limits, set: make(map[string]uint)}
+	m.initialize()
+	return m
+}
+
+// captureLog redirects the standard logger for the duration of the test
+func captureLog(t *testing.T) *bytes.Buffer {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+	return &buf
+}
+
+func TestAllocateDryRun(t *testing.T) {
+	m := newTestPlugin(config.CommandLineFlags{DryRunAllocate: true}, 2,
+		&Device{Device: newPluginDevice("GPU-0"), Index: "0"},
+	)
+	logs := captureLog(t)
+
+	resp, err := m.Allocate(context.Background(), &pluginapi.AllocateRequest{
+		ContainerRequests: []*pluginapi.ContainerAllocateRequest{
+			{DevicesIDs: []string{"GPU-0-replica-1"}},
+		},
+	})
+	require.NoError(t, err)
+	require.Len(t, resp.ContainerResponses, 1)
+	require.Empty(t, resp.ContainerResponses[0].Envs)
+	require.Empty(t, resp.ContainerResponses[0].Mounts)
+	require.Empty(t, resp.ContainerResponses[0].Devices)
+	require.Contains(t, logs.String(), "Dry run")
+	require.Contains(t, logs.String(), "NVIDIA_VISIBLE_DEVICES")
+	require.Contains(t, logs.String(), "GPU-0")
+}
+
+func TestAllocateVolumeMountsWithPassDeviceSpecs(t *testing.T) {
+	m := newTestPlugin(config.CommandLineFlags{DeviceListStrategy: DeviceListStrategyVolumeMounts, PassDeviceSpecs: true}, 2,
+		&Device{Device: newPluginDevice("GPU-0"), Index: "0", Paths: []string{"/dev/nvidia0"}},
+	)
+
+	resp, err := m.Allocate(context.Background(), &pluginapi.AllocateRequest{
+		ContainerRequests: []*pluginapi.ContainerAllocateRequest{
+			{DevicesIDs: []string{"GPU-0-replica-1"}},
+		},
+	})
+	require.NoError(t, err)
+	require.Len(t, resp.ContainerResponses, 1)
+	response := resp.ContainerResponses[0]
+
+	require.Equal(t, map[string]string{"NVIDIA_VISIBLE_DEVICES": deviceListAsVolumeMountsContainerPathRoot}, response.Envs)
+	require.NotNil(t, response.Mounts)
+	require.Equal(t, []*pluginapi.Mount{{
+		HostPath:      deviceListAsVolumeMountsHostPath,
+		ContainerPath: filepath.Join(deviceListAsVolumeMountsContainerPathRoot, "GPU-0"),
+	}}, response.Mounts)
+	require.NotNil(t, response.Devices)
+
+	var containerPaths []string
+	for _, spec := range response.Devices {
+		containerPaths = append(containerPaths, spec.ContainerPath)
+	}
+	require.Contains(t, containerPaths, "/dev/nvidia0")
+}
+
+func TestAllocateVolumeMountsDeviceNodes(t *testing.T) {
+	m := newTestPlugin(config.CommandLineFlags{
+		DeviceListStrategy:        DeviceListStrategyVolumeMounts,
+		DeviceIDStrategy:          DeviceIDStrategyIndex,
+		VolumeMountSourceStrategy: VolumeMountSourceStrategyDeviceNode,
+	}, 2,
+		&Device{Device: newPluginDevice("GPU-0"), Index: "0"},
+		&Device{Device: newPluginDevice("MIG-1"), Index: "3:1"},
+	)
+
+	resp, err := m.Allocate(context.Background(), &pluginapi.AllocateRequest{
+		ContainerRequests: []*pluginapi.ContainerAllocateRequest{
+			{DevicesIDs: []string{"GPU-0-replica-0", "MIG-1-replica-1"}},
+		},
+	})
+	require.NoError(t, err)
+	require.Len(t, resp.ContainerResponses, 1)
+	require.Equal(t, []*pluginapi.Mount{
+		{HostPath: "/dev/nvidia0", ContainerPath: filepath.Join(deviceListAsVolumeMountsContainerPathRoot, "0")},
+		{HostPath: "/dev/nvidia3", ContainerPath: filepath.Join(deviceListAsVolumeMountsContainerPathRoot, "3:1")},
+	}, resp.ContainerResponses[0].Mounts)
+}
+
+func TestAllocateAnnotation(t *testing.T) {
+	m := newTestPlugin(config.CommandLineFlags{DeviceListStrategy: DeviceListStrategyAnnotation, DeviceIDStrategy: DeviceIDStrategyUUID}, 2,
+		&Device{Device: newPluginDevice("GPU-0"), Index: "0"},
+		&Device{Device: newPluginDevice("GPU-1"), Index: "1"},
+	)
+
+	resp, err := m.Allocate(context.Background(), &pluginapi.AllocateRequest{
+		ContainerRequests: []*pluginapi.ContainerAllocateRequest{
+			{DevicesIDs: []string{"GPU-1-replica-0", "GPU-0-replica-1"}},
+		},
+	})
+	require.NoError(t, err)
+	require.Len(t, resp.ContainerResponses, 1)
+	response := resp.ContainerResponses[0]
+
+	require.Equal(t, map[string]string{"nvidia.com/allocated-devices": "GPU-0,GPU-1"}, response.Annotations)
+	require.Equal(t, map[string]string{"NVIDIA_VISIBLE_DEVICES": "GPU-0,GPU-1"}, response.Envs)
+	require.Empty(t, response.Mounts)
+}
+
+func TestAllocateExtraDeviceEnvvars(t *testing.T) {
+	m := newTestPlugin(config.CommandLineFlags{ExtraDeviceEnvvars: []string{"CUDA_VISIBLE_DEVICES", "SINGULARITYENV_NVIDIA_VISIBLE_DEVICES"}}, 2,
+		&Device{Device: newPluginDevice("GPU-0"), Index: "0"},
+		&Device{Device: newPluginDevice("GPU-1"), Index: "1"},
+	)
+
+	resp, err := m.Allocate(context.Background(), &pluginapi.AllocateRequest{
+		ContainerRequests: []*pluginapi.ContainerAllocateRequest{
+			{DevicesIDs: []string{"GPU-1-replica-0", "GPU-0-replica-1"}},
+		},
+	})
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{
+		"NVIDIA_VISIBLE_DEVICES":                "GPU-0,GPU-1",
+		"CUDA_VISIBLE_DEVICES":                  "GPU-0,GPU-1",
+		"SINGULARITYENV_NVIDIA_VISIBLE_DEVICES": "GPU-0,GPU-1",
+	}, resp.ContainerResponses[0].Envs)
+
+	// The extra variables follow the volume-mounts strategy too
+	m = newTestPlugin(config.CommandLineFlags{DeviceListStrategy: DeviceListStrategyVolumeMounts, ExtraDeviceEnvvars: []string{"CUDA_VISIBLE_DEVICES"}}, 2,
+		&Device{Device: newPluginDevice("GPU-0"), Index: "0"},
+	)
+	resp, err = m.Allocate(context.Background(), &pluginapi.AllocateRequest{
+		ContainerRequests: []*pluginapi.ContainerAllocateRequest{
+			{DevicesIDs: []string{"GPU-0-replica-0"}},
+		},
+	})
+	require.NoError(t, err)
+	envs := resp.ContainerResponses[0].Envs
+	require.Equal(t, envs["NVIDIA_VISIBLE_DEVICES"], envs["CUDA_VISIBLE_DEVICES"])
+}
+
+func TestAllocatePCIAddress(t *testing.T) {
+	m := newTestPlugin(config.CommandLineFlags{DeviceIDStrategy: DeviceIDStrategyPCIAddress}, 2,
+		&Device{Device: newPluginDevice("GPU-0"), PCIAddress: "0000:3b:00.0"},
+		&Device{Device: newPluginDevice("GPU-1"), PCIAddress: "0000:86:00.0"},
+	)
+	require.NoError(t, m.checkPCIAddresses())
+
+	resp, err := m.Allocate(context.Background(), &pluginapi.AllocateRequest{
+		ContainerRequests: []*pluginapi.ContainerAllocateRequest{
+			{DevicesIDs: []string{"GPU-1-replica-0", "GPU-0-replica-1"}},
+		},
+	})
+	require.NoError(t, err)
+	require.Equal(t, "0000:3b:00.0,0000:86:00.0", resp.ContainerResponses[0].Envs["NVIDIA_VISIBLE_DEVICES"])
+}
+
+func TestPCIAddressStrategyRequiresPCIAddresses(t *testing.T) {
+	m := newTestPlugin(config.CommandLineFlags{DeviceIDStrategy: DeviceIDStrategyPCIAddress}, 1,
+		&Device{Device: newPluginDevice("GPU-0"), PCIAddress: "0000:3b:00.0"},
+		&Device{Device: newPluginDevice("MIG-GPU-0/1/0")},
+	)
+	err := m.checkPCIAddresses()
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "MIG-GPU-0/1/0")
+
+	// Start fails before serving anything
+	m.cleanup()
+	require.Error(t, m.Start())
+	require.Nil(t, m.server)
+}
+
+func TestValidateEnvVarName(t *testing.T) {
+	valid := []string{"NVIDIA_VISIBLE_DEVICES", "_", "a", "CUDA_VISIBLE_DEVICES2", "_1"}
+	for _, name := range valid {
+		require.NoError(t, validateEnvVarName(name), name)
+	}
+
+	invalid := []string{"", "1ABC", "A=B", "A\x00B", "NVIDIA VISIBLE", "GPU-DEVICES", "ÉCRAN", "DEVICESé", "A\nB"}
+	for _, name := range invalid {
+		require.Error(t, validateEnvVarName(name), name)
+	}
+}
+
+func TestNewNvidiaDevicePluginErrors(t *testing.T) {
+	testCases := []struct {
+		description      string
+		flags            config.CommandLineFlags
+		deviceListEnvvar string
+	}{
+		{"invalid device list envvar", config.CommandLineFlags{}, "A=B"},
+		{"invalid retry policy", config.CommandLineFlags{AllocateRetryPolicy: "{"}, "NVIDIA_VISIBLE_DEVICES"},
+		{"missing topology file", config.CommandLineFlags{TopologyFile: filepath.Join(t.TempDir(), "missing.yaml")}, "NVIDIA_VISIBLE_DEVICES"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.description, func(t *testing.T) {
+			flags := tc.flags
+			cfg := &config.Config{Flags: config.Flags{CommandLineFlags: &flags}}
+			m, err := NewNvidiaDevicePlugin(cfg, "nvidia.com/gpu", &testResourceManager{}, tc.deviceListEnvvar, gpuallocator.NewBestEffortPolicy(), "", 2, false, nil)
+			require.Error(t, err)
+			require.Nil(t, m)
+		})
+	}
+}
+
+func FuzzValidateEnvVarName(f *testing.F) {
+	for _, seed := range []string{"NVIDIA_VISIBLE_DEVICES", "A=B", "A\x00B", "1A", "é", ""} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, name string) {
+		err := validateEnvVarName(name)
+
+		valid := name != ""
+		for i, r := range name {
+			isLetter := (r >= 'A' && r <= 'Z') || (r >= 'a' && r <= 'z') || r == '_'
+			isDigit := r >= '0' && r <= '9'
+			if !isLetter && !(isDigit && i > 0) {
+				valid = false
+			}
+		}
+
+		if valid && err != nil {
+			t.Errorf("validateEnvVarName(%q) rejected a valid name: %v", name, err)
+		}
+		if !valid && err == nil {
+			t.Errorf("validateEnvVarName(%q) accepted an invalid name", name)
+		}
+	})
+}
+
+func TestVirtualType(t *testing.T) {
+	require.Equal(t, VirtualTypePhysical, virtualType("None", "Default", false))
+	require.Equal(t, VirtualTypeVGPU, virtualType("VGPU", "Default", false))
+	// Exclusive process GPUs are only shared through MPS while its control daemon runs
+	require.Equal(t, VirtualTypePhysical, virtualType("None", "Exclusive_Process", false))
+	require.Equal(t, VirtualTypeMPS, virtualType("None", "Exclusive_Process", true))
+	require.Equal(t, VirtualTypePhysical, virtualType("None", "Default", true))
+}
+
+func TestMPSControlDaemonRunning(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("CUDA_MPS_PIPE_DIRECTORY", dir)
+	require.False(t, mpsControlDaemonRunning())
+
+	require.NoError(t, syscall.Mkfifo(filepath.Join(dir, "control"), 0600))
+	require.True(t, mpsControlDaemonRunning())
+}
+
+func TestSetVirtualTypes(t *testing.T) {
+	m := newTestPlugin(config.CommandLineFlags{}, 1,
+		&Device{Device: newPluginDevice("GPU-0")},
+		&Device{Device: newPluginDevice("GPU-1"), VirtualType: VirtualTypeVGPU},
+		&Device{Device: newPluginDevice("MIG-GPU-2/1/0"), VirtualType: VirtualTypeMIG},
+	)
+
+	require.Equal(t, VirtualTypePhysical, m.cachedDevices[0].VirtualType)
+	require.False(t, m.cachedDevices[0].IsVirtual)
+	require.Equal(t, VirtualTypeVGPU, m.cachedDevices[1].VirtualType)
+	require.True(t, m.cachedDevices[1].IsVirtual)
+	require.True(t, m.cachedDevices[2].IsVirtual)
+
+	physical := m.physicalDevices()
+	require.Len(t, physical, 1)
+	require.Equal(t, "GPU-0", physical[0].ID)
+}
+
+func TestAllocateCallCounters(t *testing.T) {
+	m := newTestPlugin(config.CommandLineFlags{}, 2, &Device{Device: newPluginDevice("GPU-0")})
+
+	request := &pluginapi.AllocateRequest{
+		ContainerRequests: []*pluginapi.ContainerAllocateRequest{
+			{DevicesIDs: []string{"GPU-0-replica-0"}},
+		},
+	}
+	for i := 0; i < 2; i++ {
+		_, err := m.Allocate(context.Background(), request)
+		require.NoError(t, err)
+	}
+	require.Equal(t, uint64(2), m.allocateCallsTotal.Load())
+	require.Equal(t, uint64(0), m.allocateErrorsTotal.Load())
+
+	_, err := m.Allocate(context.Background(), &pluginapi.AllocateRequest{
+		ContainerRequests: []*pluginapi.ContainerAllocateRequest{
+			{DevicesIDs: []string{"GPU-1-replica-0"}},
+		},
+	})
+	require.Error(t, err)
+
+	_, err = m.GetPreferredAllocation(context.Background(), &pluginapi.PreferredAllocationRequest{})
+	require.NoError(t, err)
+
+	state := m.State()
+	require.Equal(t, uint64(3), state.AllocateCallsTotal)
+	require.Equal(t, uint64(1), state.AllocateErrorsTotal)
+	require.Equal(t, uint64(1), state.GetPreferredAllocationCallsTotal)
+}
+
+func TestStateDuringHealthChanges(t *testing.T) {
+	m := newTestPlugin(config.CommandLineFlags{}, 2, &Device{Device: newPluginDevice("GPU-0")})
+
+	// Run with -race: the debug endpoint reads the devices while ListAndWatch changes their health
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			m.setHealth(m.cachedDevices[0], pluginapi.Unhealthy, "test")
+			m.setHealth(m.cachedDevices[0], pluginapi.Healthy, "test")
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		state := m.State()
+		require.Len(t, state.Devices, 1)
+		require.Equal(t, 2, state.Replicas)
+	}
+	<-done
+}
+
+func TestAllocateErrorCodes(t *testing.T) {
+	m := newTestPlugin(config.CommandLineFlags{}, 2,
+		&Device{Device: newPluginDevice("GPU-a")},
+		&Device{Device: newPluginDevice("GPU-b")},
+	)
+
+	testCases := []struct {
+		description string
+		deviceIDs   []string
+		expected    codes.Code
+	}{
+		{"known replica", []string{"GPU-a-replica-0"}, codes.OK},
+		{"unknown replica", []string{"GPU-c-replica-0"}, codes.NotFound},
+		{"malformed replica ID", []string{"GPU-a"}, codes.InvalidArgument},
+		{"replica requested twice", []string{"GPU-a-replica-0", "GPU-a-replica-0"}, codes.InvalidArgument},
+	}
+	for _, tc := range testCases {
+		_, err := m.Allocate(context.Background(), &pluginapi.AllocateRequest{
+			ContainerRequests: []*pluginapi.ContainerAllocateRequest{{DevicesIDs: tc.deviceIDs}},
+		})
+		require.Equal(t, tc.expected, status.Code(err), "%s: %v", tc.description, err)
+	}
+
+	_, err := m.GetPreferredAllocation(context.Background(), &pluginapi.PreferredAllocationRequest{
+		ContainerRequests: []*pluginapi.ContainerPreferredAllocationRequest{{
+			AvailableDeviceIDs:   []string{"GPU-a-replica-0"},
+			MustIncludeDeviceIDs: []string{"GPU-b-replica-0"},
+			AllocationSize:       1,
+		}},
+	})
+	require.Equal(t, codes.InvalidArgument, status.Code(err), "%v", err)
+}
+
+// fakeEventSource delivers the events sent on its channel, timing out right away when none is pending
+type fakeEventSource struct {
+	events      chan nvml.Event
+	unsupported map[string]bool
+}
+
+func newFakeEventSource(unsupported ...string) *fakeEventSource {
+	s := &fakeEventSource{events: make(chan nvml.Event), unsupported: make(map[string]bool)}
+	for _, uuid := range unsupported {
+		s.unsupported[uuid] = true
+	}
+	return s
+}
+
+func (s *fakeEventSource) Register(eventType int, uuid string) error {
+	if s.unsupported[uuid] {
+		return fmt.Errorf("events not supported by %s", uuid)
+	}
+	return nil
+}
+
+func (s *fakeEventSource) Wait(timeout uint) (nvml.Event, error) {
+	select {
+	case e := <-s.events:
+		return e, nil
+	case <-time.After(time.Millisecond):
+		return nvml.Event{}, fmt.Errorf("timeout")
+	}
+}
+
+func (s *fakeEventSource) Close() {}
+
+// xid returns the event of a critical Xid error on the GPU with the given UUID
+func (s *fakeEventSource) xid(uuid string, xid uint64) {
+	noInstance := uint(0xFFFFFFFF)
+	s.events <- nvml.Event{UUID: &uuid, GpuInstanceId: &noInstance, ComputeInstanceId: &noInstance, Etype: nvml.XidCriticalError, Edata: xid}
+}
+
+func TestHealthGracePeriod(t *testing.T) {
+	m := newTestPlugin(config.CommandLineFlags{}, 2,
+		&Device{Device: newPluginDevice("GPU-0")},
+		&Device{Device: newPluginDevice("GPU-1")},
+	)
+	stream := newFakeListAndWatchServer()
+	go m.ListAndWatch(&pluginapi.Empty{}, stream)
+	defer close(m.stop)
+
+	initial := stream.next(time.Second)
+	require.NotNil(t, initial)
+	require.Len(t, initial.Devices, 4)
+
+	events := newFakeEventSource()
+	skippedXids := map[uint64]bool{13: true}
+	go watchHealthEvents(m.stop, m.cachedDevices, m.health, events, skippedXids, 3, 10*time.Minute, nil)
+
+	// Neither timeouts nor the errors of other devices reset the count of failures
+	events.xid("GPU-0", 79)
+	time.Sleep(10 * time.Millisecond)
+	events.xid("GPU-1", 79)
+	events.xid("GPU-0", 13)
+	events.xid("GPU-0", 79)
+	require.Nil(t, stream.next(50*time.Millisecond), "device marked unhealthy before the grace period expired")
+
+	events.xid("GPU-0", 79)
+	update := stream.next(time.Second)
+	require.NotNil(t, update, "device not marked unhealthy after the grace period expired")
+	require.Equal(t, pluginapi.Unhealthy, m.cachedDevices[0].Health)
+	require.Equal(t, pluginapi.Healthy, m.cachedDevices[1].Health)
+}
+
+func TestHealthEventsWithoutGracePeriod(t *testing.T) {
+	devices := []*Device{{Device: newPluginDevice("GPU-0")}, {Device: newPluginDevice("GPU-1")}}
+	unhealthy := make(chan *Device, 1)
+	stop := make(chan interface{})
+	defer close(stop)
+
+	events := newFakeEventSource("GPU-1")
+	var polled []*Device
+	pollStarted := make(chan struct{})
+	go watchHealthEvents(stop, devices, unhealthy, events, nil, 1, 10*time.Minute, func(p []*Device) {
+		polled = p
+		close(pollStarted)
+	})
+
+	// With --graceful-period-on-unhealthy=1, a single critical Xid marks the device unhealthy
+	events.xid("GPU-0", 79)
+	select {
+	case d := <-unhealthy:
+		require.Equal(t, "GPU-0", d.ID)
+	case <-time.After(time.Second):
+		t.Fatal("device not marked unhealthy")
+	}
+
+	// The devices without events are polled instead
+	<-pollStarted
+	require.Len(t, polled, 1)
+	require.Equal(t, "GPU-1", polled[0].ID)
+}
+
+func TestHealthGracePeriodWindow(t *testing.T) {
+	now := time.Now()
+	grace := newHealthGracePeriod(2, time.Minute)
+	grace.now = func() time.Time { return now }
+
+	require.False(t, grace.fail("GPU-0"))
+	// The first failure is out of the window by the time of the second one
+	now = now.Add(2 * time.Minute)
+	require.False(t, grace.fail("GPU-0"))
+	now = now.Add(30 * time.Second)
+	require.True(t, grace.fail("GPU-0"))
+	// Further failures are not reported again until they drop out of the window
+	require.False(t, grace.fail("GPU-0"))
+	now = now.Add(2 * time.Minute)
+	require.False(t, grace.fail("GPU-0"))
+	require.True(t, grace.fail("GPU-0"))
+
+	// Passing checks reset the count of the periodic checks
+	grace.pass("GPU-0")
+	require.Equal(t, 0, grace.count("GPU-0"))
+	require.False(t, grace.fail("GPU-0"))
+}
+
+func TestHealthDebounce(t *testing.T) {
+	var devices []*Device
+	for i := 0; i < 8; i++ {
+		devices = append(devices, &Device{Device: newPluginDevice(fmt.Sprintf("GPU-%d", i))})
+	}
+	m := newTestPlugin(config.CommandLineFlags{HealthDebounceMs: 200}, 1, devices...)
+	stream := newFakeListAndWatchServer()
+	go m.ListAndWatch(&pluginapi.Empty{}, stream)
+	defer close(m.stop)
+	require.NotNil(t, stream.next(time.Second))
+
+	// All the devices go unhealthy at once, as on a driver reset, without blocking the health checks
+	for _, d := range m.cachedDevices {
+		select {
+		case m.health <- d:
+		default:
+			t.Fatalf("health update of %s blocked", d.ID)
+		}
+	}
+
+	update := stream.next(time.Second)
+	require.NotNil(t, update)
+	require.Len(t, update.Devices, 8)
+	for _, d := range update.Devices {
+		require.Equal(t, pluginapi.Unhealthy, d.Health, d.ID)
+	}
+	require.Nil(t, stream.next(400*time.Millisecond), "health changes sent in more than one update")
+}
+
+func TestNoHealthCheck(t *testing.T) {
+	for _, disabled := range []bool{false, true} {
+		m := newTestPlugin(config.CommandLineFlags{NoHealthCheck: disabled}, 2, &Device{Device: newPluginDevice("GPU-0")})
+		rm := m.ResourceManager.(*testResourceManager)
+
+		m.startHealthChecks()
+		require.Eventually(t, func() bool {
+			return atomic.LoadInt32(&rm.checkHealthCalls) > 0 != disabled
+		}, time.Second, 10*time.Millisecond)
+		if !disabled {
+			close(m.stop)
+			continue
+		}
+		require.NotNil(t, m.health)
+
+		stream := newFakeListAndWatchServer()
+		done := make(chan error)
+		go func() { done <- m.ListAndWatch(&pluginapi.Empty{}, stream) }()
+
+		initial := stream.next(time.Second)
+		require.NotNil(t, initial, "ListAndWatch did not send the initial device list")
+		for _, d := range initial.Devices {
+			require.Equal(t, pluginapi.Healthy, d.Health)
+		}
+
+		close(m.stop)
+		select {
+		case err := <-done:
+			require.NoError(t, err)
+		case <-time.After(time.Second):
+			t.Fatal("ListAndWatch did not return after the plugin was stopped")
+		}
+		require.Zero(t, atomic.LoadInt32(&rm.checkHealthCalls))
+	}
+}
+
+func TestGetDeviceByUUID(t *testing.T) {
+	devices := []*Device{
+		{Device: newPluginDevice("GPU-0"), Index: "0", Paths: []string{"/dev/nvidia0"}},
+		{Device: newPluginDevice("GPU-1"), Index: "1", Paths: []string{"/dev/nvidia1"}},
+		{Device: newPluginDevice("MIG-GPU-1/1/0"), Index: "1:0", Paths: []string{"/dev/nvidia1"}},
+	}
+	indexed := newDeviceMap(devices)
+
+	for _, uuid := range []string{"GPU-0", "GPU-1", "MIG-GPU-1/1/0", "GPU-2", ""} {
+		t.Run(uuid, func(t *testing.T) {
+			slow, slowErr := getDeviceByUUID(devices, uuid)
+			fast, fastErr := indexed.get(uuid)
+			require.Equal(t, slowErr, fastErr)
+			require.Equal(t, slow, fast)
+		})
+	}
+
+	m := newTestPlugin(config.CommandLineFlags{DeviceIDStrategy: DeviceIDStrategyIndex}, 1, devices...)
+	_, err := m.GetDeviceByUUID("GPU-1")
+	require.NoError(t, err)
+	_, err = m.GetDeviceByUUID("GPU-2")
+	require.Equal(t, &UnknownDeviceError{"GPU-2"}, err)
+	require.Equal(t, []string{"1", "0"}, m.deviceIDsFromUUIDs([]string{"GPU-1", "GPU-0"}))
+}
+
+func TestNeedsPreferredAllocation(t *testing.T) {
+	for _, replicated := range []bool{false, true} {
+		for _, autoReplicas := range []bool{false, true} {
+			for _, withPolicy := range []bool{false, true} {
+				m := &NvidiaDevicePlugin{replicas: 1, autoReplicas: autoReplicas}
+				m.config.Flags.CommandLineFlags = &config.CommandLineFlags{}
+				if replicated {
+					m.replicas = 2
+				}
+				if withPolicy {
+					m.allocatePolicy = gpuallocator.NewBestEffortPolicy()
+				}
+
+				expected := replicated || autoReplicas || withPolicy
+				require.Equal(t, expected, m.needsPreferredAllocation(), "replicated=%v autoReplicas=%v policy=%v", replicated, autoReplicas, withPolicy)
+
+				options, err := m.GetDevicePluginOptions(context.Background(), &pluginapi.Empty{})
+				require.NoError(t, err)
+				require.Equal(t, expected, options.GetPreferredAllocationAvailable)
+			}
+		}
+	}
+}
+
+func TestIgnoreDeviceUUIDs(t *testing.T) {
+	logs := captureLog(t)
+	m := newTestPlugin(config.CommandLineFlags{IgnoreDeviceUUIDs: []string{"GPU-1", "GPU-typo"}}, 2,
+		&Device{Device: newPluginDevice("GPU-0")},
+		&Device{Device: newPluginDevice("GPU-1")},
+		&Device{Device: newPluginDevice("GPU-2")},
+	)
+
+	var cached []string
+	for _, d := range m.cachedDevices {
+		cached = append(cached, d.ID)
+	}
+	require.Equal(t, []string{"GPU-0", "GPU-2"}, cached)
+
+	var replicas []string
+	for _, d := range m.deviceReplicas {
+		replicas = append(replicas, d.ID)
+	}
+	require.Equal(t, []string{"GPU-0-replica-0", "GPU-0-replica-1", "GPU-2-replica-0", "GPU-2-replica-1"}, replicas)
+
+	require.Equal(t, 2, m.servedDeviceCount())
+	require.NotContains(t, logs.String(), "ignored_device_not_found")
+}
+
+func TestIgnoreAllDeviceUUIDs(t *testing.T) {
+	m := newTestPlugin(config.CommandLineFlags{IgnoreDeviceUUIDs: []string{"GPU-0"}}, 2, &Device{Device: newPluginDevice("GPU-0")})
+	require.Equal(t, 1, m.DeviceCount())
+	require.Zero(t, m.servedDeviceCount())
+}
+
+func TestWarnUnknownIgnoredDevices(t *testing.T) {
+	logs := captureLog(t)
+	flags := config.CommandLineFlags{IgnoreDeviceUUIDs: []string{"GPU-0", "GPU-1", "GPU-typo"}}
+	plugins := []*NvidiaDevicePlugin{
+		newTestPlugin(flags, 1, &Device{Device: newPluginDevice("GPU-0")}),
+		newTestPlugin(flags, 1, &Device{Device: newPluginDevice("GPU-1")}),
+	}
+
+	warnUnknownIgnoredDevices(plugins, flags.IgnoreDeviceUUIDs)
+	require.Equal(t, 1, strings.Count(logs.String(), "event_type=ignored_device_not_found device_uuid=GPU-typo"))
+	require.NotContains(t, logs.String(), "event_type=ignored_device_not_found device_uuid=GPU-0")
+	require.NotContains(t, logs.String(), "event_type=ignored_device_not_found device_uuid=GPU-1")
+}
+
+func TestDeviceFilters(t *testing.T) {
+	logs := captureLog(t)
+	m := newTestPlugin(config.CommandLineFlags{DeviceFilterUUIDRegex: "^GPU-display-", DeviceFilterIndex: []string{"2"}}, 2,
+		&Device{Device: newPluginDevice("GPU-display-0"), Index: "0"},
+		&Device{Device: newPluginDevice("GPU-1"), Index: "1"},
+		&Device{Device: newPluginDevice("GPU-2"), Index: "2"},
+		&Device{Device: newPluginDevice("GPU-3"), Index: "3"},
+	)
+
+	var replicas []string
+	for _, d := range m.deviceReplicas {
+		replicas = append(replicas, d.ID)
+	}
+	require.Equal(t, []string{"GPU-1-replica-0", "GPU-1-replica-1", "GPU-3-replica-0", "GPU-3-replica-1"}, replicas)
+
+	require.Contains(t, logs.String(), "event_type=device_excluded device_uuid=GPU-display-0")
+	require.Contains(t, logs.String(), "event_type=device_excluded device_uuid=GPU-2 index=2")
+}
+
+func TestDeviceCount(t *testing.T) {
+	for _, n := range []int{0, 1, 4} {
+		rm := &testResourceManager{}
+		for i := 0; i < n; i++ {
+			rm.devices = append(rm.devices, &Device{Device: newPluginDevice(fmt.Sprintf("GPU-%d", i))})
+		}
+		require.Equal(t, len(rm.Devices()), rm.DeviceCount())
+	}
+}
+
+func TestApiDeviceSpecsWithMockFS(t *testing.T) {
+	defer func(root string) { devRoot = root }(devRoot)
+
+	testCases := []struct {
+		description string
+		wsl2Mode    bool
+		present     []string
+		expected    []string
+	}{
+		{
+			description: "standard installation",
+			present:     []string{"/dev/nvidiactl", "/dev/nvidia-uvm", "/dev/nvidia-uvm-tools", "/dev/nvidia0", "/dev/nvidia1"},
+			expected:    []string{"/dev/nvidiactl", "/dev/nvidia-uvm", "/dev/nvidia-uvm-tools", "/dev/nvidia0"},
+		},
+		{
+			description: "with nvidia-modeset",
+			present:     []string{"/dev/nvidiactl", "/dev/nvidia-uvm", "/dev/nvidia-uvm-tools", "/dev/nvidia-modeset", "/dev/nvidia0"},
+			expected:    []string{"/dev/nvidiactl", "/dev/nvidia-uvm", "/dev/nvidia-uvm-tools", "/dev/nvidia-modeset", "/dev/nvidia0"},
+		},
+		{
+			description: "without uvm",
+			present:     []string{"/dev/nvidiactl", "/dev/nvidia0"},
+			expected:    []string{"/dev/nvidiactl", "/dev/nvidia0"},
+		},
+		{
+			description: "wsl2",
+			present:     []string{"/dev/dxg"},
+			expected:    []string{"/dev/dxg"},
+		},
+		{
+			description: "wsl2 mode",
+			wsl2Mode:    true,
+			expected:    []string{"/dev/dxg"},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.description, func(t *testing.T) {
+			driverRoot := t.TempDir()
+			require.NoError(t, os.Mkdir(filepath.Join(driverRoot, "dev"), 0755))
+			for _, p := range tc.present {
+				require.NoError(t, os.WriteFile(filepath.Join(driverRoot, p), nil, 0644))
+			}
+			devRoot = driverRoot
+
+			gpu0 := &Device{Device: newPluginDevice("GPU-0"), Paths: []string{"/dev/nvidia0"}}
+			gpu1 := &Device{Device: newPluginDevice("GPU-1"), Paths: []string{"/dev/nvidia1"}}
+			m := newTestPlugin(config.CommandLineFlags{WSL2Mode: tc.wsl2Mode}, 1, gpu0, gpu1)
+
+			specs := m.apiDeviceSpecs(driverRoot, []string{"GPU-0"})
+
+			var containerPaths []string
+			for _, spec := range specs {
+				require.Equal(t, filepath.Join(driverRoot, spec.ContainerPath), spec.HostPath)
+				require.Equal(t, "rw", spec.Permissions)
+				containerPaths = append(containerPaths, spec.ContainerPath)
+			}
+			require.Equal(t, tc.expected, containerPaths)
+		})
+	}
+}
+
+// countingResourceManager counts the device lookups
+type countingResourceManager struct {
+	ResourceManager
+	lookups int
+}
+
+func (r *countingResourceManager) GetDeviceByUUID(uuid string) (*Device, error) {
+	r.lookups++
+	return r.ResourceManager.GetDeviceByUUID(uuid)
+}
+
+func TestAllocateSharesResponsesAcrossContainers(t *testing.T) {
+	m := newTestPlugin(config.CommandLineFlags{}, 4,
+		&Device{Device: newPluginDevice("GPU-a")},
+		&Device{Device: newPluginDevice("GPU-b")},
+	)
+	rm := &countingResourceManager{ResourceManager: m.ResourceManager}
+	m.ResourceManager = rm
+
+	response, err := m.Allocate(context.Background(), &pluginapi.AllocateRequest{
+		ContainerRequests: []*pluginapi.ContainerAllocateRequest{
+			{DevicesIDs: []string{"GPU-a-replica-0"}},
+			{DevicesIDs: []string{"GPU-a-replica-1"}},
+			{DevicesIDs: []string{"GPU-b-replica-0"}},
+			{DevicesIDs: []string{"GPU-a-replica-2"}},
+		},
+	})
+	require.NoError(t, err)
+	require.Len(t, response.ContainerResponses, 4)
+
+	var visible []string
+	for _, r := range response.ContainerResponses {
+		visible = append(visible, r.Envs["NVIDIA_VISIBLE_DEVICES"])
+	}
+	require.Equal(t, []string{"GPU-a", "GPU-a", "GPU-b", "GPU-a"}, visible)
+	require.Equal(t, 2, rm.lookups)
+}
+
+func benchmarkAllocate(b *testing.B, batch bool) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	m := newTestPlugin(config.CommandLineFlags{}, 10, &Device{Device: newPluginDevice("GPU-a"), Paths: []string{"/dev/nvidia0"}})
+	var requests []*pluginapi.ContainerAllocateRequest
+	for i := 0; i < 10; i++ {
+		requests = append(requests, &pluginapi.ContainerAllocateRequest{
+			DevicesIDs: []string{fmt.Sprintf("GPU-a-replica-%d", i)},
+		})
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if batch {
+			_, err := m.Allocate(context.Background(), &pluginapi.AllocateRequest{ContainerRequests: requests})
+			require.NoError(b, err)
+			continue
+		}
+		for _, req := range requests {
+			_, err := m.Allocate(context.Background(), &pluginapi.AllocateRequest{ContainerRequests: []*pluginapi.ContainerAllocateRequest{req}})
+			require.NoError(b, err)
+		}
+	}
+}
+
+// BenchmarkAllocateBatch allocates 10 containers sharing a GPU in a single request
+func BenchmarkAllocateBatch(b *testing.B) {
+	benchmarkAllocate(b, true)
+}
+
+// BenchmarkAllocateSequential allocates the same 10 containers with one request each
+func BenchmarkAllocateSequential(b *testing.B) {
+	benchmarkAllocate(b, false)
+}
+
+func TestName(t *testing.T) {
+	cfg := &config.Config{Flags: config.Flags{CommandLineFlags: &config.CommandLineFlags{}}}
+	gpu, err := NewNvidiaDevicePlugin(cfg, "nvidia.com/gpu", &testResourceManager{}, "NVIDIA_VISIBLE_DEVICES", nil, pluginapi.DevicePluginPath+"nvidia-gpu.sock", 1, false, nil)
+	require.NoError(t, err)
+	mig, err := NewNvidiaDevicePlugin(cfg, "nvidia.com/mig-1g.5gb", &testResourceManager{}, "NVIDIA_VISIBLE_DEVICES", nil, pluginapi.DevicePluginPath+"nvidia-mig-1g.5gb.sock", 1, false, nil)
+	require.NoError(t, err)
+
+	require.Equal(t, "nvidia.com/gpu@/var/lib/kubelet/device-plugins/nvidia-gpu.sock", gpu.Name())
+	require.Equal(t, "nvidia.com/mig-1g.5gb@/var/lib/kubelet/device-plugins/nvidia-mig-1g.5gb.sock", mig.Name())
+}
+
+func TestMaxGRPCMessageSize(t *testing.T) {
+	// 5000 replicas with IDs of more than 1KB take more than the default 4MB limit of gRPC
+	longID := "GPU-" + strings.Repeat("0", 1024)
+
+	testCases := []struct {
+		description   string
+		size          int
+		expectedError bool
+	}{
+		{"increased limit", 16 * 1024 * 1024, false},
+		{"default limit", 4 * 1024 * 1024, true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.description, func(t *testing.T) {
+			m := newTestPlugin(config.CommandLineFlags{MaxGRPCMessageSize: tc.size}, 5000, &Device{Device: newPluginDevice(longID)})
+			m.socket = filepath.Join(t.TempDir(), "plugin.sock")
+			require.NoError(t, m.Serve())
+			defer m.Stop()
+
+			conn, err := m.dial(m.socket, 5*time.Second)
+			require.NoError(t, err)
+			defer conn.Close()
+
+			stream, err := pluginapi.NewDevicePluginClient(conn).ListAndWatch(context.Background(), &pluginapi.Empty{})
+			require.NoError(t, err)
+			response, err := stream.Recv()
+			if tc.expectedError {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.True(t, response.Size() > 4*1024*1024, "response of %d bytes", response.Size())
+			require.Len(t, response.Devices, 5000)
+		})
+	}
+}
+
+// hangingListAndWatchPlugin serves ListAndWatch streams that never end on their own,
+// like those of a kubelet that does not disconnect
+type hangingListAndWatchPlugin struct {
+	*NvidiaDevicePlugin
+}
+
+func (p *hangingListAndWatchPlugin) ListAndWatch(e *pluginapi.Empty, s pluginapi.DevicePlugin_ListAndWatchServer) error {
+	<-s.Context().Done()
+	return s.Context().Err()
+}
+
+// slowAllocatePlugin takes 'delay' to answer Allocate, signaling 'started' once it received the request
+type slowAllocatePlugin struct {
+	*NvidiaDevicePlugin
+	delay   time.Duration
+	started chan struct{}
+}
+
+func (p *slowAllocatePlugin) Allocate(ctx context.Context, reqs *pluginapi.AllocateRequest) (*pluginapi.AllocateResponse, error) {
+	close(p.started)
+	time.Sleep(p.delay)
+	return p.NvidiaDevicePlugin.Allocate(ctx, reqs)
+}
+
+func TestStopDrainsInFlightAllocate(t *testing.T) {
+	logs := captureLog(t)
+	m := newTestPlugin(config.CommandLineFlags{GRPCStopTimeout: config.Duration(10 * time.Second)}, 2, &Device{Device: newPluginDevice("GPU-a")})
+	m.socket = filepath.Join(t.TempDir(), "plugin.sock")
+
+	sock, err := net.Listen("unix", m.socket)
+	require.NoError(t, err)
+	plugin := &slowAllocatePlugin{NvidiaDevicePlugin: m, delay: 300 * time.Millisecond, started: make(chan struct{})}
+	pluginapi.RegisterDevicePluginServer(m.server, plugin)
+	go m.server.Serve(sock)
+
+	conn, err := m.dial(m.socket, 5*time.Second)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	type result struct {
+		resp *pluginapi.AllocateResponse
+		err  error
+	}
+	results := make(chan result, 1)
+	go func() {
+		resp, err := pluginapi.NewDevicePluginClient(conn).Allocate(context.Background(), &pluginapi.AllocateRequest{
+			ContainerRequests: []*pluginapi.ContainerAllocateRequest{{DevicesIDs: []string{"GPU-a-replica-1"}}},
+		})
+		results <- result{resp, err}
+	}()
+	<-plugin.started
+
+	// The kubelet gets its allocation although the plugin is stopped while it is being handled
+	start := time.Now()
+	require.NoError(t, m.Stop())
+	require.True(t, time.Since(start) < 10*time.Second)
+
+	r := <-results
+	require.NoError(t, r.err)
+	require.Equal(t, "GPU-a", r.resp.ContainerResponses[0].Envs["NVIDIA_VISIBLE_DEVICES"])
+	require.NotContains(t, logs.String(), "grpc_stop_timeout")
+}
+
+func TestGRPCStopTimeout(t *testing.T) {
+	testCases := []struct {
+		description string
+		plugin      func(m *NvidiaDevicePlugin) pluginapi.DevicePluginServer
+		timeout     time.Duration
+		forced      bool
+	}{
+		{
+			"graceful stop",
+			func(m *NvidiaDevicePlugin) pluginapi.DevicePluginServer { return m },
+			time.Minute,
+			false,
+		},
+		{
+			"forced stop",
+			func(m *NvidiaDevicePlugin) pluginapi.DevicePluginServer { return &hangingListAndWatchPlugin{m} },
+			200 * time.Millisecond,
+			true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.description, func(t *testing.T) {
+			logs := captureLog(t)
+			m := newTestPlugin(config.CommandLineFlags{GRPCStopTimeout: config.Duration(tc.timeout)}, 1, &Device{Device: newPluginDevice("GPU-a")})
+			m.socket = filepath.Join(t.TempDir(), "plugin.sock")
+
+			sock, err := net.Listen("unix", m.socket)
+			require.NoError(t, err)
+			pluginapi.RegisterDevicePluginServer(m.server, tc.plugin(m))
+			go m.server.Serve(sock)
+
+			conn, err := m.dial(m.socket, 5*time.Second)
+			require.NoError(t, err)
+			defer conn.Close()
+
+			_, err = pluginapi.NewDevicePluginClient(conn).ListAndWatch(context.Background(), &pluginapi.Empty{})
+			require.NoError(t, err)
+			rpcs := m.rpcs
+			require.Eventually(t, func() bool {
+				return rpcs.String() == "1 RPC(s): 1 /v1beta1.DevicePlugin/ListAndWatch"
+			}, 5*time.Second, 10*time.Millisecond)
+
+			start := time.Now()
+			require.NoError(t, m.Stop())
+			elapsed := time.Since(start)
+
+			if tc.forced {
+				require.True(t, elapsed >= tc.timeout, "stopped after %v", elapsed)
+				require.Contains(t, logs.String(), `event_type=grpc_stop_timeout timeout=200ms rpcs="1 RPC(s): 1 /v1beta1.DevicePlugin/ListAndWatch"`)
+			} else {
+				require.True(t, elapsed < tc.timeout, "stopped after %v", elapsed)
+				require.NotContains(t, logs.String(), "grpc_stop_timeout")
+			}
+			require.Eventually(t, func() bool {
+				return rpcs.String() == "no RPC"
+			}, 5*time.Second, 10*time.Millisecond)
+		})
+	}
+}
+
+// failingListener is a net.Listener on which the gRPC server crashes as soon as it starts serving
+type failingListener struct{}
+
+func (failingListener) Accept() (net.Conn, error) { return nil, fmt.Errorf("accept failed") }
+func (failingListener) Close() error              { return nil }
+func (failingListener) Addr() net.Addr            { return &net.UnixAddr{Net: "unix"} }
+
+// shortenServeRestartBackoff makes the gRPC server restart without waiting for the remainder of the test
+func shortenServeRestartBackoff(t *testing.T) {
+	initial, max := initialServeRestartBackoff, maxServeRestartBackoff
+	initialServeRestartBackoff, maxServeRestartBackoff = time.Millisecond, time.Millisecond
+	t.Cleanup(func() { initialServeRestartBackoff, maxServeRestartBackoff = initial, max })
+}
+
+func TestSocketCleanupOnExit(t *testing.T) {
+	shortenServeRestartBackoff(t)
+	for _, cleanup := range []bool{false, true} {
+		t.Run(fmt.Sprintf("socket-cleanup-on-exit=%v", cleanup), func(t *testing.T) {
+			m := newTestPlugin(config.CommandLineFlags{SocketCleanupOnExit: cleanup, RestartStableDuration: config.Duration(time.Hour)}, 1, &Device{Device: newPluginDevice("GPU-a")})
+			m.socket = filepath.Join(t.TempDir(), "nvidia-gpu.sock")
+			require.NoError(t, ioutil.WriteFile(m.socket, nil, 0600))
+
+			exited := make(chan error)
+			go func() { exited <- m.serveWithRestarts(failingListener{}) }()
+			select {
+			case err := <-exited:
+				require.Error(t, err)
+				require.Contains(t, err.Error(), "repeatedly crashed")
+			case <-time.After(5 * time.Second):
+				t.Fatal("gRPC server did not give up")
+			}
+
+			_, err := os.Stat(m.socket)
+			require.Equal(t, cleanup, os.IsNotExist(err))
+
+			// Stop() does not fail on the socket being gone
+			require.NoError(t, m.Stop())
+		})
+	}
+}
+
+func TestServeRestartBackoffResetsOnceStable(t *testing.T) {
+	shortenServeRestartBackoff(t)
+	// Every crash happens after serving for longer than --restart-stable-duration, so the server never gives up
+	m := newTestPlugin(config.CommandLineFlags{RestartStableDuration: config.Duration(time.Nanosecond)}, 1, &Device{Device: newPluginDevice("GPU-a")})
+
+	exited := make(chan error)
+	go func() { exited <- m.serveWithRestarts(failingListener{}) }()
+	select {
+	case err := <-exited:
+		t.Fatalf("gRPC server gave up: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// Stopping the plugin interrupts the backoff
+	close(m.stop)
+	select {
+	case err := <-exited:
+		require.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("gRPC server kept restarting after the plugin stopped")
+	}
+}
+
+func TestKubeletRegistrationTimeout(t *testing.T) {
+	m := newTestPlugin(config.CommandLineFlags{KubeletRegistrationTimeout: config.Duration(100 * time.Millisecond)}, 1, &Device{Device: newPluginDevice("GPU-a")})
+	// No kubelet listens next to the plugin socket
+	m.socket = filepath.Join(t.TempDir(), "nvidia-gpu.sock")
+
+	start := time.Now()
+	require.Error(t, m.Register(context.Background()))
+	require.True(t, time.Since(start) < 5*time.Second, "registration took %v", time.Since(start))
+}
+
+func TestAllocationTimeout(t *testing.T) {
+	m := newTestPlugin(config.CommandLineFlags{AllocationTimeout: config.Duration(100 * time.Millisecond)}, 1, &Device{Device: newPluginDevice("GPU-a")})
+	release := make(chan struct{})
+	defer close(release)
+	m.deviceIDsFromUUIDs = func(uuids []string) []string {
+		<-release
+		return uuids
+	}
+
+	start := time.Now()
+	_, err := m.Allocate(context.Background(), &pluginapi.AllocateRequest{
+		ContainerRequests: []*pluginapi.ContainerAllocateRequest{{DevicesIDs: []string{"GPU-a-replica-0"}}},
+	})
+	require.Equal(t, codes.DeadlineExceeded, status.Code(err), "%v", err)
+	require.True(t, time.Since(start) < 5*time.Second, "allocation took %v", time.Since(start))
+	require.Equal(t, 0, m.allocations.Count())
+}
@@ -0,0 +1,143 @@
+/*
+ * Copyright (c) 2022, NVIDIA CORPORATION.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+
+	config "github.com/NVIDIA/k8s-device-plugin/api/config/v1"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+// errSimulatedGPU is returned by the queries that have no meaningful answer for simulated GPUs
+var errSimulatedGPU = errors.New("not available for simulated GPUs")
+
+// simulatedGPUModel is the model reported for simulated GPUs
+const simulatedGPUModel = "Simulated GPU"
+
+// SimulatedDeviceManager implements the ResourceManager interface over synthetic GPUs, so that the plugin can
+// be exercised on machines without any, as enabled by --simulate-n-gpus in builds with the 'testing' tag.
+// The simulated GPUs are always healthy.
+type SimulatedDeviceManager struct {
+	devices deviceMap
+	ordered []*Device
+}
+
+// NewSimulatedDeviceManager returns a SimulatedDeviceManager with 'count' GPUs of 'memoryMB' MiB of memory each
+func NewSimulatedDeviceManager(count int, memoryMB uint) *SimulatedDeviceManager {
+	var devices []*Device
+	for i := 0; i < count; i++ {
+		d := &Device{}
+		d.ID = simulatedGPUUUID(i)
+		d.Health = pluginapi.Healthy
+		d.Paths = []string{fmt.Sprintf("/dev/nvidia%d", i)}
+		d.Index = strconv.Itoa(i)
+		d.TotalMemory = memoryMB
+		d.NUMANode = int(unknownNUMANode)
+		devices = append(devices, d)
+	}
+	return &SimulatedDeviceManager{devices: newDeviceMap(devices), ordered: devices}
+}
+
+// simulatedGPUUUID returns the UUID of the i-th simulated GPU, in the format of the UUIDs reported by NVML
+func simulatedGPUUUID(i int) string {
+	return fmt.Sprintf("GPU-00000000-0000-0000-0000-%012d", i)
+}
+
+// Devices returns a copy of the simulated GPUs
+func (r *SimulatedDeviceManager) Devices() []*Device {
+	var devices []*Device
+	for _, d := range r.ordered {
+		device := *d
+		devices = append(devices, &device)
+	}
+	return devices
+}
+
+// DeviceCount returns the number of simulated GPUs
+func (r *SimulatedDeviceManager) DeviceCount() int {
+	return len(r.ordered)
+}
+
+// GetDeviceByUUID returns the simulated GPU with the given UUID
+func (r *SimulatedDeviceManager) GetDeviceByUUID(uuid string) (*Device, error) {
+	return r.devices.get(uuid)
+}
+
+// CheckHealth is a no-op, as simulated GPUs never become unhealthy
+func (r *SimulatedDeviceManager) CheckHealth(stop <-chan interface{}, devices []*Device, unhealthy chan<- *Device) {
+}
+
+// newSimulatedGPUPlugins returns the plugins advertising the GPUs simulated with --simulate-n-gpus. Allocation
+// policies relying on the GPU topology are not available, since it cannot be queried without NVML.
+func newSimulatedGPUPlugins(cfg *config.Config, resourceConfig resourceConfiguration) ([]*NvidiaDevicePlugin, error) {
+	newResourceManager := func() ResourceManager {
+		return NewSimulatedDeviceManager(cfg.Flags.SimulateNGPUs, uint(cfg.Flags.SimulateGPUMemoryMB))
+	}
+	plugins, err := newGPUPlugins(cfg, resourceConfig, newResourceManager, nil)
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range plugins {
+		p.simulateNVML()
+	}
+	return plugins, nil
+}
+
+// simulateNVML replaces the device queries going through NVML, which must not be called without loading it,
+// with answers for simulated GPUs
+func (m *NvidiaDevicePlugin) simulateNVML() {
+	m.queryThrottleReasons = func(uuid string) (uint64, error) { return 0, nil }
+	m.queryEnergy = func(uuid string) (uint64, error) { return 0, nil }
+	m.queryVirtualType = func(d *Device) (string, error) { return VirtualTypePhysical, nil }
+	m.queryModel = func(d *Device) (string, error) { return simulatedGPUModel, nil }
+	m.queryVBIOSVersion = func(uuid string) (string, error) { return "", errSimulatedGPU }
+	m.queryFreeMemory = func(uuid string) (uint64, error) {
+		d, err := m.GetDeviceByUUID(uuid)
+		if err != nil {
+			return 0, err
+		}
+		return uint64(d.TotalMemory), nil
+	}
+	m.queryUsedMemory = func(uuid string) (uint64, error) { return 0, nil }
+	m.readXIDErrors = func(busID string) (map[uint]uint64, error) { return map[uint]uint64{}, nil }
+	m.resetGPU = func(uuid string) error { return nil }
+	m.probeDevice = func(d *Device) error { return nil }
+	m.validateDeviceAccess = func(uuid string) error { return nil }
+	m.powerManager = simulatedPowerManager{}
+}
+
+// simulatedPowerManager implements the PowerManager interface for simulated GPUs, which have no power limits
+type simulatedPowerManager struct{}
+
+func (simulatedPowerManager) PowerLimit(uuid string) (uint, error) {
+	return 0, errSimulatedGPU
+}
+
+func (simulatedPowerManager) DefaultPowerLimit(uuid string) (uint, error) {
+	return 0, errSimulatedGPU
+}
+
+func (simulatedPowerManager) PowerLimits(uuid string) (*PowerLimits, error) {
+	return nil, errSimulatedGPU
+}
+
+func (simulatedPowerManager) SetPowerLimit(uuid string, watts uint) error {
+	return errSimulatedGPU
+}
@@ -0,0 +1,77 @@
+/*
+ * Copyright (c) 2022, NVIDIA CORPORATION.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	config "github.com/NVIDIA/k8s-device-plugin/api/config/v1"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+func TestSimulatedGPUPlugins(t *testing.T) {
+	cfg := &config.Config{Flags: config.Flags{CommandLineFlags: &config.CommandLineFlags{
+		ResourceName:        "nvidia.com/gpu",
+		SocketDir:           "/var/lib/kubelet/device-plugins",
+		DeviceListEnvvar:    "NVIDIA_VISIBLE_DEVICES",
+		DeviceListStrategy:  DeviceListStrategyEnvvar,
+		DeviceIDStrategy:    DeviceIDStrategyIndex,
+		AllocationTimeout:   config.Duration(10 * time.Second),
+		SimulateNGPUs:       2,
+		SimulateGPUMemoryMB: 8192,
+	}}}
+	plugins, err := newSimulatedGPUPlugins(cfg, resourceConfiguration{"gpu": {Name: "gpu", Replicas: 2}})
+	require.NoError(t, err)
+	require.Len(t, plugins, 1)
+	m := plugins[0]
+
+	m.initialize()
+	defer close(m.stop)
+	m.startHealthChecks()
+
+	var replicas []string
+	for _, d := range m.deviceReplicas {
+		replicas = append(replicas, d.ID)
+		require.Equal(t, uint(8192), d.TotalMemory)
+		require.Equal(t, VirtualTypePhysical, d.VirtualType)
+	}
+	require.Equal(t, []string{
+		"GPU-00000000-0000-0000-0000-000000000000-replica-0", "GPU-00000000-0000-0000-0000-000000000000-replica-1",
+		"GPU-00000000-0000-0000-0000-000000000001-replica-0", "GPU-00000000-0000-0000-0000-000000000001-replica-1",
+	}, replicas)
+
+	s := newFakeListAndWatchServer()
+	go m.ListAndWatch(&pluginapi.Empty{}, s)
+	resp := s.next(5 * time.Second)
+	require.NotNil(t, resp)
+	require.Len(t, resp.Devices, 4)
+
+	preferred, err := m.GetPreferredAllocation(context.Background(), &pluginapi.PreferredAllocationRequest{
+		ContainerRequests: []*pluginapi.ContainerPreferredAllocationRequest{{AvailableDeviceIDs: replicas, AllocationSize: 2}},
+	})
+	require.NoError(t, err)
+	require.Len(t, preferred.ContainerResponses[0].DeviceIDs, 2)
+
+	allocated, err := m.Allocate(context.Background(), &pluginapi.AllocateRequest{
+		ContainerRequests: []*pluginapi.ContainerAllocateRequest{{DevicesIDs: []string{replicas[3]}}},
+	})
+	require.NoError(t, err)
+	require.Equal(t, "1", allocated.ContainerResponses[0].Envs["NVIDIA_VISIBLE_DEVICES"])
+}
@@ -0,0 +1,139 @@
+/*
+ * Copyright (c) 2022, NVIDIA CORPORATION.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// prioritizeDevicesBySMCount is prioritizeDevicesBySMWeight for the GPUs of the plugin.
+// If the SM count of any GPU is unknown, all GPUs weigh the same and the request is handed to prioritizeDevices.
+func (m *NvidiaDevicePlugin) prioritizeDevicesBySMCount(availableDeviceIDs []string, mustIncludeDeviceIDs []string, allocationSize int) ([]string, error) {
+	m.mu.RLock()
+	replicas := make(map[string]int)
+	smCounts := make(map[string]uint)
+	for _, d := range m.cachedDevices {
+		if d.SMCount == 0 {
+			m.mu.RUnlock()
+			return prioritizeDevices(availableDeviceIDs, mustIncludeDeviceIDs, allocationSize, m.replicaCodec)
+		}
+		replicas[d.ID] = len(m.replicasOf(d))
+		smCounts[d.ID] = d.SMCount
+	}
+	m.mu.RUnlock()
+	return prioritizeDevicesBySMWeight(availableDeviceIDs, mustIncludeDeviceIDs, allocationSize, m.replicaCodec, replicas, smCounts)
+}
+
+// prioritizeDevicesBySMWeight picks replicas one at a time so that the number of replicas in use on each GPU
+// stays proportional to its number of streaming multiprocessors (SMs): a GPU with twice as many SMs serves
+// twice as many replicas. Like prioritizeDevices, GPUs not yet part of the allocation are picked first.
+// 'replicas' is the total number of replicas of each GPU and 'smCounts' its number of SMs.
+func prioritizeDevicesBySMWeight(availableDeviceIDs []string, mustIncludeDeviceIDs []string, allocationSize int, codec ReplicaIDCodec, replicas map[string]int, smCounts map[string]uint) ([]string, error) {
+	rawDeviceCount := make(map[string]*devCount)
+	for _, id := range availableDeviceIDs {
+		dev := stripReplica(id, codec)
+		if _, exists := rawDeviceCount[dev]; !exists {
+			rawDeviceCount[dev] = &devCount{}
+		}
+		rawDeviceCount[dev].ReplicaDeviceNames = append(rawDeviceCount[dev].ReplicaDeviceNames, id)
+	}
+
+	var rawDeviceCountSorted []string
+	for dev, deviceCount := range rawDeviceCount {
+		sort.Strings(deviceCount.ReplicaDeviceNames)
+		rawDeviceCountSorted = append(rawDeviceCountSorted, dev)
+	}
+	sort.Strings(rawDeviceCountSorted)
+
+	// inUse returns the number of replicas of a GPU not available for allocation
+	inUse := func(dev string) uint {
+		remaining := len(rawDeviceCount[dev].ReplicaDeviceNames)
+		if replicas[dev] < remaining {
+			return 0
+		}
+		return uint(replicas[dev] - remaining)
+	}
+	// weight returns the number of SMs of a GPU, or 1 if it is unknown
+	weight := func(dev string) uint {
+		if smCounts[dev] == 0 {
+			return 1
+		}
+		return smCounts[dev]
+	}
+	// lessLoaded compares the replicas in use per SM of two GPUs without dividing
+	lessLoaded := func(a, b string) bool {
+		return inUse(a)*weight(b) < inUse(b)*weight(a)
+	}
+
+	allocated := make([]string, len(mustIncludeDeviceIDs), allocationSize)
+	unique := true
+
+	for i, deviceID := range mustIncludeDeviceIDs {
+		deviceCount, exists := rawDeviceCount[stripReplica(deviceID, codec)]
+		if !exists {
+			return nil, fmt.Errorf("device '%s' in mustIncludeDeviceIDs is missing from availableDeviceIDs", deviceID)
+		}
+		if deviceCount.Allocated {
+			// This physical GPU is already allocated so we are no longer unique
+			unique = false
+		}
+		if !deviceCount.allocate(deviceID) {
+			return nil, fmt.Errorf("device '%s' in mustIncludeDeviceIDs is missing from availableDeviceIDs", deviceID)
+		}
+		allocated[i] = deviceID
+	}
+
+	for i := len(allocated); i < allocationSize; i++ {
+		var best string
+		for _, dev := range rawDeviceCountSorted {
+			deviceCount := rawDeviceCount[dev]
+			if len(deviceCount.ReplicaDeviceNames) == 0 {
+				continue
+			}
+			if best == "" {
+				best = dev
+				continue
+			}
+			// Prioritize unique (aka "unallocated") devices, then the least loaded ones
+			if rawDeviceCount[best].Allocated != deviceCount.Allocated {
+				if rawDeviceCount[best].Allocated {
+					best = dev
+				}
+				continue
+			}
+			if lessLoaded(dev, best) {
+				best = dev
+			}
+		}
+		if best == "" {
+			return nil, errors.New("no devices left to allocate")
+		}
+		if rawDeviceCount[best].Allocated {
+			unique = false
+		}
+		allocated = append(allocated, rawDeviceCount[best].allocateAny())
+	}
+	sort.Strings(allocated)
+
+	var err error
+	if !unique {
+		err = &NonUniqueError{}
+	}
+	return allocated, err
+}
@@ -0,0 +1,150 @@
+/*
+ * Copyright (c) 2022, NVIDIA CORPORATION.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	config "github.com/NVIDIA/k8s-device-plugin/api/config/v1"
+	"github.com/stretchr/testify/require"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+func newSMDevice(id string, smCount uint) *Device {
+	return &Device{Device: newPluginDevice(id), SMCount: smCount}
+}
+
+// allocateOneAtATime requests a single replica 'n' times, removing the allocated replica from the available ones
+func allocateOneAtATime(t *testing.T, m *NvidiaDevicePlugin, n int) []string {
+	var available []string
+	for _, d := range m.apiDevices() {
+		available = append(available, d.ID)
+	}
+
+	var gpus []string
+	for i := 0; i < n; i++ {
+		resp, err := m.GetPreferredAllocation(nil, &pluginapi.PreferredAllocationRequest{
+			ContainerRequests: []*pluginapi.ContainerPreferredAllocationRequest{
+				{AvailableDeviceIDs: available, AllocationSize: 1},
+			},
+		})
+		require.NoError(t, err)
+		id := resp.ContainerResponses[0].DeviceIDs[0]
+		available = remove(available, find(available, id))
+		gpus = append(gpus, stripReplica(id, m.replicaCodec))
+	}
+	return gpus
+}
+
+func TestSMWeightedAllocation(t *testing.T) {
+	testCases := []struct {
+		description string
+		flags       config.CommandLineFlags
+		devices     []*Device
+		expected    []string
+	}{
+		{
+			"uniform allocation",
+			config.CommandLineFlags{},
+			[]*Device{newSMDevice("GPU-a", 4), newSMDevice("GPU-b", 2)},
+			[]string{"GPU-a", "GPU-b", "GPU-a", "GPU-b", "GPU-a", "GPU-b"},
+		},
+		{
+			"GPU-a has twice as many SMs as GPU-b",
+			config.CommandLineFlags{SMWeightedAllocation: true},
+			[]*Device{newSMDevice("GPU-a", 4), newSMDevice("GPU-b", 2)},
+			[]string{"GPU-a", "GPU-b", "GPU-a", "GPU-a", "GPU-b", "GPU-a"},
+		},
+		{
+			"GPU-b has three times as many SMs as GPU-a",
+			config.CommandLineFlags{SMWeightedAllocation: true},
+			[]*Device{newSMDevice("GPU-a", 2), newSMDevice("GPU-b", 6)},
+			[]string{"GPU-a", "GPU-b", "GPU-b", "GPU-b", "GPU-a", "GPU-b"},
+		},
+		{
+			"unknown SM count falls back to uniform allocation",
+			config.CommandLineFlags{SMWeightedAllocation: true},
+			[]*Device{newSMDevice("GPU-a", 4), newSMDevice("GPU-b", 0)},
+			[]string{"GPU-a", "GPU-b", "GPU-a", "GPU-b", "GPU-a", "GPU-b"},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.description, func(t *testing.T) {
+			m := newTestPlugin(tc.flags, 4, tc.devices...)
+			require.Equal(t, tc.expected, allocateOneAtATime(t, m, len(tc.expected)))
+		})
+	}
+}
+
+func TestPrioritizeDevicesBySMWeight(t *testing.T) {
+	available := []string{"GPU-a-replica-0", "GPU-a-replica-1", "GPU-b-replica-0", "GPU-b-replica-1"}
+	replicas := map[string]int{"GPU-a": 2, "GPU-b": 2}
+	smCounts := map[string]uint{"GPU-a": 4, "GPU-b": 2}
+
+	ids, err := prioritizeDevicesBySMWeight(available, []string{"GPU-b-replica-1"}, 2, defaultReplicaIDCodec, replicas, smCounts)
+	require.NoError(t, err)
+	require.Equal(t, []string{"GPU-a-replica-0", "GPU-b-replica-1"}, ids)
+
+	ids, err = prioritizeDevicesBySMWeight(available, nil, 3, defaultReplicaIDCodec, replicas, smCounts)
+	require.Equal(t, []string{"GPU-a-replica-0", "GPU-a-replica-1", "GPU-b-replica-0"}, ids)
+	require.IsType(t, &NonUniqueError{}, err)
+
+	_, err = prioritizeDevicesBySMWeight(available, []string{"GPU-c-replica-0"}, 1, defaultReplicaIDCodec, replicas, smCounts)
+	require.Error(t, err)
+
+	_, err = prioritizeDevicesBySMWeight(available, nil, 5, defaultReplicaIDCodec, replicas, smCounts)
+	require.Error(t, err)
+}
+
+// benchmarkReplicaAllocation allocates the replicas of 8 GPUs of different SM counts one at a time
+func benchmarkReplicaAllocation(b *testing.B, weighted bool) {
+	replicas := make(map[string]int)
+	smCounts := make(map[string]uint)
+	var all []string
+	for i := 0; i < 8; i++ {
+		gpu := fmt.Sprintf("GPU-%d", i)
+		replicas[gpu] = 16
+		smCounts[gpu] = uint(54 * (1 + i%2))
+		for r := uint(0); r < 16; r++ {
+			all = append(all, defaultReplicaIDCodec.Encode(gpu, r))
+		}
+	}
+
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		available := append([]string(nil), all...)
+		for len(available) > 0 {
+			var ids []string
+			if weighted {
+				ids, _ = prioritizeDevicesBySMWeight(available, nil, 1, defaultReplicaIDCodec, replicas, smCounts)
+			} else {
+				ids, _ = prioritizeDevices(available, nil, 1, defaultReplicaIDCodec)
+			}
+			available = remove(available, find(available, ids[0]))
+		}
+	}
+}
+
+func BenchmarkUniformReplicaAllocation(b *testing.B) {
+	benchmarkReplicaAllocation(b, false)
+}
+
+func BenchmarkSMWeightedReplicaAllocation(b *testing.B) {
+	benchmarkReplicaAllocation(b, true)
+}
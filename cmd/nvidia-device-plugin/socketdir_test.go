@@ -0,0 +1,46 @@
+/*
+ * Copyright (c) 2022, NVIDIA CORPORATION.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestKubeletSocketPath(t *testing.T) {
+	require.Equal(t, "/var/lib/kubelet/device-plugins/kubelet.sock", kubeletSocketPath("/var/lib/kubelet/device-plugins"))
+	require.Equal(t, "/var/lib/rancher/k3s/agent/kubelet/device-plugins/kubelet.sock", kubeletSocketPath("/var/lib/rancher/k3s/agent/kubelet/device-plugins/"))
+}
+
+func TestCheckSocketDir(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, checkSocketDir(dir))
+
+	// The probe file is cleaned up
+	files, err := ioutil.ReadDir(dir)
+	require.NoError(t, err)
+	require.Empty(t, files)
+
+	require.Error(t, checkSocketDir(filepath.Join(dir, "missing")))
+
+	file := filepath.Join(dir, "file")
+	require.NoError(t, ioutil.WriteFile(file, nil, 0600))
+	require.Error(t, checkSocketDir(file))
+}
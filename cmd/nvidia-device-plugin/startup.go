@@ -0,0 +1,43 @@
+/*
+ * Copyright (c) 2022, NVIDIA CORPORATION.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"log/slog"
+	"os"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// exitOnStartupTimeout exits with a non-zero code, so that the plugin pod is restarted
+var exitOnStartupTimeout = func() { os.Exit(1) }
+
+// startupWatchdog returns a context expiring after 'timeout', bounding the registration of the plugins with the
+// kubelet. Unless the returned function is called once they are registered, 'exit' is called when the context
+// expires, even if the startup is hung.
+func startupWatchdog(timeout time.Duration, exit func()) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	go func() {
+		<-ctx.Done()
+		if ctx.Err() == context.DeadlineExceeded {
+			slog.Error("Plugins not registered with the kubelet in time, exiting", logKeyEventType, "startup_timeout", "timeout", timeout)
+			exit()
+		}
+	}()
+	return ctx, cancel
+}
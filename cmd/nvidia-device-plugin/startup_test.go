@@ -0,0 +1,49 @@
+/*
+ * Copyright (c) 2022, NVIDIA CORPORATION.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	config "github.com/NVIDIA/k8s-device-plugin/api/config/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStartupWatchdog(t *testing.T) {
+	var exits int32
+	exit := func() { atomic.AddInt32(&exits, 1) }
+
+	// Confirmed in time
+	_, confirm := startupWatchdog(time.Second, exit)
+	confirm()
+	time.Sleep(10 * time.Millisecond)
+	require.Zero(t, atomic.LoadInt32(&exits))
+
+	// Registration hung past the timeout, without a kubelet next to the plugin socket
+	ctx, confirm := startupWatchdog(100*time.Millisecond, exit)
+	defer confirm()
+	m := newTestPlugin(config.CommandLineFlags{KubeletRegistrationTimeout: config.Duration(time.Minute)}, 1, &Device{Device: newPluginDevice("GPU-a")})
+	m.socket = filepath.Join(t.TempDir(), "nvidia-gpu.sock")
+
+	start := time.Now()
+	require.Error(t, m.Register(ctx))
+	require.True(t, time.Since(start) < 5*time.Second, "registration took %v", time.Since(start))
+	require.Eventually(t, func() bool { return atomic.LoadInt32(&exits) == 1 }, 5*time.Second, 10*time.Millisecond)
+}
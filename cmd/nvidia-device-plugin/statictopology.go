@@ -0,0 +1,86 @@
+/*
+ * Copyright (c) 2022, NVIDIA CORPORATION.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"sync"
+
+	"github.com/NVIDIA/go-gpuallocator/gpuallocator"
+	topology "github.com/NVIDIA/k8s-device-plugin/api/topology/v1"
+)
+
+// staticTopologyPolicy is an allocation policy working on the devices linked as queried through NVML or,
+// where the query fails as on some virtualized or older driver environments, as described by --topology-file
+type staticTopologyPolicy struct {
+	gpuallocator.Policy
+	devices    map[string]*gpuallocator.Device                      // the devices of the topology file by UUID
+	newDevices func(uuids []string) ([]*gpuallocator.Device, error) // queries the devices and their links through NVML
+	fallback   sync.Once
+}
+
+func newStaticTopologyPolicy(policy gpuallocator.Policy, t *topology.Topology) (*staticTopologyPolicy, error) {
+	var uuids []string
+	for _, d := range t.Devices {
+		uuids = append(uuids, d.UUID)
+	}
+	// The devices are built once, as the policies compare the devices of a request by identity
+	devices, err := t.DevicesFrom(uuids)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &staticTopologyPolicy{
+		Policy:     policy,
+		devices:    make(map[string]*gpuallocator.Device),
+		newDevices: gpuallocator.NewDevicesFrom,
+	}
+	for _, d := range devices {
+		p.devices[d.UUID] = d
+	}
+	return p, nil
+}
+
+// DevicesFrom returns the devices with the given UUIDs, falling back to the static topology if they cannot be queried
+func (p *staticTopologyPolicy) DevicesFrom(uuids []string) ([]*gpuallocator.Device, error) {
+	devices, err := p.newDevices(uuids)
+	if err == nil {
+		return devices, nil
+	}
+	p.fallback.Do(func() {
+		slog.Warn("Failed to query the GPU topology, using --topology-file instead", logKeyEventType, "topology_fallback", "error", err)
+	})
+
+	var static []*gpuallocator.Device
+	for _, uuid := range uuids {
+		d, ok := p.devices[uuid]
+		if !ok {
+			return nil, fmt.Errorf("no device with uuid %v in --topology-file", uuid)
+		}
+		static = append(static, d)
+	}
+	return static, nil
+}
+
+// allocatorDevices returns the devices with the given UUIDs, linked as seen by the allocate policy
+func (m *NvidiaDevicePlugin) allocatorDevices(uuids []string) ([]*gpuallocator.Device, error) {
+	if p, ok := m.allocatePolicy.(*staticTopologyPolicy); ok {
+		return p.DevicesFrom(uuids)
+	}
+	return gpuallocator.NewDevicesFrom(uuids)
+}
@@ -0,0 +1,145 @@
+/*
+ * Copyright (c) 2022, NVIDIA CORPORATION.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/NVIDIA/go-gpuallocator/gpuallocator"
+	config "github.com/NVIDIA/k8s-device-plugin/api/config/v1"
+	topology "github.com/NVIDIA/k8s-device-plugin/api/topology/v1"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+// Two pairs of GPUs linked through NVLink, on different CPU sockets
+const testTopologyFile = `{
+  "version": "v1",
+  "devices": [
+    {"uuid": "GPU-a", "index": 0, "links": [{"peer": "GPU-b", "type": "nvlink2"}, {"peer": "GPU-c", "type": "cross-cpu"}, {"peer": "GPU-d", "type": "cross-cpu"}]},
+    {"uuid": "GPU-b", "index": 1, "links": [{"peer": "GPU-a", "type": "nvlink2"}, {"peer": "GPU-c", "type": "cross-cpu"}, {"peer": "GPU-d", "type": "cross-cpu"}]},
+    {"uuid": "GPU-c", "index": 2, "links": [{"peer": "GPU-a", "type": "cross-cpu"}, {"peer": "GPU-b", "type": "cross-cpu"}, {"peer": "GPU-d", "type": "nvlink2"}]},
+    {"uuid": "GPU-d", "index": 3, "links": [{"peer": "GPU-a", "type": "cross-cpu"}, {"peer": "GPU-b", "type": "cross-cpu"}, {"peer": "GPU-c", "type": "nvlink2"}]}
+  ]
+}`
+
+func TestStaticTopologyFallback(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "topology.json")
+	require.NoError(t, os.WriteFile(path, []byte(testTopologyFile), 0644))
+	static, err := topology.Load(path)
+	require.NoError(t, err)
+
+	m := newTestPlugin(config.CommandLineFlags{NoReplicas: true}, 0,
+		&Device{Device: newPluginDevice("GPU-a")}, &Device{Device: newPluginDevice("GPU-b")},
+		&Device{Device: newPluginDevice("GPU-c")}, &Device{Device: newPluginDevice("GPU-d")})
+	policy, err := newStaticTopologyPolicy(gpuallocator.NewBestEffortPolicy(), static)
+	require.NoError(t, err)
+	policy.newDevices = func(uuids []string) ([]*gpuallocator.Device, error) {
+		return nil, errors.New("topology unavailable")
+	}
+	m.allocatePolicy = policy
+
+	resp, err := m.GetPreferredAllocation(context.Background(), &pluginapi.PreferredAllocationRequest{
+		ContainerRequests: []*pluginapi.ContainerPreferredAllocationRequest{
+			{AvailableDeviceIDs: []string{"GPU-a", "GPU-c", "GPU-b", "GPU-d"}, MustIncludeDeviceIDs: []string{"GPU-d"}, AllocationSize: 2},
+		},
+	})
+	require.NoError(t, err)
+	require.ElementsMatch(t, []string{"GPU-c", "GPU-d"}, resp.ContainerResponses[0].DeviceIDs)
+
+	_, err = policy.DevicesFrom([]string{"GPU-z"})
+	require.Error(t, err)
+}
+
+func TestStaticTopologyReplicas(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "topology.json")
+	require.NoError(t, os.WriteFile(path, []byte(testTopologyFile), 0644))
+	static, err := topology.Load(path)
+	require.NoError(t, err)
+
+	m := newTestPlugin(config.CommandLineFlags{}, 2,
+		&Device{Device: newPluginDevice("GPU-a")}, &Device{Device: newPluginDevice("GPU-b")},
+		&Device{Device: newPluginDevice("GPU-c")}, &Device{Device: newPluginDevice("GPU-d")})
+	policy, err := newStaticTopologyPolicy(gpuallocator.NewBestEffortPolicy(), static)
+	require.NoError(t, err)
+	policy.newDevices = func(uuids []string) ([]*gpuallocator.Device, error) {
+		return nil, errors.New("topology unavailable")
+	}
+	m.allocatePolicy = policy
+
+	var all []string
+	for _, d := range m.deviceReplicas {
+		all = append(all, d.ID)
+	}
+
+	tests := []struct {
+		name        string
+		available   []string
+		mustInclude []string
+		size        int32
+		expected    []string
+	}{
+		{
+			name:        "policy picks the NVLink peer of the required GPU",
+			available:   all,
+			mustInclude: []string{"GPU-d-replica-1"},
+			size:        2,
+			expected:    []string{"GPU-c-replica-0", "GPU-d-replica-1"},
+		},
+		{
+			name:      "policy picks the GPUs before their replicas",
+			available: []string{"GPU-a-replica-1", "GPU-b-replica-1", "GPU-c-replica-0", "GPU-c-replica-1", "GPU-d-replica-1"},
+			size:      2,
+			expected:  []string{"GPU-a-replica-1", "GPU-b-replica-1"},
+		},
+		{
+			name:      "single replica is left to the least used GPU",
+			available: []string{"GPU-a-replica-1", "GPU-c-replica-0", "GPU-c-replica-1"},
+			size:      1,
+			expected:  []string{"GPU-c-replica-0"},
+		},
+		{
+			name:      "more replicas than GPUs are shared",
+			available: []string{"GPU-a-replica-0", "GPU-a-replica-1", "GPU-b-replica-0"},
+			size:      3,
+			expected:  []string{"GPU-a-replica-0", "GPU-a-replica-1", "GPU-b-replica-0"},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			resp, err := m.GetPreferredAllocation(context.Background(), &pluginapi.PreferredAllocationRequest{
+				ContainerRequests: []*pluginapi.ContainerPreferredAllocationRequest{
+					{AvailableDeviceIDs: tc.available, MustIncludeDeviceIDs: tc.mustInclude, AllocationSize: tc.size},
+				},
+			})
+			require.NoError(t, err)
+			require.ElementsMatch(t, tc.expected, resp.ContainerResponses[0].DeviceIDs)
+		})
+	}
+	_, err = m.GetPreferredAllocation(context.Background(), &pluginapi.PreferredAllocationRequest{
+		ContainerRequests: []*pluginapi.ContainerPreferredAllocationRequest{
+			{AvailableDeviceIDs: []string{"GPU-a-replica-0", "GPU-b-replica-x"}, AllocationSize: 2},
+		},
+	})
+	require.Equal(t, codes.InvalidArgument, status.Code(err), "%v", err)
+}
@@ -0,0 +1,97 @@
+//go:build testing
+// +build testing
+
+/*
+ * Copyright (c) 2022, NVIDIA CORPORATION.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"time"
+
+	config "github.com/NVIDIA/k8s-device-plugin/api/config/v1"
+	cli "github.com/urfave/cli/v2"
+	altsrc "github.com/urfave/cli/v2/altsrc"
+	"golang.org/x/net/context"
+)
+
+// testingFlags are the flags only available in builds with the 'testing' tag.
+// They alter the behaviour of the plugin in ways that must never happen in production.
+var testingFlags = []cli.Flag{
+	altsrc.NewDurationFlag(
+		&cli.DurationFlag{
+			Name:    "allocate-response-delay",
+			Value:   0,
+			Usage:   "delay every Allocate response by the given duration, bounded by the request deadline",
+			EnvVars: []string{"ALLOCATE_RESPONSE_DELAY"},
+		},
+	),
+	altsrc.NewBoolFlag(
+		&cli.BoolFlag{
+			Name:    "panic-on-double-allocate",
+			Value:   false,
+			Usage:   "panic with a dump of all goroutines instead of failing Allocate when a device is requested more than once",
+			EnvVars: []string{"PANIC_ON_DOUBLE_ALLOCATE"},
+		},
+	),
+	altsrc.NewIntFlag(
+		&cli.IntFlag{
+			Name:    "simulate-n-gpus",
+			Value:   0,
+			Usage:   "advertise the given number of synthetic GPUs instead of the GPUs of the node, without loading NVML",
+			EnvVars: []string{"SIMULATE_N_GPUS"},
+		},
+	),
+	altsrc.NewIntFlag(
+		&cli.IntFlag{
+			Name:    "simulate-gpu-memory-mb",
+			Value:   16384,
+			Usage:   "memory in MiB of each GPU simulated with --simulate-n-gpus",
+			EnvVars: []string{"SIMULATE_GPU_MEMORY_MB"},
+		},
+	),
+}
+
+// delayAllocate waits for --allocate-response-delay or until 'ctx' is done, whichever comes first
+func (m *NvidiaDevicePlugin) delayAllocate(ctx context.Context) {
+	delay := time.Duration(m.config.Flags.AllocateResponseDelay)
+	if delay <= 0 {
+		return
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+	case <-timer.C:
+	}
+}
+
+// doubleAllocated panics with a dump of all goroutines if --panic-on-double-allocate is set
+func (m *NvidiaDevicePlugin) doubleAllocated(id string) {
+	if !m.config.Flags.PanicOnDoubleAllocate {
+		return
+	}
+
+	panic(fmt.Sprintf("double allocation of '%s' device %s\n\n%s", m.Name(), id, goroutineStacks()))
+}
+
+// simulatingGPUs returns whether --simulate-n-gpus replaces the GPUs of the node with synthetic ones
+func simulatingGPUs(config *config.Config) bool {
+	return config.Flags.SimulateNGPUs > 0
+}
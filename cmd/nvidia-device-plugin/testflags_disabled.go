@@ -0,0 +1,38 @@
+//go:build !testing
+// +build !testing
+
+/*
+ * Copyright (c) 2022, NVIDIA CORPORATION.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	config "github.com/NVIDIA/k8s-device-plugin/api/config/v1"
+	cli "github.com/urfave/cli/v2"
+	"golang.org/x/net/context"
+)
+
+// testingFlags are only available in builds with the 'testing' tag
+var testingFlags []cli.Flag
+
+// delayAllocate is a no-op outside of builds with the 'testing' tag
+func (m *NvidiaDevicePlugin) delayAllocate(ctx context.Context) {}
+
+// doubleAllocated is a no-op outside of builds with the 'testing' tag
+func (m *NvidiaDevicePlugin) doubleAllocated(id string) {}
+
+// simulatingGPUs is always false outside of builds with the 'testing' tag
+func simulatingGPUs(config *config.Config) bool { return false }
@@ -0,0 +1,181 @@
+//go:build testing
+// +build testing
+
+/*
+ * Copyright (c) 2022, NVIDIA CORPORATION.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	config "github.com/NVIDIA/k8s-device-plugin/api/config/v1"
+	"github.com/stretchr/testify/require"
+	cli "github.com/urfave/cli/v2"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+func TestAllocateResponseDelay(t *testing.T) {
+	delay := 100 * time.Millisecond
+	m := newTestPlugin(config.CommandLineFlags{AllocateResponseDelay: config.Duration(delay)}, 1, &Device{Device: newPluginDevice("GPU-a")})
+	request := &pluginapi.AllocateRequest{
+		ContainerRequests: []*pluginapi.ContainerAllocateRequest{
+			{DevicesIDs: []string{"GPU-a-replica-0"}},
+		},
+	}
+
+	start := time.Now()
+	_, err := m.Allocate(context.Background(), request)
+	require.NoError(t, err)
+	require.True(t, time.Since(start) >= delay, "Allocate returned after %v", time.Since(start))
+
+	// The delay is bounded by the deadline of the request, which then expires
+	m.config.Flags.AllocateResponseDelay = config.Duration(time.Hour)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	start = time.Now()
+	_, err = m.Allocate(ctx, request)
+	require.Equal(t, codes.DeadlineExceeded, status.Code(err), "%v", err)
+	require.True(t, time.Since(start) < time.Minute, "Allocate returned after %v", time.Since(start))
+}
+
+func TestPanicOnDoubleAllocate(t *testing.T) {
+	m := newTestPlugin(config.CommandLineFlags{PanicOnDoubleAllocate: true}, 2, &Device{Device: newPluginDevice("GPU-a")})
+
+	var recovered interface{}
+	func() {
+		defer func() { recovered = recover() }()
+		m.Allocate(context.Background(), &pluginapi.AllocateRequest{
+			ContainerRequests: []*pluginapi.ContainerAllocateRequest{
+				{DevicesIDs: []string{"GPU-a-replica-1"}},
+				{DevicesIDs: []string{"GPU-a-replica-1"}},
+			},
+		})
+	}()
+
+	require.NotNil(t, recovered)
+	message, ok := recovered.(string)
+	require.True(t, ok)
+	require.Contains(t, message, "double allocation of 'nvidia.com/gpu@' device GPU-a-replica-1")
+	require.Contains(t, message, "goroutine ")
+}
+
+func TestSimulatedGPUsGracefulStopOnSIGTERM(t *testing.T) {
+	kubelet, dir := newFakeKubelet(t)
+	defer func(rc resourceConfiguration) { resourceConfig = rc }(resourceConfig)
+	resourceConfig = resourceConfiguration{"gpu": {Name: "gpu", Replicas: 2}}
+
+	cfg := &config.Config{Flags: config.Flags{CommandLineFlags: &config.CommandLineFlags{
+		MigStrategy:                MigStrategyNone,
+		ResourceName:               "nvidia.com/gpu",
+		SocketDir:                  dir,
+		DeviceListEnvvar:           "NVIDIA_VISIBLE_DEVICES",
+		DeviceListStrategy:         DeviceListStrategyEnvvar,
+		DeviceIDStrategy:           DeviceIDStrategyUUID,
+		GRPCDialTimeout:            config.Duration(5 * time.Second),
+		KubeletRegistrationTimeout: config.Duration(5 * time.Second),
+		AllocationTimeout:          config.Duration(10 * time.Second),
+		StartupTimeout:             config.Duration(time.Minute),
+		GRPCStopTimeout:            config.Duration(5 * time.Second),
+		SimulateNGPUs:              1,
+		SimulateGPUMemoryMB:        8192,
+	}}}
+	exited := make(chan error)
+	go func() { exited <- start(nil, cfg) }()
+
+	registration, err := kubelet.NextRegistration(10 * time.Second)
+	require.NoError(t, err)
+	client, err := kubelet.Connect(registration.Endpoint, 5*time.Second)
+	require.NoError(t, err)
+	stream, err := client.ListAndWatch(context.Background(), &pluginapi.Empty{})
+	require.NoError(t, err)
+	_, err = stream.Recv()
+	require.NoError(t, err)
+
+	// The plugins are stopped gracefully, ending the streams and removing their sockets
+	require.NoError(t, syscall.Kill(os.Getpid(), syscall.SIGTERM))
+	select {
+	case err := <-exited:
+		require.NoError(t, err)
+	case <-time.After(10 * time.Second):
+		t.Fatal("the plugins were not stopped on SIGTERM")
+	}
+	_, err = stream.Recv()
+	require.Equal(t, io.EOF, err)
+	_, err = os.Stat(filepath.Join(dir, registration.Endpoint))
+	require.True(t, os.IsNotExist(err), "%v", err)
+}
+
+func TestSimulatedGPUsReloadConfigOnSIGHUP(t *testing.T) {
+	kubelet, dir := newFakeKubelet(t)
+	defer func(rc resourceConfiguration) { resourceConfig = rc }(resourceConfig)
+
+	configFile := filepath.Join(t.TempDir(), "config.yaml")
+	writeReloadTestConfig(t, configFile, "  gpu: 2\n")
+
+	exited := make(chan error, 1)
+	app := cli.NewApp()
+	app.Flags = append(reloadTestFlags(configFile),
+		&cli.StringFlag{Name: "socket-dir", Value: dir},
+		&cli.DurationFlag{Name: "grpc-stop-timeout", Value: 5 * time.Second},
+		&cli.IntFlag{Name: "simulate-n-gpus", Value: 1},
+		&cli.IntFlag{Name: "simulate-gpu-memory-mb", Value: 8192},
+	)
+	app.Action = func(c *cli.Context) error {
+		cfg, err := setup(c, c.App.Flags)
+		if err != nil {
+			return err
+		}
+		return start(c, cfg)
+	}
+	go func() { exited <- app.Run([]string{"nvidia-device-plugin"}) }()
+
+	// listDevices returns the devices first sent by the next plugin registering with the kubelet
+	listDevices := func() []*pluginapi.Device {
+		registration, err := kubelet.NextRegistration(10 * time.Second)
+		require.NoError(t, err)
+		client, err := kubelet.Connect(registration.Endpoint, 5*time.Second)
+		require.NoError(t, err)
+		stream, err := client.ListAndWatch(context.Background(), &pluginapi.Empty{})
+		require.NoError(t, err)
+		response, err := stream.Recv()
+		require.NoError(t, err)
+		return response.Devices
+	}
+	require.Len(t, listDevices(), 2)
+
+	// The operator changes the replica count, then sends SIGHUP
+	writeReloadTestConfig(t, configFile, "  gpu: 4\n")
+	require.NoError(t, syscall.Kill(os.Getpid(), syscall.SIGHUP))
+	require.Len(t, listDevices(), 4)
+
+	require.NoError(t, syscall.Kill(os.Getpid(), syscall.SIGTERM))
+	select {
+	case err := <-exited:
+		require.NoError(t, err)
+	case <-time.After(10 * time.Second):
+		t.Fatal("the plugins were not stopped on SIGTERM")
+	}
+}
@@ -0,0 +1,124 @@
+/*
+ * Copyright (c) 2022, NVIDIA CORPORATION.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Bitmask values returned by nvmlDeviceGetCurrentClocksThrottleReasons()
+const (
+	clocksThrottleReasonGpuIdle                   uint64 = 0x0000000000000001
+	clocksThrottleReasonApplicationsClocksSetting uint64 = 0x0000000000000002
+	clocksThrottleReasonSwPowerCap                uint64 = 0x0000000000000004
+	clocksThrottleReasonHwSlowdown                uint64 = 0x0000000000000008
+	clocksThrottleReasonSyncBoost                 uint64 = 0x0000000000000010
+	clocksThrottleReasonSwThermalSlowdown         uint64 = 0x0000000000000020
+	clocksThrottleReasonHwThermalSlowdown         uint64 = 0x0000000000000040
+	clocksThrottleReasonHwPowerBrakeSlowdown      uint64 = 0x0000000000000080
+	clocksThrottleReasonDisplayClockSetting       uint64 = 0x0000000000000100
+)
+
+// clocksThrottleReasonNames maps each throttle reason bit to a human-readable name, in bit order
+var clocksThrottleReasonNames = []struct {
+	bit  uint64
+	name string
+}{
+	{clocksThrottleReasonGpuIdle, "GPU_IDLE"},
+	{clocksThrottleReasonApplicationsClocksSetting, "APPLICATIONS_CLOCKS_SETTING"},
+	{clocksThrottleReasonSwPowerCap, "SW_POWER_CAP"},
+	{clocksThrottleReasonHwSlowdown, "HW_SLOWDOWN"},
+	{clocksThrottleReasonSyncBoost, "SYNC_BOOST"},
+	{clocksThrottleReasonSwThermalSlowdown, "SW_THERMAL_SLOWDOWN"},
+	{clocksThrottleReasonHwThermalSlowdown, "HW_THERMAL_SLOWDOWN"},
+	{clocksThrottleReasonHwPowerBrakeSlowdown, "HW_POWER_BRAKE_SLOWDOWN"},
+	{clocksThrottleReasonDisplayClockSetting, "DISPLAY_CLOCK_SETTING"},
+}
+
+var clockThrottleEventsTotal = metrics.NewCounterVec(
+	"gpu_sharing_clock_throttle_events_total",
+	"Number of times a clock throttle reason became active on a device.",
+	"plugin", "device_uuid", "reason",
+)
+
+// decodeClocksThrottleReasons returns the names of all reasons set in a throttle reason bitmask.
+// Unknown bits are reported by their hexadecimal value.
+func decodeClocksThrottleReasons(reasons uint64) []string {
+	names := []string{}
+	for _, r := range clocksThrottleReasonNames {
+		if reasons&r.bit != 0 {
+			names = append(names, r.name)
+			reasons &^= r.bit
+		}
+	}
+	for bit := uint64(1); reasons != 0; bit <<= 1 {
+		if reasons&bit != 0 {
+			names = append(names, fmt.Sprintf("UNKNOWN_0x%x", bit))
+			reasons &^= bit
+		}
+	}
+	return names
+}
+
+// queryClocksThrottleReasons returns the active clock throttle reasons of a device as a bitmask.
+// The NVML go bindings only expose the reasons collapsed into a single value, so nvidia-smi is used instead.
+func queryClocksThrottleReasons(uuid string) (uint64, error) {
+	values, err := queryNvidiaSMI(uuid, "clocks_throttle_reasons.active")
+	if err != nil {
+		return 0, err
+	}
+	reasons, err := strconv.ParseUint(strings.TrimPrefix(values[0], "0x"), 16, 64)
+	if err != nil {
+		return 0, fmt.Errorf("unable to parse clock throttle reasons '%s': %v", values[0], err)
+	}
+	return reasons, nil
+}
+
+// watchClocksThrottleReasons polls each device for its clock throttle reasons until 'stop' is closed
+func (m *NvidiaDevicePlugin) watchClocksThrottleReasons(stop <-chan interface{}, devices []*Device, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		for _, d := range devices {
+			reasons, err := m.queryThrottleReasons(d.ID)
+			if err != nil {
+				m.logger.Warn("Unable to query clock throttle reasons of device", logKeyEventType, "throttle_query_failed", logKeyDeviceUUID, d.ID, "error", err)
+				continue
+			}
+			m.updateClocksThrottleReasons(d, reasons)
+		}
+
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// updateClocksThrottleReasons records the new throttle reasons of a device and counts any reason that was not active before
+func (m *NvidiaDevicePlugin) updateClocksThrottleReasons(d *Device, reasons uint64) {
+	previous := atomic.SwapUint64(&d.ClockThrottleReasons, reasons)
+	for _, name := range decodeClocksThrottleReasons(reasons &^ previous) {
+		clockThrottleEventsTotal.Inc(m.Name(), d.ID, name)
+	}
+}
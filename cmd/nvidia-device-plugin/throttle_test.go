@@ -0,0 +1,86 @@
+/*
+ * Copyright (c) 2022, NVIDIA CORPORATION.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	config "github.com/NVIDIA/k8s-device-plugin/api/config/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDecodeClocksThrottleReasons(t *testing.T) {
+	testCases := []struct {
+		reasons  uint64
+		expected []string
+	}{
+		{0, []string{}},
+		{0x1, []string{"GPU_IDLE"}},
+		{0x4, []string{"SW_POWER_CAP"}},
+		{0x2 | 0x4, []string{"APPLICATIONS_CLOCKS_SETTING", "SW_POWER_CAP"}},
+		{0x1ff, []string{
+			"GPU_IDLE",
+			"APPLICATIONS_CLOCKS_SETTING",
+			"SW_POWER_CAP",
+			"HW_SLOWDOWN",
+			"SYNC_BOOST",
+			"SW_THERMAL_SLOWDOWN",
+			"HW_THERMAL_SLOWDOWN",
+			"HW_POWER_BRAKE_SLOWDOWN",
+			"DISPLAY_CLOCK_SETTING",
+		}},
+		{0x20 | 0x1000, []string{"SW_THERMAL_SLOWDOWN", "UNKNOWN_0x1000"}},
+	}
+
+	for _, tc := range testCases {
+		require.Equal(t, tc.expected, decodeClocksThrottleReasons(tc.reasons), "reasons: 0x%x", tc.reasons)
+	}
+}
+
+func TestUpdateClocksThrottleReasons(t *testing.T) {
+	m := newTestPlugin(config.CommandLineFlags{}, 1, &Device{Device: newPluginDevice("GPU-throttle")})
+	d := m.cachedDevices[0]
+
+	m.updateClocksThrottleReasons(d, clocksThrottleReasonGpuIdle)
+	m.updateClocksThrottleReasons(d, clocksThrottleReasonGpuIdle|clocksThrottleReasonSwPowerCap)
+	m.updateClocksThrottleReasons(d, clocksThrottleReasonSwPowerCap)
+	m.updateClocksThrottleReasons(d, clocksThrottleReasonGpuIdle|clocksThrottleReasonSwPowerCap)
+
+	require.Equal(t, float64(2), clockThrottleEventsTotal.Get(m.Name(), "GPU-throttle", "GPU_IDLE"))
+	require.Equal(t, float64(1), clockThrottleEventsTotal.Get(m.Name(), "GPU-throttle", "SW_POWER_CAP"))
+
+	server := NewDebugServer()
+	server.SetPlugins([]*NvidiaDevicePlugin{m})
+	rec := httptest.NewRecorder()
+	server.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/debug/state", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	var state struct {
+		Plugins []*PluginState `json:"plugins"`
+	}
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &state))
+	require.Len(t, state.Plugins, 1)
+	require.Len(t, state.Plugins[0].Devices, 1)
+	require.Equal(t, []string{"GPU_IDLE", "SW_POWER_CAP"}, state.Plugins[0].Devices[0].ClockThrottleReasons)
+
+	rec = httptest.NewRecorder()
+	server.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	require.Contains(t, rec.Body.String(), `gpu_sharing_clock_throttle_events_total{plugin="nvidia.com/gpu@",device_uuid="GPU-throttle",reason="SW_POWER_CAP"} 1`)
+}
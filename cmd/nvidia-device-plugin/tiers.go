@@ -0,0 +1,140 @@
+/*
+ * Copyright (c) 2022, NVIDIA CORPORATION.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/NVIDIA/go-gpuallocator/gpuallocator"
+	config "github.com/NVIDIA/k8s-device-plugin/api/config/v1"
+)
+
+// memoryTier is one of the --tiered-resources, holding the full GPUs with more memory than the previous tier
+// and up to MaxMemoryMB MiB. The last tier may be unbounded, with MaxMemoryMB set to 0.
+type memoryTier struct {
+	Suffix      string
+	MaxMemoryMB uint
+}
+
+// parseTieredResources parses --tiered-resources as comma-separated <suffix>:<max memory MiB> entries in increasing
+// order of memory, the last of which may leave out the memory to hold all the larger GPUs, e.g. "small:16384,large".
+func parseTieredResources(s string) ([]memoryTier, error) {
+	if s == "" {
+		return nil, nil
+	}
+
+	var tiers []memoryTier
+	entries := strings.Split(s, ",")
+	for i, entry := range entries {
+		parts := strings.SplitN(strings.TrimSpace(entry), ":", 2)
+		tier := memoryTier{Suffix: parts[0]}
+		if !resourceNameRegexp.MatchString(tier.Suffix) {
+			return nil, fmt.Errorf("invalid tier %q: %q is not a valid resource name suffix", entry, tier.Suffix)
+		}
+		if len(parts) == 2 {
+			memory, err := strconv.ParseUint(parts[1], 10, 0)
+			if err != nil || memory == 0 {
+				return nil, fmt.Errorf("invalid tier %q: the memory must be a positive number of MiB", entry)
+			}
+			tier.MaxMemoryMB = uint(memory)
+		} else if i != len(entries)-1 {
+			return nil, fmt.Errorf("invalid tier %q: only the last tier may leave out its memory", entry)
+		}
+		if i > 0 && tier.MaxMemoryMB != 0 && tier.MaxMemoryMB <= tiers[i-1].MaxMemoryMB {
+			return nil, fmt.Errorf("invalid tier %q: tiers must be in increasing order of memory", entry)
+		}
+		for _, t := range tiers {
+			if t.Suffix == tier.Suffix {
+				return nil, fmt.Errorf("invalid tier %q: duplicate suffix", entry)
+			}
+		}
+		tiers = append(tiers, tier)
+	}
+	return tiers, nil
+}
+
+// memoryTierResourceManager only manages the devices of a ResourceManager with more than 'minMemoryMB' MiB of
+// memory and up to 'maxMemoryMB' MiB, or without upper bound if 0
+type memoryTierResourceManager struct {
+	ResourceManager
+	minMemoryMB uint
+	maxMemoryMB uint
+}
+
+// Devices returns the devices of the memory tier
+func (r *memoryTierResourceManager) Devices() []*Device {
+	var devices []*Device
+	for _, d := range r.ResourceManager.Devices() {
+		if d.TotalMemory > r.minMemoryMB && (r.maxMemoryMB == 0 || d.TotalMemory <= r.maxMemoryMB) {
+			devices = append(devices, d)
+		}
+	}
+	return devices
+}
+
+// DeviceCount returns the number of devices of the memory tier
+func (r *memoryTierResourceManager) DeviceCount() int {
+	return len(r.Devices())
+}
+
+// newGPUPlugins returns the plugin advertising the full GPUs, or one plugin per memory tier with --tiered-resources,
+// named after the GPU resource with the suffix of the tier and serving on a socket of its own.
+func newGPUPlugins(cfg *config.Config, resourceConfig resourceConfiguration, newResourceManager func() ResourceManager, allocatePolicy gpuallocator.Policy) ([]*NvidiaDevicePlugin, error) {
+	rc := resourceConfig.Get("gpu")
+	resourceName := gpuResourceName(cfg, resourceConfig)
+
+	tiers, err := parseTieredResources(cfg.Flags.TieredResources)
+	if err != nil {
+		return nil, err
+	}
+	if len(tiers) == 0 {
+		plugin, err := NewNvidiaDevicePlugin(
+			cfg,
+			resourceName,
+			newResourceManager(),
+			cfg.Flags.DeviceListEnvvar,
+			allocatePolicy,
+			filepath.Join(cfg.Flags.SocketDir, "nvidia-gpu.sock"),
+			rc.Replicas, rc.AutoReplicas, nil)
+		if err != nil {
+			return nil, err
+		}
+		return []*NvidiaDevicePlugin{plugin}, nil
+	}
+
+	var plugins []*NvidiaDevicePlugin
+	var minMemoryMB uint
+	for _, tier := range tiers {
+		plugin, err := NewNvidiaDevicePlugin(
+			cfg,
+			resourceName+"-"+tier.Suffix,
+			&memoryTierResourceManager{ResourceManager: newResourceManager(), minMemoryMB: minMemoryMB, maxMemoryMB: tier.MaxMemoryMB},
+			cfg.Flags.DeviceListEnvvar,
+			allocatePolicy,
+			filepath.Join(cfg.Flags.SocketDir, "nvidia-gpu-"+tier.Suffix+".sock"),
+			rc.Replicas, rc.AutoReplicas, nil)
+		if err != nil {
+			return nil, err
+		}
+		plugins = append(plugins, plugin)
+		minMemoryMB = tier.MaxMemoryMB
+	}
+	return plugins, nil
+}
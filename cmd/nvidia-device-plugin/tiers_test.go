@@ -0,0 +1,80 @@
+/*
+ * Copyright (c) 2022, NVIDIA CORPORATION.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"testing"
+
+	config "github.com/NVIDIA/k8s-device-plugin/api/config/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseTieredResources(t *testing.T) {
+	tiers, err := parseTieredResources("")
+	require.NoError(t, err)
+	require.Empty(t, tiers)
+
+	tiers, err = parseTieredResources("small:16384, large")
+	require.NoError(t, err)
+	require.Equal(t, []memoryTier{{Suffix: "small", MaxMemoryMB: 16384}, {Suffix: "large"}}, tiers)
+
+	tiers, err = parseTieredResources("small:16384,medium:40960,large:81920")
+	require.NoError(t, err)
+	require.Len(t, tiers, 3)
+
+	for _, s := range []string{"small:16384,", ":16384", "small:0", "small:many", "small,large", "large:40960,small:16384", "a:1,a:2", "small/1:16384"} {
+		_, err := parseTieredResources(s)
+		require.Error(t, err, s)
+	}
+}
+
+func TestMemoryTierResourceManager(t *testing.T) {
+	devices := []*Device{
+		{Device: newPluginDevice("GPU-16g"), TotalMemory: 16384},
+		{Device: newPluginDevice("GPU-24g"), TotalMemory: 24576},
+		{Device: newPluginDevice("GPU-80g"), TotalMemory: 81920},
+	}
+	cfg := &config.Config{Flags: config.Flags{CommandLineFlags: &config.CommandLineFlags{
+		ResourceName:     "nvidia.com/gpu",
+		SocketDir:        "/var/lib/kubelet/device-plugins",
+		TieredResources:  "small:16384,large",
+		DeviceListEnvvar: "NVIDIA_VISIBLE_DEVICES",
+	}}}
+	newResourceManager := func() ResourceManager { return &testResourceManager{devices: devices} }
+
+	plugins, err := newGPUPlugins(cfg, resourceConfiguration{"gpu": {Name: "gpu", Replicas: 2}}, newResourceManager, nil)
+	require.NoError(t, err)
+	require.Len(t, plugins, 2)
+
+	require.Equal(t, "nvidia.com/gpu-small", plugins[0].resourceName)
+	require.Equal(t, "/var/lib/kubelet/device-plugins/nvidia-gpu-small.sock", plugins[0].socket)
+	require.Equal(t, 1, plugins[0].DeviceCount())
+	require.Equal(t, "GPU-16g", plugins[0].Devices()[0].ID)
+
+	require.Equal(t, "nvidia.com/gpu-large", plugins[1].resourceName)
+	require.Equal(t, "/var/lib/kubelet/device-plugins/nvidia-gpu-large.sock", plugins[1].socket)
+	require.Equal(t, 2, plugins[1].DeviceCount())
+
+	// Without tiers, a single plugin advertises all the GPUs
+	cfg.Flags.TieredResources = ""
+	plugins, err = newGPUPlugins(cfg, resourceConfiguration{}, newResourceManager, nil)
+	require.NoError(t, err)
+	require.Len(t, plugins, 1)
+	require.Equal(t, "nvidia.com/gpu", plugins[0].resourceName)
+	require.Equal(t, "/var/lib/kubelet/device-plugins/nvidia-gpu.sock", plugins[0].socket)
+	require.Equal(t, 3, plugins[0].DeviceCount())
+}
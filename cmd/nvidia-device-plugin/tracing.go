@@ -0,0 +1,337 @@
+/*
+ * Copyright (c) 2022, NVIDIA CORPORATION.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// tracerName is the name of the instrumentation scope and service reported with the spans of the plugin
+const tracerName = "gpu-sharing-plugin"
+
+// traceExportInterval is how often the spans recorded with --otel-endpoint are exported
+const traceExportInterval = 5 * time.Second
+
+// tracer records the spans of the allocation flows. It is disabled unless --otel-endpoint is set.
+var tracer = NewTracer(tracerName, nil)
+
+// SpanExporter receives the spans recorded by a Tracer once they have ended
+type SpanExporter interface {
+	Export(span *Span)
+}
+
+// Tracer starts spans and hands them to its exporter once they end.
+// Without an exporter, spans are not recorded and Start returns a nil span, on which all methods are no-ops.
+type Tracer struct {
+	name     string
+	exporter SpanExporter
+}
+
+// NewTracer returns a Tracer handing its spans to 'exporter'
+func NewTracer(name string, exporter SpanExporter) *Tracer {
+	return &Tracer{name: name, exporter: exporter}
+}
+
+// Span is a single timed operation of a trace, following the OpenTelemetry data model
+type Span struct {
+	sync.Mutex
+	tracer       *Tracer
+	TraceID      [16]byte
+	SpanID       [8]byte
+	ParentSpanID [8]byte // zero for the root span of a trace
+	Name         string
+	StartTime    time.Time
+	EndTime      time.Time
+	Attributes   map[string]string
+	Err          error
+}
+
+type spanKey struct{}
+
+// spanFromContext returns the span carried by 'ctx', or nil if there is none
+func spanFromContext(ctx context.Context) *Span {
+	if ctx == nil {
+		return nil
+	}
+	span, _ := ctx.Value(spanKey{}).(*Span)
+	return span
+}
+
+// Start starts a span named 'name', the child of the span carried by 'ctx' if any, and returns a context carrying it
+func (t *Tracer) Start(ctx context.Context, name string) (context.Context, *Span) {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	if t.exporter == nil {
+		return ctx, nil
+	}
+
+	span := &Span{
+		tracer:     t,
+		Name:       name,
+		StartTime:  time.Now(),
+		Attributes: make(map[string]string),
+	}
+	if parent := spanFromContext(ctx); parent != nil {
+		span.TraceID = parent.TraceID
+		span.ParentSpanID = parent.SpanID
+	} else {
+		rand.Read(span.TraceID[:])
+	}
+	rand.Read(span.SpanID[:])
+	return context.WithValue(ctx, spanKey{}, span), span
+}
+
+// SetAttribute records a key-value pair describing the operation of the span
+func (s *Span) SetAttribute(key string, value string) {
+	if s == nil {
+		return
+	}
+	s.Lock()
+	defer s.Unlock()
+	s.Attributes[key] = value
+}
+
+// End ends the span, marking it as failed if 'err' is not nil, and hands it to the exporter
+func (s *Span) End(err error) {
+	if s == nil {
+		return
+	}
+	s.Lock()
+	s.EndTime = time.Now()
+	s.Err = err
+	s.Unlock()
+	s.tracer.exporter.Export(s)
+}
+
+// traceLog logs a message with 'logger', along with the ID of the trace carried by 'ctx' if any
+// so that log lines can be correlated with the exported traces
+func traceLog(ctx context.Context, logger *slog.Logger, msg string, args ...interface{}) {
+	if span := spanFromContext(ctx); span != nil {
+		args = append(args, "trace_id", hex.EncodeToString(span.TraceID[:]))
+	}
+	logger.Info(msg, args...)
+}
+
+// OTLPExporter exports spans in batches to an OpenTelemetry collector using the OTLP/HTTP protocol with JSON encoding
+type OTLPExporter struct {
+	sync.Mutex
+	url     string
+	client  *http.Client
+	pending []*Span
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+var _ SpanExporter = &OTLPExporter{}
+
+// NewOTLPExporter returns an OTLPExporter sending the spans to the collector at 'endpoint' every 'interval'
+func NewOTLPExporter(endpoint string, interval time.Duration) *OTLPExporter {
+	e := &OTLPExporter{
+		url:    strings.TrimSuffix(endpoint, "/") + "/v1/traces",
+		client: &http.Client{Timeout: 10 * time.Second},
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	go e.run(interval)
+	return e
+}
+
+// Export queues an ended span for the next export
+func (e *OTLPExporter) Export(span *Span) {
+	e.Lock()
+	defer e.Unlock()
+	e.pending = append(e.pending, span)
+}
+
+// Shutdown stops the periodic exports and exports the remaining spans
+func (e *OTLPExporter) Shutdown() {
+	close(e.stop)
+	<-e.done
+}
+
+func (e *OTLPExporter) run(interval time.Duration) {
+	defer close(e.done)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-e.stop:
+			e.flush()
+			return
+		case <-ticker.C:
+			e.flush()
+		}
+	}
+}
+
+// flush exports the pending spans. Spans failing to be exported are dropped.
+func (e *OTLPExporter) flush() {
+	e.Lock()
+	spans := e.pending
+	e.pending = nil
+	e.Unlock()
+
+	if len(spans) == 0 {
+		return
+	}
+	if err := e.send(spans); err != nil {
+		slog.Warn("Failed to export spans", "spans", len(spans), "url", e.url, "error", err)
+	}
+}
+
+func (e *OTLPExporter) send(spans []*Span) error {
+	body, err := json.Marshal(newOTLPTraces(spans))
+	if err != nil {
+		return fmt.Errorf("unable to encode spans: %v", err)
+	}
+
+	resp, err := e.client.Post(e.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		message, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("collector returned %d: %s", resp.StatusCode, strings.TrimSpace(string(message)))
+	}
+	return nil
+}
+
+// OTLP/JSON representation of an ExportTraceServiceRequest. IDs are hex encoded and timestamps are
+// nanoseconds since the epoch encoded as strings, as specified for the JSON encoding of OTLP.
+type otlpTraces struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource struct {
+		Attributes []otlpAttribute `json:"attributes"`
+	} `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpScopeSpans struct {
+	Scope struct {
+		Name string `json:"name"`
+	} `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            otlpStatus      `json:"status"`
+}
+
+type otlpAttribute struct {
+	Key   string `json:"key"`
+	Value struct {
+		StringValue string `json:"stringValue"`
+	} `json:"value"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+// Span kinds and status codes of the OpenTelemetry data model
+const (
+	otlpSpanKindInternal = 1
+	otlpStatusCodeOk     = 1
+	otlpStatusCodeError  = 2
+)
+
+func newOTLPAttribute(key string, value string) otlpAttribute {
+	a := otlpAttribute{Key: key}
+	a.Value.StringValue = value
+	return a
+}
+
+// newOTLPTraces groups spans by tracer, all of them sharing the resource of the plugin
+func newOTLPTraces(spans []*Span) *otlpTraces {
+	resource := otlpResourceSpans{}
+	resource.Resource.Attributes = []otlpAttribute{newOTLPAttribute("service.name", tracerName)}
+
+	scopes := make(map[string]int)
+	for _, s := range spans {
+		s.Lock()
+		span := otlpSpan{
+			TraceID:           hex.EncodeToString(s.TraceID[:]),
+			SpanID:            hex.EncodeToString(s.SpanID[:]),
+			Name:              s.Name,
+			Kind:              otlpSpanKindInternal,
+			StartTimeUnixNano: strconv.FormatInt(s.StartTime.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.EndTime.UnixNano(), 10),
+			Status:            otlpStatus{Code: otlpStatusCodeOk},
+		}
+		if s.ParentSpanID != [8]byte{} {
+			span.ParentSpanID = hex.EncodeToString(s.ParentSpanID[:])
+		}
+		for _, key := range sortedKeys(s.Attributes) {
+			span.Attributes = append(span.Attributes, newOTLPAttribute(key, s.Attributes[key]))
+		}
+		if s.Err != nil {
+			span.Status = otlpStatus{Code: otlpStatusCodeError, Message: s.Err.Error()}
+		}
+		s.Unlock()
+
+		i, exists := scopes[s.tracer.name]
+		if !exists {
+			i = len(resource.ScopeSpans)
+			scopes[s.tracer.name] = i
+			resource.ScopeSpans = append(resource.ScopeSpans, otlpScopeSpans{})
+			resource.ScopeSpans[i].Scope.Name = s.tracer.name
+		}
+		resource.ScopeSpans[i].Spans = append(resource.ScopeSpans[i].Spans, span)
+	}
+
+	return &otlpTraces{ResourceSpans: []otlpResourceSpans{resource}}
+}
+
+func sortedKeys(m map[string]string) []string {
+	var keys []string
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
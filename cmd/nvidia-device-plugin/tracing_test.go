@@ -0,0 +1,137 @@
+/*
+ * Copyright (c) 2022, NVIDIA CORPORATION.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	config "github.com/NVIDIA/k8s-device-plugin/api/config/v1"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+// fakeCollector is an OTLP/HTTP endpoint recording the spans exported to it
+type fakeCollector struct {
+	sync.Mutex
+	spans []otlpSpan
+}
+
+func (c *fakeCollector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost || r.URL.Path != "/v1/traces" || r.Header.Get("Content-Type") != "application/json" {
+		http.Error(w, "unexpected request", http.StatusBadRequest)
+		return
+	}
+	var traces otlpTraces
+	if err := json.NewDecoder(r.Body).Decode(&traces); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	c.Lock()
+	defer c.Unlock()
+	for _, rs := range traces.ResourceSpans {
+		for _, ss := range rs.ScopeSpans {
+			if ss.Scope.Name != tracerName {
+				continue
+			}
+			c.spans = append(c.spans, ss.Spans...)
+		}
+	}
+	w.Write([]byte("{}"))
+}
+
+func (c *fakeCollector) byName(name string) []otlpSpan {
+	c.Lock()
+	defer c.Unlock()
+	var spans []otlpSpan
+	for _, s := range c.spans {
+		if s.Name == name {
+			spans = append(spans, s)
+		}
+	}
+	return spans
+}
+
+func TestTracing(t *testing.T) {
+	collector := &fakeCollector{}
+	server := httptest.NewServer(collector)
+	defer server.Close()
+
+	exporter := NewOTLPExporter(server.URL, time.Hour)
+	tracer = NewTracer(tracerName, exporter)
+	defer func() { tracer = NewTracer(tracerName, nil) }()
+
+	logs := captureLog(t)
+	m := newTestPlugin(config.CommandLineFlags{}, 2, &Device{Device: newPluginDevice("GPU-a")})
+
+	_, err := m.Allocate(context.Background(), &pluginapi.AllocateRequest{
+		ContainerRequests: []*pluginapi.ContainerAllocateRequest{{DevicesIDs: []string{"GPU-a-replica-1"}}},
+	})
+	require.NoError(t, err)
+	_, err = m.Allocate(context.Background(), &pluginapi.AllocateRequest{
+		ContainerRequests: []*pluginapi.ContainerAllocateRequest{{DevicesIDs: []string{"GPU-b-replica-0"}}},
+	})
+	require.Error(t, err)
+	_, err = m.GetPreferredAllocation(context.Background(), &pluginapi.PreferredAllocationRequest{
+		ContainerRequests: []*pluginapi.ContainerPreferredAllocationRequest{
+			{AvailableDeviceIDs: []string{"GPU-a-replica-0", "GPU-a-replica-1"}, AllocationSize: 1},
+		},
+	})
+	require.NoError(t, err)
+
+	// Shutting the exporter down exports the pending spans
+	exporter.Shutdown()
+
+	allocates := collector.byName("Allocate")
+	require.Len(t, allocates, 2)
+	require.Equal(t, otlpStatusCodeOk, allocates[0].Status.Code)
+	require.Equal(t, otlpStatusCodeError, allocates[1].Status.Code)
+	require.Contains(t, allocates[1].Status.Message, "unknown device: GPU-b-replica-0")
+	require.Empty(t, allocates[0].ParentSpanID)
+	require.Len(t, allocates[0].TraceID, 32)
+	require.Len(t, allocates[0].SpanID, 16)
+	require.NotEqual(t, allocates[0].TraceID, allocates[1].TraceID)
+	require.Equal(t, []otlpAttribute{newOTLPAttribute("resource", "nvidia.com/gpu")}, allocates[0].Attributes)
+
+	lookups := collector.byName("GetDeviceByUUID")
+	require.Len(t, lookups, 1)
+	require.Equal(t, allocates[0].TraceID, lookups[0].TraceID)
+	require.Equal(t, allocates[0].SpanID, lookups[0].ParentSpanID)
+	require.Equal(t, []otlpAttribute{newOTLPAttribute("device", "GPU-a")}, lookups[0].Attributes)
+
+	preferred := collector.byName("GetPreferredAllocation")
+	require.Len(t, preferred, 1)
+	require.NotEqual(t, allocates[0].TraceID, preferred[0].TraceID)
+
+	require.Contains(t, logs.String(), "uuids=[GPU-a] trace_id="+allocates[0].TraceID)
+}
+
+func TestTracingDisabled(t *testing.T) {
+	ctx, span := NewTracer(tracerName, nil).Start(context.Background(), "Allocate")
+	require.Nil(t, span)
+	require.Nil(t, spanFromContext(ctx))
+
+	// Methods of the nil span are no-ops
+	span.SetAttribute("resource", "nvidia.com/gpu")
+	span.End(nil)
+}
@@ -0,0 +1,57 @@
+/*
+ * Copyright (c) 2022, NVIDIA CORPORATION.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+)
+
+// queryVBIOSVersion returns the version of the VBIOS of a GPU, e.g. "90.04.38.00.03"
+func queryVBIOSVersion(uuid string) (string, error) {
+	values, err := queryNvidiaSMI(uuid, "vbios_version")
+	if err != nil {
+		return "", err
+	}
+	return values[0], nil
+}
+
+// setVBIOSVersions populates and logs the VBIOS version of all devices for firmware audits.
+// Devices whose version cannot be determined are left with an empty version.
+func (m *NvidiaDevicePlugin) setVBIOSVersions() {
+	for _, dev := range m.cachedDevices {
+		version, err := m.queryVBIOSVersion(dev.ID)
+		if err != nil {
+			m.logger.Info("Unable to determine the VBIOS version of device", logKeyEventType, "vbios_query_failed", logKeyDeviceUUID, dev.ID, "error", err)
+			continue
+		}
+		dev.VBIOSVersion = version
+		m.logger.Info("Device VBIOS version", logKeyEventType, "device_vbios", logKeyDeviceUUID, dev.ID, "vbios_version", version)
+	}
+}
+
+// checkVBIOSVersions returns an error if the VBIOS version of any device is not 'required'
+func (m *NvidiaDevicePlugin) checkVBIOSVersions(required string) error {
+	if required == "" {
+		return nil
+	}
+	for _, dev := range m.cachedDevices {
+		if dev.VBIOSVersion != required {
+			return fmt.Errorf("device %s has VBIOS version %q, but --require-vbios-version is %q", dev.ID, dev.VBIOSVersion, required)
+		}
+	}
+	return nil
+}
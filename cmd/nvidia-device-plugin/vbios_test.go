@@ -0,0 +1,113 @@
+/*
+ * Copyright (c) 2022, NVIDIA CORPORATION.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	config "github.com/NVIDIA/k8s-device-plugin/api/config/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func newVBIOSDevice(id string, version string) *Device {
+	return &Device{Device: newPluginDevice(id), VBIOSVersion: version}
+}
+
+func TestVBIOSVersions(t *testing.T) {
+	logs := captureLog(t)
+	m := newTestPlugin(config.CommandLineFlags{}, 1,
+		newVBIOSDevice("GPU-0", "90.04.38.00.03"),
+		newVBIOSDevice("GPU-1", "90.04.38.00.05"),
+		newVBIOSDevice("GPU-2", ""),
+	)
+
+	require.Contains(t, logs.String(), "event_type=device_vbios device_uuid=GPU-0 vbios_version=90.04.38.00.03")
+	require.Contains(t, logs.String(), "event_type=device_vbios device_uuid=GPU-1 vbios_version=90.04.38.00.05")
+	require.Contains(t, logs.String(), "event_type=vbios_query_failed device_uuid=GPU-2")
+
+	server := NewDebugServer()
+	server.SetPlugins([]*NvidiaDevicePlugin{m})
+	rec := httptest.NewRecorder()
+	server.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/debug/state", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	var state struct {
+		Plugins []*PluginState `json:"plugins"`
+	}
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &state))
+	require.Len(t, state.Plugins, 1)
+	var versions []string
+	for _, d := range state.Plugins[0].Devices {
+		versions = append(versions, d.VBIOSVersion)
+	}
+	require.Equal(t, []string{"90.04.38.00.03", "90.04.38.00.05", ""}, versions)
+}
+
+func TestRequireVBIOSVersion(t *testing.T) {
+	testCases := []struct {
+		description   string
+		required      string
+		devices       []*Device
+		expectedError string
+	}{
+		{
+			"no required version",
+			"",
+			[]*Device{newVBIOSDevice("GPU-0", "90.04.38.00.03"), newVBIOSDevice("GPU-1", "")},
+			"",
+		},
+		{
+			"all devices match",
+			"90.04.38.00.03",
+			[]*Device{newVBIOSDevice("GPU-0", "90.04.38.00.03"), newVBIOSDevice("GPU-1", "90.04.38.00.03")},
+			"",
+		},
+		{
+			"mismatching version",
+			"90.04.38.00.03",
+			[]*Device{newVBIOSDevice("GPU-0", "90.04.38.00.03"), newVBIOSDevice("GPU-1", "90.04.38.00.05")},
+			`device GPU-1 has VBIOS version "90.04.38.00.05"`,
+		},
+		{
+			"unknown version",
+			"90.04.38.00.03",
+			[]*Device{newVBIOSDevice("GPU-0", "")},
+			`device GPU-0 has VBIOS version ""`,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.description, func(t *testing.T) {
+			m := newTestPlugin(config.CommandLineFlags{RequireVBIOSVersion: tc.required}, 1, tc.devices...)
+			err := m.checkVBIOSVersions(tc.required)
+			if tc.expectedError == "" {
+				require.NoError(t, err)
+				return
+			}
+			require.Error(t, err)
+			require.Contains(t, err.Error(), tc.expectedError)
+
+			// Start fails before serving anything
+			m.cleanup()
+			require.Error(t, m.Start())
+			require.Nil(t, m.server)
+		})
+	}
+}
@@ -0,0 +1,100 @@
+/*
+ * Copyright (c) 2022, NVIDIA CORPORATION.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/NVIDIA/gpu-monitoring-tools/bindings/go/nvml"
+)
+
+// Constants representing the kinds of GPU instances a Device can be backed by
+const (
+	VirtualTypePhysical = "physical"
+	VirtualTypeVGPU     = "vgpu"
+	VirtualTypeMIG      = "mig"
+	VirtualTypeMPS      = "mps"
+)
+
+// mpsPipeDirectory is where the MPS control daemon creates its control pipe, as set by CUDA_MPS_PIPE_DIRECTORY.
+// It must be mounted into the plugin's container for GPUs shared through MPS to be recognized.
+var mpsPipeDirectory = "/tmp/nvidia-mps"
+
+// queryDeviceVirtualType determines what kind of GPU instance backs a device.
+// MIG devices are identified by their UUID. For full GPUs, the virtualization and compute
+// modes are queried through nvidia-smi as the NVML go bindings do not expose them.
+func queryDeviceVirtualType(d *Device) (string, error) {
+	if _, _, _, err := nvml.ParseMigDeviceUUID(d.ID); err == nil {
+		return VirtualTypeMIG, nil
+	}
+
+	values, err := queryNvidiaSMI(d.ID, "virtualization_mode", "compute_mode")
+	if err != nil {
+		return "", err
+	}
+	return virtualType(values[0], values[1], mpsControlDaemonRunning()), nil
+}
+
+// virtualType returns the kind of GPU instance backing a full GPU given its virtualization and compute modes.
+// Exclusive process mode is what the MPS control daemon requires to share a GPU, but it is also used on its
+// own to restrict a GPU to a single process, so GPUs are only taken as shared through MPS while it runs.
+func virtualType(virtualizationMode string, computeMode string, mpsRunning bool) string {
+	switch {
+	case strings.EqualFold(virtualizationMode, "VGPU"):
+		return VirtualTypeVGPU
+	case strings.EqualFold(computeMode, "Exclusive_Process") && mpsRunning:
+		return VirtualTypeMPS
+	}
+	return VirtualTypePhysical
+}
+
+// mpsControlDaemonRunning returns whether the MPS control daemon is running, going by its control pipe
+func mpsControlDaemonRunning() bool {
+	dir := mpsPipeDirectory
+	if env := os.Getenv("CUDA_MPS_PIPE_DIRECTORY"); env != "" {
+		dir = env
+	}
+	info, err := os.Stat(filepath.Join(dir, "control"))
+	return err == nil && info.Mode()&os.ModeNamedPipe != 0
+}
+
+// setVirtualTypes populates the IsVirtual and VirtualType fields of all devices.
+// Devices whose type cannot be determined are assumed to be physical GPUs.
+func (m *NvidiaDevicePlugin) setVirtualTypes() {
+	for _, dev := range m.cachedDevices {
+		virtualType, err := m.queryVirtualType(dev)
+		if err != nil {
+			m.logger.Warn("Unable to determine the type of device, assuming "+VirtualTypePhysical, logKeyDeviceUUID, dev.ID, "error", err)
+			virtualType = VirtualTypePhysical
+		}
+		dev.VirtualType = virtualType
+		dev.IsVirtual = virtualType != VirtualTypePhysical
+	}
+}
+
+// physicalDevices returns the devices backed by a full physical GPU
+func (m *NvidiaDevicePlugin) physicalDevices() []*Device {
+	var devices []*Device
+	for _, dev := range m.cachedDevices {
+		if dev.VirtualType == VirtualTypePhysical {
+			devices = append(devices, dev)
+		}
+	}
+	return devices
+}
@@ -2,10 +2,18 @@ package main
 
 import (
 	"github.com/fsnotify/fsnotify"
+	"log/slog"
 	"os"
 	"os/signal"
+	"time"
 )
 
+// defaultSocketWatchInterval is the polling interval used when inotify is not available
+const defaultSocketWatchInterval = 5 * time.Second
+
+// statSocket is replaced in tests to simulate the deletion of sockets
+var statSocket = os.Stat
+
 func newFSWatcher(files ...string) (*fsnotify.Watcher, error) {
 	watcher, err := fsnotify.NewWatcher()
 	if err != nil {
@@ -29,3 +37,64 @@ func newOSWatcher(sigs ...os.Signal) chan os.Signal {
 
 	return sigChan
 }
+
+// socketWatcher polls for the existence of a set of sockets as an alternative to
+// inotify, sending the path of any socket that disappeared on its Events channel.
+type socketWatcher struct {
+	Events chan string
+	stop   chan struct{}
+}
+
+func newSocketWatcher(interval time.Duration, sockets ...string) *socketWatcher {
+	w := &socketWatcher{
+		Events: make(chan string),
+		stop:   make(chan struct{}),
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-w.stop:
+				return
+			case <-ticker.C:
+			}
+
+			for _, socket := range sockets {
+				_, err := statSocket(socket)
+				if err == nil {
+					continue
+				}
+				if !os.IsNotExist(err) {
+					slog.Warn("Unable to stat socket", "socket", socket, "error", err)
+					continue
+				}
+				select {
+				case w.Events <- socket:
+				case <-w.stop:
+					return
+				}
+			}
+		}
+	}()
+
+	return w
+}
+
+// events returns the Events channel, or nil for a nil socketWatcher so that receiving from it blocks forever
+func (w *socketWatcher) events() <-chan string {
+	if w == nil {
+		return nil
+	}
+	return w.Events
+}
+
+// Close stops polling for the sockets
+func (w *socketWatcher) Close() {
+	if w == nil {
+		return
+	}
+	close(w.stop)
+}
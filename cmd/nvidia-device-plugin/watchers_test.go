@@ -0,0 +1,69 @@
+/*
+ * Copyright (c) 2022, NVIDIA CORPORATION.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSocketWatcher(t *testing.T) {
+	var lock sync.Mutex
+	existing := map[string]bool{
+		"/var/lib/kubelet/device-plugins/nvidia-gpu.sock": true,
+		"/var/lib/kubelet/device-plugins/nvidia-mig.sock": true,
+	}
+	defer func(stat func(string) (os.FileInfo, error)) { statSocket = stat }(statSocket)
+	statSocket = func(name string) (os.FileInfo, error) {
+		lock.Lock()
+		defer lock.Unlock()
+		if !existing[name] {
+			return nil, os.ErrNotExist
+		}
+		return nil, nil
+	}
+
+	w := newSocketWatcher(time.Millisecond, "/var/lib/kubelet/device-plugins/nvidia-gpu.sock", "/var/lib/kubelet/device-plugins/nvidia-mig.sock")
+	defer w.Close()
+
+	select {
+	case socket := <-w.Events:
+		t.Fatalf("unexpected event for existing socket %s", socket)
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	lock.Lock()
+	delete(existing, "/var/lib/kubelet/device-plugins/nvidia-mig.sock")
+	lock.Unlock()
+
+	select {
+	case socket := <-w.Events:
+		require.Equal(t, "/var/lib/kubelet/device-plugins/nvidia-mig.sock", socket)
+	case <-time.After(time.Second):
+		t.Fatal("socket deletion was not detected")
+	}
+}
+
+func TestNilSocketWatcher(t *testing.T) {
+	var w *socketWatcher
+	require.Nil(t, w.events())
+	w.Close()
+}
@@ -0,0 +1,217 @@
+/*
+ * Copyright (c) 2022, NVIDIA CORPORATION.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// xidPollInterval is how often the Xid error counts are read when --watch-xid-errors is set
+const xidPollInterval = 30 * time.Second
+
+// kernelLogPath is where the kernel log is read from. The driver only reports Xid errors there.
+var kernelLogPath = "/dev/kmsg"
+
+// xidLogPattern matches the kernel log records of the driver reporting an Xid error, e.g.
+// "NVRM: Xid (PCI:0000:3b:00): 79, pid=1234, GPU has fallen off the bus."
+var xidLogPattern = regexp.MustCompile(`NVRM: Xid \(PCI:([0-9a-fA-F:.]+)\): (\d+),`)
+
+// procBusID converts a bus ID as returned by NVML (e.g. 00000000:3B:00.0) into the
+// form used by the kernel and under /proc/driver/nvidia/gpus (e.g. 0000:3b:00.0)
+func procBusID(busID string) string {
+	busID = strings.ToLower(busID)
+	if parts := strings.SplitN(busID, ":", 2); len(parts) == 2 && len(parts[0]) > 4 {
+		busID = parts[0][len(parts[0])-4:] + ":" + parts[1]
+	}
+	return busID
+}
+
+// xidBusKey returns the domain, bus and device of a bus ID, which the driver reports Xid errors with
+func xidBusKey(busID string) string {
+	busID = procBusID(busID)
+	if i := strings.LastIndex(busID, "."); i > 0 {
+		busID = busID[:i]
+	}
+	return busID
+}
+
+// kernelXIDCounter counts the Xid errors reported in the kernel log for each GPU, keyed by xidBusKey().
+// It starts from the records still in the kernel ring buffer and follows the log for the lifetime of the
+// process, so that no Xid is missed while the plugins restart.
+type kernelXIDCounter struct {
+	path  string
+	start sync.Once
+	sync.Mutex
+	counts map[string]map[uint]uint64
+	err    error
+}
+
+func newKernelXIDCounter(path string) *kernelXIDCounter {
+	return &kernelXIDCounter{
+		path:   path,
+		counts: make(map[string]map[uint]uint64),
+	}
+}
+
+// kernelXIDs is the counter of the Xid errors of the process, started on the first read
+var kernelXIDs = newKernelXIDCounter(kernelLogPath)
+
+// readXIDErrors returns the Xid error counts of the GPU with the given bus ID reported in the kernel log
+func readXIDErrors(busID string) (map[uint]uint64, error) {
+	kernelXIDs.start.Do(func() { go kernelXIDs.run() })
+	return kernelXIDs.read(busID)
+}
+
+// read returns the Xid error counts of the GPU with the given bus ID, or the error which stopped reading the log
+func (c *kernelXIDCounter) read(busID string) (map[uint]uint64, error) {
+	c.Lock()
+	defer c.Unlock()
+	if c.err != nil {
+		return nil, c.err
+	}
+	counts := make(map[uint]uint64)
+	for code, count := range c.counts[xidBusKey(busID)] {
+		counts[code] = count
+	}
+	return counts, nil
+}
+
+// run reads the kernel log until it fails, counting the Xid errors. It returns at the end of regular files,
+// whereas reading /dev/kmsg blocks until new records are logged.
+func (c *kernelXIDCounter) run() {
+	err := c.follow()
+	if err == io.EOF {
+		return
+	}
+	slog.Error("Stopped reading Xid errors", "path", c.path, "error", err)
+	c.Lock()
+	defer c.Unlock()
+	c.err = err
+}
+
+func (c *kernelXIDCounter) follow() error {
+	file, err := os.Open(c.path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	// Each read of /dev/kmsg returns a single record, failing if it does not fit in the buffer
+	reader := bufio.NewReaderSize(file, 8192)
+	for {
+		line, err := reader.ReadString('\n')
+		// Reading /dev/kmsg fails with EPIPE when records were overwritten before being read, and resumes after them
+		if errors.Is(err, syscall.EPIPE) {
+			continue
+		}
+		c.count(line)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// count counts the Xid error reported by a kernel log record, if any
+func (c *kernelXIDCounter) count(record string) {
+	match := xidLogPattern.FindStringSubmatch(record)
+	if match == nil {
+		return
+	}
+	code, err := strconv.ParseUint(match[2], 10, 32)
+	if err != nil {
+		return
+	}
+
+	c.Lock()
+	defer c.Unlock()
+	key := xidBusKey(match[1])
+	if c.counts[key] == nil {
+		c.counts[key] = make(map[uint]uint64)
+	}
+	c.counts[key][uint(code)]++
+}
+
+// reportedXIDs holds the Xid error counts last reported for each device, by UUID. It survives plugin restarts,
+// so that the Xid errors occurring while the plugins restart are reported once they are back.
+var reportedXIDs = struct {
+	sync.Mutex
+	counts map[string]map[uint]uint64
+}{counts: make(map[string]map[uint]uint64)}
+
+// watchXIDErrors polls each device for its Xid error counts until 'stop' is closed
+func (m *NvidiaDevicePlugin) watchXIDErrors(stop <-chan interface{}, devices []*Device, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		for _, d := range devices {
+			if d.BusID == "" {
+				continue
+			}
+			counts, err := m.readXIDErrors(d.BusID)
+			if err != nil {
+				m.logger.Warn("Unable to read Xid errors of device", logKeyEventType, "xid_read_failed", logKeyDeviceUUID, d.ID, "error", err)
+				continue
+			}
+			m.updateXIDErrors(d, counts)
+		}
+
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// updateXIDErrors records the new Xid error counts of a device and emits a warning event for every
+// Xid whose count increased. The first counts read for a device by the process are taken as the baseline.
+func (m *NvidiaDevicePlugin) updateXIDErrors(d *Device, counts map[uint]uint64) {
+	d.XIDErrors = counts
+
+	reportedXIDs.Lock()
+	previous := reportedXIDs.counts[d.ID]
+	reportedXIDs.counts[d.ID] = counts
+	reportedXIDs.Unlock()
+	if previous == nil {
+		return
+	}
+
+	var codes []uint
+	for code := range counts {
+		codes = append(codes, code)
+	}
+	sort.Slice(codes, func(i, j int) bool { return codes[i] < codes[j] })
+
+	for _, code := range codes {
+		if counts[code] > previous[code] {
+			m.events.Warning("GPUXidError", fmt.Sprintf("Device %s reported Xid %d %d time(s), %d in total", d.ID, code, counts[code]-previous[code], counts[code]))
+		}
+	}
+}
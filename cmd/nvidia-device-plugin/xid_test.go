@@ -0,0 +1,152 @@
+/*
+ * Copyright (c) 2022, NVIDIA CORPORATION.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	config "github.com/NVIDIA/k8s-device-plugin/api/config/v1"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeEventRecorder records the events it receives
+type fakeEventRecorder struct {
+	sync.Mutex
+	normals  []string
+	warnings []string
+}
+
+func (r *fakeEventRecorder) Normal(reason string, message string) {
+	r.Lock()
+	defer r.Unlock()
+	r.normals = append(r.normals, reason+": "+message)
+}
+
+func (r *fakeEventRecorder) Warning(reason string, message string) {
+	r.Lock()
+	defer r.Unlock()
+	r.warnings = append(r.warnings, reason+": "+message)
+}
+
+// writeKernelLogFixture writes a kernel log in the format of /dev/kmsg, reporting the given Xid errors
+// of the GPU at 'busID' along with unrelated records
+func writeKernelLogFixture(t *testing.T, path string, busID string, xids ...uint) {
+	content := "6,1024,5000000,-;nvidia-nvlink: Nvlink Core is being initialized\n"
+	for i, xid := range xids {
+		content += fmt.Sprintf("4,%d,%d,-;NVRM: Xid (PCI:%s): %d, pid=1234, name=python, Ch 00000010\n", 1025+i, 6000000+i, xidBusKey(busID), xid)
+	}
+	content += "6,2048,7000000,-;NVRM: GPU at PCI:0000:af:00: GPU-1\n"
+	require.NoError(t, ioutil.WriteFile(path, []byte(content), 0644))
+}
+
+// readKernelLogFixture returns the function reading the Xid error counts from the kernel log at 'path'
+func readKernelLogFixture(path string) func(busID string) (map[uint]uint64, error) {
+	return func(busID string) (map[uint]uint64, error) {
+		c := newKernelXIDCounter(path)
+		c.run()
+		return c.read(busID)
+	}
+}
+
+// resetReportedXIDs forgets the Xid error counts reported by previous tests
+func resetReportedXIDs() {
+	reportedXIDs.Lock()
+	defer reportedXIDs.Unlock()
+	reportedXIDs.counts = make(map[string]map[uint]uint64)
+}
+
+func TestProcBusID(t *testing.T) {
+	require.Equal(t, "0000:3b:00.0", procBusID("00000000:3B:00.0"))
+	require.Equal(t, "0000:3b:00.0", procBusID("0000:3b:00.0"))
+	require.Equal(t, "0000:3b:00", xidBusKey("00000000:3B:00.0"))
+	require.Equal(t, "0000:3b:00", xidBusKey("0000:3b:00"))
+}
+
+func TestKernelXIDCounter(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "kmsg")
+	writeKernelLogFixture(t, path, "00000000:3B:00.0", 79, 13, 79)
+
+	c := newKernelXIDCounter(path)
+	c.run()
+	counts, err := c.read("00000000:3B:00.0")
+	require.NoError(t, err)
+	require.Equal(t, map[uint]uint64{13: 1, 79: 2}, counts)
+
+	// Other GPUs have no Xid errors
+	counts, err = c.read("00000000:AF:00.0")
+	require.NoError(t, err)
+	require.Empty(t, counts)
+
+	// Failing to read the log is reported by all further reads
+	c = newKernelXIDCounter(filepath.Join(t.TempDir(), "missing"))
+	c.run()
+	_, err = c.read("00000000:3B:00.0")
+	require.Error(t, err)
+}
+
+func TestWatchXIDErrors(t *testing.T) {
+	resetReportedXIDs()
+	path := filepath.Join(t.TempDir(), "kmsg")
+
+	events := &fakeEventRecorder{}
+	newPlugin := func() *NvidiaDevicePlugin {
+		m := newTestPlugin(config.CommandLineFlags{}, 1, &Device{Device: newPluginDevice("GPU-0"), BusID: "00000000:3B:00.0"})
+		m.events = events
+		m.readXIDErrors = readKernelLogFixture(path)
+		return m
+	}
+	m := newPlugin()
+	device := m.cachedDevices[0]
+
+	poll := func(m *NvidiaDevicePlugin) {
+		stop := make(chan interface{})
+		close(stop)
+		m.watchXIDErrors(stop, m.cachedDevices, time.Hour)
+	}
+
+	// The counts read first are the baseline
+	writeKernelLogFixture(t, path, device.BusID, 13, 13)
+	poll(m)
+	require.Equal(t, map[uint]uint64{13: 2}, device.XIDErrors)
+	require.Empty(t, events.warnings)
+
+	// Unchanged counts do not emit events
+	poll(m)
+	require.Empty(t, events.warnings)
+
+	writeKernelLogFixture(t, path, device.BusID, 13, 13, 79)
+	poll(m)
+	require.Equal(t, map[uint]uint64{13: 2, 79: 1}, device.XIDErrors)
+	require.Equal(t, []string{"GPUXidError: Device GPU-0 reported Xid 79 1 time(s), 1 in total"}, events.warnings)
+
+	// The Xid errors occurring while the plugin restarts are reported by the restarted plugin
+	writeKernelLogFixture(t, path, device.BusID, 13, 13, 79, 79)
+	poll(newPlugin())
+	require.Len(t, events.warnings, 2)
+	require.Equal(t, "GPUXidError: Device GPU-0 reported Xid 79 1 time(s), 2 in total", events.warnings[1])
+
+	// A kernel log that cannot be read is not fatal and keeps the previous counts
+	require.NoError(t, os.Remove(path))
+	poll(m)
+	require.Equal(t, map[uint]uint64{13: 2, 79: 1}, device.XIDErrors)
+}
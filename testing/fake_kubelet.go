@@ -0,0 +1,107 @@
+/*
+ * Copyright (c) 2022, NVIDIA CORPORATION.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package testing provides a fake kubelet to exercise device plugins end to end over their gRPC sockets.
+package testing
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+// FakeKubelet serves the kubelet Registration service on kubelet.sock in a plugin directory, recording the
+// registrations of the plugins and connecting to their sockets in the same directory like the kubelet does.
+type FakeKubelet struct {
+	sync.Mutex
+	dir           string
+	server        *grpc.Server
+	registrations chan *pluginapi.RegisterRequest
+	conns         []*grpc.ClientConn
+}
+
+// NewFakeKubelet starts serving the Registration service on the kubelet socket in 'dir'
+func NewFakeKubelet(dir string) (*FakeKubelet, error) {
+	socket := filepath.Join(dir, filepath.Base(pluginapi.KubeletSocket))
+	os.Remove(socket)
+	sock, err := net.Listen("unix", socket)
+	if err != nil {
+		return nil, fmt.Errorf("unable to listen on %s: %v", socket, err)
+	}
+
+	k := &FakeKubelet{
+		dir:           dir,
+		server:        grpc.NewServer(),
+		registrations: make(chan *pluginapi.RegisterRequest, 16),
+	}
+	pluginapi.RegisterRegistrationServer(k.server, k)
+	go k.server.Serve(sock)
+	return k, nil
+}
+
+// Register records the registration of a plugin
+func (k *FakeKubelet) Register(ctx context.Context, r *pluginapi.RegisterRequest) (*pluginapi.Empty, error) {
+	if r.Version != pluginapi.Version {
+		return nil, fmt.Errorf("unsupported device plugin API version %q", r.Version)
+	}
+	k.registrations <- r
+	return &pluginapi.Empty{}, nil
+}
+
+// NextRegistration returns the next registration of a plugin, failing if none happens within 'timeout'
+func (k *FakeKubelet) NextRegistration(timeout time.Duration) (*pluginapi.RegisterRequest, error) {
+	select {
+	case r := <-k.registrations:
+		return r, nil
+	case <-time.After(timeout):
+		return nil, fmt.Errorf("no plugin registered within %v", timeout)
+	}
+}
+
+// Connect returns a client of the plugin registered with 'endpoint', the name of its socket
+func (k *FakeKubelet) Connect(endpoint string, timeout time.Duration) (pluginapi.DevicePluginClient, error) {
+	conn, err := grpc.Dial(filepath.Join(k.dir, endpoint), grpc.WithInsecure(), grpc.WithBlock(), grpc.WithTimeout(timeout),
+		grpc.WithDialer(func(addr string, timeout time.Duration) (net.Conn, error) {
+			return net.DialTimeout("unix", addr, timeout)
+		}),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("unable to connect to plugin %s: %v", endpoint, err)
+	}
+
+	k.Lock()
+	defer k.Unlock()
+	k.conns = append(k.conns, conn)
+	return pluginapi.NewDevicePluginClient(conn), nil
+}
+
+// Stop closes the connections to the plugins and stops serving the Registration service
+func (k *FakeKubelet) Stop() {
+	k.Lock()
+	defer k.Unlock()
+	for _, conn := range k.conns {
+		conn.Close()
+	}
+	k.conns = nil
+	k.server.Stop()
+}
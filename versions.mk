@@ -18,4 +18,4 @@ VERSION  ?= v0.11.0
 vVERSION := v$(VERSION:v%=%)
 
 CUDA_VERSION ?= 11.6.0
-GOLANG_VERSION ?= 1.17.9
+GOLANG_VERSION ?= 1.21.13